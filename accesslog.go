@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Listeners with `accessLog: true` log each request. Since webhook
+// URLs and requests carry secrets, the digest in a hook path is
+// shortened to the endpoint's fingerprint, query parameter values
+// (e.g., a queryToken) are redacted, and so are the values of headers
+// carrying signatures, tokens, or credentials. The lines are in the
+// log, like everything else, unless the listener asks for the Apache
+// combined log format, which is written to stdout.
+
+const (
+	accessLogFormatLog      = "log"
+	accessLogFormatCombined = "combined"
+)
+
+// combinedLogOutput is where lines in the combined log format are
+// written.
+var combinedLogOutput io.Writer = kitlog.NewSyncWriter(os.Stdout)
+
+// accessLogSecretHeaders matches the names of headers whose values
+// are redacted, e.g., X-Hub-Signature, X-Gitlab-Token, Authorization.
+var accessLogSecretHeaders = regexp.MustCompile(`(?i)signature|token|secret|authorization|cookie|api-?key`)
+
+// accessLogHeaders are the headers logged, besides those of
+// deliveryIDHeaders.
+var accessLogHeaders = []string{
+	"User-Agent",
+	"Content-Type",
+	"X-GitHub-Event",
+	"X-Gitlab-Event",
+	"X-Event-Key",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitlab-Token",
+	"Authorization",
+}
+
+// countingWriter keeps the status and the number of bytes written.
+type countingWriter struct {
+	statusRecorder
+	bytes int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusRecorder.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// withAccessLog logs each request to the listener, in the format
+// given, except those left out by an endpoint's logSampling.
+func withAccessLog(format string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cw := &countingWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		sample := &logSample{}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), logSampleKey{}, sample)))
+		if sample.skipped {
+			return
+		}
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if format == accessLogFormatCombined {
+			fmt.Fprintln(combinedLogOutput, combinedLogLine(r, start, status, cw.bytes))
+			return
+		}
+		level.Info(logger).Log(
+			"component", "access",
+			"method", r.Method,
+			"path", redactedPath(r.URL.Path),
+			"query", redactedQuery(r.URL.RawQuery),
+			"client", clientIP(r).String(),
+			"status", status,
+			"duration", time.Since(start).String(),
+			"bytes", cw.bytes,
+			"headers", redactedHeaders(r.Header),
+		)
+	})
+}
+
+// combinedLogLine gives the request in the Apache combined log format,
+// `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`, with the
+// path and query redacted. The user is always given as `-`, since the
+// only user there can be is from the credentials of an endpoint's
+// basicAuth.
+func combinedLogLine(r *http.Request, start time.Time, status int, bytes int64) string {
+	uri := redactedPath(r.URL.Path)
+	if q := redactedQuery(r.URL.RawQuery); q != "" {
+		uri += "?" + q
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s "%s" "%s"`,
+		clientIP(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, combinedLogEscape(uri), r.Proto, status, size,
+		combinedLogEscape(orDash(r.Referer())), combinedLogEscape(orDash(r.UserAgent())))
+}
+
+// combinedLogEscape escapes quotes, backslashes, and control
+// characters, as Apache does, so a header can't break the line.
+func combinedLogEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// redactedPath shortens the digest in a hook path to its fingerprint,
+// since the whole of it is enough to send hooks. The path may be with
+// or without hookBasePath: it's stripped inside the listener's mux,
+// and a source may send a hook to the path without it.
+func redactedPath(path string) string {
+	for _, prefix := range []string{hookPath(""), hookPrefix} {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if digest := strings.TrimPrefix(path, prefix); len(digest) > len(endpointLabel(digest)) {
+			return prefix + endpointLabel(digest) + "..."
+		}
+		break
+	}
+	return path
+}
+
+func redactedQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return redacted
+	}
+	for k, vs := range query {
+		for i := range vs {
+			vs[i] = redacted
+		}
+		query[k] = vs
+	}
+	return query.Encode()
+}
+
+// redactedHeaders gives the headers of interest, as `Name: value`
+// separated by `; `.
+func redactedHeaders(h http.Header) string {
+	var names []string
+	for _, name := range append(append([]string{}, accessLogHeaders...), deliveryIDHeaders...) {
+		if h.Get(name) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		value := h.Get(name)
+		if accessLogSecretHeaders.MatchString(name) {
+			value = redacted
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l kitlog.Logger) { logger = l }(logger)
+	logger = newLogger(&buf, logFormatConsole, level.AllowInfo())
+
+	handler := withAccessLog("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	req := httptest.NewRequest("POST", "/hook/0123456789abcdef0123456789abcdef?token=s3cr3t", nil)
+	req.Header.Set("X-Hub-Signature", "sha1=deadbeef")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "d-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	assert.Contains(t, line, "method=POST")
+	assert.Contains(t, line, "path=/hook/0123456789ab...")
+	assert.Contains(t, line, `query="token=REDACTED"`)
+	assert.Contains(t, line, "status=401")
+	assert.Contains(t, line, "bytes=13")
+	assert.Contains(t, line, "X-Hub-Signature: REDACTED")
+	assert.Contains(t, line, "X-GitHub-Event: push")
+	assert.Contains(t, line, "X-GitHub-Delivery: d-1")
+	assert.NotContains(t, line, "s3cr3t")
+	assert.NotContains(t, line, "deadbeef")
+	assert.NotContains(t, line, "cdef0123")
+}
+
+func TestCombinedAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(w io.Writer) { combinedLogOutput = w }(combinedLogOutput)
+	combinedLogOutput = &buf
+
+	handler := withAccessLog(accessLogFormatCombined, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	req := httptest.NewRequest("POST", "/hook/0123456789abcdef0123456789abcdef?token=s3cr3t", nil)
+	req.RemoteAddr = "140.82.115.10:41234"
+	req.Header.Set("User-Agent", `GitHub-Hookshot/5e2a "quoted"`)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	assert.Regexp(t, `^140\.82\.115\.10 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] `, line)
+	assert.Contains(t, line, `"POST /hook/0123456789ab...?token=REDACTED HTTP/1.1" 200 2 "-" "GitHub-Hookshot/5e2a \"quoted\""`+"\n")
+	assert.NotContains(t, line, "s3cr3t")
+}
+
+func TestAccessLogBasePath(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l kitlog.Logger) { logger = l }(logger)
+	logger = newLogger(&buf, logFormatConsole, level.AllowInfo())
+	hookBasePath = "/webhooks"
+	defer func() { hookBasePath = "" }()
+
+	handler := withAccessLog("", http.StripPrefix(hookBasePath, withAccessLog("", http.NotFoundHandler())))
+	for _, path := range []string{
+		"/webhooks/hook/0123456789abcdef0123456789abcdef",
+		"/hook/0123456789abcdef0123456789abcdef",
+	} {
+		buf.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+		line := buf.String()
+		assert.Contains(t, line, "/hook/0123456789ab...", path)
+		assert.NotContains(t, line, "cdef0123", path)
+	}
+}
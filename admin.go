@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The admin API is served at /admin/ on each listener, if `admin` is
+// given in the config. Every request needs the admin token, as a
+// bearer token or, so that a browser can show the dashboard, as the
+// password for basic auth (with any username). A tenant's admin token
+// (see tenant.go) will do too, but sees only the tenant's endpoints.
+
+const adminPrefix = "/admin/"
+
+// adminToken is the token for the admin API; if it's empty, the admin
+// API is not served.
+var adminToken string
+
+func loadAdminToken(baseDir string, admin *Admin) (string, error) {
+	token, _, err := loadKey(baseDir, admin.TokenPath)
+	if err != nil {
+		return "", err
+	}
+	t := strings.TrimRight(string(token), "\r\n")
+	if t == "" {
+		return "", fmt.Errorf("admin token file %s is empty", admin.TokenPath)
+	}
+	return t, nil
+}
+
+// adminHandler constructs the handler for the admin API.
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"stats", adminStats)
+	mux.HandleFunc(adminPrefix+"deliveries", adminDeliveries)
+	mux.HandleFunc(adminPrefix+"rejected", adminRejected)
+	mux.HandleFunc(adminPrefix+"endpoints", adminEndpoints)
+	mux.HandleFunc(adminPrefix, adminDashboard)
+	if pprofEnabled {
+		mux.Handle(adminPrefix+"debug/pprof/", withFullAdminScope(pprofHandler()))
+	}
+	return withAdminAuth(token, mux)
+}
+
+func withAdminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			given = password
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if t := tenantWithToken(given); t != nil {
+			next.ServeHTTP(w, withAdminScope(r, t))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="flux-recv admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		level.Warn(logger).Log("component", "admin", "msg", "missing or incorrect admin token", "path", r.URL.Path)
+	})
+}
+
+// writeJSON writes v as the (JSON) response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		level.Error(logger).Log("component", "admin", "msg", "could not write response", "err", err)
+	}
+}
+
+// adminStats responds with the delivery statistics for each endpoint.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct {
+		Endpoints []endpointStats `json:"endpoints"`
+	}{scopedStats(r, deliveryStats.snapshot())})
+}
+
+// scopedStats gives the statistics for the endpoints the request can
+// see.
+func scopedStats(r *http.Request, stats []endpointStats) []endpointStats {
+	if adminScope(r) == "" {
+		return stats
+	}
+	scoped := []endpointStats{}
+	for _, s := range stats {
+		if inAdminScope(r, s.Endpoint) {
+			scoped = append(scoped, s)
+		}
+	}
+	return scoped
+}
+
+// scopedDeliveries gives the deliveries to the endpoints the request
+// can see.
+func scopedDeliveries(r *http.Request, list []*deliveryRecord) []*deliveryRecord {
+	if adminScope(r) == "" {
+		return list
+	}
+	scoped := []*deliveryRecord{}
+	for _, rec := range list {
+		if inAdminScope(r, rec.Endpoint) {
+			scoped = append(scoped, rec)
+		}
+	}
+	return scoped
+}
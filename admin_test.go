@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuth(t *testing.T) {
+	handler := adminHandler("s3cr3t-admin-token")
+
+	get := func(path string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		auth(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get(adminPrefix+"stats", func(*http.Request) {}).Code)
+	assert.Equal(t, http.StatusUnauthorized, get(adminPrefix+"stats", bearer("wrong")).Code)
+	rec := get(adminPrefix+"stats", bearer("s3cr3t-admin-token"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		Endpoints []endpointStats `json:"endpoints"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	// a browser gives the token as a basic auth password
+	rec = get(adminPrefix, func(r *http.Request) { r.SetBasicAuth("admin", "s3cr3t-admin-token") })
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "<h2>Endpoints</h2>")
+	assert.Equal(t, http.StatusUnauthorized, get(adminPrefix, func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }).Code)
+	assert.Equal(t, http.StatusNotFound, get(adminPrefix+"nothing", bearer("s3cr3t-admin-token")).Code)
+}
+
+func TestDashboard(t *testing.T) {
+	defer func(d *deliveryLog) { recentDeliveries = d }(recentDeliveries)
+	recentDeliveries, _ = newDeliveryLog(10, "")
+	recentDeliveries.add(&deliveryRecord{Source: GitHub, Endpoint: "0123456789ab", Status: 401, Reason: "<script>bad</script>"})
+
+	rec := httptest.NewRecorder()
+	adminDashboard(rec, httptest.NewRequest("GET", adminPrefix, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	page := rec.Body.String()
+	assert.Contains(t, page, "<h2>Failures</h2>")
+	assert.Contains(t, page, "0123456789ab")
+	// the reason is the response body, which can include things from
+	// the request, so it must be escaped
+	assert.NotContains(t, page, "<script>bad")
+	assert.Contains(t, page, "&lt;script&gt;bad")
+}
+
+func TestPprof(t *testing.T) {
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t-admin-token")
+		rec := httptest.NewRecorder()
+		adminHandler("s3cr3t-admin-token").ServeHTTP(rec, req)
+		return rec
+	}
+
+	// not served unless enabled
+	assert.Equal(t, http.StatusNotFound, get(adminPrefix+"debug/pprof/").Code)
+
+	defer func() { pprofEnabled = false }()
+	pprofEnabled = true
+	rec := get(adminPrefix + "debug/pprof/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine")
+	rec = get(adminPrefix + "debug/pprof/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine profile:")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This decrypts files encrypted with age (https://age-encryption.org),
+// for X25519 identities (those made by `age-keygen`). Only decryption
+// is done. The format is specified at https://age-encryption.org/v1.
+
+const (
+	ageIntro       = "age-encryption.org/v1\n"
+	ageArmorBegin  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd    = "-----END AGE ENCRYPTED FILE-----"
+	ageSecretHRP   = "age-secret-key-"
+	ageChunkSize   = 64 << 10
+	ageX25519Label = "age-encryption.org/v1/X25519"
+)
+
+// ageIdentity is an X25519 identity, i.e., a private key.
+type ageIdentity struct {
+	secret, public [32]byte
+}
+
+// parseAgeIdentities reads identities from an identity file, as
+// written by `age-keygen`: one per line, with comments starting with
+// `#`.
+func parseAgeIdentities(data []byte) ([]ageIdentity, error) {
+	var ids []ageIdentity
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, secret, err := bech32Decode(line)
+		if err != nil || hrp != ageSecretHRP || len(secret) != 32 {
+			return nil, fmt.Errorf("line %d is not an age X25519 identity (AGE-SECRET-KEY-1...)", n)
+		}
+		var id ageIdentity
+		copy(id.secret[:], secret)
+		curve25519.ScalarBaseMult(&id.public, &id.secret)
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no age identities found")
+	}
+	return ids, nil
+}
+
+// isAgeEncrypted reports whether data looks like an age file, binary
+// or armored.
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageIntro)) ||
+		bytes.HasPrefix(bytes.TrimSpace(data), []byte(ageArmorBegin))
+}
+
+// ageDecrypt decrypts an age file with whichever of the identities
+// it was encrypted for.
+func ageDecrypt(data []byte, ids []ageIdentity) ([]byte, error) {
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte(ageArmorBegin)) {
+		var err error
+		if data, err = ageDearmor(trimmed); err != nil {
+			return nil, err
+		}
+	}
+
+	header, stanzas, payload, err := ageParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileKey []byte
+	for _, s := range stanzas {
+		if s.kind != "X25519" || len(s.args) != 1 {
+			continue
+		}
+		for _, id := range ids {
+			if fileKey, err = id.unwrap(s); err == nil {
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, errors.New("age: no identity matched any of the recipients")
+	}
+
+	if err := ageCheckHeaderMAC(header, fileKey); err != nil {
+		return nil, err
+	}
+	return ageDecryptPayload(payload, fileKey)
+}
+
+type ageStanza struct {
+	kind string
+	args []string
+	body []byte
+}
+
+// ageParseHeader splits an age file into its header (up to and
+// including `---`, which is what the MAC covers), the recipient
+// stanzas, and the payload; the MAC is left at the start of the
+// header's last line.
+func ageParseHeader(data []byte) (header ageHeader, stanzas []ageStanza, payload []byte, err error) {
+	if !bytes.HasPrefix(data, []byte(ageIntro)) {
+		return ageHeader{}, nil, nil, errors.New("age: not an age file")
+	}
+	rest := data[len(ageIntro):]
+	nextLine := func() (string, bool) {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return "", false
+		}
+		line := string(rest[:i])
+		rest = rest[i+1:]
+		return line, true
+	}
+	b64 := base64.RawStdEncoding.Strict()
+	for {
+		line, ok := nextLine()
+		if !ok {
+			return ageHeader{}, nil, nil, errors.New("age: truncated header")
+		}
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := b64.DecodeString(strings.TrimPrefix(line, "--- "))
+			if err != nil {
+				return ageHeader{}, nil, nil, errors.New("age: malformed header MAC")
+			}
+			headerLen := len(data) - len(rest) - len(line) - 1 + len("---")
+			return ageHeader{bytes: data[:headerLen], mac: mac}, stanzas, rest, nil
+		}
+		if !strings.HasPrefix(line, "-> ") {
+			return ageHeader{}, nil, nil, errors.New("age: malformed header")
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "-> "))
+		if len(fields) == 0 {
+			return ageHeader{}, nil, nil, errors.New("age: malformed stanza")
+		}
+		s := ageStanza{kind: fields[0], args: fields[1:]}
+		// the body is wrapped at 64 columns, and ends with a line
+		// shorter than that (possibly empty)
+		for {
+			line, ok := nextLine()
+			if !ok {
+				return ageHeader{}, nil, nil, errors.New("age: truncated stanza")
+			}
+			chunk, err := b64.DecodeString(line)
+			if err != nil {
+				return ageHeader{}, nil, nil, errors.New("age: malformed stanza body")
+			}
+			s.body = append(s.body, chunk...)
+			if len(line) < 64 {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+type ageHeader struct {
+	bytes []byte
+	mac   []byte
+}
+
+func ageHKDF(secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err) // can only happen if asking for too much output
+	}
+	return key
+}
+
+// unwrap gets the file key from an X25519 recipient stanza, if it
+// was made for this identity.
+func (id ageIdentity) unwrap(s ageStanza) ([]byte, error) {
+	share, err := base64.RawStdEncoding.Strict().DecodeString(s.args[0])
+	if err != nil || len(share) != 32 {
+		return nil, errors.New("age: malformed X25519 stanza")
+	}
+	var theirs, shared [32]byte
+	copy(theirs[:], share)
+	curve25519.ScalarMult(&shared, &id.secret, &theirs)
+	if shared == [32]byte{} {
+		return nil, errors.New("age: invalid X25519 share")
+	}
+	salt := append(append([]byte{}, share...), id.public[:]...)
+	aead, err := chacha20poly1305.New(ageHKDF(shared[:], salt, ageX25519Label))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.body, nil)
+}
+
+func ageCheckHeaderMAC(header ageHeader, fileKey []byte) error {
+	mac := hmac.New(sha256.New, ageHKDF(fileKey, nil, "header"))
+	mac.Write(header.bytes)
+	if !hmac.Equal(mac.Sum(nil), header.mac) {
+		return errors.New("age: header MAC check failed")
+	}
+	return nil
+}
+
+// ageDecryptPayload decrypts the STREAM-encrypted payload: a nonce,
+// then chunks of up to 64KiB, each sealed with a counter and a flag
+// for the last chunk.
+func ageDecryptPayload(payload, fileKey []byte) ([]byte, error) {
+	if len(payload) < 16 {
+		return nil, errors.New("age: truncated payload")
+	}
+	aead, err := chacha20poly1305.New(ageHKDF(fileKey, payload[:16], "payload"))
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[16:]
+
+	var out []byte
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for counter := uint64(0); ; counter++ {
+		n := ageChunkSize + aead.Overhead()
+		last := len(payload) <= n
+		if last {
+			n = len(payload)
+		}
+		binary.BigEndian.PutUint64(nonce[3:11], counter)
+		if last {
+			nonce[11] = 1
+		}
+		chunk, err := aead.Open(nil, nonce, payload[:n], nil)
+		if err != nil {
+			return nil, errors.New("age: payload could not be decrypted")
+		}
+		if len(chunk) == 0 && counter > 0 {
+			return nil, errors.New("age: empty final chunk")
+		}
+		out = append(out, chunk...)
+		payload = payload[n:]
+		if last {
+			return out, nil
+		}
+	}
+}
+
+func ageDearmor(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, ageArmorBegin) || !strings.HasSuffix(s, ageArmorEnd) {
+		return nil, errors.New("age: malformed armor")
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, ageArmorBegin), ageArmorEnd)
+	decoded, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.Join(strings.Fields(s), ""))))
+	if err != nil {
+		return nil, errors.New("age: malformed armor")
+	}
+	return decoded, nil
+}
+
+// bech32Decode decodes a bech32 string (BIP 173), as used for age
+// identities, giving the (lowercase) human-readable part and the
+// data.
+func bech32Decode(s string) (string, []byte, error) {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("bech32: mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("bech32: malformed")
+	}
+	hrp := s[:sep]
+	var values []byte
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(charset, c)
+		if v < 0 {
+			return "", nil, errors.New("bech32: invalid character")
+		}
+		values = append(values, byte(v))
+	}
+
+	polymod := func(values []byte) uint32 {
+		gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+		chk := uint32(1)
+		for _, v := range values {
+			top := chk >> 25
+			chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+			for i := 0; i < 5; i++ {
+				if (top>>uint(i))&1 == 1 {
+					chk ^= gen[i]
+				}
+			}
+		}
+		return chk
+	}
+	var expanded []byte
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	if polymod(append(expanded, values...)) != 1 {
+		return "", nil, errors.New("bech32: invalid checksum")
+	}
+
+	// convert from 5-bit groups to bytes, dropping the checksum
+	var data []byte
+	var acc, bits uint32
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, errors.New("bech32: invalid padding")
+	}
+	return hrp, data, nil
+}
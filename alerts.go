@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// With `alerts` in the config, flux-recv posts to a Slack or Microsoft
+// Teams incoming webhook when deliveries to an endpoint have failed
+// several times in a row, and again when they succeed after that; for
+// teams without monitoring that would catch it from the metrics. Like
+// callbacks, alerts are sent with the client used for notifications.
+
+const (
+	alertFormatSlack = "slack"
+	alertFormatTeams = "teams"
+
+	// defaultAlertFailures is how many deliveries must fail in a row
+	// to alert, if not given in the config
+	defaultAlertFailures = 5
+	// maxPendingAlerts bounds the alerts waiting to be sent; any more
+	// are dropped
+	maxPendingAlerts = 20
+)
+
+// failureAlerts sends the alerts, if configured; otherwise it's nil.
+var failureAlerts *alerter
+
+type alerter struct {
+	url       string
+	format    string
+	threshold int
+	host      string
+	pending   chan string
+
+	mu sync.Mutex
+	// failures counts the deliveries that have failed in a row, for
+	// each endpoint
+	failures map[string]int
+}
+
+func newAlerter(config Alerts) *alerter {
+	a := &alerter{
+		url:       config.URL,
+		format:    config.Format,
+		threshold: config.ConsecutiveFailures,
+		pending:   make(chan string, maxPendingAlerts),
+		failures:  map[string]int{},
+	}
+	if a.format == "" {
+		a.format = alertFormatSlack
+	}
+	if a.threshold == 0 {
+		a.threshold = defaultAlertFailures
+	}
+	a.host, _ = os.Hostname()
+	return a
+}
+
+// add counts the delivery towards the failures in a row for its
+// endpoint, alerting when there are enough, and when the endpoint
+// recovers after an alert; it's a sink for withDeliveryRecords.
+func (a *alerter) add(rec *deliveryRecord) {
+	key := rec.Source + " endpoint " + rec.Endpoint
+	failed := rec.failedChanges()
+	a.mu.Lock()
+	n := a.failures[key]
+	if rec.Status < 400 && len(failed) == 0 {
+		delete(a.failures, key)
+		a.mu.Unlock()
+		if n >= a.threshold {
+			a.alert(fmt.Sprintf("The %s is delivering again, after %d failures in a row.", key, n))
+		}
+		return
+	}
+	n++
+	a.failures[key] = n
+	a.mu.Unlock()
+	if n != a.threshold {
+		return
+	}
+	reason := fmt.Sprintf("%d %s", rec.Status, rec.Reason)
+	if len(failed) > 0 {
+		reason = "could not notify fluxd of " + strings.Join(failed, "; ")
+	}
+	a.alert(fmt.Sprintf("The last %d deliveries to the %s failed. The last: %s", n, key, strings.TrimSpace(reason)))
+}
+
+// alert queues a message to be posted.
+func (a *alerter) alert(text string) {
+	if a.host != "" {
+		text = "flux-recv on " + a.host + ": " + text
+	} else {
+		text = "flux-recv: " + text
+	}
+	queuedSend("alerts")
+	select {
+	case a.pending <- text:
+	default:
+		sentQueued("alerts")
+		level.Warn(logger).Log("component", "alerts", "msg", "dropped alert, since the alerts URL isn't keeping up")
+	}
+}
+
+// run posts the alerts queued.
+func (a *alerter) run() {
+	for text := range a.pending {
+		if err := a.send(text); err != nil {
+			level.Error(logger).Log("component", "alerts", "msg", "could not send alert", "err", err)
+		}
+		sentQueued("alerts")
+	}
+}
+
+// alertBody gives the message in the format of the incoming webhook:
+// Slack takes just the text, while Teams takes a MessageCard.
+func (a *alerter) alertBody(text string) interface{} {
+	if a.format == alertFormatTeams {
+		return map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "flux-recv alert",
+			"text":     text,
+		}
+	}
+	return map[string]string{"text": text}
+}
+
+func (a *alerter) send(text string) error {
+	data, err := json.Marshal(a.alertBody(text))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := downstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("alerts URL responded with %s", res.Status)
+	}
+	return nil
+}
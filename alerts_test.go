@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerts(t *testing.T) {
+	posted := make(chan map[string]string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		posted <- body
+	}))
+	defer receiver.Close()
+
+	a := newAlerter(Alerts{URL: receiver.URL, ConsecutiveFailures: 3})
+	go a.run()
+
+	rejected := &deliveryRecord{Source: GitHub, Endpoint: "4a2f0c1e9b3d", Status: 401, Reason: "The GitHub signature header is invalid."}
+	ok := &deliveryRecord{Source: GitHub, Endpoint: "4a2f0c1e9b3d", Status: 200}
+
+	// a success in between starts the count again
+	a.add(rejected)
+	a.add(rejected)
+	a.add(ok)
+	a.add(rejected)
+	a.add(rejected)
+	assert.Len(t, posted, 0)
+
+	a.add(rejected)
+	alert := <-posted
+	assert.True(t, strings.HasSuffix(alert["text"], "The last 3 deliveries to the GitHub endpoint 4a2f0c1e9b3d failed. The last: 401 The GitHub signature header is invalid."), alert["text"])
+
+	// only once, until it recovers
+	a.add(rejected)
+	a.add(ok)
+	recovered := <-posted
+	assert.True(t, strings.HasSuffix(recovered["text"], "The GitHub endpoint 4a2f0c1e9b3d is delivering again, after 4 failures in a row."), recovered["text"])
+	assert.Len(t, posted, 0)
+
+	// failing to notify fluxd counts as failing
+	a.add(ok)
+	undelivered := &deliveryRecord{Source: DockerHub, Endpoint: "0123456789ab", Status: 200, Changes: []auditChange{{Subject: "docker.io/org/app", Result: "connection refused"}}}
+	for i := 0; i < 3; i++ {
+		a.add(undelivered)
+	}
+	alert = <-posted
+	assert.Contains(t, alert["text"], "could not notify fluxd of docker.io/org/app: connection refused")
+}
+
+func TestAlertFormats(t *testing.T) {
+	teams := newAlerter(Alerts{URL: "https://example.com", Format: alertFormatTeams})
+	assert.Equal(t, defaultAlertFailures, teams.threshold)
+	assert.Equal(t, map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  "flux-recv alert",
+		"text":     "failing",
+	}, teams.alertBody("failing"))
+	slack := newAlerter(Alerts{URL: "https://example.com"})
+	assert.Equal(t, map[string]string{"text": "failing"}, slack.alertBody("failing"))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// auditLog writes a record of each delivery, as a line of JSON, to a
+// file (or stdout).
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openAuditLog opens the file at path for appending, creating it if
+// necessary; `-` means stdout, and a syslog URL means sending each
+// record to a syslog server.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "-" {
+		return &auditLog{out: os.Stdout}, nil
+	}
+	if isSyslogURL(path) {
+		w, err := newSyslogWriter(path, "audit")
+		if err != nil {
+			return nil, err
+		}
+		go w.run()
+		return &auditLog{out: w}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: f}, nil
+}
+
+func (a *auditLog) write(rec *auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		level.Error(logger).Log("component", "audit", "msg", "could not encode record", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		level.Error(logger).Log("component", "audit", "msg", "could not write record", "err", err)
+	}
+}
+
+// auditRecord is the record of a delivery.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Endpoint string    `json:"endpoint"`
+	ClientIP string    `json:"clientIP"`
+	Status   int       `json:"status"`
+	// Verification is "failed" if the request was refused as
+	// unauthenticated, "passed" if it got as far as notifying
+	// downstream, and empty if it was refused before either could be
+	// known
+	Verification string `json:"verification,omitempty"`
+	// Reason is the reason given for refusing the request
+	Reason string `json:"reason,omitempty"`
+	// Changes are the changes notified downstream
+	Changes []auditChange `json:"changes,omitempty"`
+
+	mu sync.Mutex
+}
+
+// auditChange is the result of notifying downstream of a change:
+// "ok", "filtered" if the endpoint didn't accept it, or the error.
+type auditChange struct {
+	// Kind is "git" or "image"
+	Kind    string `json:"kind,omitempty"`
+	Subject string `json:"subject"`
+	Result  string `json:"result"`
+}
+
+func newAuditChange(change fluxapi_v9.Change, result string) auditChange {
+	return auditChange{Kind: string(change.Kind), Subject: changeSubject(change), Result: result}
+}
+
+type auditContextKey struct{}
+
+// auditChangeResult adds the result of notifying a change to the
+// audit record for the request, if there is one, and to the record of
+// the delivery kept for the admin API.
+func auditChangeResult(ctx context.Context, change fluxapi_v9.Change, result string) {
+	recentChangeResult(ctx, change, result)
+	rec, ok := ctx.Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	rec.mu.Lock()
+	rec.Changes = append(rec.Changes, newAuditChange(change, result))
+	rec.mu.Unlock()
+}
+
+// auditingServer records the result of each notification in the
+// audit record for the request.
+type auditingServer struct {
+	fluxapi.Server
+}
+
+func (s auditingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	err := s.Server.NotifyChange(ctx, change)
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	auditChangeResult(ctx, change, result)
+	return err
+}
+
+// auditResponseWriter keeps the status, and the body of error
+// responses, which is the reason given for refusing a request.
+type auditResponseWriter struct {
+	statusRecorder
+	reason strings.Builder
+}
+
+// maxReasonLength bounds how much of an error response is kept as
+// the reason.
+const maxReasonLength = 256
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.statusRecorder.Write(b)
+	if w.status >= 400 && w.reason.Len() < maxReasonLength {
+		w.reason.Write(b)
+	}
+	return n, err
+}
+
+// reasonText gives the reason kept, trimmed.
+func (w *auditResponseWriter) reasonText() string {
+	reason := w.reason.String()
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	return strings.TrimSpace(reason)
+}
+
+// withAudit writes a record of each request to the audit log. It
+// goes outside everything else, so that requests refused by any of
+// the checks are recorded.
+func withAudit(audit *auditLog, source, digest string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{
+			Time:     time.Now().UTC(),
+			Source:   source,
+			Endpoint: digest,
+			ClientIP: clientIP(r).String(),
+		}
+		aw := &auditResponseWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec)))
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.Status = aw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		switch {
+		case rec.Status == http.StatusUnauthorized:
+			rec.Verification = "failed"
+		case len(rec.Changes) > 0 || rec.Status < 300:
+			rec.Verification = "passed"
+		}
+		if rec.Status >= 400 {
+			rec.Reason = aw.reasonText()
+		}
+		audit.write(rec)
+	})
+}
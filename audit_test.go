@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	audit := &auditLog{out: &out}
+	hookServer := httptest.NewServer(withAudit(audit, GitHub, fp, handler))
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "github_payload")
+	send := func(signature string) {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature", signature)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	send(xHubSignature(payload, loadFixture(t, "github_key")))
+	send(xHubSignature(payload, []byte("wrong key")))
+
+	var records []*auditRecord
+	lines := bufio.NewScanner(&out)
+	for lines.Scan() {
+		rec := &auditRecord{}
+		assert.NoError(t, json.Unmarshal(lines.Bytes(), rec))
+		records = append(records, rec)
+	}
+	if !assert.Len(t, records, 2) {
+		return
+	}
+
+	ok := records[0]
+	assert.Equal(t, GitHub, ok.Source)
+	assert.Equal(t, fp, ok.Endpoint)
+	assert.Equal(t, "127.0.0.1", ok.ClientIP)
+	assert.Equal(t, 200, ok.Status)
+	assert.Equal(t, "passed", ok.Verification)
+	assert.Empty(t, ok.Reason)
+	assert.Equal(t, []auditChange{{Kind: "git", Subject: "git@github.com:Codertocat/Hello-World.git", Result: "ok"}}, ok.Changes)
+
+	bad := records[1]
+	assert.Equal(t, 401, bad.Status)
+	assert.Equal(t, "failed", bad.Verification)
+	assert.Equal(t, "The GitHub signature header is invalid.", bad.Reason)
+	assert.Empty(t, bad.Changes)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwtgo "github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := loadBasicAuth(dir, &BasicAuth{Username: "hook", PasswordPath: "password"})
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", creds.password)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := withBasicAuth(DockerHub, creds, ok)
+	send := func(user, password string, set bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hook/abc", nil)
+		if set {
+			req.SetBasicAuth(user, password)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	assert.Equal(t, 200, send("hook", "s3cret", true).Code)
+	res := send("", "", false)
+	assert.Equal(t, 401, res.Code)
+	assert.NotEmpty(t, res.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, 401, send("hook", "wrong", true).Code)
+	assert.Equal(t, 401, send("other", "s3cret", true).Code)
+}
+
+func TestQueryToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("t0ken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	param, token, err := loadQueryToken(dir, &QueryToken{TokenPath: "token"})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTokenParam, param)
+	assert.Equal(t, "t0ken", token)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := withQueryToken(DockerHub, param, token, ok)
+	send := func(query string) int {
+		req := httptest.NewRequest("POST", "/hook/abc"+query, nil)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	assert.Equal(t, 200, send("?token=t0ken"))
+	assert.Equal(t, 401, send(""))
+	assert.Equal(t, 401, send("?token=wrong"))
+	assert.Equal(t, 401, send("?other=t0ken"))
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   b64.EncodeToString(key.N.Bytes()),
+				"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwksServer.Close()
+
+	expected := JWT{JWKSURL: jwksServer.URL, Issuer: "https://issuer.example.com", Audience: "flux-recv"}
+	keys := newJWKS(GitHub, expected.JWKSURL)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := withJWT(GitHub, keys, expected, ok)
+
+	token := func(signer *rsa.PrivateKey, claims jwtgo.MapClaims) string {
+		tok := jwtgo.NewWithClaims(jwtgo.SigningMethodRS256, claims)
+		tok.Header["kid"] = "k1"
+		s, err := tok.SignedString(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	claims := func(iss string, aud interface{}, exp time.Time) jwtgo.MapClaims {
+		return jwtgo.MapClaims{"iss": iss, "aud": aud, "exp": exp.Unix()}
+	}
+	send := func(auth string) int {
+		req := httptest.NewRequest("POST", "/hook/abc", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+	later := time.Now().Add(time.Hour)
+
+	assert.Equal(t, 200, send("Bearer "+token(key, claims(expected.Issuer, "flux-recv", later))))
+	assert.Equal(t, 200, send("Bearer "+token(key, claims(expected.Issuer, []string{"other", "flux-recv"}, later))))
+	assert.Equal(t, 401, send(""))
+	assert.Equal(t, 401, send("Bearer "+token(other, claims(expected.Issuer, "flux-recv", later))))
+	assert.Equal(t, 401, send("Bearer "+token(key, claims("https://elsewhere", "flux-recv", later))))
+	assert.Equal(t, 401, send("Bearer "+token(key, claims(expected.Issuer, "other", later))))
+	assert.Equal(t, 401, send("Bearer "+token(key, claims(expected.Issuer, "flux-recv", time.Now().Add(-time.Hour)))))
+	assert.Equal(t, 401, send("Bearer "+token(key, jwtgo.MapClaims{"iss": expected.Issuer, "aud": "flux-recv"})))
+}
+
+func TestJWKSRefreshOnce(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer jwksServer.Close()
+
+	keys := &jwks{source: GitHub, url: jwksServer.URL}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys.refresh()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
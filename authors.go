@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Commits made by automation -- including those fluxd makes itself,
+// when it updates images -- needn't be synced as soon as they're
+// pushed; and notifying fluxd of its own commits just has it sync
+// again what it's just written. An endpoint can be given the authors
+// (or committers) of the head commit for which changes are dropped.
+// Each pattern is matched against the name, email, and username of
+// the author, ignoring case; `*` in a pattern matches anything, and
+// a pattern between slashes is a regular expression. So, e.g.,
+// `renovate[bot]` matches just that username, and `*@bots.example.com`
+// any email address at that domain.
+
+// authorMatcher reports whether a commit's author or committer
+// matches a pattern.
+type authorMatcher func(commitPerson) bool
+
+func compileAuthorPattern(pattern string) (authorMatcher, error) {
+	var expr string
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("author pattern cannot be empty")
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		expr = pattern[1 : len(pattern)-1]
+	default:
+		parts := strings.Split(pattern, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		expr = strings.Join(parts, ".*")
+	}
+	re, err := regexp.Compile("^(?i:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("author pattern %q is not a valid regular expression: %s", pattern, err.Error())
+	}
+	return func(p commitPerson) bool {
+		for _, s := range []string{p.Name, p.Email, p.Username} {
+			if s != "" && re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileAuthorPatterns(patterns []string) ([]authorMatcher, error) {
+	var res []authorMatcher
+	for _, p := range patterns {
+		m, err := compileAuthorPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// authorFilter drops git changes whose head commit has an author, or
+// committer, matching one of the patterns given for each. A change
+// for which the payload doesn't give the author (or committer) is
+// accepted.
+func authorFilter(authors, committers []string) (changeFilter, error) {
+	authorMatchers, err := compileAuthorPatterns(authors)
+	if err != nil {
+		return nil, fmt.Errorf("ignoreAuthors: %s", err.Error())
+	}
+	committerMatchers, err := compileAuthorPatterns(committers)
+	if err != nil {
+		return nil, fmt.Errorf("ignoreCommitters: %s", err.Error())
+	}
+	return func(ctx context.Context, change fluxapi_v9.Change) string {
+		if _, ok := change.Source.(fluxapi_v9.GitUpdate); !ok {
+			return ""
+		}
+		details := pushDetailsFrom(ctx)
+		if details == nil {
+			return ""
+		}
+		for _, m := range authorMatchers {
+			if m(details.HeadCommit.Author) {
+				return fmt.Sprintf("head commit author %q is ignored", personString(details.HeadCommit.Author))
+			}
+		}
+		for _, m := range committerMatchers {
+			if m(details.HeadCommit.Committer) {
+				return fmt.Sprintf("head commit committer %q is ignored", personString(details.HeadCommit.Committer))
+			}
+		}
+		return ""
+	}, nil
+}
+
+// personString gives the author or committer, for logging.
+func personString(p commitPerson) string {
+	switch {
+	case p.Username != "":
+		return p.Username
+	case p.Email != "":
+		return p.Email
+	}
+	return p.Name
+}
+
+// parsePerson takes apart an author given as e.g., `Jane Doe
+// <jane@example.com>`; if it can't, it's all taken as the name.
+func parsePerson(raw string) commitPerson {
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return commitPerson{Name: raw}
+	}
+	return commitPerson{Name: addr.Name, Email: addr.Address}
+}
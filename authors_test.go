@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+func TestAuthorFilter(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, Endpoint{
+		Source:           GitHub,
+		IgnoreAuthors:    []string{"renovate[bot]", "*@bots.example.com"},
+		IgnoreCommitters: []string{"/flux(bot)?/"},
+	})
+	assert.NoError(t, err)
+
+	commit := func(author, committer commitPerson) context.Context {
+		return withPushDetails(context.Background(), &pushDetails{HeadCommit: commitDetails{Author: author, Committer: committer}})
+	}
+	jane := commitPerson{Name: "Jane Doe", Email: "jane@example.com", Username: "jane"}
+	for _, c := range []struct {
+		ctx    context.Context
+		branch string
+	}{
+		{commit(commitPerson{Name: "renovate[bot]", Username: "Renovate[bot]"}, jane), "renovate"},
+		{commit(commitPerson{Name: "Release bot", Email: "release@bots.example.com"}, jane), "release"},
+		{commit(jane, commitPerson{Name: "Weave Flux", Username: "fluxbot"}), "flux"},
+		// the brackets aren't a character class
+		{commit(commitPerson{Username: "renovateb"}, jane), "not-a-bot"},
+		{commit(jane, jane), "main"},
+		// without the author, the change is forwarded
+		{context.Background(), "unknown"},
+	} {
+		assert.NoError(t, s.NotifyChange(c.ctx, gitChange(repo, c.branch)))
+	}
+	assert.Equal(t, []fluxapi_v9.Change{gitChange(repo, "not-a-bot"), gitChange(repo, "main"), gitChange(repo, "unknown")}, downstream.changes)
+
+	for _, bad := range []string{"", "/(/"} {
+		_, err := authorFilter([]string{bad}, nil)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParsePerson(t *testing.T) {
+	assert.Equal(t, commitPerson{Name: "Jane Doe", Email: "jane@example.com"}, parsePerson("Jane Doe <jane@example.com>"))
+	assert.Equal(t, commitPerson{Email: "jane@example.com"}, parsePerson("jane@example.com"))
+	assert.Equal(t, commitPerson{Name: "renovate[bot]"}, parsePerson("renovate[bot]"))
+}
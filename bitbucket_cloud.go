@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 
+	"github.com/go-kit/kit/log/level"
+
 	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 )
@@ -17,20 +18,29 @@ import (
 //
 // (For completeness, the docs for the self-hosted Bitbucket "Server"
 // are at
-// https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html. The
-// self-hosted version includes a signature in the header
-// "X-Hub-Signature", but this is not present for "Cloud").
+// https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html).
+//
+// Both sign payloads in the header "X-Hub-Signature", but for "Cloud"
+// only if a secret is set for the webhook; so a signature is checked
+// if present, and required only if the endpoint says so.
 
 const BitbucketCloud = "BitbucketCloud"
 
 func init() {
+	SignedSources[BitbucketCloud] = true
+	DeliveryIDSources[BitbucketCloud] = true
 	Sources[BitbucketCloud] = handleBitbucketCloudPush
+	CommitMessageSources[BitbucketCloud] = true
+	CommitAuthorSources[BitbucketCloud] = true
+	SourceEvents[BitbucketCloud] = []string{eventPush, eventTag}
+	DefaultEvents[BitbucketCloud] = []string{eventPush, eventTag}
 }
 
-func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request) {
-	if event := r.Header.Get("X-Event-Key"); event != "repo:push" {
-		http.Error(w, "Unexpected or missing header X-Event-Key", http.StatusBadRequest)
-		log(BitbucketCloud, "missing or incorrect X-Event-Key header:", event)
+func handleBitbucketCloudPush(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request) {
+	body, err := newSignedBody(r, v, v.RequireSignature || hasSignature(r))
+	if err != nil {
+		http.Error(w, "The signature header is invalid.", http.StatusUnauthorized)
+		level.Warn(requestLogger(r)).Log("msg", "invalid signature", "err", err)
 		return
 	}
 
@@ -40,15 +50,47 @@ func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter,
 			Changes []struct {
 				New struct {
 					Type, Name string
+					Target     struct {
+						Hash    string
+						Message string
+						Author  struct {
+							Raw  string
+							User struct {
+								Nickname string
+							}
+						}
+					}
 				}
 			}
 		}
 	}
 
 	var payload bitbucketCloudPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	decodeErr := decodeJSONObject(body, &payload)
+	if err := body.verify(r.Context()); err != nil {
+		if unreadableBody(w, r, err) {
+			return
+		}
+		http.Error(w, "The signature header is invalid.", http.StatusUnauthorized)
+		level.Warn(requestLogger(r)).Log("msg", "invalid signature", "err", err)
+		return
+	}
+
+	event := r.Header.Get("X-Event-Key")
+	if event == "" {
+		http.Error(w, "Unexpected or missing header X-Event-Key", http.StatusBadRequest)
+		level.Warn(requestLogger(r)).Log("msg", "missing X-Event-Key header")
+		return
+	}
+
+	if decodeErr != nil {
 		http.Error(w, "Unable to decode payload as JSON", http.StatusBadRequest)
-		log(BitbucketCloud, "unable to decode payload:", err.Error())
+		logPayload(r, body.head, "msg", "unable to decode payload", "err", decodeErr)
+		reportError(r.Context(), "could not parse payload", decodeErr)
+		return
+	}
+	if event != "repo:push" {
+		ignoreEvent(w, r, event)
 		return
 	}
 
@@ -60,8 +102,8 @@ func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter,
 	//  - send as many as we can before we reach our deadline.
 	// That may mean we miss some, but this is best effort.
 	//
-	// NB a change can be to a branch or a tag; here we'll send both
-	// through, since it's in principle possible to sync to a tag.
+	// NB a change can be to a branch or a tag; by default, we'll send
+	// both through, since it's in principle possible to sync to a tag.
 
 	repo := payload.Repository.RepoURL()
 	ctx, cancel := context.WithTimeout(r.Context(), timeout)
@@ -75,9 +117,21 @@ func handleBitbucketCloudPush(s fluxapi.Server, _ []byte, w http.ResponseWriter,
 				Branch: refChange.Name,
 			},
 		}
-		if err := s.NotifyChange(ctx, change); err != nil {
+		details := &pushDetails{
+			Event: eventPush,
+			HeadCommit: commitDetails{
+				SHA:     refChange.Target.Hash,
+				Message: refChange.Target.Message,
+				Author:  parsePerson(refChange.Target.Author.Raw),
+			},
+		}
+		details.HeadCommit.Author.Username = refChange.Target.Author.User.Nickname
+		if refChange.Type == "tag" {
+			details.Event = eventTag
+		}
+		if err := s.NotifyChange(withPushDetails(ctx, details), change); err != nil {
 			http.Error(w, "Unable to process all push events", http.StatusInternalServerError)
-			log(BitbucketCloud, "error from downstream:", err.Error())
+			level.Error(requestLogger(r)).Log("msg", "error from downstream", "err", err)
 			return
 		}
 	}
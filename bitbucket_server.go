@@ -2,57 +2,75 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 
 	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
-	"github.com/google/go-github/v28/github"
+	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sync/errgroup"
 )
 
 const BitbucketServer = "BitbucketServer"
 
 func init() {
+	SignedSources[BitbucketServer] = true
+	DeliveryIDSources[BitbucketServer] = true
 	Sources[BitbucketServer] = handleBitbucketServerPush
+	SourceEvents[BitbucketServer] = []string{eventPush, eventTag}
+	DefaultEvents[BitbucketServer] = []string{eventPush}
 }
 
-func handleBitbucketServerPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request) {
+func handleBitbucketServerPush(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request) {
 	// See incomplete docs: https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html
 
-	body, err := github.ValidatePayload(r, key)
+	body, err := newSignedBody(r, v, true)
 	if err != nil {
 		http.Error(w, "The signature header is invalid.", http.StatusUnauthorized)
-		log(BitbucketServer, "invalid signature:", err.Error())
+		level.Warn(requestLogger(r)).Log("msg", "invalid signature", "err", err)
 		return
 	}
-	if eventKey := r.Header.Get("X-Event-Key"); eventKey != "repo:refs_changed" {
+	var event bitbucketRefsChangedEvent
+	decodeErr := decodeJSONObject(body, &event)
+	if err := body.verify(r.Context()); err != nil {
+		if unreadableBody(w, r, err) {
+			return
+		}
+		http.Error(w, "The signature header is invalid.", http.StatusUnauthorized)
+		level.Warn(requestLogger(r)).Log("msg", "invalid signature", "err", err)
+		return
+	}
+	eventKey := r.Header.Get("X-Event-Key")
+	if eventKey == "" {
 		http.Error(w, "Unexpected or missing header X-Event-Key", http.StatusBadRequest)
-		log(BitbucketServer, "unexpected X-Event-Key header:", eventKey)
+		level.Warn(requestLogger(r)).Log("msg", "missing X-Event-Key header")
 		return
 	}
-	var event bitbucketRefsChangedEvent
-	if err := json.Unmarshal(body, &event); err != nil {
+	if decodeErr != nil {
 		http.Error(w, "Unable to JSON decode payload", http.StatusBadRequest)
-		log(BitbucketServer, "unable to decode payload:", err.Error())
+		logPayload(r, body.head, "msg", "unable to decode payload", "err", decodeErr)
+		reportError(r.Context(), "could not parse payload", decodeErr)
+		return
+	}
+	if eventKey != "repo:refs_changed" {
+		ignoreEvent(w, r, eventKey)
 		return
 	}
 	repoURL, ok := event.repoCloneLink("ssh")
 	if !ok {
 		http.Error(w, "Missing repository SSH clone link", http.StatusBadRequest)
-		log(BitbucketServer, "missing repository SSH clone link")
+		level.Warn(requestLogger(r)).Log("msg", "missing repository SSH clone link")
 		return
 	}
 
 	var grp errgroup.Group
 	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
-	for refID := range event.changeRefIDs("BRANCH") {
+	notify := func(refID string, details *pushDetails) {
 		branch := strings.TrimPrefix(refID, "refs/heads/")
 		grp.Go(func() error {
-			return s.NotifyChange(ctx, fluxapi_v9.Change{
+			return s.NotifyChange(withPushDetails(ctx, details), fluxapi_v9.Change{
 				Kind: fluxapi_v9.GitChange,
 				Source: fluxapi_v9.GitUpdate{
 					URL:    repoURL,
@@ -61,9 +79,15 @@ func handleBitbucketServerPush(s fluxapi.Server, key []byte, w http.ResponseWrit
 			})
 		})
 	}
+	for refID, hash := range event.changeRefIDs("BRANCH") {
+		notify(refID, &pushDetails{Event: eventPush, HeadCommit: commitDetails{SHA: hash}})
+	}
+	for refID, hash := range event.changeRefIDs("TAG") {
+		notify(refID, &pushDetails{Event: eventTag, HeadCommit: commitDetails{SHA: hash}})
+	}
 	if err := grp.Wait(); err != nil {
 		http.Error(w, "Unable to process all push events", http.StatusInternalServerError)
-		log(BitbucketServer, "error from downstream:", err.Error())
+		level.Error(requestLogger(r)).Log("msg", "error from downstream", "err", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -84,6 +108,7 @@ type bitbucketRefsChangedEvent struct {
 			ID   string
 			Type string
 		}
+		ToHash string
 	}
 }
 
@@ -96,16 +121,18 @@ func (e *bitbucketRefsChangedEvent) repoCloneLink(name string) (string, bool) {
 	return "", false
 }
 
-func (e *bitbucketRefsChangedEvent) changeRefIDs(typ string) map[string]bool {
-	var refIDs map[string]bool
+// changeRefIDs gives the refs of the type given that changed, each
+// with the commit it changed to.
+func (e *bitbucketRefsChangedEvent) changeRefIDs(typ string) map[string]string {
+	var refIDs map[string]string
 	for _, c := range e.Changes {
 		if c.Ref.Type != typ {
 			continue
 		}
 		if refIDs == nil {
-			refIDs = make(map[string]bool)
+			refIDs = make(map[string]string)
 		}
-		refIDs[c.Ref.ID] = true
+		refIDs[c.Ref.ID] = c.ToHash
 	}
 	return refIDs
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultMaxBodyBytes is the largest request body accepted, if
+// neither the config nor the endpoint says otherwise. GitHub, for
+// one, caps payloads at 25MB, but push events are usually much
+// smaller than this.
+const defaultMaxBodyBytes = 10 << 20
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is like http.MaxBytesReader, but returns a sentinel
+// error that handlers can check for.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// read one more than allowed, to tell whether it's over
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// withBodyLimit refuses requests with bodies larger than limit.
+func withBodyLimit(source string, limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request with body over the size limit", "bytes", r.ContentLength, "limit", limit)
+			return
+		}
+		r.Body = &limitedBody{ReadCloser: r.Body, remaining: limit}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyTooLarge checks whether the error (from reading the request
+// body) is because the body was over the limit, and if so, responds
+// accordingly.
+func bodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errBodyTooLarge) {
+		return false
+	}
+	// stop the server trying to read the rest of the body
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	level.Warn(requestLogger(r)).Log("msg", "rejected request with body over the size limit")
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// With `callback` in the config, flux-recv POSTs the outcome of each
+// delivery to a URL, so that other systems can keep track of whether
+// pushes are triggering deployments. Callbacks are sent with the same
+// client as notifications, so they're subject to the
+// downstreamPolicy, and signed if there's an apiSigningKeyPath.
+
+const (
+	// callbackTimeout bounds the time spent sending a callback
+	callbackTimeout = 10 * time.Second
+	// maxPendingCallbacks bounds the callbacks waiting to be sent;
+	// any more are dropped
+	maxPendingCallbacks = 100
+
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// deliveryCallbacks sends the callbacks, if configured; otherwise
+// it's nil.
+var deliveryCallbacks *callbackSender
+
+type callbackSender struct {
+	url     string
+	pending chan callbackBody
+}
+
+func newCallbackSender(url string) *callbackSender {
+	return &callbackSender{url: url, pending: make(chan callbackBody, maxPendingCallbacks)}
+}
+
+// callbackBody is what's sent for each delivery.
+type callbackBody struct {
+	// Result is "delivered" if the request succeeded, and "failed"
+	// otherwise
+	Result         string        `json:"result"`
+	Time           time.Time     `json:"time"`
+	Source         string        `json:"source"`
+	Endpoint       string        `json:"endpoint"`
+	DeliveryID     string        `json:"deliveryID,omitempty"`
+	CorrelationID  string        `json:"correlationID,omitempty"`
+	Status         int           `json:"status"`
+	Reason         string        `json:"reason,omitempty"`
+	DurationMillis int64         `json:"durationMillis"`
+	Changes        []auditChange `json:"changes,omitempty"`
+}
+
+// newCallbackBody gives what's sent for the delivery.
+func newCallbackBody(rec *deliveryRecord) callbackBody {
+	body := callbackBody{
+		Result:         callbackDelivered,
+		Time:           rec.Time,
+		Source:         rec.Source,
+		Endpoint:       rec.Endpoint,
+		DeliveryID:     rec.DeliveryID,
+		CorrelationID:  rec.CorrelationID,
+		Status:         rec.Status,
+		Reason:         rec.Reason,
+		DurationMillis: rec.DurationMillis,
+		Changes:        rec.Changes,
+	}
+	if rec.Status >= 300 {
+		body.Result = callbackFailed
+	}
+	return body
+}
+
+// add queues a callback for the delivery; it's a sink for
+// withDeliveryRecords.
+func (c *callbackSender) add(rec *deliveryRecord) {
+	queuedSend("callback")
+	select {
+	case c.pending <- newCallbackBody(rec):
+	default:
+		sentQueued("callback")
+		level.Warn(logger).Log("component", "callback", "msg", "dropped callback, since the callback URL isn't keeping up", "source", rec.Source, "endpoint", rec.Endpoint)
+	}
+}
+
+// run sends the callbacks queued.
+func (c *callbackSender) run() {
+	for body := range c.pending {
+		if err := c.send(body); err != nil {
+			level.Error(logger).Log("component", "callback", "msg", "could not send callback", "source", body.Source, "endpoint", body.Endpoint, "err", err)
+		}
+		sentQueued("callback")
+	}
+}
+
+func (c *callbackSender) send(body callbackBody) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := downstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("callback URL responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryCallbacks(t *testing.T) {
+	var fluxdCalled bool
+	downstream := newDownstream(t, expectedGithub, &fluxdCalled)
+	defer downstream.Close()
+
+	callbacks := make(chan callbackBody, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body callbackBody
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		callbacks <- body
+	}))
+	defer receiver.Close()
+
+	sender := newCallbackSender(receiver.URL)
+	go sender.run()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewServer(withDeliveryRecords(GitHub, fp, handler, sender.add))
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "github_payload")
+	send := func(signature string) {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature", signature)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	send(xHubSignature(payload, loadFixture(t, "github_key")))
+	ok := <-callbacks
+	assert.Equal(t, callbackDelivered, ok.Result)
+	assert.Equal(t, GitHub, ok.Source)
+	assert.Equal(t, endpointLabel(fp), ok.Endpoint)
+	assert.Equal(t, 200, ok.Status)
+	assert.Equal(t, []auditChange{{Kind: "git", Subject: "git@github.com:Codertocat/Hello-World.git", Result: "ok"}}, ok.Changes)
+
+	send(xHubSignature(payload, []byte("wrong key")))
+	failed := <-callbacks
+	assert.Equal(t, callbackFailed, failed.Result)
+	assert.Equal(t, 401, failed.Status)
+	assert.Equal(t, "The GitHub signature header is invalid.", failed.Reason)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// `flux-recv check` asks a flux-recv running alongside (usually, in
+// the same container) whether it's healthy, and exits 0 if so, or 1
+// if not. It's for a Docker HEALTHCHECK, or an exec probe, in an
+// image that has no curl or wget to do that with.
+
+const checkUsage = `usage:
+  flux-recv check [--listen <address>] [--ready] [--tls] [--timeout <duration>]`
+
+func checkCommand(args []string) {
+	var (
+		listen  string
+		ready   bool
+		useTLS  bool
+		timeout time.Duration
+	)
+	flags := flag.NewFlagSet("flux-recv check", flag.ExitOnError)
+	flags.StringVar(&listen, "listen", ":8080", "the address flux-recv is listening on (or with --listen-admin, the admin address); unix:<path> for a Unix socket")
+	flags.BoolVar(&ready, "ready", false, "check readiness (/readyz), rather than liveness (/healthz)")
+	flags.BoolVar(&useTLS, "tls", false, "the address is served over TLS; the certificate isn't verified, since it's for the public name")
+	flags.DurationVar(&timeout, "timeout", 5*time.Second, "how long to wait for an answer")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		bail(checkUsage)
+	}
+
+	path := healthzPath
+	if ready {
+		path = readyzPath
+	}
+	if err := check(listen, path, useTLS, timeout); err != nil {
+		bail(err.Error())
+	}
+}
+
+// check asks for the path at the listening address, and gives an
+// error unless it's answered with 200 OK.
+func check(listen, path string, useTLS bool, timeout time.Duration) error {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	host := listen
+	if isUnixAddr(listen) {
+		socket := strings.TrimPrefix(listen, unixAddrPrefix)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		host = "localhost"
+	} else if h, port, err := net.SplitHostPort(listen); err == nil && (h == "" || h == "0.0.0.0" || h == "::") {
+		// listening on all interfaces; ask on loopback
+		host = net.JoinHostPort("localhost", port)
+	}
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	res, err := client.Get(scheme + "://" + host + path)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return nil
+}
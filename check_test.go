@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc(healthzPath, healthz)
+	handler.HandleFunc(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No endpoints are loaded", http.StatusServiceUnavailable)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	assert.NoError(t, check(addr, healthzPath, false, time.Second))
+	err := check(addr, readyzPath, false, time.Second)
+	assert.EqualError(t, err, "/readyz: 503 Service Unavailable")
+
+	// listening on all interfaces is checked on loopback
+	port := addr[strings.LastIndex(addr, ":"):]
+	assert.NoError(t, check(port, healthzPath, false, time.Second))
+
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	assert.NoError(t, check(strings.TrimPrefix(tlsServer.URL, "https://"), healthzPath, true, time.Second))
+
+	dir, err := ioutil.TempDir("", "flux-recv-check")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := "unix:" + filepath.Join(dir, "recv.sock")
+	l, err := listenOn(socket, nil)
+	assert.NoError(t, err)
+	unixServer := &http.Server{Handler: handler}
+	go unixServer.Serve(l)
+	defer unixServer.Close()
+	assert.NoError(t, check(socket, healthzPath, false, time.Second))
+
+	server.Close()
+	assert.Error(t, check(addr, healthzPath, false, time.Second))
+}
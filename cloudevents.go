@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// With `auditEvents` in the config, flux-recv emits a CloudEvent
+// (https://cloudevents.io) for each delivery it accepts -- that is,
+// each that passed verification -- so that event-driven audit
+// pipelines can consume what the receiver did. The sink is either an
+// HTTP URL, which is sent each event in structured mode, or a Kafka
+// topic (kafka://broker:9092/topic), which gets each event as a
+// message in structured mode, keyed by the repo or image. The data of
+// each event is the same as the body of a callback.
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	// auditEventType is the type of the events
+	auditEventType = "io.fluxcd.recv.delivery"
+
+	auditEventsTimeout = 10 * time.Second
+	// maxPendingAuditEvents bounds the events waiting to be sent;
+	// any more are dropped
+	maxPendingAuditEvents = 100
+)
+
+// auditEvents sends the audit events, if configured; otherwise it's
+// nil.
+var auditEvents *auditEventSender
+
+// cloudEvent is a CloudEvent in the JSON format.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	// CorrelationID is an extension attribute, so that events can be
+	// related to the logs
+	CorrelationID string       `json:"correlationid,omitempty"`
+	Data          callbackBody `json:"data"`
+}
+
+type auditEventSender struct {
+	// send delivers an encoded event to the sink
+	send    func(ev *cloudEvent, data []byte) error
+	pending chan *cloudEvent
+}
+
+// newAuditEventSender constructs a sender for the sink URL given,
+// which is either http(s):// or kafka(+tls)://.
+func newAuditEventSender(sink string) (*auditEventSender, error) {
+	s := &auditEventSender{pending: make(chan *cloudEvent, maxPendingAuditEvents)}
+	if strings.HasPrefix(sink, "kafka") {
+		producer, err := newKafkaProducer(sink)
+		if err != nil {
+			return nil, err
+		}
+		s.send = func(ev *cloudEvent, data []byte) error {
+			return producer.produce([]byte(ev.Subject), data, []kafkaHeader{{"content-type", cloudEventsContentType}})
+		}
+		return s, nil
+	}
+	s.send = func(ev *cloudEvent, data []byte) error {
+		return postAuditEvent(sink, data)
+	}
+	return s, nil
+}
+
+// checkAuditEventsURL checks that the sink is one events can be sent
+// to; HTTP URLs are subject to the downstreamPolicy.
+func checkAuditEventsURL(policy *DownstreamPolicy, sink string) error {
+	if strings.HasPrefix(sink, "kafka") {
+		_, _, _, err := parseKafkaURL(sink)
+		return err
+	}
+	return policy.checkURL(sink)
+}
+
+// newAuditEvent gives the event for the delivery, or nil if the
+// delivery wasn't accepted.
+func newAuditEvent(rec *deliveryRecord) *cloudEvent {
+	if rec.Status >= 400 && len(rec.Changes) == 0 {
+		return nil
+	}
+	ev := &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              newCorrelationID(),
+		Source:          "/flux-recv/" + rec.Source + "/" + rec.Endpoint,
+		Type:            auditEventType,
+		Time:            rec.Time,
+		DataContentType: "application/json",
+		CorrelationID:   rec.CorrelationID,
+		Data:            newCallbackBody(rec),
+	}
+	if len(rec.Changes) > 0 {
+		ev.Subject = rec.Changes[0].Subject
+	}
+	return ev
+}
+
+// add queues an event for the delivery, if it was accepted; it's a
+// sink for withDeliveryRecords.
+func (s *auditEventSender) add(rec *deliveryRecord) {
+	ev := newAuditEvent(rec)
+	if ev == nil {
+		return
+	}
+	queuedSend("audit-events")
+	select {
+	case s.pending <- ev:
+	default:
+		sentQueued("audit-events")
+		level.Warn(logger).Log("component", "audit-events", "msg", "dropped audit event, since the sink isn't keeping up", "source", rec.Source, "endpoint", rec.Endpoint)
+	}
+}
+
+// run sends the events queued.
+func (s *auditEventSender) run() {
+	for ev := range s.pending {
+		data, err := json.Marshal(ev)
+		if err == nil {
+			err = s.send(ev, data)
+		}
+		if err != nil {
+			level.Error(logger).Log("component", "audit-events", "msg", "could not send audit event", "source", ev.Data.Source, "endpoint", ev.Data.Endpoint, "err", err)
+		}
+		sentQueued("audit-events")
+	}
+}
+
+func postAuditEvent(url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), auditEventsTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", cloudEventsContentType)
+	res, err := downstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("audit events sink responded with %s", res.Status)
+	}
+	return nil
+}
@@ -1,31 +1,926 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
 )
 
 type Endpoint struct {
 	Source  string `json:"source"`
-	KeyPath string `json:"keyPath"`
+	KeyPath string `json:"keyPath,omitempty"`
+	// Key is the key given inline, instead of a KeyPath; this is for
+	// development and tests, and is only allowed when flux-recv is
+	// run with `--allow-inline-keys`.
+	Key string `json:"key,omitempty"`
+	// KeyEncoding is how Key is encoded; either empty, meaning as-is,
+	// or "base64".
+	KeyEncoding string `json:"keyEncoding,omitempty"`
+	// KeyPaths are additional keys, each of which is routed to the
+	// endpoint by its digest
+	KeyPaths []string `json:"keyPaths,omitempty"`
+	// SecretPaths are additional secrets which are accepted when
+	// verifying requests, but which aren't used for routing; this
+	// is so you can change the secret registered with the source,
+	// without changing the URL.
+	SecretPaths []string `json:"secretPaths,omitempty"`
+	// RotationGracePeriod, if given, means the key files are watched
+	// for changes; when a key changes, its previous digest keeps
+	// being routed to the endpoint (verified with the new key) for
+	// this long. It's a duration, e.g., "24h".
+	RotationGracePeriod string `json:"rotationGracePeriod,omitempty"`
+	// CatchAll marks this as the endpoint for any repository (or
+	// image) from its source, for e.g., organisation-wide
+	// webhooks. A catch-all endpoint must give Allow, and there can
+	// only be one for each source on a listener.
+	CatchAll bool `json:"catchAll,omitempty"`
+	// Allow is a regular expression which must match the whole of
+	// the git repo URL or image name in a change, for the change to
+	// be forwarded.
+	Allow string `json:"allow,omitempty"`
+	// Events, if given, are the kinds of event (push, tag, release,
+	// or pipeline) changes are forwarded for; otherwise, those
+	// always forwarded for the source.
+	Events []string `json:"events,omitempty"`
+	// Repos, if given, are the git repos changes are forwarded for,
+	// and those they're not.
+	Repos *Repos `json:"repos,omitempty"`
+	// Branches, if given, are glob patterns (e.g., `release/*`) one
+	// of which must match the branch of a git change, for the change
+	// to be forwarded.
+	Branches []string `json:"branches,omitempty"`
+	// DefaultBranchOnly, if true, means only git changes for the
+	// repo's default branch, as given in the payload, are forwarded.
+	DefaultBranchOnly bool `json:"defaultBranchOnly,omitempty"`
+	// TagPattern, if given, is a regular expression which must match
+	// the whole of the tag of an image pushed, for the change to be
+	// forwarded.
+	TagPattern string `json:"tagPattern,omitempty"`
+	// SkipMarkers, if given, are markers (e.g., "[skip flux]") which,
+	// if in the message of the head commit of a push, mean the change
+	// isn't forwarded.
+	SkipMarkers []string `json:"skipMarkers,omitempty"`
+	// IgnoreAuthors and IgnoreCommitters, if given, are patterns
+	// for the authors and committers (e.g., bots) of head commits
+	// whose changes aren't forwarded.
+	IgnoreAuthors    []string `json:"ignoreAuthors,omitempty"`
+	IgnoreCommitters []string `json:"ignoreCommitters,omitempty"`
+	// ExtendedNotifications, if true, means each notification has an
+	// "extensions" field as well, with e.g., the head commit's SHA
+	// (see extensions.go).
+	ExtendedNotifications bool `json:"extendedNotifications,omitempty"`
+	// GitURLRewrites are rules for rewriting the repo URL of each
+	// change forwarded, so it's the URL fluxd has.
+	GitURLRewrites []GitURLRewrite `json:"gitURLRewrites,omitempty"`
+	// ImageRewrites are rules for rewriting the name of each image
+	// change forwarded, e.g., from a mirror's registry to the one
+	// workloads use.
+	ImageRewrites []ImageRewrite `json:"imageRewrites,omitempty"`
+	// Generic is how changes are found in payloads, and requests
+	// authenticated, for the Generic source.
+	Generic *GenericMapping `json:"generic,omitempty"`
+	// SignatureAlgorithms are the hash algorithms accepted for
+	// signatures ("sha1", "sha256", "sha512"), for sources that sign
+	// payloads (e.g., GitHub). If not given, SHA256 and SHA512 are
+	// accepted.
+	SignatureAlgorithms []string `json:"signatureAlgorithms,omitempty"`
+	// RequireSignature, if true, means requests must be signed, for
+	// sources for which a secret is optional (e.g., BitbucketCloud);
+	// otherwise, they are checked only if they have a signature.
+	RequireSignature bool `json:"requireSignature,omitempty"`
+	// TimestampTolerance, if given, is how far from now the signed
+	// time a request was sent can be, for sources that sign it (see
+	// generic.timestampHeader); the default is five minutes.
+	TimestampTolerance string `json:"timestampTolerance,omitempty"`
+	// ProviderIPs, if true, means only requests from the IP ranges
+	// published by the provider (e.g., GitHub) are accepted. The
+	// ranges are fetched when starting, and refreshed periodically.
+	ProviderIPs bool `json:"providerIPs,omitempty"`
+	// AllowCIDRs, if given, are the only IP ranges from which requests
+	// are accepted.
+	AllowCIDRs []string `json:"allowCIDRs,omitempty"`
+	// DenyCIDRs are IP ranges from which requests are refused, even if
+	// they are in AllowCIDRs.
+	DenyCIDRs []string `json:"denyCIDRs,omitempty"`
+	// MaxBodyBytes is the largest request body accepted by the
+	// endpoint; if zero, the limit from the config is used.
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+	// JSONLimits, if given, changes the limits on the structure of
+	// JSON payloads, which are checked before payloads are parsed.
+	JSONLimits *JSONLimits `json:"jsonLimits,omitempty"`
+	// BasicAuth, if given, means requests must have these basic auth
+	// credentials; e.g., for sources that don't sign payloads.
+	BasicAuth *BasicAuth `json:"basicAuth,omitempty"`
+	// QueryToken, if given, means requests must have a secret token
+	// in a query parameter; e.g., for DockerHub, which has no other
+	// means of authenticating requests.
+	QueryToken *QueryToken `json:"queryToken,omitempty"`
+	// JWT, if given, means requests must have a bearer token signed
+	// by a key from the JWKS, with the issuer and audience given.
+	JWT *JWT `json:"jwt,omitempty"`
+	// RejectReplays, if true, means requests with the same delivery ID
+	// (e.g., the X-GitHub-Delivery header) as a request already
+	// processed are refused. Since sources also re-use the delivery
+	// ID when you ask for a webhook to be redelivered, this is off by
+	// default.
+	RejectReplays bool `json:"rejectReplays,omitempty"`
+	// IdempotentResponses, if given, means a retried delivery (by
+	// delivery ID) is answered with the response it got the first
+	// time, rather than being handled again.
+	IdempotentResponses *IdempotentResponses `json:"idempotentResponses,omitempty"`
+	// Require, if given, lists the checks made on each request, in
+	// the order they're made (see require.go). It must include all
+	// the checks configured for the endpoint.
+	Require []string `json:"require,omitempty"`
+	// RateLimit limits the rate of requests to the endpoint
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// RateLimitPerIP limits the rate of requests to the endpoint
+	// from each client IP address
+	RateLimitPerIP *RateLimit `json:"rateLimitPerIP,omitempty"`
+	// Faults, if given, are faults to inject into deliveries to the
+	// endpoint, for testing; they need --inject-faults.
+	Faults *Faults `json:"faults,omitempty"`
+	// Isolation, if given, gives the endpoint resources of its own
+	// for handling deliveries, rather than sharing them with other
+	// endpoints.
+	Isolation *Isolation `json:"isolation,omitempty"`
+	// Tenant, if given, is the name of the tenant the endpoint
+	// belongs to.
+	Tenant string `json:"tenant,omitempty"`
+	// LogSampling, if more than 1, means only one in this many
+	// successful deliveries is logged; failures are always logged.
+	LogSampling int `json:"logSampling,omitempty"`
+}
+
+// defaultTimestampTolerance is how far a signed timestamp can be from
+// now, if an endpoint doesn't give timestampTolerance.
+const defaultTimestampTolerance = 5 * time.Minute
+
+func (ep Endpoint) timestampTolerance() (time.Duration, error) {
+	if ep.TimestampTolerance == "" {
+		return defaultTimestampTolerance, nil
+	}
+	tolerance, err := time.ParseDuration(ep.TimestampTolerance)
+	if err != nil || tolerance <= 0 {
+		return 0, fmt.Errorf("timestampTolerance %q is not a positive duration", ep.TimestampTolerance)
+	}
+	return tolerance, nil
+}
+
+func (ep Endpoint) rotationGracePeriod() (time.Duration, error) {
+	grace, err := time.ParseDuration(ep.RotationGracePeriod)
+	if err != nil || grace <= 0 {
+		return 0, fmt.Errorf("rotationGracePeriod %q is not a positive duration", ep.RotationGracePeriod)
+	}
+	return grace, nil
+}
+
+// JSONLimits are limits on the structure of JSON payloads; zero
+// means the default.
+type JSONLimits struct {
+	MaxDepth       int `json:"maxDepth,omitempty"`
+	MaxArrayLength int `json:"maxArrayLength,omitempty"`
+	// RequireContentType, if true, means requests must have a JSON
+	// (or form encoded) Content-Type.
+	RequireContentType bool `json:"requireContentType,omitempty"`
+}
+
+// BasicAuth gives the credentials that requests must have. The
+// password is read from a file, relative to the config.
+type BasicAuth struct {
+	Username     string `json:"username"`
+	PasswordPath string `json:"passwordPath"`
+}
+
+// QueryToken gives the query parameter that must have the token, and
+// the file containing the token, relative to the config.
+type QueryToken struct {
+	// Param is the name of the query parameter; if empty,
+	// defaultTokenParam is used
+	Param     string `json:"param,omitempty"`
+	TokenPath string `json:"tokenPath"`
+}
+
+// defaultTokenParam is the query parameter for the token, if not
+// given.
+const defaultTokenParam = "token"
+
+// JWT says how to verify bearer tokens: which keys they may be signed
+// with, and what the issuer (`iss`) and audience (`aud`) must be.
+type JWT struct {
+	JWKSURL  string `json:"jwksURL"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+// RateLimit is a token bucket: requests are allowed at PerSecond on
+// average, with up to Burst at once. Requests over the limit get a
+// 429 Too Many Requests response.
+type RateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	// Burst defaults to PerSecond (rounded up), or 1 if that's less.
+	Burst int `json:"burst,omitempty"`
+}
+
+// DownstreamPolicy restricts where notifications are sent, including
+// when following redirects.
+type DownstreamPolicy struct {
+	// AllowedSchemes defaults to http and https
+	AllowedSchemes []string `json:"allowedSchemes,omitempty"`
+	// AllowedHosts, if given, are the host names (or addresses)
+	// allowed; an entry like `*.example.com` allows any subdomain
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// ForbidLinkLocal refuses link-local addresses, which include the
+	// metadata services of cloud providers (e.g., 169.254.169.254)
+	ForbidLinkLocal bool `json:"forbidLinkLocal,omitempty"`
+}
+
+// Quota limits the requests handled across all endpoints and
+// listeners; requests over it get a 429 Too Many Requests response.
+type Quota struct {
+	// MaxConcurrent is the most requests handled at once
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// RateLimit limits the rate of requests
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+}
+
+func (q *Quota) validate() error {
+	if q.MaxConcurrent < 0 {
+		return fmt.Errorf("quota: maxConcurrent must not be negative")
+	}
+	if q.RateLimit != nil && q.RateLimit.PerSecond <= 0 {
+		return fmt.Errorf("quota: rateLimit needs a positive perSecond")
+	}
+	return nil
+}
+
+// Downstream gives how notifications are sent to the API.
+type Downstream struct {
+	// Workers, if given, is how many notifications are sent at once;
+	// the rest wait in a queue
+	Workers int `json:"workers,omitempty"`
+	// QueueSize is how many notifications can wait for a worker; if
+	// zero, defaultDownstreamQueueSize
+	QueueSize int `json:"queueSize,omitempty"`
+
+	// The rest tune the client's connection pool; zero means the
+	// default (see downstream.go).
+
+	// MaxIdleConns bounds the idle connections kept, to all hosts
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+	// MaxIdleConnsPerHost bounds the idle connections kept to each
+	// host
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+	// MaxConnsPerHost bounds the connections to each host, including
+	// those in use
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+	// IdleConnTimeout is how long an idle connection is kept, e.g.,
+	// "90s"
+	IdleConnTimeout string `json:"idleConnTimeout,omitempty"`
+	// KeepAlive is the interval between TCP keep-alive probes, e.g.,
+	// "30s"
+	KeepAlive string `json:"keepAlive,omitempty"`
+	// TLSHandshakeTimeout bounds the time for a TLS handshake, e.g.,
+	// "10s"
+	TLSHandshakeTimeout string `json:"tlsHandshakeTimeout,omitempty"`
+}
+
+// Admin enables the admin API, at /admin/ on each listener, for
+// requests with the token in the file (relative to the config) as a
+// bearer token.
+type Admin struct {
+	TokenPath string `json:"tokenPath"`
+	// RecentDeliveries is how many deliveries to keep for
+	// /admin/deliveries; if zero, defaultRecentDeliveries
+	RecentDeliveries int `json:"recentDeliveries,omitempty"`
+	// DeliveriesPath, if given, is a file (relative to the config) to
+	// persist the recent deliveries to, so they're kept across
+	// restarts
+	DeliveriesPath string `json:"deliveriesPath,omitempty"`
+}
+
+// Alerts posts a message to a Slack or Microsoft Teams incoming
+// webhook when deliveries to an endpoint keep failing.
+type Alerts struct {
+	// URL is the incoming webhook
+	URL string `json:"url"`
+	// Format is "slack" (the default) or "teams"
+	Format string `json:"format,omitempty"`
+	// ConsecutiveFailures is how many deliveries to an endpoint must
+	// fail in a row to alert; if zero, defaultAlertFailures
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+}
+
+// SLO gives the objectives for deliveries, for which burn rates are
+// exported in the metrics.
+type SLO struct {
+	// Availability is the fraction of deliveries that should succeed,
+	// e.g., 0.999
+	Availability float64 `json:"availability,omitempty"`
+	// Latency is the time deliveries should be handled within, e.g.,
+	// "2s"
+	Latency string `json:"latency,omitempty"`
+	// LatencyObjective is the fraction of deliveries that should be
+	// handled within Latency; if zero, defaultLatencyObjective
+	LatencyObjective float64 `json:"latencyObjective,omitempty"`
+}
+
+// InlineKey returns the key given inline, decoded as necessary.
+func (ep Endpoint) InlineKey() ([]byte, error) {
+	switch ep.KeyEncoding {
+	case "":
+		return []byte(ep.Key), nil
+	case "base64":
+		key, err := base64.StdEncoding.DecodeString(ep.Key)
+		if err != nil {
+			return nil, fmt.Errorf("inline key for source %q is not valid base64: %s", ep.Source, err.Error())
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown keyEncoding %q for source %q (expected \"base64\" or nothing)", ep.KeyEncoding, ep.Source)
+}
+
+// Listener is an address to listen on, and the endpoints to serve
+// there. This lets you put e.g., internet-facing git hooks on one
+// port and internal image registry hooks on another.
+type Listener struct {
+	Listen string `json:"listen"`
+	TLS    *TLS   `json:"tls,omitempty"`
+	// AccessLog, if true, means each request to the listener is
+	// logged, with secrets redacted.
+	AccessLog bool `json:"accessLog,omitempty"`
+	// AccessLogFormat is "log" (the default), to log requests along
+	// with everything else, or "combined", to write them to stdout in
+	// the Apache combined log format; giving it implies AccessLog.
+	AccessLogFormat string `json:"accessLogFormat,omitempty"`
+	// ProxyProtocol, if true, means each connection to the listener
+	// must start with a PROXY protocol (version 1 or 2) preface, as
+	// sent by e.g., an AWS NLB or HAProxy, giving the address of the
+	// client.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+	// H2C, if true, means HTTP/2 is served over cleartext as well as
+	// HTTP/1.1, to clients that ask for it (HTTP/2 is always served
+	// over TLS); it can't be given along with TLS.
+	H2C bool `json:"h2c,omitempty"`
+	// Timeouts, if given, changes the server's timeouts; those not
+	// given are taken from the top level of the config.
+	Timeouts  *Timeouts  `json:"timeouts,omitempty"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// TLS gives the certificate and key with which to serve a listener
+// over HTTPS. The paths are relative to the config file. The
+// certificate is reloaded when the files change.
+type TLS struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// Autocert, if given, is used to obtain certificates from an
+	// ACME provider (e.g., Let's Encrypt), in place of CertFile and
+	// KeyFile.
+	Autocert *Autocert `json:"autocert,omitempty"`
+	// ClientCAFile, if given, is a file of PEM-encoded CA
+	// certificates; clients must then present a certificate signed
+	// by one of these CAs.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// MinVersion is the lowest TLS version accepted, e.g., "1.2",
+	// or "1.3" for TLS 1.3 only.
+	MinVersion string `json:"minVersion,omitempty"`
+	// CipherSuites, if given, are the cipher suites allowed for TLS
+	// 1.2 and below, by their IANA names (e.g.,
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). The cipher suites
+	// for TLS 1.3 are not configurable.
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+}
+
+// Autocert says how to obtain certificates automatically via ACME.
+type Autocert struct {
+	// Hosts are the hostnames for which to obtain certificates
+	Hosts []string `json:"hosts"`
+	// Email is given to the ACME provider as a contact
+	Email string `json:"email,omitempty"`
+	// CacheDir is where certificates are kept between runs; it
+	// should be writable, and persist across restarts, otherwise you
+	// may run into the provider's rate limits.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// DirectoryURL is the ACME directory; if empty, Let's Encrypt is
+	// used.
+	DirectoryURL string `json:"directoryURL,omitempty"`
+	// HTTPListen, if given, is an address on which to answer HTTP-01
+	// challenges (it must be reachable on port 80 from the
+	// internet). Otherwise only TLS-ALPN-01 challenges are answered,
+	// on the listener itself.
+	HTTPListen string `json:"httpListen,omitempty"`
+}
+
+func (t *TLS) validate() error {
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		return fmt.Errorf("TLS minVersion %q is not one of 1.0, 1.1, 1.2, 1.3", t.MinVersion)
+	}
+	for _, name := range t.CipherSuites {
+		if _, ok := tlsCipherSuites[name]; !ok {
+			return fmt.Errorf("TLS cipher suite %q is not known", name)
+		}
+	}
+	if t.Autocert != nil {
+		if t.CertFile != "" || t.KeyFile != "" {
+			return fmt.Errorf("TLS should give either autocert, or certFile and keyFile, but not both")
+		}
+		if len(t.Autocert.Hosts) == 0 {
+			return fmt.Errorf("TLS autocert needs at least one host")
+		}
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("TLS needs both certFile and keyFile, or autocert")
+	}
+	return nil
+}
+
+// CurrentAPIVersion is the version of the config format used by this
+// version of flux-recv. Configs using an older version are upgraded
+// when loaded (see migrations, below).
+const CurrentAPIVersion = "flux-recv/v2"
+
+// legacyAPIVersion is the version given to configs from before
+// apiVersion was introduced, i.e., those with `fluxRecvVersion: 1`.
+const legacyAPIVersion = "flux-recv/v1"
+
+// migrations upgrade a config from the apiVersion of the key, to the
+// next apiVersion. They are applied in turn until the config is at
+// CurrentAPIVersion; so, when changing the config format, add a
+// migration from the previous version.
+var migrations = map[string]func(*Config) error{
+	legacyAPIVersion: func(c *Config) error {
+		// v2 is v1 with `apiVersion` in place of `fluxRecvVersion`
+		c.FluxRecvVersion = 0
+		c.APIVersion = "flux-recv/v2"
+		return nil
+	},
 }
 
 type Config struct {
-	FluxRecvVersion int        `json:"fluxRecvVersion"`
-	API             string     `json:"api"`
-	Endpoints       []Endpoint `json:"endpoints"`
+	APIVersion      string `json:"apiVersion,omitempty"`
+	FluxRecvVersion int    `json:"fluxRecvVersion,omitempty"`
+	API             string `json:"api"`
+	// APISigningKeyPath, if given, is a file with a key used to sign
+	// each notification sent to the API, so that a proxy in front of
+	// fluxd can check it came from flux-recv.
+	APISigningKeyPath string `json:"apiSigningKeyPath,omitempty"`
+	// MaxBodyBytes is the largest request body accepted, unless an
+	// endpoint gives its own limit; if zero, a default of 10MiB is
+	// used.
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+	// RedactKeys are patterns (regular expressions, matched without
+	// regard to case) for keys whose values are redacted when
+	// payloads are logged (see --log-payloads), in addition to the
+	// defaults.
+	RedactKeys []string `json:"redactKeys,omitempty"`
+	// DownstreamPolicy, if given, restricts the URLs notifications can
+	// be sent to.
+	DownstreamPolicy *DownstreamPolicy `json:"downstreamPolicy,omitempty"`
+	// Downstream, if given, bounds the notifications sent to the API
+	// at once.
+	Downstream *Downstream `json:"downstream,omitempty"`
+	// Quota, if given, limits the requests handled across all
+	// endpoints.
+	Quota *Quota `json:"quota,omitempty"`
+	// LoadShedding, if given, means requests for hooks are refused
+	// while flux-recv is overloaded.
+	LoadShedding *LoadShedding `json:"loadShedding,omitempty"`
+	// BasePath, if given, is a path under which all the endpoints are
+	// routed, e.g., `/webhooks` to route them at
+	// `/webhooks/hook/<digest>`, for path-based routing in front of
+	// flux-recv.
+	BasePath string `json:"basePath,omitempty"`
+	// TrustedProxies are the IP ranges of the proxies in front of
+	// flux-recv, that are trusted to give the address of the client
+	// in the ForwardedHeader.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// ForwardedHeader is the header the trusted proxies add the
+	// client's address to: `X-Forwarded-For` (the default) or
+	// `Forwarded`.
+	ForwardedHeader string `json:"forwardedHeader,omitempty"`
+	// Spool, if given, means request bodies over a threshold are
+	// written to disk while they're checked and handled, rather than
+	// kept in memory.
+	Spool *Spool `json:"spool,omitempty"`
+	// Dedup, if given, is a Redis server shared by replicas, to
+	// avoid notifying fluxd twice for the same delivery.
+	Dedup *Dedup `json:"dedup,omitempty"`
+	// LeaderElection, if given, means only the replica holding a
+	// Kubernetes Lease handles hooks.
+	LeaderElection *LeaderElection `json:"leaderElection,omitempty"`
+	// Callback, if given, is a URL to POST the outcome of each
+	// delivery to.
+	Callback string `json:"callback,omitempty"`
+	// AuditEvents, if given, is an HTTP URL or a Kafka topic (as
+	// kafka://broker:9092/topic) to send a CloudEvent to for each
+	// accepted delivery.
+	AuditEvents string `json:"auditEvents,omitempty"`
+	// Alerts, if given, is where to post alerts about endpoints
+	// that keep failing.
+	Alerts *Alerts `json:"alerts,omitempty"`
+	// SLO, if given, is the objectives to export burn rates for.
+	SLO *SLO `json:"slo,omitempty"`
+	// Admin, if given, enables the admin API.
+	Admin *Admin `json:"admin,omitempty"`
+	// Tenants, if given, are the tenants endpoints can belong to,
+	// each with its own downstream API, quota, and admin token.
+	Tenants   []Tenant   `json:"tenants,omitempty"`
+	Endpoints []Endpoint `json:"endpoints"`
+	// TLS, if given, is used to serve the top-level endpoints over
+	// HTTPS (see also --tls-cert and --tls-key).
+	TLS *TLS `json:"tls,omitempty"`
+	// AccessLog, if true, means requests to the top-level endpoints
+	// are logged (see Listener), in the AccessLogFormat.
+	AccessLog       bool   `json:"accessLog,omitempty"`
+	AccessLogFormat string `json:"accessLogFormat,omitempty"`
+	// ProxyProtocol, if true, means connections to the top-level
+	// endpoints start with a PROXY protocol preface (see Listener).
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+	// H2C, if true, means the top-level endpoints are served over
+	// HTTP/2 in cleartext, too (see Listener).
+	H2C bool `json:"h2c,omitempty"`
+	// Timeouts, if given, changes the server's timeouts, for all
+	// listeners.
+	Timeouts  *Timeouts  `json:"timeouts,omitempty"`
+	Listeners []Listener `json:"listeners,omitempty"`
+
+	// inlineKeysEncrypted is true if the config was decrypted when
+	// loaded, and any keys given inline in it were encrypted (so it
+	// can be trusted with them)
+	inlineKeysEncrypted bool
 }
 
+// ConfigFromBytes parses and validates a config, first decrypting it
+// if it's encrypted with SOPS or age.
 func ConfigFromBytes(configBytes []byte) (Config, error) {
 	var config Config
 
-	if err := yaml.Unmarshal(configBytes, &config); err != nil {
+	plain, encrypted, err := decryptConfig(configBytes)
+	if err != nil {
+		return config, fmt.Errorf("cannot decrypt config: %s", err.Error())
+	}
+	if err := yaml.Unmarshal(plain, &config); err != nil {
 		return config, err
 	}
-	if config.FluxRecvVersion != 1 {
-		return config, fmt.Errorf("not a valid config file (field fluxRecvVersion != 1)")
+	// SOPS can leave values in plaintext (e.g., those not matching
+	// encrypted_regex), so each inline key is checked
+	config.inlineKeysEncrypted = encrypted && (!isSOPSEncrypted(configBytes) || sopsInlineKeysEncrypted(configBytes))
+	switch {
+	case config.APIVersion != "" && config.FluxRecvVersion != 0:
+		return config, fmt.Errorf("not a valid config file (only one of apiVersion and fluxRecvVersion should be given)")
+	case config.APIVersion == "":
+		if config.FluxRecvVersion != 1 {
+			return config, fmt.Errorf("not a valid config file (field apiVersion is missing, and fluxRecvVersion != 1)")
+		}
+		config.APIVersion = legacyAPIVersion
+	}
+	for config.APIVersion != CurrentAPIVersion {
+		migrate, ok := migrations[config.APIVersion]
+		if !ok {
+			return config, fmt.Errorf("not a valid config file (apiVersion %q is not %q)", config.APIVersion, CurrentAPIVersion)
+		}
+		from := config.APIVersion
+		if err := migrate(&config); err != nil {
+			return config, fmt.Errorf("upgrading config from apiVersion %q: %s", from, err.Error())
+		}
+	}
+
+	if config.TLS != nil {
+		if err := config.TLS.validate(); err != nil {
+			return config, err
+		}
+	}
+	if _, err := newRedactor(config.RedactKeys); err != nil {
+		return config, err
+	}
+	if config.API != "" {
+		if err := config.DownstreamPolicy.checkURL(config.API); err != nil {
+			return config, fmt.Errorf("api: %s", err.Error())
+		}
+	}
+	if config.Callback != "" {
+		if err := config.DownstreamPolicy.checkURL(config.Callback); err != nil {
+			return config, fmt.Errorf("callback: %s", err.Error())
+		}
+	}
+	if config.AuditEvents != "" {
+		if err := checkAuditEventsURL(config.DownstreamPolicy, config.AuditEvents); err != nil {
+			return config, fmt.Errorf("auditEvents: %s", err.Error())
+		}
+	}
+	if a := config.Alerts; a != nil {
+		if a.URL == "" {
+			return config, fmt.Errorf("alerts needs url")
+		}
+		if err := config.DownstreamPolicy.checkURL(a.URL); err != nil {
+			return config, fmt.Errorf("alerts: %s", err.Error())
+		}
+		if a.Format != "" && a.Format != alertFormatSlack && a.Format != alertFormatTeams {
+			return config, fmt.Errorf("alerts: format %q is not one of %s, %s", a.Format, alertFormatSlack, alertFormatTeams)
+		}
+		if a.ConsecutiveFailures < 0 {
+			return config, fmt.Errorf("alerts: consecutiveFailures must not be negative")
+		}
+	}
+	if slo := config.SLO; slo != nil {
+		if slo.Availability == 0 && slo.Latency == "" {
+			return config, fmt.Errorf("slo needs availability, or latency, or both")
+		}
+		if slo.Availability < 0 || slo.Availability >= 1 {
+			return config, fmt.Errorf("slo: availability must be more than 0 and less than 1, e.g., 0.999")
+		}
+		if slo.LatencyObjective < 0 || slo.LatencyObjective >= 1 {
+			return config, fmt.Errorf("slo: latencyObjective must be more than 0 and less than 1, e.g., 0.99")
+		}
+		if slo.Latency != "" {
+			if d, err := time.ParseDuration(slo.Latency); err != nil || d <= 0 {
+				return config, fmt.Errorf("slo: latency %q is not a positive duration, e.g., 2s", slo.Latency)
+			}
+		}
+	}
+	if d := config.Downstream; d != nil {
+		if d.Workers < 0 || d.QueueSize < 0 {
+			return config, fmt.Errorf("downstream: workers and queueSize must not be negative")
+		}
+		if d.QueueSize > 0 && d.Workers == 0 {
+			return config, fmt.Errorf("downstream: queueSize is given, but not workers")
+		}
+		if d.MaxIdleConns < 0 || d.MaxIdleConnsPerHost < 0 || d.MaxConnsPerHost < 0 {
+			return config, fmt.Errorf("downstream: connection limits must not be negative")
+		}
+		for name, value := range map[string]string{
+			"idleConnTimeout":     d.IdleConnTimeout,
+			"keepAlive":           d.KeepAlive,
+			"tlsHandshakeTimeout": d.TLSHandshakeTimeout,
+		} {
+			if value == "" {
+				continue
+			}
+			if v, err := time.ParseDuration(value); err != nil || v <= 0 {
+				return config, fmt.Errorf("downstream: %s %q is not a positive duration", name, value)
+			}
+		}
+	}
+	if s := config.Spool; s != nil {
+		if err := s.validate(); err != nil {
+			return config, err
+		}
+	}
+	if d := config.Dedup; d != nil {
+		if err := d.validate(); err != nil {
+			return config, err
+		}
+	}
+	if le := config.LeaderElection; le != nil {
+		if err := le.validate(); err != nil {
+			return config, err
+		}
+	}
+	if q := config.Quota; q != nil {
+		if err := q.validate(); err != nil {
+			return config, err
+		}
+	}
+	if ls := config.LoadShedding; ls != nil {
+		if err := ls.validate(); err != nil {
+			return config, err
+		}
+	}
+	if a := config.Admin; a != nil {
+		if a.TokenPath == "" {
+			return config, fmt.Errorf("admin needs tokenPath")
+		}
+		if a.RecentDeliveries < 0 {
+			return config, fmt.Errorf("admin: recentDeliveries must not be negative")
+		}
+	}
+	tenantNames := map[string]bool{}
+	for _, t := range config.Tenants {
+		if err := t.validate(); err != nil {
+			return config, err
+		}
+		if tenantNames[t.Name] {
+			return config, fmt.Errorf("more than one tenant is named %q", t.Name)
+		}
+		tenantNames[t.Name] = true
+		if t.AdminTokenPath != "" && config.Admin == nil {
+			return config, fmt.Errorf("tenant %q: adminTokenPath needs admin", t.Name)
+		}
+	}
+	if b := config.BasePath; b != "" && (!strings.HasPrefix(b, "/") || path.Clean(b) != b || b == "/") {
+		return config, fmt.Errorf("basePath %q must start with / and not end with /, e.g., /webhooks", b)
+	}
+	if _, err := parseCIDRs(config.TrustedProxies); err != nil {
+		return config, fmt.Errorf("trustedProxies: %s", err.Error())
+	}
+	switch config.ForwardedHeader {
+	case "", headerXForwardedFor, headerForwarded:
+	default:
+		return config, fmt.Errorf("forwardedHeader %q is not %s or %s", config.ForwardedHeader, headerXForwardedFor, headerForwarded)
+	}
+	seen := map[string]bool{}
+	for i, l := range config.Listeners {
+		if l.Listen == "" {
+			return config, fmt.Errorf("listener %d has no listen address", i)
+		}
+		if seen[l.Listen] {
+			return config, fmt.Errorf("more than one listener uses the address %q", l.Listen)
+		}
+		seen[l.Listen] = true
+		if l.TLS != nil {
+			if err := l.TLS.validate(); err != nil {
+				return config, fmt.Errorf("listener %q: %s", l.Listen, err.Error())
+			}
+		}
+	}
+
+	for _, l := range config.ListenersWithDefault("") {
+		if f := l.AccessLogFormat; f != "" && f != accessLogFormatLog && f != accessLogFormatCombined {
+			return config, fmt.Errorf("listener %q: accessLogFormat %q is not one of %s, %s", l.Listen, f, accessLogFormatLog, accessLogFormatCombined)
+		}
+		if err := l.Timeouts.validate(); err != nil {
+			return config, fmt.Errorf("listener %q: %s", l.Listen, err.Error())
+		}
+		if l.H2C && l.TLS != nil {
+			return config, fmt.Errorf("listener %q: h2c is for listeners without TLS (HTTP/2 is served over TLS anyway)", l.Listen)
+		}
+		catchAll := map[string]bool{}
+		for _, ep := range l.Endpoints {
+			if ep.CatchAll {
+				if ep.Allow == "" {
+					return config, fmt.Errorf("catch-all endpoint for source %q must give an allow expression", ep.Source)
+				}
+				if catchAll[ep.Source] {
+					return config, fmt.Errorf("more than one catch-all endpoint for source %q on the same listener", ep.Source)
+				}
+				catchAll[ep.Source] = true
+			}
+			if ep.Allow != "" {
+				if _, err := compileAllow(ep.Allow); err != nil {
+					return config, err
+				}
+			}
+			if err := validateEvents(ep.Source, ep.Events); err != nil {
+				return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+			}
+			if r := ep.Repos; r != nil {
+				if err := r.validate(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if err := validateBranches(ep.Branches); err != nil {
+				return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+			}
+			if ep.DefaultBranchOnly && !DefaultBranchSources[ep.Source] {
+				return config, fmt.Errorf("endpoint for source %q gives defaultBranchOnly, but that source does not say which is the default branch", ep.Source)
+			}
+			if len(ep.SkipMarkers) > 0 && !CommitMessageSources[ep.Source] {
+				return config, fmt.Errorf("endpoint for source %q gives skipMarkers, but that source does not give commit messages", ep.Source)
+			}
+			if containsString(ep.SkipMarkers, "") {
+				return config, fmt.Errorf("endpoint for source %q: skipMarkers cannot include an empty marker", ep.Source)
+			}
+			if len(ep.IgnoreAuthors) > 0 || len(ep.IgnoreCommitters) > 0 {
+				if len(ep.IgnoreAuthors) > 0 && !CommitAuthorSources[ep.Source] {
+					return config, fmt.Errorf("endpoint for source %q gives ignoreAuthors, but that source does not give commit authors", ep.Source)
+				}
+				if len(ep.IgnoreCommitters) > 0 && !CommitCommitterSources[ep.Source] {
+					return config, fmt.Errorf("endpoint for source %q gives ignoreCommitters, but that source does not give commit committers", ep.Source)
+				}
+				if _, err := authorFilter(ep.IgnoreAuthors, ep.IgnoreCommitters); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if ep.TagPattern != "" {
+				if !ImageTagSources[ep.Source] {
+					return config, fmt.Errorf("endpoint for source %q gives tagPattern, but that source does not give image tags", ep.Source)
+				}
+				if _, err := compileTagPattern(ep.TagPattern); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if _, err := compileGitURLRewrites(ep.GitURLRewrites); err != nil {
+				return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+			}
+			if err := validateImageRewrites(ep.ImageRewrites); err != nil {
+				return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+			}
+			if (ep.Source == Generic) != (ep.Generic != nil) {
+				return config, fmt.Errorf("endpoint for source %q: generic must be given for, and only for, the Generic source", ep.Source)
+			}
+			if g := ep.Generic; g != nil {
+				if _, err := compileGeneric(g); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if len(ep.SignatureAlgorithms) > 0 && !signsPayloads(ep) {
+				return config, fmt.Errorf("endpoint for source %q gives signatureAlgorithms, but that source does not sign payloads", ep.Source)
+			}
+			if ep.TimestampTolerance != "" {
+				if !signsTimestamps(ep) {
+					return config, fmt.Errorf("endpoint for source %q gives timestampTolerance, but requests to it do not have a signed timestamp", ep.Source)
+				}
+				if _, err := ep.timestampTolerance(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if ep.RequireSignature && !SignedSources[ep.Source] {
+				return config, fmt.Errorf("endpoint for source %q gives requireSignature, but that source does not sign payloads", ep.Source)
+			}
+			if _, ok := providerIPRanges[ep.Source]; ep.ProviderIPs && !ok {
+				return config, fmt.Errorf("endpoint for source %q has providerIPs, but that source does not publish its IP ranges", ep.Source)
+			}
+			for _, cidrs := range [][]string{ep.AllowCIDRs, ep.DenyCIDRs} {
+				if _, err := parseCIDRs(cidrs); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			for _, l := range []*RateLimit{ep.RateLimit, ep.RateLimitPerIP} {
+				if l != nil && l.PerSecond <= 0 {
+					return config, fmt.Errorf("endpoint for source %q has a rate limit without a positive perSecond", ep.Source)
+				}
+			}
+			if ep.BasicAuth != nil && (ep.BasicAuth.Username == "" || ep.BasicAuth.PasswordPath == "") {
+				return config, fmt.Errorf("endpoint for source %q: basicAuth needs username and passwordPath", ep.Source)
+			}
+			if err := ep.validateRequire(l.TLS); err != nil {
+				return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+			}
+			if ep.RotationGracePeriod != "" {
+				if _, err := ep.rotationGracePeriod(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if f := ep.Faults; f != nil {
+				if err := f.validate(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if ep.Tenant != "" && !tenantNames[ep.Tenant] {
+				return config, fmt.Errorf("endpoint for source %q: there is no tenant %q", ep.Source, ep.Tenant)
+			}
+			if iso := ep.Isolation; iso != nil {
+				if err := iso.validate(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if ep.RejectReplays && !DeliveryIDSources[ep.Source] {
+				return config, fmt.Errorf("endpoint for source %q gives rejectReplays, but that source does not give deliveries an ID", ep.Source)
+			}
+			if c := ep.IdempotentResponses; c != nil {
+				if ep.RejectReplays {
+					return config, fmt.Errorf("endpoint for source %q: rejectReplays and idempotentResponses cannot both be given", ep.Source)
+				}
+				if err := c.validate(); err != nil {
+					return config, fmt.Errorf("endpoint for source %q: %s", ep.Source, err.Error())
+				}
+			}
+			if ep.LogSampling < 0 {
+				return config, fmt.Errorf("endpoint for source %q: logSampling must not be negative", ep.Source)
+			}
+			if l := ep.JSONLimits; l != nil && (l.MaxDepth < 0 || l.MaxArrayLength < 0) {
+				return config, fmt.Errorf("endpoint for source %q: jsonLimits cannot be negative", ep.Source)
+			}
+			if ep.QueryToken != nil && ep.QueryToken.TokenPath == "" {
+				return config, fmt.Errorf("endpoint for source %q: queryToken needs tokenPath", ep.Source)
+			}
+			if ep.JWT != nil {
+				if u, err := url.Parse(ep.JWT.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+					return config, fmt.Errorf("endpoint for source %q: jwt needs an http(s) jwksURL", ep.Source)
+				}
+				if ep.JWT.Issuer == "" || ep.JWT.Audience == "" {
+					return config, fmt.Errorf("endpoint for source %q: jwt needs issuer and audience", ep.Source)
+				}
+			}
+			for _, alg := range ep.SignatureAlgorithms {
+				if _, ok := hmacAlgorithms[alg]; !ok {
+					return config, fmt.Errorf("endpoint for source %q has unknown signature algorithm %q", ep.Source, alg)
+				}
+				if fipsBuild && !fipsSignatureAlgorithms[alg] {
+					return config, fmt.Errorf("endpoint for source %q: signature algorithm %q is %s", ep.Source, alg, errNotFIPSApproved)
+				}
+			}
+			if ep.Key != "" && ep.KeyPath != "" {
+				return config, fmt.Errorf("endpoint for source %q has both key and keyPath; only one should be given", ep.Source)
+			}
+			if ep.Key != "" {
+				if _, err := ep.InlineKey(); err != nil {
+					return config, err
+				}
+			}
+		}
 	}
 
 	return config, nil
@@ -38,3 +933,186 @@ func ConfigFromFile(path string) (Config, error) {
 	}
 	return ConfigFromBytes(configBytes)
 }
+
+// LoadConfig loads the config from the location given, which is
+// either a path, `-` meaning stdin, or an http(s) URL. If checksum is
+// not empty, the config must have that (hex-encoded) SHA256 digest; a
+// plain http:// URL is refused without one, since nothing else
+// vouches for what's fetched. It returns the directory against which
+// key paths etc. in the config are resolved -- for a path, that's the
+// directory it's in, otherwise the working directory.
+func LoadConfig(location, checksum string) (Config, string, error) {
+	var (
+		configBytes []byte
+		configDir   = "."
+		err         error
+	)
+	switch {
+	case location == "-":
+		configBytes, err = ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(location, "http://") && checksum == "":
+		return Config{}, "", fmt.Errorf("config from %s: an http:// URL needs --config-sha256, or use https://", location)
+	case strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://"):
+		configBytes, err = fetchConfig(location)
+	default:
+		configBytes, err = ioutil.ReadFile(location)
+		configDir = filepath.Dir(location)
+	}
+	if err != nil {
+		return Config{}, "", err
+	}
+
+	if checksum != "" {
+		if digest := fmt.Sprintf("%x", sha256.Sum256(configBytes)); !strings.EqualFold(digest, checksum) {
+			return Config{}, "", fmt.Errorf("config from %s has SHA256 %s, but expected %s", location, digest, checksum)
+		}
+	}
+
+	config, err := ConfigFromBytes(configBytes)
+	return config, configDir, err
+}
+
+// configFetchTimeout bounds fetching the config from a URL, so an
+// unresponsive server doesn't hold up starting indefinitely.
+const configFetchTimeout = 30 * time.Second
+
+var configFetchClient = &http.Client{Timeout: configFetchTimeout}
+
+func fetchConfig(u string) ([]byte, error) {
+	resp, err := configFetchClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching config from %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ListenersWithDefault returns all the listeners to run: those given
+// in the config, plus one at defaultListen for the top-level
+// endpoints. The latter is left out if there are no top-level
+// endpoints but other listeners are given. Settings given for the
+// whole config are filled in for the endpoints that don't give their
+// own.
+func (c Config) ListenersWithDefault(defaultListen string) []Listener {
+	var listeners []Listener
+	if len(c.Endpoints) > 0 || len(c.Listeners) == 0 {
+		listeners = append(listeners, Listener{
+			Listen:          defaultListen,
+			TLS:             c.TLS,
+			AccessLog:       c.AccessLog,
+			AccessLogFormat: c.AccessLogFormat,
+			ProxyProtocol:   c.ProxyProtocol,
+			H2C:             c.H2C,
+			Endpoints:       c.Endpoints,
+		})
+	}
+	listeners = append(listeners, c.Listeners...)
+
+	for i := range listeners {
+		listeners[i].Timeouts = listeners[i].Timeouts.withDefaults(c.Timeouts)
+		var endpoints []Endpoint
+		for _, ep := range listeners[i].Endpoints {
+			if ep.MaxBodyBytes == 0 {
+				ep.MaxBodyBytes = c.MaxBodyBytes
+			}
+			endpoints = append(endpoints, ep)
+		}
+		listeners[i].Endpoints = endpoints
+	}
+	return listeners
+}
+
+// HasInlineKeys reports whether any endpoint has a key given inline,
+// rather than by path.
+func (c Config) HasInlineKeys() bool {
+	for _, l := range c.ListenersWithDefault("") {
+		for _, ep := range l.Endpoints {
+			if ep.Key != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkInlineKeys refuses a config with keys given inline, unless
+// they're allowed (with --allow-inline-keys), or were encrypted in
+// the config file.
+func checkInlineKeys(config Config, allow bool) error {
+	if config.HasInlineKeys() && !allow && !config.inlineKeysEncrypted {
+		return fmt.Errorf("the config has keys given inline (with `key:`) and not encrypted; this is only allowed with --allow-inline-keys, for development and tests")
+	}
+	return nil
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config with any secrets removed, so
+// it can be printed out.
+func (c Config) Redacted() Config {
+	redactEndpoints := func(eps []Endpoint) []Endpoint {
+		var out []Endpoint
+		for _, ep := range eps {
+			if ep.Key != "" {
+				ep.Key = redacted
+			}
+			out = append(out, ep)
+		}
+		return out
+	}
+	c.Endpoints = redactEndpoints(c.Endpoints)
+	var listeners []Listener
+	for _, l := range c.Listeners {
+		l.Endpoints = redactEndpoints(l.Endpoints)
+		listeners = append(listeners, l)
+	}
+	c.Listeners = listeners
+
+	redactAPI := func(api string) string {
+		if u, err := url.Parse(api); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+		return api
+	}
+	c.API = redactAPI(c.API)
+	var tenants []Tenant
+	for _, t := range c.Tenants {
+		t.API = redactAPI(t.API)
+		tenants = append(tenants, t)
+	}
+	c.Tenants = tenants
+	c.Callback = redactURL(c.Callback)
+	c.AuditEvents = redactURL(c.AuditEvents)
+	if c.Dedup != nil {
+		dedup := *c.Dedup
+		dedup.Redis = redactURL(dedup.Redis)
+		c.Dedup = &dedup
+	}
+	if c.Alerts != nil {
+		// the secret in an incoming webhook URL is its path (or, for
+		// some, its query)
+		alerts := *c.Alerts
+		if u, err := url.Parse(alerts.URL); err == nil {
+			if u.User != nil {
+				u.User = url.User(redacted)
+			}
+			if u.Path != "" {
+				u.Path, u.RawPath = "/"+redacted, ""
+			}
+			if u.RawQuery != "" {
+				u.RawQuery = redacted
+			}
+			alerts.URL = u.String()
+		} else {
+			alerts.URL = redacted
+		}
+		c.Alerts = &alerts
+	}
+	return c
+}
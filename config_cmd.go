@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+	flag "github.com/spf13/pflag"
+)
+
+const configUsage = `usage:
+  flux-recv config dump [--config <file>] [--listen <address>] [--age-identity <file>]
+  flux-recv config schema`
+
+// configCommand implements `flux-recv config <subcommand>`.
+func configCommand(args []string) {
+	if len(args) == 0 {
+		bail(configUsage)
+	}
+	switch args[0] {
+	case "dump":
+		configDump(args[1:])
+	case "schema":
+		out, err := json.MarshalIndent(ConfigSchema(), "", "  ")
+		if err != nil {
+			bail(err.Error())
+		}
+		fmt.Println(string(out))
+	default:
+		bail(configUsage)
+	}
+}
+
+func configDump(args []string) {
+
+	var (
+		configFile   string
+		configSHA256 string
+		listen       string
+		ageIdentity  string
+	)
+	flags := flag.NewFlagSet("flux-recv config dump", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv; or, - for stdin, or an http(s) URL")
+	flags.StringVar(&configSHA256, "config-sha256", "", "if given, the config must have this (hex-encoded) SHA256 digest")
+	flags.StringVar(&listen, "listen", ":8080", "address to listen on, for endpoints not given a listener in the config")
+	flags.StringVar(&ageIdentity, "age-identity", os.Getenv("SOPS_AGE_KEY_FILE"), "path to a file of age identities, for decrypting the config and key files; defaults to $SOPS_AGE_KEY_FILE")
+	flags.Parse(args)
+
+	if err := useAgeIdentities(ageIdentity); err != nil {
+		bail(err.Error())
+	}
+	config, configDir, err := LoadConfig(configFile, configSHA256)
+	if err != nil {
+		bail(err.Error())
+	}
+	out, err := yaml.Marshal(dumpConfig(configDir, listen, config))
+	if err != nil {
+		bail(err.Error())
+	}
+	os.Stdout.Write(out)
+}
+
+// dumpedEndpoint is an endpoint along with the hook paths at which
+// it will be served.
+type dumpedEndpoint struct {
+	Endpoint
+	Hooks  []string `json:"hooks,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type dumpedListener struct {
+	Listener
+	Endpoints []dumpedEndpoint `json:"endpoints"`
+}
+
+// dumpedConfig is the configuration as it will be used: with
+// defaults filled in, all endpoints assigned to a listener, and any
+// secrets redacted.
+type dumpedConfig struct {
+	Config
+	Endpoints []dumpedEndpoint `json:"endpoints,omitempty"`
+	Listeners []dumpedListener `json:"listeners"`
+}
+
+func dumpConfig(configDir, defaultListen string, config Config) dumpedConfig {
+	// The hooks are calculated from the config as given, but what's
+	// printed comes from the redacted config, which has the same
+	// shape.
+	listeners := config.ListenersWithDefault(defaultListen)
+	config = config.Redacted()
+	redactedListeners := config.ListenersWithDefault(defaultListen)
+	if config.API == "" {
+		config.API = defaultApiBase
+	}
+
+	dumped := dumpedConfig{Config: config}
+	for i, l := range listeners {
+		dl := dumpedListener{Listener: redactedListeners[i]}
+		for j, ep := range l.Endpoints {
+			de := dumpedEndpoint{Endpoint: redactedListeners[i].Endpoints[j]}
+			if SignedSources[ep.Source] && len(de.SignatureAlgorithms) == 0 {
+				de.SignatureAlgorithms = defaultSignatureAlgorithms
+			}
+			keys, err := loadEndpointKeys(configDir, ep)
+			if err != nil {
+				de.Errors = append(de.Errors, err.Error())
+			}
+			for _, k := range keys {
+				de.Hooks = append(de.Hooks, config.BasePath+hookPrefix+k.digest)
+			}
+			if _, ok := Sources[ep.Source]; !ok {
+				de.Errors = append(de.Errors, fmt.Sprintf("unknown source %q", ep.Source))
+			}
+			dl.Endpoints = append(dl.Endpoints, de)
+		}
+		dumped.Listeners = append(dumped.Listeners, dl)
+	}
+	return dumped
+}
@@ -0,0 +1,14 @@
+package main
+
+// flux-recv is told to shut down, or to restart (see restart.go), by
+// signals on Unix, and on Windows by Ctrl-C, or the service control
+// manager when it's running as a service (see service_windows.go).
+// Either way, it arrives on a channel as a control, so that the serve
+// loop in main doesn't depend on the platform.
+
+// control is a request to shut down or to restart.
+type control struct {
+	restart bool
+	// reason says what asked, e.g., the signal
+	reason string
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyControl(t *testing.T) {
+	controls := make(chan control, 1)
+	notifyControl(controls)
+
+	receive := func() control {
+		select {
+		case c := <-controls:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no control received")
+			return control{}
+		}
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+	assert.Equal(t, control{restart: true, reason: "user defined signal 2"}, receive())
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	assert.Equal(t, control{reason: "terminated"}, receive())
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyControl sends a control to c for each signal to shut down
+// (SIGTERM, or an interrupt) or restart (SIGUSR2).
+func notifyControl(c chan<- control) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			c <- control{restart: sig == syscall.SIGUSR2, reason: sig.String()}
+		}
+	}()
+}
+
+// controlDone is called once flux-recv has shut down, just before it
+// exits.
+func controlDone() {}
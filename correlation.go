@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Each request gets a correlation ID: the delivery ID given by the
+// source (e.g., X-GitHub-Delivery), or one made up if there isn't one.
+// It's in every log line about the request, in the response, and in
+// the notifications sent downstream, so that a delivery can be
+// followed from the source, through flux-recv, to fluxd.
+
+const correlationIDHeader = "X-Correlation-ID"
+
+type correlationIDKey struct{}
+
+// withCorrelationID gives the request its correlation ID.
+func withCorrelationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := deliveryID(r)
+		if id == "" {
+			id = newCorrelationID()
+		}
+		w.Header().Set(correlationIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), correlationIDKey{}, id)))
+	})
+}
+
+// newCorrelationID makes up a correlation ID, in the form of a UUID
+// (version 4), like the delivery IDs most sources give.
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// correlationID gives the correlation ID of the request the context
+// is for, or the empty string if it's not for a request.
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// correlationTransport passes the correlation ID downstream.
+type correlationTransport struct {
+	base http.RoundTripper
+}
+
+func (t correlationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := correlationID(req.Context())
+	if id == "" {
+		return t.base.RoundTrip(req)
+	}
+	// as with tracingTransport, the request mustn't be changed
+	tagged := req.Clone(req.Context())
+	tagged.Header.Set(correlationIDHeader, id)
+	return t.base.RoundTrip(tagged)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelationID(t *testing.T) {
+	var seen string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(correlationIDHeader)
+	}))
+	defer downstream.Close()
+
+	client := newDownstreamClient(nil, nil, nil)
+	handler := withCorrelationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest("POST", downstream.URL, nil)
+		res, err := client.Do(req.WithContext(r.Context()))
+		if assert.NoError(t, err) {
+			res.Body.Close()
+		}
+	}))
+
+	// the delivery ID is used, if there is one
+	req := httptest.NewRequest("POST", "/hook/abc", nil)
+	req.Header.Set("X-Request-UUID", "d-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "d-1", rec.Header().Get(correlationIDHeader))
+	assert.Equal(t, "d-1", seen)
+
+	// otherwise, one is made up
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/hook/abc", nil))
+	id := rec.Header().Get(correlationIDHeader)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	assert.Equal(t, id, seen)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The dashboard, at /admin/, shows the endpoints, the recent
+// deliveries and failures, and the notifications in flight, for when
+// Grafana isn't to hand. It's a single page, refreshed every so often,
+// so it needs no scripts or assets.
+
+const (
+	dashboardRefreshSeconds = 15
+	dashboardCSP            = "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'"
+)
+
+type dashboardData struct {
+	Now             time.Time
+	RefreshSeconds  int
+	Endpoints       []endpointStats
+	Deliveries      []*deliveryRecord
+	Failures        []*deliveryRecord
+	InFlight        int64
+	KeepsDeliveries bool
+}
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != adminPrefix {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data := dashboardData{
+		Now:             time.Now().UTC(),
+		RefreshSeconds:  dashboardRefreshSeconds,
+		Endpoints:       scopedStats(r, deliveryStats.snapshot()),
+		InFlight:        atomic.LoadInt64(&notificationsInFlight),
+		KeepsDeliveries: recentDeliveries != nil,
+	}
+	if recentDeliveries != nil {
+		data.Deliveries = scopedDeliveries(r, recentDeliveries.list())
+		for _, rec := range data.Deliveries {
+			if rec.Status >= 400 {
+				data.Failures = append(data.Failures, rec)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// this replaces the policy set with --hardened, which would
+	// forbid the stylesheet
+	w.Header().Set("Content-Security-Policy", dashboardCSP)
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		level.Error(logger).Log("component", "admin", "msg", "could not render dashboard", "err", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"when": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RefreshSeconds}}">
+<title>flux-recv</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+.failed { color: #b00; }
+.idle { color: #888; }
+code { font-size: 90%; }
+</style>
+</head>
+<body>
+<h1>flux-recv</h1>
+<p>As of {{.Now.Format "2006-01-02T15:04:05Z07:00"}}; notifications in flight: {{.InFlight}}.</p>
+
+<h2>Endpoints</h2>
+<table>
+<tr><th>Listener</th><th>Source</th><th>Endpoint</th><th>Received</th><th>Succeeded</th><th>Failed</th><th>Last delivery</th><th>Last error</th></tr>
+{{range .Endpoints}}<tr{{if not .LastDelivery}} class="idle"{{end}}>
+<td>{{.Listen}}</td><td>{{.Source}}</td><td><code>{{.Endpoint}}</code></td>
+<td>{{.Received}}</td><td>{{.Succeeded}}</td><td>{{if .Failed}}<span class="failed">{{.Failed}}</span>{{else}}0{{end}}</td>
+<td>{{when .LastDelivery}}</td><td>{{if .LastError}}<span class="failed">{{.LastError}}</span> ({{when .LastErrorTime}}){{end}}</td>
+</tr>
+{{end}}</table>
+
+{{if .KeepsDeliveries}}
+<h2>Failures</h2>
+{{if .Failures}}<table>
+<tr><th>Time</th><th>Source</th><th>Endpoint</th><th>Client</th><th>Status</th><th>Reason</th></tr>
+{{range .Failures}}<tr>
+<td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Source}}</td><td><code>{{.Endpoint}}</code></td><td>{{.ClientIP}}</td>
+<td class="failed">{{.Status}}</td><td>{{.Reason}}</td>
+</tr>
+{{end}}</table>
+{{else}}<p>None among the recent deliveries.</p>
+{{end}}
+
+<h2>Recent deliveries</h2>
+<table>
+<tr><th>Time</th><th>Source</th><th>Endpoint</th><th>Delivery</th><th>Status</th><th>Duration</th><th>Changes</th></tr>
+{{range .Deliveries}}<tr>
+<td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Source}}</td><td><code>{{.Endpoint}}</code></td><td><code>{{.DeliveryID}}</code></td>
+<td{{if ge .Status 400}} class="failed"{{end}}>{{.Status}}</td><td>{{.DurationMillis}}ms</td>
+<td>{{range .Changes}}<code>{{.Subject}}</code>: {{.Result}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// decryptionIdentities are the age identities for decrypting files
+// encrypted with age or SOPS, as given with --age-identity.
+var decryptionIdentities []ageIdentity
+
+// loadAgeIdentities reads the identity file given with
+// --age-identity.
+func loadAgeIdentities(path string) ([]ageIdentity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAgeIdentities(data)
+}
+
+// useAgeIdentities loads the identity file given with --age-identity
+// (if any) to decrypt with.
+func useAgeIdentities(path string) error {
+	if path == "" {
+		return nil
+	}
+	ids, err := loadAgeIdentities(path)
+	if err != nil {
+		return fmt.Errorf("cannot load age identities from %s: %s", path, err.Error())
+	}
+	decryptionIdentities = ids
+	return nil
+}
+
+// decryptConfig decrypts a config file, if it's encrypted with SOPS
+// (as YAML or JSON) or age; otherwise, it returns the contents as they
+// are.
+func decryptConfig(data []byte) (plain []byte, encrypted bool, err error) {
+	if !isSOPSEncrypted(data) {
+		return decryptFile(data)
+	}
+	if fipsBuild {
+		return nil, true, fmt.Errorf("decrypting SOPS files is %s", errNotFIPSApproved)
+	}
+	if len(decryptionIdentities) == 0 {
+		return nil, true, errors.New("the config is encrypted, but no identity was given to decrypt it with (see --age-identity)")
+	}
+	doc, err := sopsDecrypt(data, decryptionIdentities)
+	if err != nil {
+		return nil, true, err
+	}
+	plain, err = yaml.Marshal(doc)
+	return plain, true, err
+}
+
+// decryptFile decrypts the contents of a file, if encrypted with age
+// or SOPS (as binary); otherwise, it returns the contents as they
+// are.
+func decryptFile(data []byte) (plain []byte, encrypted bool, err error) {
+	var decrypt func([]byte, []ageIdentity) ([]byte, error)
+	switch {
+	case isAgeEncrypted(data):
+		decrypt = ageDecrypt
+	case isSOPSEncrypted(data):
+		decrypt = sopsDecryptBinary
+	default:
+		return data, false, nil
+	}
+	if fipsBuild {
+		return nil, true, fmt.Errorf("decrypting age or SOPS files is %s", errNotFIPSApproved)
+	}
+	if len(decryptionIdentities) == 0 {
+		return nil, true, errors.New("the file is encrypted, but no identity was given to decrypt it with (see --age-identity)")
+	}
+	plain, err = decrypt(data, decryptionIdentities)
+	return plain, true, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedKeyFiles(t *testing.T) {
+	if fipsBuild {
+		t.Skip("age and SOPS files can't be decrypted in FIPS mode")
+	}
+	plain, digest, err := loadKey("test/fixtures", "github_key")
+	assert.NoError(t, err)
+
+	// without an identity, encrypted files can't be loaded
+	decryptionIdentities = nil
+	_, _, err = loadKey("test/fixtures", "github_key.age")
+	assert.Error(t, err)
+
+	ids, err := loadAgeIdentities("test/fixtures/age_identity")
+	assert.NoError(t, err)
+	decryptionIdentities = ids
+	defer func() { decryptionIdentities = nil }()
+
+	for _, file := range []string{"github_key.age", "github_key.sops.json"} {
+		t.Run(file, func(t *testing.T) {
+			key, d, err := loadKey("test/fixtures", file)
+			assert.NoError(t, err)
+			assert.Equal(t, plain, key)
+			assert.Equal(t, digest, d)
+		})
+	}
+
+	// unencrypted files are untouched
+	key, _, err := loadKey("test/fixtures", "github_key")
+	assert.NoError(t, err)
+	assert.Equal(t, plain, key)
+}
+
+func TestSOPSTampering(t *testing.T) {
+	ids, err := loadAgeIdentities("test/fixtures/age_identity")
+	assert.NoError(t, err)
+	encrypted, err := ioutil.ReadFile("test/fixtures/github_key.sops.json")
+	assert.NoError(t, err)
+
+	_, err = sopsDecrypt(encrypted, ids)
+	assert.NoError(t, err)
+
+	// a value that needn't be encrypted can still be added, but the
+	// MAC check will fail
+	tampered := bytes.Replace(encrypted, []byte("{"), []byte(`{"note_unencrypted": "hello",`), 1)
+	_, err = sopsDecrypt(tampered, ids)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "MAC")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With `dedup.redis` in the config, replicas of flux-recv behind one
+// Service share a record, in Redis, of the deliveries they've
+// handled, so that a source retrying a delivery (or sending it to
+// more than one replica) doesn't notify fluxd twice. Once a delivery
+// with an ID has been verified, and before fluxd is notified, a
+// replica claims the ID (see deliveryClaim); once fluxd has been
+// notified it marks the ID done, and a delivery with that ID is then
+// answered with a success, without notifying fluxd. If the delivery
+// fails, the claim is released, so that the source's retry is handled
+// afresh.
+//
+// If Redis can't be reached, deliveries are handled anyway (and may
+// be duplicated), since a missed notification is worse than a
+// repeated one.
+
+const (
+	defaultDedupTTL       = 24 * time.Hour
+	defaultDedupKeyPrefix = "flux-recv:"
+	// dedupClaimTTL bounds how long an ID stays claimed if the
+	// replica handling it goes away before finishing
+	dedupClaimTTL = 30 * time.Second
+)
+
+const (
+	dedupClaimed = "claimed"
+	dedupDone    = "done"
+)
+
+// Dedup is the config for deduplicating deliveries across replicas.
+type Dedup struct {
+	// Redis is the URL of the Redis server, as
+	// redis://[:password@]host[:port][/db], or rediss:// for TLS
+	Redis string `json:"redis"`
+	// TTL is how long a delivery ID is remembered; the default is
+	// 24h
+	TTL string `json:"ttl,omitempty"`
+	// KeyPrefix is prefixed to the keys used in Redis; the default
+	// is "flux-recv:"
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+}
+
+func (d *Dedup) validate() error {
+	if d.Redis == "" {
+		return fmt.Errorf("dedup: redis is required")
+	}
+	if _, err := newRedisClient(d.Redis); err != nil {
+		return fmt.Errorf("dedup: redis %q: %s", redactURL(d.Redis), err.Error())
+	}
+	if d.TTL != "" {
+		if ttl, err := time.ParseDuration(d.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("dedup: ttl %q is not a positive duration, e.g., 24h", d.TTL)
+		}
+	}
+	return nil
+}
+
+var dedupResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "flux_recv",
+	Name:      "dedup_total",
+	Help:      "Deliveries checked against the shared record, by result: new, duplicate, in_progress, or error.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(dedupResults)
+}
+
+// sharedDedup is the shared record of deliveries, if configured;
+// otherwise it's nil.
+var sharedDedup *deliveryDedup
+
+type deliveryDedup struct {
+	client *redisClient
+	ttl    time.Duration
+	prefix string
+}
+
+// newDeliveryDedup constructs the shared record from a (validated)
+// config.
+func newDeliveryDedup(config Dedup) (*deliveryDedup, error) {
+	client, err := newRedisClient(config.Redis)
+	if err != nil {
+		return nil, err
+	}
+	d := &deliveryDedup{client: client, ttl: defaultDedupTTL, prefix: defaultDedupKeyPrefix}
+	if config.TTL != "" {
+		d.ttl, _ = time.ParseDuration(config.TTL)
+	}
+	if config.KeyPrefix != "" {
+		d.prefix = config.KeyPrefix
+	}
+	return d, nil
+}
+
+// withDedup answers deliveries already handled by any replica without
+// handling them again. The key for a delivery includes the endpoint,
+// since IDs are only unique for a source. Requests without a delivery
+// ID are passed through.
+func withDedup(digest string, dedup *deliveryDedup, next http.Handler) http.Handler {
+	endpoint := endpointLabel(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := deliveryID(r)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := dedup.prefix + endpoint + ":" + id
+
+		claim := &deliveryClaim{claim: func(ctx context.Context) (bool, *deliveryRefusal) {
+			claimed, err := dedup.client.setNX(key, dedupClaimed, dedupClaimTTL)
+			if err != nil {
+				dedupResults.WithLabelValues("error").Inc()
+				level.Warn(contextLogger(ctx)).Log("msg", "could not check for duplicate delivery; handling it anyway", "err", err)
+				return false, nil
+			}
+			if claimed {
+				dedupResults.WithLabelValues("new").Inc()
+				return true, nil
+			}
+			state, err := dedup.client.get(key)
+			switch {
+			case err == nil && state == dedupDone:
+				dedupResults.WithLabelValues("duplicate").Inc()
+				level.Info(contextLogger(ctx)).Log("msg", "delivery already handled by a replica; not notifying again")
+				return false, &deliveryRefusal{status: http.StatusOK, message: "Delivery already handled"}
+			case err == nil:
+				dedupResults.WithLabelValues("in_progress").Inc()
+				level.Info(contextLogger(ctx)).Log("msg", "delivery is being handled by a replica")
+				return false, &deliveryRefusal{status: http.StatusConflict, message: "Delivery is being handled by another replica"}
+			}
+			// the claim expired in between (errRedisNil), or Redis
+			// failed; either way, handle it
+			dedupResults.WithLabelValues("error").Inc()
+			level.Warn(contextLogger(ctx)).Log("msg", "could not check for duplicate delivery; handling it anyway", "err", err)
+			return false, nil
+		}}
+		rec := &statusRecorder{ResponseWriter: &claimedResponseWriter{ResponseWriter: w, claim: claim}}
+		next.ServeHTTP(rec, withDeliveryClaim(r, claim))
+		if !claim.taken {
+			return
+		}
+		var err error
+		if rec.status >= 200 && rec.status <= 299 {
+			err = dedup.client.set(key, dedupDone, dedup.ttl)
+		} else {
+			err = dedup.client.del(key)
+		}
+		if err != nil {
+			level.Warn(requestLogger(r)).Log("msg", "could not record delivery as handled", "err", err)
+		}
+	})
+}
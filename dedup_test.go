@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis answers the few commands the client sends, from a map.
+type fakeRedis struct {
+	net.Listener
+	password string
+
+	mu   sync.Mutex
+	keys map[string]string
+	// dropSET, if true, means the connection is closed after a SET
+	// takes effect, without replying, as if it failed in between
+	dropSET bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeRedis{Listener: l, password: password, keys: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		s.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			if args[1] != s.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				break
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "SET":
+			_, exists := s.keys[args[1]]
+			if len(args) > 3 && strings.ToUpper(args[3]) == "NX" && exists {
+				io.WriteString(conn, "$-1\r\n")
+				break
+			}
+			s.keys[args[1]] = args[2]
+			if s.dropSET {
+				s.mu.Unlock()
+				return
+			}
+			io.WriteString(conn, "+OK\r\n")
+		case "GET":
+			if v, ok := s.keys[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				io.WriteString(conn, "$-1\r\n")
+			}
+		case "DEL":
+			delete(s.keys, args[1])
+			io.WriteString(conn, ":1\r\n")
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisClient(t *testing.T) {
+	redis := newFakeRedis(t, "hunter2")
+	defer redis.Close()
+
+	c, err := newRedisClient("redis://:hunter2@" + redis.Addr().String())
+	assert.NoError(t, err)
+	ok, err := c.setNX("a", "1", dedupClaimTTL)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = c.setNX("a", "2", dedupClaimTTL)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	v, err := c.get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+	assert.NoError(t, c.del("a"))
+	_, err = c.get("a")
+	assert.Equal(t, errRedisNil, err)
+
+	// it reconnects if the connection is lost
+	c.conn.Close()
+	assert.NoError(t, c.set("b", "1", defaultDedupTTL))
+
+	// but SET NX isn't tried again, since it may have taken effect
+	// the first time, and would then seem to fail
+	redis.mu.Lock()
+	redis.dropSET = true
+	redis.mu.Unlock()
+	_, err = c.setNX("c", "1", dedupClaimTTL)
+	assert.Error(t, err)
+	redis.mu.Lock()
+	redis.dropSET = false
+	redis.mu.Unlock()
+	v, err = c.get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+
+	c, err = newRedisClient("redis://:wrong@" + redis.Addr().String())
+	assert.NoError(t, err)
+	_, err = c.get("a")
+	assert.Error(t, err)
+
+	for _, bad := range []string{"http://redis", "redis://", "redis://redis/zero"} {
+		_, err = newRedisClient(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestDedupAcrossReplicas(t *testing.T) {
+	redis := newFakeRedis(t, "")
+	defer redis.Close()
+
+	var err error
+	sharedDedup, err = newDeliveryDedup(Dedup{Redis: "redis://" + redis.Addr().String()})
+	assert.NoError(t, err)
+	defer func() { sharedDedup = nil }()
+
+	var called bool
+	downstream := newDownstream(t, expectedGitlab, &called)
+	defer downstream.Close()
+
+	// two replicas, with the same endpoint
+	endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key"}
+	var replicas []*httptest.Server
+	var fp string
+	for i := 0; i < 2; i++ {
+		var handler http.Handler
+		fp, handler, err = HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+		assert.NoError(t, err)
+		replica := httptest.NewServer(handler)
+		defer replica.Close()
+		replicas = append(replicas, replica)
+	}
+
+	payload := loadFixture(t, "gitlab_payload")
+	token := string(loadFixture(t, "gitlab_key"))
+	send := func(replica *httptest.Server, uuid, token string) int {
+		req, err := http.NewRequest("POST", replica.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		req.Header.Set("X-Gitlab-Token", token)
+		if uuid != "" {
+			req.Header.Set("X-Gitlab-Event-UUID", uuid)
+		}
+		called = false
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 200, send(replicas[0], "delivery-1", token))
+	assert.True(t, called)
+	// the same delivery, to the other replica, is answered without
+	// notifying fluxd again
+	assert.Equal(t, 200, send(replicas[1], "delivery-1", token))
+	assert.False(t, called)
+
+	// a delivery that isn't verified doesn't claim its ID, so can't
+	// block the real one
+	assert.Equal(t, 401, send(replicas[0], "delivery-2", "BOGUS"))
+	redis.mu.Lock()
+	_, claimed := redis.keys[defaultDedupKeyPrefix+endpointLabel(fp)+":delivery-2"]
+	redis.mu.Unlock()
+	assert.False(t, claimed)
+	assert.Equal(t, 200, send(replicas[1], "delivery-2", token))
+	assert.True(t, called)
+
+	// one being handled elsewhere is refused, so the source retries
+	redis.mu.Lock()
+	redis.keys[defaultDedupKeyPrefix+endpointLabel(fp)+":delivery-3"] = dedupClaimed
+	redis.mu.Unlock()
+	assert.Equal(t, 409, send(replicas[0], "delivery-3", token))
+	assert.False(t, called)
+
+	// those without an ID aren't deduplicated
+	assert.Equal(t, 200, send(replicas[0], "", token))
+	assert.Equal(t, 200, send(replicas[1], "", token))
+	assert.True(t, called)
+
+	// without Redis, deliveries are still handled
+	redis.Close()
+	sharedDedup.client.close()
+	assert.Equal(t, 200, send(replicas[0], "delivery-4", token))
+	assert.True(t, called)
+}
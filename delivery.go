@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/go-kit/kit/log/level"
+)
+
+// deliveryIDHeaders are headers in which sources give a unique ID
+// for each delivery of a webhook.
+var deliveryIDHeaders = []string{
+	"X-GitHub-Delivery",   // GitHub
+	"X-Request-UUID",      // Bitbucket Cloud
+	"X-Request-Id",        // Bitbucket Server
+	"X-Gitlab-Event-UUID", // GitLab
+}
+
+// DeliveryIDSources are the sources that give each delivery an ID (in
+// one of deliveryIDHeaders), and so can have rejectReplays.
+var DeliveryIDSources = map[string]bool{}
+
+// deliveryID returns the ID of the delivery given by the source in
+// the request headers, or the empty string if there isn't one.
+func deliveryID(r *http.Request) string {
+	for _, h := range deliveryIDHeaders {
+		if id := r.Header.Get(h); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// recentIDs is a set with a bounded size; once full, adding an ID
+// evicts the least recently added.
+type recentIDs struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{size: size, order: list.New(), ids: map[string]*list.Element{}}
+}
+
+// add adds the ID, returning false if it was already present.
+func (s *recentIDs) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = s.order.PushBack(id)
+	for s.order.Len() > s.size {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+	return true
+}
+
+func (s *recentIDs) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.ids[id]; ok {
+		s.order.Remove(e)
+		delete(s.ids, id)
+	}
+}
+
+// replayCacheSize is how many delivery IDs are remembered for each
+// endpoint that rejects replays.
+const replayCacheSize = 10000
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// -- claiming delivery IDs
+
+// A delivery's ID is claimed (by withReplayProtection, or withDedup)
+// only once the request has been verified, so that someone without
+// the secret can't block a delivery by sending its ID first. The
+// source handlers verify a request before notifying fluxd of
+// anything, so the claim is taken when the first change is notified,
+// by claimingServer. If the claim is refused, the notification fails,
+// and the refusal is the response, in place of the handler's.
+
+// deliveryRefusal is the response to a delivery whose ID couldn't be
+// claimed.
+type deliveryRefusal struct {
+	status  int
+	message string
+}
+
+// deliveryClaim claims a delivery's ID, once. The claim func reports
+// whether the ID was claimed (and so must be released, or marked
+// done, after), or else the refusal to respond with, if any; a claim
+// neither taken nor refused lets the delivery go ahead regardless.
+type deliveryClaim struct {
+	claim func(ctx context.Context) (bool, *deliveryRefusal)
+
+	once    sync.Once
+	taken   bool
+	refusal *deliveryRefusal
+}
+
+func (c *deliveryClaim) take(ctx context.Context) *deliveryRefusal {
+	c.once.Do(func() {
+		c.taken, c.refusal = c.claim(ctx)
+	})
+	return c.refusal
+}
+
+type deliveryClaimsKey struct{}
+
+// withDeliveryClaim gives the request with the claim added to those
+// to be taken when it's verified.
+func withDeliveryClaim(r *http.Request, claim *deliveryClaim) *http.Request {
+	claims, _ := r.Context().Value(deliveryClaimsKey{}).([]*deliveryClaim)
+	claims = append(claims[:len(claims):len(claims)], claim)
+	return r.WithContext(context.WithValue(r.Context(), deliveryClaimsKey{}, claims))
+}
+
+var errDeliveryRefused = errors.New("the delivery's ID could not be claimed")
+
+// claimingServer takes the claims on a delivery's ID before the first
+// change from it is notified.
+type claimingServer struct {
+	fluxapi.Server
+}
+
+func (s claimingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	claims, _ := ctx.Value(deliveryClaimsKey{}).([]*deliveryClaim)
+	for _, claim := range claims {
+		if claim.take(ctx) != nil {
+			return errDeliveryRefused
+		}
+	}
+	return s.Server.NotifyChange(ctx, change)
+}
+
+// claimedResponseWriter responds with the claim's refusal, if it's
+// refused, in place of whatever the handler responds with.
+type claimedResponseWriter struct {
+	http.ResponseWriter
+	claim   *deliveryClaim
+	refused bool
+}
+
+func (w *claimedResponseWriter) refuse() bool {
+	if w.claim.refusal == nil {
+		return false
+	}
+	if !w.refused {
+		w.refused = true
+		http.Error(w.ResponseWriter, w.claim.refusal.message, w.claim.refusal.status)
+	}
+	return true
+}
+
+func (w *claimedResponseWriter) WriteHeader(status int) {
+	if !w.refuse() {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *claimedResponseWriter) Write(b []byte) (int, error) {
+	if w.refuse() {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withReplayProtection refuses requests that have the same delivery
+// ID as one already accepted. The ID is claimed once the request has
+// been verified, and released if the request then fails. Requests
+// without a delivery ID are refused, since there's no way to know if
+// they are replays.
+func withReplayProtection(source string, seen *recentIDs, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := deliveryID(r)
+		if id == "" {
+			http.Error(w, "Missing delivery ID header", http.StatusBadRequest)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request without a delivery ID")
+			return
+		}
+		claim := &deliveryClaim{claim: func(ctx context.Context) (bool, *deliveryRefusal) {
+			// this reserves the ID, so that concurrent replays are
+			// also caught
+			if !seen.add(id) {
+				level.Warn(contextLogger(ctx)).Log("msg", "rejected replay of delivery")
+				return false, &deliveryRefusal{status: http.StatusConflict, message: "Delivery has already been processed"}
+			}
+			return true, nil
+		}}
+		rec := &statusRecorder{ResponseWriter: &claimedResponseWriter{ResponseWriter: w, claim: claim}}
+		next.ServeHTTP(rec, withDeliveryClaim(r, claim))
+		if claim.taken && (rec.status < 200 || rec.status > 299) {
+			seen.remove(id)
+		}
+	})
+}
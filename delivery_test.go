@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentIDs(t *testing.T) {
+	s := newRecentIDs(2)
+	assert.True(t, s.add("a"))
+	assert.False(t, s.add("a"))
+	assert.True(t, s.add("b"))
+	assert.True(t, s.add("c")) // evicts "a"
+	assert.True(t, s.add("a"))
+	assert.False(t, s.add("c"))
+	s.remove("c")
+	assert.True(t, s.add("c"))
+}
+
+func TestRejectReplays(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGitlab, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", RejectReplays: true}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "gitlab_payload")
+	send := func(uuid, token string) int {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		req.Header.Set("X-Gitlab-Token", token)
+		if uuid != "" {
+			req.Header.Set("X-Gitlab-Event-UUID", uuid)
+		}
+		called = false
+		res, err := hookServer.Client().Do(req)
+		assert.NoError(t, err)
+		return res.StatusCode
+	}
+	token := string(loadFixture(t, "gitlab_key"))
+
+	assert.Equal(t, 200, send("delivery-1", token))
+	assert.True(t, called)
+	assert.Equal(t, 409, send("delivery-1", token))
+	assert.False(t, called)
+
+	// a request that fails verification doesn't use up the ID
+	assert.Equal(t, 401, send("delivery-2", "BOGUS"))
+	assert.Equal(t, 200, send("delivery-2", token))
+	assert.True(t, called)
+
+	assert.Equal(t, 400, send("", token))
+	assert.False(t, called)
+
+	// a request that's not yet verified doesn't hold the ID, either
+	body, stall := io.Pipe()
+	defer stall.Close()
+	forged, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, body)
+	assert.NoError(t, err)
+	forged.Header.Set("Content-Type", "application/json")
+	forged.Header.Set("X-Gitlab-Event", "Push Hook")
+	forged.Header.Set("X-Gitlab-Token", "BOGUS")
+	forged.Header.Set("X-Gitlab-Event-UUID", "delivery-3")
+	forgedDone := make(chan struct{})
+	go func() {
+		defer close(forgedDone)
+		if res, err := hookServer.Client().Do(forged); err == nil {
+			res.Body.Close()
+		}
+	}()
+	stall.Write([]byte("{"))
+	assert.Equal(t, 200, send("delivery-3", token))
+	assert.True(t, called)
+	stall.Close()
+	<-forgedDone
+}
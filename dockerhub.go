@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/go-kit/kit/log/level"
+
 	fluxapi "github.com/fluxcd/flux/pkg/api"
 )
 
@@ -11,19 +13,29 @@ const DockerHub = "DockerHub"
 
 func init() {
 	Sources[DockerHub] = handleDockerhub
+	ImageTagSources[DockerHub] = true
+	SourceEvents[DockerHub] = []string{eventPush}
+	DefaultEvents[DockerHub] = []string{eventPush}
 }
 
-func handleDockerhub(s fluxapi.Server, _ []byte, w http.ResponseWriter, r *http.Request) {
+func handleDockerhub(s fluxapi.Server, _ Verification, w http.ResponseWriter, r *http.Request) {
 	type payload struct {
+		PushData struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
 		Repository struct {
 			RepoName string `json:"repo_name"`
 		} `json:"repository"`
 	}
 	var p payload
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		if bodyTooLarge(w, r, err) {
+			return
+		}
 		http.Error(w, "Cannot decode webhook payload", http.StatusBadRequest)
-		log(DockerHub, err.Error())
+		level.Warn(requestLogger(r)).Log("msg", "cannot decode payload", "err", err)
+		reportError(r.Context(), "could not parse payload", err)
 		return
 	}
-	doImageNotify(s, w, r, p.Repository.RepoName)
+	doImageNotify(s, w, r, p.Repository.RepoName, &pushDetails{Tag: p.PushData.Tag})
 }
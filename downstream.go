@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// downstreamClient is the HTTP client used for notifying fluxd; it's
+// shared by all the endpoints, so they share its connection pool.
+var downstreamClient = newDownstreamClient(nil, nil, nil)
+
+// defaultDownstreamIdleConnsPerHost is the idle connections kept to
+// each host, if not given. Since notifications (nearly) all go to the
+// one host, the net/http default of two would mean opening a new
+// connection for most of a burst.
+const defaultDownstreamIdleConnsPerHost = 16
+
+// tune sets the transport's connection pool, and the dialer's
+// keep-alive, as given in the (validated) config.
+func (d *Downstream) tune(t *http.Transport, dialer *net.Dialer) {
+	t.MaxIdleConnsPerHost = defaultDownstreamIdleConnsPerHost
+	if d == nil {
+		return
+	}
+	if d.MaxIdleConns > 0 {
+		t.MaxIdleConns = d.MaxIdleConns
+	}
+	if d.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+	if d.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = d.MaxConnsPerHost
+	}
+	if d.IdleConnTimeout != "" {
+		t.IdleConnTimeout, _ = time.ParseDuration(d.IdleConnTimeout)
+	}
+	if d.KeepAlive != "" {
+		dialer.KeepAlive, _ = time.ParseDuration(d.KeepAlive)
+	}
+	if d.TLSHandshakeTimeout != "" {
+		t.TLSHandshakeTimeout, _ = time.ParseDuration(d.TLSHandshakeTimeout)
+	}
+}
+
+// downstreamSignatureHeader carries the signature of notifications
+// sent downstream, when the config gives `apiSigningKeyPath`. It's in
+// the same form as GitHub's X-Hub-Signature-256, i.e., `sha256=<hex
+// HMAC of the body>`, so a proxy in front of fluxd can verify it the
+// same way.
+const downstreamSignatureHeader = "X-Flux-Recv-Signature-256"
+
+// signingTransport adds a signature header to each request.
+type signingTransport struct {
+	base http.RoundTripper
+	key  []byte
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write(body)
+
+	// a RoundTripper mustn't change the request it's given
+	signed := req.Clone(req.Context())
+	signed.Header.Set(downstreamSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	signed.ContentLength = int64(len(body))
+	return t.base.RoundTrip(signed)
+}
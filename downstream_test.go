@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedNotifications(t *testing.T) {
+	key := []byte("downstream key")
+	var called bool
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedDockerhub, string(body))
+		assert.Equal(t, hubSignature("sha256", body, key), r.Header.Get(downstreamSignatureHeader))
+		called = true
+	}))
+	defer downstream.Close()
+
+	downstreamClient = newDownstreamClient(nil, nil, key)
+	defer func() { downstreamClient = newDownstreamClient(nil, nil, nil) }()
+
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.True(t, called)
+}
+
+func TestDownstreamClientTuning(t *testing.T) {
+	transport := func(client *http.Client) *http.Transport {
+		return client.Transport.(tracingTransport).base.(correlationTransport).base.(extensionsTransport).base.(*http.Transport)
+	}
+
+	// notifications nearly all go to fluxd, so more than the default
+	// two idle connections are kept for it
+	assert.Equal(t, defaultDownstreamIdleConnsPerHost, transport(newDownstreamClient(nil, nil, nil)).MaxIdleConnsPerHost)
+
+	tuned := transport(newDownstreamClient(&DownstreamPolicy{ForbidLinkLocal: true}, &Downstream{
+		MaxIdleConns:        50,
+		MaxIdleConnsPerHost: 20,
+		MaxConnsPerHost:     30,
+		IdleConnTimeout:     "45s",
+		TLSHandshakeTimeout: "5s",
+	}, nil))
+	assert.Equal(t, 50, tuned.MaxIdleConns)
+	assert.Equal(t, 20, tuned.MaxIdleConnsPerHost)
+	assert.Equal(t, 30, tuned.MaxConnsPerHost)
+	assert.Equal(t, 45*time.Second, tuned.IdleConnTimeout)
+	assert.Equal(t, 5*time.Second, tuned.TLSHandshakeTimeout)
+	assert.Nil(t, tuned.Proxy)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A DownstreamPolicy restricts the URLs that notifications can be
+// sent to, so that a config that's been tampered with can't use
+// flux-recv to reach other services (e.g., a cloud provider's
+// metadata service, which will hand out credentials).
+
+// defaultDownstreamSchemes are the schemes allowed if the policy
+// doesn't say; the flux API client can't use anything else anyway.
+var defaultDownstreamSchemes = []string{"http", "https"}
+
+// metadataIPs are addresses of metadata services that aren't
+// link-local (those that are, like 169.254.169.254, are covered by
+// the link-local check).
+var metadataIPs = []net.IP{
+	net.ParseIP("fd00:ec2::254"), // AWS, over IPv6
+}
+
+// metadataHosts are host names of metadata services.
+var metadataHosts = []string{"metadata.google.internal", "metadata"}
+
+// checkURL checks that the URL is allowed by the policy. A nil policy
+// allows any http or https URL.
+func (p *DownstreamPolicy) checkURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	schemes := defaultDownstreamSchemes
+	if p != nil && len(p.AllowedSchemes) > 0 {
+		schemes = p.AllowedSchemes
+	}
+	if !containsFold(schemes, u.Scheme) {
+		return fmt.Errorf("the scheme %q is not allowed (allowed: %s)", u.Scheme, strings.Join(schemes, ", "))
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("the URL has no host")
+	}
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedHosts) > 0 && !hostAllowed(p.AllowedHosts, host) {
+		return fmt.Errorf("the host %q is not in allowedHosts", host)
+	}
+	if p.ForbidLinkLocal {
+		if containsFold(metadataHosts, strings.TrimSuffix(host, ".")) {
+			return fmt.Errorf("the host %q is a metadata service", host)
+		}
+		if ip := net.ParseIP(host); ip != nil && forbiddenIP(ip) {
+			return fmt.Errorf("the address %s is link-local, or a metadata service", ip)
+		}
+	}
+	return nil
+}
+
+// hostAllowed reports whether the host is one of those given, or
+// (for entries like `*.example.com`) a subdomain of one of them.
+func hostAllowed(allowed []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "*.") {
+			if strings.HasSuffix(host, a[1:]) {
+				return true
+			}
+		} else if host == a {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func forbiddenIP(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	for _, m := range metadataIPs {
+		if m.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidLinkLocalDial refuses connections to forbidden addresses. It
+// is checked when connecting, after names are resolved, so it applies
+// even when a host name resolves to (or is changed to resolve to) a
+// link-local address.
+func forbidLinkLocalDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && forbiddenIP(ip) {
+		return fmt.Errorf("connecting to %s is forbidden by downstreamPolicy (link-local, or a metadata service)", ip)
+	}
+	return nil
+}
+
+// newDownstreamClient gives an HTTP client for notifying fluxd, which
+// keeps to the policy (including when following redirects), has its
+// connection pool tuned as given, signs each request with signingKey,
+// and passes on the trace context. Any of policy, tuning and
+// signingKey may be nil.
+func newDownstreamClient(policy *DownstreamPolicy, tuning *Downstream, signingKey []byte) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	tuning.tune(t, dialer)
+	client := &http.Client{}
+	if policy != nil {
+		if policy.ForbidLinkLocal {
+			dialer.Control = forbidLinkLocalDial
+			// a proxy would do the dialing, and get around the check
+			t.Proxy = nil
+		}
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if err := policy.checkURL(req.URL.String()); err != nil {
+				return fmt.Errorf("redirect not allowed by downstreamPolicy: %s", err.Error())
+			}
+			return nil
+		}
+	}
+	t.DialContext = dialer.DialContext
+	var transport http.RoundTripper = t
+	if signingKey != nil {
+		transport = signingTransport{base: transport, key: signingKey}
+	}
+	transport = extensionsTransport{base: transport}
+	client.Transport = tracingTransport{base: correlationTransport{base: transport}}
+	return client
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownstreamPolicyURLs(t *testing.T) {
+	policy := &DownstreamPolicy{
+		AllowedHosts:    []string{"localhost", "*.flux-system.svc", "169.254.169.254"},
+		ForbidLinkLocal: true,
+	}
+	for url, ok := range map[string]bool{
+		"http://localhost:3030/api/flux":                   true,
+		"https://fluxd.flux-system.svc/api/flux":           true,
+		"HTTP://LOCALHOST/api/flux":                        true,
+		"ftp://localhost/api/flux":                         false,
+		"http://flux-system.svc.example.com/":              false,
+		"http://example.com/api/flux":                      false,
+		"http://169.254.169.254/latest/meta-data/":         false,
+		"http:///api/flux":                                 false,
+		"http://metadata.google.internal/computeMetadata/": false,
+	} {
+		err := policy.checkURL(url)
+		if ok {
+			assert.NoError(t, err, url)
+		} else {
+			assert.Error(t, err, url)
+		}
+	}
+
+	var nilPolicy *DownstreamPolicy
+	assert.NoError(t, nilPolicy.checkURL("http://169.254.169.254/"))
+	assert.Error(t, nilPolicy.checkURL("file:///etc/passwd"))
+}
+
+func TestDownstreamPolicyClient(t *testing.T) {
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	client := newDownstreamClient(&DownstreamPolicy{ForbidLinkLocal: true}, nil, nil)
+
+	res, err := client.Get(redirector.URL + "/ok")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, err = client.Get(redirector.URL + "/redirect")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "redirect not allowed")
+
+	// refused when connecting, not only when checking the URL
+	client.CheckRedirect = nil
+	_, err = client.Get(redirector.URL + "/redirect")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "forbidden by downstreamPolicy")
+}
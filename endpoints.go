@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// `GET /admin/endpoints` lists the endpoints each listener is serving,
+// with the paths they're routed at (including those kept for a while
+// after a key is rotated), where notifications go, and the filters
+// and checks applied -- so you can see what a running flux-recv is
+// actually doing, rather than what you think the config says. Keys
+// and other secrets are left out; key files are given by name, and
+// the paths with only the fingerprint of the digest, since the whole
+// of it is enough to send hooks.
+
+// servedEndpoints has the endpoints from each listener, as they're
+// constructed.
+var servedEndpoints = &endpointRegistry{}
+
+type endpointRegistry struct {
+	mu        sync.Mutex
+	endpoints []*servedEndpoint
+}
+
+// servedRoute is one of the paths an endpoint is routed at.
+type servedRoute struct {
+	Endpoint string `json:"endpoint"`
+	// Path is the path routed, with the digest shortened (as in the
+	// access log)
+	Path string `json:"path"`
+	// KeyPath is the key file, relative to the config, or empty if
+	// the key was given inline
+	KeyPath string `json:"keyPath,omitempty"`
+
+	digest string
+}
+
+type servedEndpoint struct {
+	Listen string `json:"listen"`
+	Source string `json:"source"`
+	Tenant string `json:"tenant,omitempty"`
+	// Downstream is the API notifications are sent to
+	Downstream          string               `json:"downstream"`
+	Routes              []servedRoute        `json:"routes"`
+	CatchAll            bool                 `json:"catchAll,omitempty"`
+	Allow               string               `json:"allow,omitempty"`
+	Events              []string             `json:"events"`
+	Repos               *Repos               `json:"repos,omitempty"`
+	Branches            []string             `json:"branches,omitempty"`
+	DefaultBranchOnly   bool                 `json:"defaultBranchOnly,omitempty"`
+	TagPattern          string               `json:"tagPattern,omitempty"`
+	SkipMarkers         []string             `json:"skipMarkers,omitempty"`
+	IgnoreAuthors       []string             `json:"ignoreAuthors,omitempty"`
+	IgnoreCommitters    []string             `json:"ignoreCommitters,omitempty"`
+	Extensions          bool                 `json:"extendedNotifications,omitempty"`
+	GitURLRewrites      []GitURLRewrite      `json:"gitURLRewrites,omitempty"`
+	ImageRewrites       []ImageRewrite       `json:"imageRewrites,omitempty"`
+	Checks              []string             `json:"checks,omitempty"`
+	SignatureAlgorithms []string             `json:"signatureAlgorithms,omitempty"`
+	RateLimit           *RateLimit           `json:"rateLimit,omitempty"`
+	RateLimitPerIP      *RateLimit           `json:"rateLimitPerIP,omitempty"`
+	MaxBodyBytes        int64                `json:"maxBodyBytes,omitempty"`
+	RejectReplays       bool                 `json:"rejectReplays,omitempty"`
+	IdempotentResponses *IdempotentResponses `json:"idempotentResponses,omitempty"`
+	LogSampling         int                  `json:"logSampling,omitempty"`
+
+	// hooks is the router the routes are in; a route that's no longer
+	// in it (e.g., because the grace period after rotating its key
+	// ran out) isn't listed
+	hooks *hookRouter
+}
+
+// register adds an endpoint as served on the listener given, via
+// hooks.
+func (reg *endpointRegistry) register(listen, apiBase string, ep Endpoint, hooks *hookRouter) *servedEndpoint {
+	algorithms := ep.SignatureAlgorithms
+	if len(algorithms) == 0 && signsPayloads(ep) {
+		algorithms = defaultSignatureAlgorithms
+	}
+	served := &servedEndpoint{
+		Listen:              listen,
+		Source:              ep.Source,
+		Tenant:              ep.Tenant,
+		Downstream:          redactURL(apiBase),
+		CatchAll:            ep.CatchAll,
+		Allow:               ep.Allow,
+		Events:              endpointEvents(ep),
+		Repos:               ep.Repos,
+		Branches:            ep.Branches,
+		DefaultBranchOnly:   ep.DefaultBranchOnly,
+		TagPattern:          ep.TagPattern,
+		SkipMarkers:         ep.SkipMarkers,
+		IgnoreAuthors:       ep.IgnoreAuthors,
+		IgnoreCommitters:    ep.IgnoreCommitters,
+		Extensions:          ep.ExtendedNotifications,
+		GitURLRewrites:      ep.GitURLRewrites,
+		ImageRewrites:       ep.ImageRewrites,
+		Checks:              ep.checkOrder(),
+		SignatureAlgorithms: algorithms,
+		RateLimit:           ep.RateLimit,
+		RateLimitPerIP:      ep.RateLimitPerIP,
+		MaxBodyBytes:        ep.MaxBodyBytes,
+		RejectReplays:       ep.RejectReplays,
+		IdempotentResponses: ep.IdempotentResponses,
+		LogSampling:         ep.LogSampling,
+		hooks:               hooks,
+	}
+	reg.mu.Lock()
+	reg.endpoints = append(reg.endpoints, served)
+	reg.mu.Unlock()
+	return served
+}
+
+// addRoute records that the endpoint is routed at the digest given.
+func (reg *endpointRegistry) addRoute(served *servedEndpoint, digest, keyPath string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, r := range served.Routes {
+		if r.digest == digest {
+			return
+		}
+	}
+	served.Routes = append(served.Routes, servedRoute{Endpoint: endpointLabel(digest), Path: redactedPath(hookPath(digest)), KeyPath: keyPath, digest: digest})
+}
+
+// tenantOf gives the tenant of the endpoint (as labelled in metrics),
+// if it has one.
+func (reg *endpointRegistry) tenantOf(endpoint string) string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, served := range reg.endpoints {
+		for _, r := range served.Routes {
+			if r.Endpoint == endpoint {
+				return served.Tenant
+			}
+		}
+	}
+	return ""
+}
+
+// list gives the endpoints, each with only the routes still served.
+func (reg *endpointRegistry) list() []servedEndpoint {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := []servedEndpoint{}
+	for _, served := range reg.endpoints {
+		ep := *served
+		ep.Routes = []servedRoute{}
+		for _, r := range served.Routes {
+			if served.hooks.has(r.digest) {
+				ep.Routes = append(ep.Routes, r)
+			}
+		}
+		list = append(list, ep)
+	}
+	return list
+}
+
+// adminEndpoints responds with the endpoints served.
+func adminEndpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := servedEndpoints.list()
+	if scope := adminScope(r); scope != "" {
+		scoped := []servedEndpoint{}
+		for _, ep := range list {
+			if ep.Tenant == scope {
+				scoped = append(scoped, ep)
+			}
+		}
+		list = scoped
+	}
+	writeJSON(w, struct {
+		Endpoints []servedEndpoint `json:"endpoints"`
+	}{list})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// When running in a Kubernetes cluster, flux-recv can record
+// verification failures and failures to notify fluxd as Events (on its
+// own Pod, or an object given with --kube-events-object), so that
+// `kubectl describe` shows webhook problems. Repeats of an Event are
+// counted in it, as `kubectl` and controllers do, rather than creating
+// another.
+//
+// The service account needs to be able to create and patch events,
+// and get the object they are about.
+
+const (
+	// kubeEventDedupWindow is how long after an Event a repeat of it
+	// is counted in it, rather than creating another
+	kubeEventDedupWindow = 10 * time.Minute
+	// maxPendingKubeEvents bounds the Events waiting to be sent; any
+	// more are dropped
+	maxPendingKubeEvents = 100
+	// maxKubeEventMessage is how much of a message is kept; the API
+	// refuses longer ones
+	maxKubeEventMessage = 1024
+
+	reasonVerificationFailed = "WebhookVerificationFailed"
+	reasonDeliveryFailed     = "WebhookDeliveryFailed"
+)
+
+// kubeEventRecorder creates Events, if enabled; otherwise it's nil.
+var kubeEventRecorder *kubeEvents
+
+// kubeObject is the object Events are about. The UID is looked up
+// before the first Event is sent.
+type kubeObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+	UID        string `json:"uid,omitempty"`
+}
+
+// kubeObjectKinds are the kinds of object Events can be about, by
+// their lowercase names.
+var kubeObjectKinds = map[string]struct{ apiVersion, kind, resource string }{
+	"pod":         {"v1", "Pod", "pods"},
+	"service":     {"v1", "Service", "services"},
+	"deployment":  {"apps/v1", "Deployment", "deployments"},
+	"statefulset": {"apps/v1", "StatefulSet", "statefulsets"},
+	"daemonset":   {"apps/v1", "DaemonSet", "daemonsets"},
+}
+
+// parseKubeObject parses `<kind>/<name>`, e.g., `deployment/flux`.
+func parseKubeObject(s, namespace string) (kubeObject, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return kubeObject{}, fmt.Errorf("kube events object %q is not <kind>/<name>", s)
+	}
+	kind, ok := kubeObjectKinds[strings.ToLower(parts[0])]
+	if !ok {
+		return kubeObject{}, fmt.Errorf("kube events object %q is not a pod, service, deployment, statefulset, or daemonset", s)
+	}
+	return kubeObject{APIVersion: kind.apiVersion, Kind: kind.kind, Name: parts[1], Namespace: namespace}, nil
+}
+
+// path gives the API path of the object.
+func (o kubeObject) path() string {
+	prefix := "/api/v1"
+	if o.APIVersion != "v1" {
+		prefix = "/apis/" + o.APIVersion
+	}
+	return prefix + "/namespaces/" + o.Namespace + "/" + kubeObjectKinds[strings.ToLower(o.Kind)].resource + "/" + o.Name
+}
+
+type kubeEvents struct {
+	api  *kubeAPI
+	host string
+
+	pending chan kubeEvent
+
+	// object and emitted are only used by run
+	object  kubeObject
+	emitted map[string]*emittedKubeEvent
+}
+
+type kubeEvent struct {
+	reason, message string
+	// key identifies repeats of the same Event
+	key string
+}
+
+type emittedKubeEvent struct {
+	name  string
+	count int
+	last  time.Time
+}
+
+// newKubeEvents constructs a recorder using the API at apiURL, with
+// the bearer token in the file at tokenPath (which is read for each
+// request, since service account tokens are rotated).
+func newKubeEvents(apiURL string, client *http.Client, tokenPath string, object kubeObject) *kubeEvents {
+	return &kubeEvents{
+		api:     &kubeAPI{url: apiURL, client: client, tokenPath: tokenPath},
+		host:    hostname(),
+		pending: make(chan kubeEvent, maxPendingKubeEvents),
+		object:  object,
+		emitted: map[string]*emittedKubeEvent{},
+	}
+}
+
+// inClusterKubeEvents constructs a recorder from the service account
+// mounted in the Pod. Events are about the object given as
+// `<kind>/<name>`, or if that's empty, the Pod, named by $POD_NAME or
+// else the hostname.
+func inClusterKubeEvents(object string) (*kubeEvents, error) {
+	api, namespace, err := inClusterKubeAPI()
+	if err != nil {
+		return nil, fmt.Errorf("kube events: %s", err.Error())
+	}
+	if object == "" {
+		object = "pod/" + podName()
+	}
+	obj, err := parseKubeObject(object, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return newKubeEvents(api.url, api.client, api.tokenPath, obj), nil
+}
+
+// add queues an Event for the delivery, if it failed verification or
+// notifying fluxd failed; it's a sink for withDeliveryRecords.
+func (k *kubeEvents) add(rec *deliveryRecord) {
+	var ev kubeEvent
+	switch {
+	case rec.Status == http.StatusUnauthorized:
+		ev = kubeEvent{
+			reason:  reasonVerificationFailed,
+			message: fmt.Sprintf("%s webhook to endpoint %s failed verification: %s", rec.Source, rec.Endpoint, rec.Reason),
+		}
+	default:
+		failed := rec.failedChanges()
+		if len(failed) == 0 {
+			return
+		}
+		ev = kubeEvent{
+			reason:  reasonDeliveryFailed,
+			message: fmt.Sprintf("could not notify fluxd of %s webhook to endpoint %s: %s", rec.Source, rec.Endpoint, strings.Join(failed, "; ")),
+		}
+	}
+	if len(ev.message) > maxKubeEventMessage {
+		ev.message = ev.message[:maxKubeEventMessage-3] + "..."
+	}
+	ev.key = ev.reason + "/" + rec.Source + "/" + rec.Endpoint
+	queuedSend("kube-events")
+	select {
+	case k.pending <- ev:
+	default:
+		sentQueued("kube-events")
+		level.Warn(logger).Log("component", "kube-events", "msg", "dropped event, since the Kubernetes API isn't keeping up", "source", rec.Source, "endpoint", rec.Endpoint)
+	}
+}
+
+// run sends the Events queued.
+func (k *kubeEvents) run() {
+	for ev := range k.pending {
+		if err := k.send(ev); err != nil {
+			level.Error(logger).Log("component", "kube-events", "msg", "could not record event", "reason", ev.reason, "err", err)
+		}
+		sentQueued("kube-events")
+	}
+}
+
+// kubeEventBody is a core/v1 Event, as much of it as is used here.
+type kubeEventBody struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject kubeObject `json:"involvedObject"`
+	Reason         string     `json:"reason"`
+	Message        string     `json:"message"`
+	Type           string     `json:"type"`
+	Source         struct {
+		Component string `json:"component"`
+		Host      string `json:"host,omitempty"`
+	} `json:"source"`
+	FirstTimestamp     string `json:"firstTimestamp"`
+	LastTimestamp      string `json:"lastTimestamp"`
+	Count              int    `json:"count"`
+	ReportingComponent string `json:"reportingComponent"`
+	ReportingInstance  string `json:"reportingInstance,omitempty"`
+}
+
+func (k *kubeEvents) send(ev kubeEvent) error {
+	if k.object.UID == "" {
+		var obj struct {
+			Metadata struct {
+				UID string `json:"uid"`
+			} `json:"metadata"`
+		}
+		if err := k.api.do("GET", k.object.path(), "", nil, &obj); err != nil {
+			return fmt.Errorf("looking up %s/%s: %s", k.object.Kind, k.object.Name, err.Error())
+		}
+		k.object.UID = obj.Metadata.UID
+	}
+
+	now := time.Now()
+	timestamp := now.UTC().Format(time.RFC3339)
+	if prev, ok := k.emitted[ev.key]; ok && now.Sub(prev.last) < kubeEventDedupWindow {
+		patch := map[string]interface{}{"count": prev.count + 1, "message": ev.message, "lastTimestamp": timestamp}
+		err := k.api.do("PATCH", k.eventsPath()+"/"+prev.name, "application/merge-patch+json", patch, nil)
+		if err == nil {
+			prev.count++
+			prev.last = now
+			return nil
+		}
+		if !isNotFound(err) {
+			return err
+		}
+		// the Event has expired; create another
+	}
+
+	body := kubeEventBody{
+		APIVersion:         "v1",
+		Kind:               "Event",
+		InvolvedObject:     k.object,
+		Reason:             ev.reason,
+		Message:            ev.message,
+		Type:               "Warning",
+		FirstTimestamp:     timestamp,
+		LastTimestamp:      timestamp,
+		Count:              1,
+		ReportingComponent: "flux-recv",
+		ReportingInstance:  k.host,
+	}
+	body.Metadata.Name = fmt.Sprintf("%s.%x", k.object.Name, now.UnixNano())
+	body.Metadata.Namespace = k.object.Namespace
+	body.Source.Component = "flux-recv"
+	body.Source.Host = k.host
+	if err := k.api.do("POST", k.eventsPath(), "application/json", body, nil); err != nil {
+		return err
+	}
+	if len(k.emitted) >= maxPendingKubeEvents {
+		// keep the map from growing without bound; at worst, repeats
+		// get another Event
+		k.emitted = map[string]*emittedKubeEvent{}
+	}
+	k.emitted[ev.key] = &emittedKubeEvent{name: body.Metadata.Name, count: 1, last: now}
+	return nil
+}
+
+func (k *kubeEvents) eventsPath() string {
+	return "/api/v1/namespaces/" + k.object.Namespace + "/events"
+}
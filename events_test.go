@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKubeObject(t *testing.T) {
+	obj, err := parseKubeObject("deployment/flux", "fluxcd")
+	assert.NoError(t, err)
+	assert.Equal(t, kubeObject{APIVersion: "apps/v1", Kind: "Deployment", Name: "flux", Namespace: "fluxcd"}, obj)
+	assert.Equal(t, "/apis/apps/v1/namespaces/fluxcd/deployments/flux", obj.path())
+
+	obj, err = parseKubeObject("Pod/flux-recv-0", "fluxcd")
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/v1/namespaces/fluxcd/pods/flux-recv-0", obj.path())
+
+	for _, bad := range []string{"flux", "pod/", "configmap/flux", "apps/v1/deployment/flux"} {
+		_, err := parseKubeObject(bad, "fluxcd")
+		assert.Error(t, err, bad)
+	}
+}
+
+type kubeRequest struct {
+	method, path, contentType, auth string
+	body                            map[string]interface{}
+}
+
+func TestKubeEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenPath, []byte("sa-token\n"), 0600))
+
+	var requests []kubeRequest
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := kubeRequest{method: r.Method, path: r.URL.Path, contentType: r.Header.Get("Content-Type"), auth: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		requests = append(requests, req)
+		if r.Method == "GET" {
+			w.Write([]byte(`{"metadata":{"name":"flux-recv-0","uid":"1234-5678"}}`))
+		}
+	}))
+	defer api.Close()
+
+	k := newKubeEvents(api.URL, api.Client(), tokenPath, kubeObject{APIVersion: "v1", Kind: "Pod", Name: "flux-recv-0", Namespace: "fluxcd"})
+	rejected := &deliveryRecord{Source: GitHub, Endpoint: "4a2f0c1e9b3d", Status: 401, Reason: "The GitHub signature header is invalid."}
+	for i := 0; i < 2; i++ {
+		k.add(rejected)
+		assert.NoError(t, k.send(<-k.pending))
+	}
+
+	// the object is looked up, then the Event created, then counted
+	assert.Len(t, requests, 3)
+	assert.Equal(t, "GET", requests[0].method)
+	assert.Equal(t, "/api/v1/namespaces/fluxcd/pods/flux-recv-0", requests[0].path)
+	assert.Equal(t, "Bearer sa-token", requests[0].auth)
+
+	created := requests[1]
+	assert.Equal(t, "POST", created.method)
+	assert.Equal(t, "/api/v1/namespaces/fluxcd/events", created.path)
+	assert.Equal(t, "Warning", created.body["type"])
+	assert.Equal(t, reasonVerificationFailed, created.body["reason"])
+	assert.Equal(t, "GitHub webhook to endpoint 4a2f0c1e9b3d failed verification: The GitHub signature header is invalid.", created.body["message"])
+	assert.Equal(t, map[string]interface{}{"apiVersion": "v1", "kind": "Pod", "name": "flux-recv-0", "namespace": "fluxcd", "uid": "1234-5678"}, created.body["involvedObject"])
+	name := created.body["metadata"].(map[string]interface{})["name"].(string)
+
+	counted := requests[2]
+	assert.Equal(t, "PATCH", counted.method)
+	assert.Equal(t, "/api/v1/namespaces/fluxcd/events/"+name, counted.path)
+	assert.Equal(t, "application/merge-patch+json", counted.contentType)
+	assert.Equal(t, float64(2), counted.body["count"])
+
+	// a failure to notify fluxd is another Event
+	k.add(&deliveryRecord{Source: GitHub, Endpoint: "4a2f0c1e9b3d", Status: 200, Changes: []auditChange{
+		{Subject: "git@github.com:Codertocat/Hello-World.git", Result: "connection refused"},
+	}})
+	assert.NoError(t, k.send(<-k.pending))
+	assert.Len(t, requests, 4)
+	assert.Equal(t, "POST", requests[3].method)
+	assert.Equal(t, reasonDeliveryFailed, requests[3].body["reason"])
+	assert.Equal(t, "could not notify fluxd of GitHub webhook to endpoint 4a2f0c1e9b3d: git@github.com:Codertocat/Hello-World.git: connection refused", requests[3].body["message"])
+
+	// deliveries that succeed aren't
+	k.add(&deliveryRecord{Source: GitHub, Status: 200, Changes: []auditChange{{Subject: "git@github.com:Codertocat/Hello-World.git", Result: "ok"}}})
+	k.add(&deliveryRecord{Source: GitHub, Status: 200, Changes: []auditChange{{Subject: "git@github.com:Codertocat/Hello-World.git", Result: "filtered"}}})
+	assert.Len(t, k.pending, 0)
+}
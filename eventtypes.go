@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Each source can tell fluxd about a change for more than one kind of
+// event: a push to a branch, a push of a tag, a release being
+// published, or a CI pipeline succeeding. An endpoint gives the
+// kinds of event it wants with `events`; by default, it's those that
+// flux-recv has always forwarded for the source. A change for any
+// other kind is logged and dropped, and events that aren't of any of
+// these kinds (e.g., a comment on an issue) are answered with 200 OK
+// and ignored, so the source doesn't think the hook is failing.
+
+const (
+	eventPush     = "push"
+	eventTag      = "tag"
+	eventRelease  = "release"
+	eventPipeline = "pipeline"
+)
+
+// SourceEvents are the kinds of event each source can give, and
+// DefaultEvents those accepted when an endpoint doesn't give events.
+var (
+	SourceEvents  = map[string][]string{}
+	DefaultEvents = map[string][]string{}
+)
+
+// validateEvents checks the events given are those the source can
+// give.
+func validateEvents(source string, events []string) error {
+	for _, e := range events {
+		if !containsString(SourceEvents[source], e) {
+			return fmt.Errorf("events: %q is not one of the events for the source (%v)", e, SourceEvents[source])
+		}
+	}
+	return nil
+}
+
+// endpointEvents gives the kinds of events the endpoint accepts.
+func endpointEvents(ep Endpoint) []string {
+	if len(ep.Events) > 0 {
+		return ep.Events
+	}
+	return DefaultEvents[ep.Source]
+}
+
+// eventFilter accepts changes from the kinds of events given. A
+// change for which the source doesn't give the kind is accepted.
+func eventFilter(events []string) changeFilter {
+	return func(ctx context.Context, _ fluxapi_v9.Change) string {
+		details := pushDetailsFrom(ctx)
+		if details == nil || details.Event == "" || containsString(events, details.Event) {
+			return ""
+		}
+		return fmt.Sprintf("%s events are not accepted by the endpoint", details.Event)
+	}
+}
+
+// ignoreEvent answers a request for an event that doesn't result in
+// a change, so the source sees it delivered.
+func ignoreEvent(w http.ResponseWriter, r *http.Request, event string) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ignored"))
+	level.Info(requestLogger(r)).Log("msg", "ignoring event", "event", event)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// fluxd is told only what changed: the repo and branch, or the image.
+// For a fork of fluxd, or a proxy in front of it, that can use more,
+// an endpoint can be given `extendedNotifications`, and then each
+// notification has, as well, an "extensions" field with what the
+// payload said about the push: the head commit's SHA, author and
+// message, or the image's tag and digest. fluxd ignores fields it
+// doesn't know, and without `extendedNotifications`, the
+// notification is exactly as it always was.
+//
+// The notification is encoded by the flux API client, so the
+// extensions are put in the context it's sent in, and added to the
+// body by extensionsTransport.
+
+// notificationExtensions are what's added to a notification.
+type notificationExtensions struct {
+	Event  string           `json:"event,omitempty"`
+	Commit *extensionCommit `json:"commit,omitempty"`
+	Image  *extensionImage  `json:"image,omitempty"`
+}
+
+type extensionCommit struct {
+	SHA     string           `json:"sha,omitempty"`
+	Message string           `json:"message,omitempty"`
+	Author  *extensionPerson `json:"author,omitempty"`
+}
+
+type extensionPerson struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type extensionImage struct {
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// extensionsFor gives the extensions for a change, from the details
+// of the push, or nil if there's nothing to add.
+func extensionsFor(change fluxapi_v9.Change, details *pushDetails) *notificationExtensions {
+	if details == nil {
+		return nil
+	}
+	ext := &notificationExtensions{Event: details.Event}
+	switch change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		c := details.HeadCommit
+		if c.SHA != "" || c.Message != "" || c.Author != (commitPerson{}) {
+			ext.Commit = &extensionCommit{SHA: c.SHA, Message: c.Message}
+			if c.Author != (commitPerson{}) {
+				author := extensionPerson(c.Author)
+				ext.Commit.Author = &author
+			}
+		}
+	case fluxapi_v9.ImageUpdate:
+		if details.Tag != "" || details.Digest != "" {
+			ext.Image = &extensionImage{Tag: details.Tag, Digest: details.Digest}
+		}
+	}
+	if *ext == (notificationExtensions{}) {
+		return nil
+	}
+	return ext
+}
+
+type extensionsKey struct{}
+
+// extendingServer gives each notification the extensions for its
+// change, for extensionsTransport to add.
+type extendingServer struct {
+	fluxapi.Server
+}
+
+func (s extendingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if ext := extensionsFor(change, pushDetailsFrom(ctx)); ext != nil {
+		ctx = context.WithValue(ctx, extensionsKey{}, ext)
+	}
+	return s.Server.NotifyChange(ctx, change)
+}
+
+// extensionsTransport adds the extensions in the context of a request
+// to its (JSON object) body. It comes before signingTransport, so the
+// signature is of the body sent.
+type extensionsTransport struct {
+	base http.RoundTripper
+}
+
+func (t extensionsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ext, _ := req.Context().Value(extensionsKey{}).(*notificationExtensions)
+	if ext == nil || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		if encoded, err := json.Marshal(ext); err == nil {
+			fields["extensions"] = encoded
+			if extended, err := json.Marshal(fields); err == nil {
+				body = extended
+			}
+		}
+	}
+	// as with signingTransport, the request mustn't be changed
+	extended := req.Clone(req.Context())
+	extended.Body = ioutil.NopCloser(bytes.NewReader(body))
+	extended.ContentLength = int64(len(body))
+	return t.base.RoundTrip(extended)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
+)
+
+const expectedGitlabExtended = `{"Kind":"git","Source":{"URL":"git@example.com:mike/diaspora.git","Branch":"master"},"extensions":{"event":"push","commit":{"sha":"da1560886d4f094c3e6c9ef40349f7d38b5d27d7","message":"fixed readme","author":{"name":"GitLab dev user","email":"gitlabdev@dv6700.(none)"}}}}`
+
+// Test that an endpoint with extendedNotifications adds the head
+// commit to the notification, and that one without sends the
+// notification as it always was.
+func TestExtendedNotifications(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		extended bool
+		expected string
+	}{
+		{name: "extended", extended: true, expected: expectedGitlabExtended},
+		{name: "not extended", extended: false, expected: expectedGitlab},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, tt.expected, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", ExtendedNotifications: tt.extended}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "gitlab_payload")))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "gitlab_key")))
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.True(t, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+func TestExtensionsFor(t *testing.T) {
+	name, err := image.ParseRef("registry.example.com/app")
+	assert.NoError(t, err)
+	imageChange := fluxapi_v9.Change{Kind: fluxapi_v9.ImageChange, Source: fluxapi_v9.ImageUpdate{Name: name.Name}}
+
+	assert.Nil(t, extensionsFor(imageChange, nil))
+	assert.Nil(t, extensionsFor(imageChange, &pushDetails{}))
+	assert.Equal(t, &notificationExtensions{
+		Event: "push",
+		Image: &extensionImage{Tag: "v1.2.3", Digest: "sha256:abc"},
+	}, extensionsFor(imageChange, &pushDetails{Event: "push", Tag: "v1.2.3", Digest: "sha256:abc"}))
+
+	// the commit isn't given for an image, nor the image for a commit
+	assert.Equal(t, &notificationExtensions{Event: "push"},
+		extensionsFor(imageChange, &pushDetails{Event: "push", HeadCommit: commitDetails{SHA: "abc"}}))
+	gitChange := fluxapi_v9.Change{Kind: fluxapi_v9.GitChange, Source: fluxapi_v9.GitUpdate{URL: "git@example.com:org/repo"}}
+	assert.Nil(t, extensionsFor(gitChange, &pushDetails{Tag: "v1.2.3"}))
+	assert.Equal(t, &notificationExtensions{
+		Commit: &extensionCommit{SHA: "abc", Author: &extensionPerson{Username: "bot"}},
+	}, extensionsFor(gitChange, &pushDetails{HeadCommit: commitDetails{SHA: "abc", Author: commitPerson{Username: "bot"}}}))
+}
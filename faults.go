@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// To check, end to end, that providers retry failed deliveries, and
+// that alerts fire when they should, an endpoint can be given
+// `faults` to inject: delays before handling requests, error
+// responses, and notifications to fluxd that are dropped (and fail as
+// if the connection had been lost). This is for testing only, so it
+// needs --inject-faults, and a config with faults is refused without
+// it.
+
+// Faults are the faults injected into an endpoint's deliveries. Each
+// ratio is the fraction (from 0 to 1) of requests, or notifications,
+// that get the fault.
+type Faults struct {
+	// Latency is a delay before handling a request (e.g., "2s")
+	Latency string `json:"latency,omitempty"`
+	// LatencyRatio is the fraction of requests delayed; if not given,
+	// all of them are, when there's a latency
+	LatencyRatio *float64 `json:"latencyRatio,omitempty"`
+	// ErrorRatio is the fraction of requests answered with
+	// ErrorStatus, rather than being handled
+	ErrorRatio float64 `json:"errorRatio,omitempty"`
+	// ErrorStatus is the status of the error responses; the default
+	// is 503
+	ErrorStatus int `json:"errorStatus,omitempty"`
+	// DropRatio is the fraction of notifications to fluxd dropped
+	DropRatio float64 `json:"dropRatio,omitempty"`
+}
+
+func (f *Faults) validate() error {
+	if f.Latency != "" {
+		if d, err := time.ParseDuration(f.Latency); err != nil || d <= 0 {
+			return fmt.Errorf("faults: latency %q is not a positive duration", f.Latency)
+		}
+	}
+	ratios := map[string]float64{"errorRatio": f.ErrorRatio, "dropRatio": f.DropRatio}
+	if f.LatencyRatio != nil {
+		ratios["latencyRatio"] = *f.LatencyRatio
+	}
+	for name, ratio := range ratios {
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("faults: %s must be from 0 to 1", name)
+		}
+	}
+	if s := f.ErrorStatus; s != 0 && (s < 400 || s > 599) {
+		return fmt.Errorf("faults: errorStatus %d is not an error status", s)
+	}
+	return nil
+}
+
+// HasFaults reports whether any endpoint has faults to inject.
+func (c Config) HasFaults() bool {
+	for _, l := range c.ListenersWithDefault("") {
+		for _, ep := range l.Endpoints {
+			if ep.Faults != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var faultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "flux_recv",
+	Name:      "faults_injected_total",
+	Help:      "Faults injected, with --inject-faults, by source and fault (latency, error, or drop).",
+}, []string{"source", "fault"})
+
+func init() {
+	prometheus.MustRegister(faultsInjected)
+}
+
+// errFaultDropped is the error from a notification dropped by fault
+// injection.
+var errFaultDropped = errors.New("notification dropped (injected fault)")
+
+// faultChance gives a number in [0, 1), to decide whether to inject
+// a fault; it's a variable so tests can fix it.
+var faultChance = rand.Float64
+
+// withFaults injects latency and errors into the requests to the
+// endpoint.
+func withFaults(source string, faults Faults, next http.Handler) http.Handler {
+	// these were checked when the config was loaded
+	latency, _ := time.ParseDuration(faults.Latency)
+	latencyRatio := 1.0
+	if faults.LatencyRatio != nil {
+		latencyRatio = *faults.LatencyRatio
+	}
+	errorStatus := faults.ErrorStatus
+	if errorStatus == 0 {
+		errorStatus = http.StatusServiceUnavailable
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if latency > 0 && faultChance() < latencyRatio {
+			faultsInjected.WithLabelValues(source, "latency").Inc()
+			level.Warn(requestLogger(r)).Log("msg", "injecting latency", "latency", latency)
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if faultChance() < faults.ErrorRatio {
+			faultsInjected.WithLabelValues(source, "error").Inc()
+			level.Warn(requestLogger(r)).Log("msg", "injecting error response", "status", errorStatus)
+			http.Error(w, http.StatusText(errorStatus)+" (injected fault)", errorStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultyServer drops some of the notifications to the downstream API.
+type faultyServer struct {
+	fluxapi.Server
+	source    string
+	dropRatio float64
+}
+
+func (s faultyServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if faultChance() < s.dropRatio {
+		faultsInjected.WithLabelValues(s.source, "drop").Inc()
+		level.Warn(contextLogger(ctx)).Log("msg", "dropping notification (injected fault)", "change", changeSubject(change))
+		return errFaultDropped
+	}
+	return s.Server.NotifyChange(ctx, change)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// fixFaultChance fixes the chance used to decide on faults; calling
+// what it returns restores the original, even after it's been fixed
+// again.
+func fixFaultChance(chance float64) func() {
+	prev := faultChance
+	faultChance = func() float64 { return chance }
+	return func() { faultChance = prev }
+}
+
+func TestFaultsError(t *testing.T) {
+	handler := withFaults(GitHub, Faults{ErrorRatio: 0.5, ErrorStatus: http.StatusBadGateway}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() int {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+		return res.Code
+	}
+	before := testutil.ToFloat64(faultsInjected.WithLabelValues(GitHub, "error"))
+
+	defer fixFaultChance(0.4)()
+	assert.Equal(t, http.StatusBadGateway, serve())
+	assert.Equal(t, before+1, testutil.ToFloat64(faultsInjected.WithLabelValues(GitHub, "error")))
+	fixFaultChance(0.6)
+	assert.Equal(t, http.StatusOK, serve())
+}
+
+func TestFaultsLatency(t *testing.T) {
+	half := 0.5
+	handler := withFaults(GitHub, Faults{Latency: "50ms", LatencyRatio: &half}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	took := func() time.Duration {
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hook/abc", nil))
+		return time.Since(start)
+	}
+
+	defer fixFaultChance(0.1)()
+	assert.True(t, took() >= 50*time.Millisecond)
+	fixFaultChance(0.9)
+	assert.True(t, took() < 50*time.Millisecond)
+}
+
+func TestFaultsDrop(t *testing.T) {
+	server := &blockingServer{release: make(chan struct{})}
+	close(server.release)
+	faulty := faultyServer{Server: server, source: GitHub, dropRatio: 0.5}
+	change := fluxapi_v9.Change{Kind: fluxapi_v9.GitChange, Source: fluxapi_v9.GitUpdate{URL: "git@github.com:example/config.git"}}
+
+	defer fixFaultChance(0.4)()
+	assert.Equal(t, errFaultDropped, faulty.NotifyChange(context.Background(), change))
+	assert.Equal(t, int32(0), server.most)
+	fixFaultChance(0.6)
+	assert.NoError(t, faulty.NotifyChange(context.Background(), change))
+	assert.Equal(t, int32(1), server.most)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// filteringServer wraps the downstream API, dropping (rather than
+// forwarding) any change that the endpoint doesn't want. Since the
+// source handlers only see a fluxapi.Server, they needn't know about
+// any of this.
+type filteringServer struct {
+	fluxapi.Server
+	source  string
+	filters []changeFilter
+}
+
+// changeFilter gives the reason a change isn't wanted, or an empty
+// string if it is. The context is that the change is notified in,
+// which may have the details of the push (see push.go).
+type changeFilter func(context.Context, fluxapi_v9.Change) string
+
+func (s filteringServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	for _, filter := range s.filters {
+		reason := filter(ctx, change)
+		if reason == "" {
+			continue
+		}
+		level.Info(contextLogger(ctx)).Log("msg", "dropping change not accepted by endpoint", "change", changeSubject(change), "reason", reason)
+		auditChangeResult(ctx, change, "filtered")
+		return nil
+	}
+	return s.Server.NotifyChange(ctx, change)
+}
+
+// changeSubject gives the thing that changed; i.e., the git repo
+// URL, or the image name.
+func changeSubject(change fluxapi_v9.Change) string {
+	switch source := change.Source.(type) {
+	case fluxapi_v9.GitUpdate:
+		return source.URL
+	case fluxapi_v9.ImageUpdate:
+		return source.Name.String()
+	}
+	return ""
+}
+
+// compileAllow compiles an endpoint's `allow` expression, which must
+// match the whole of the repo URL or image name.
+func compileAllow(allow string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + allow + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("allow expression %q is not a valid regular expression: %s", allow, err.Error())
+	}
+	return re, nil
+}
+
+// Repos are lists of the git repos an endpoint forwards changes for,
+// and those it doesn't, e.g., for a hook on a whole GitHub
+// organisation or GitLab group. Each entry is a glob pattern (e.g.,
+// `git@github.com:example-org/*`), or a regular expression if it's
+// between slashes (e.g., `/.*-config\.git/`); either must match the
+// whole repo URL.
+type Repos struct {
+	// Allow, if given, are the repos changes are forwarded for; a
+	// change for any other is dropped
+	Allow []string `json:"allow,omitempty"`
+	// Deny are repos changes aren't forwarded for, even if allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+// repoMatcher reports whether a repo URL matches a pattern.
+type repoMatcher func(string) bool
+
+// compileRepoPattern compiles an entry of Repos.
+func compileRepoPattern(pattern string) (repoMatcher, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("repos: %q is not a valid regular expression: %s", pattern, err.Error())
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return nil, fmt.Errorf("repos: %q is not a valid pattern", pattern)
+	}
+	return func(url string) bool {
+		ok, _ := path.Match(pattern, url)
+		return ok
+	}, nil
+}
+
+func compileRepoPatterns(patterns []string) ([]repoMatcher, error) {
+	var res []repoMatcher
+	for _, p := range patterns {
+		m, err := compileRepoPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func (r *Repos) validate() error {
+	if len(r.Allow) == 0 && len(r.Deny) == 0 {
+		return fmt.Errorf("repos needs allow or deny")
+	}
+	_, err := r.filter()
+	return err
+}
+
+// filter constructs the filter for the repos, which accepts git
+// changes for a repo allowed, and not denied. Image changes are
+// accepted.
+func (r *Repos) filter() (changeFilter, error) {
+	allow, err := compileRepoPatterns(r.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compileRepoPatterns(r.Deny)
+	if err != nil {
+		return nil, err
+	}
+	matchesAny := func(matchers []repoMatcher, url string) bool {
+		for _, m := range matchers {
+			if m(url) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(_ context.Context, change fluxapi_v9.Change) string {
+		update, ok := change.Source.(fluxapi_v9.GitUpdate)
+		if !ok {
+			return ""
+		}
+		if matchesAny(deny, update.URL) {
+			return "repo is denied by repos"
+		}
+		if len(allow) > 0 && !matchesAny(allow, update.URL) {
+			return "repo is not allowed by repos"
+		}
+		return ""
+	}, nil
+}
+
+// validateBranches checks an endpoint's `branches` are valid glob
+// patterns.
+func validateBranches(branches []string) error {
+	for _, b := range branches {
+		if _, err := path.Match(b, ""); err != nil || b == "" {
+			return fmt.Errorf("branches: %q is not a valid pattern", b)
+		}
+	}
+	return nil
+}
+
+// branchFilter accepts git changes only for a branch matching one of
+// the (glob) patterns given, e.g., `release/*`. Image changes are
+// accepted, since they have no branch.
+func branchFilter(branches []string) changeFilter {
+	return func(_ context.Context, change fluxapi_v9.Change) string {
+		update, ok := change.Source.(fluxapi_v9.GitUpdate)
+		if !ok {
+			return ""
+		}
+		for _, b := range branches {
+			if ok, _ := path.Match(b, update.Branch); ok {
+				return ""
+			}
+		}
+		return fmt.Sprintf("branch %q is not in branches", update.Branch)
+	}
+}
+
+// defaultBranchFilter accepts git changes only for the repo's default
+// branch, as given in the payload. If the payload doesn't say what the
+// default branch is, the change is dropped, since it can't be told
+// whether it's wanted.
+func defaultBranchFilter(ctx context.Context, change fluxapi_v9.Change) string {
+	update, ok := change.Source.(fluxapi_v9.GitUpdate)
+	if !ok {
+		return ""
+	}
+	details := pushDetailsFrom(ctx)
+	if details == nil || details.DefaultBranch == "" {
+		return "the payload does not give the default branch"
+	}
+	if update.Branch != details.DefaultBranch {
+		return fmt.Sprintf("branch %q is not the default branch %q", update.Branch, details.DefaultBranch)
+	}
+	return ""
+}
+
+// compileTagPattern compiles an endpoint's `tagPattern`, which must
+// match the whole of an image's tag.
+func compileTagPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("tagPattern %q is not a valid regular expression: %s", pattern, err.Error())
+	}
+	return re, nil
+}
+
+// tagFilter accepts image changes only for a tag matched by the
+// pattern, as given in the payload; if the payload doesn't give the
+// tag, the change is dropped. Git changes are accepted.
+func tagFilter(pattern *regexp.Regexp) changeFilter {
+	return func(ctx context.Context, change fluxapi_v9.Change) string {
+		if _, ok := change.Source.(fluxapi_v9.ImageUpdate); !ok {
+			return ""
+		}
+		details := pushDetailsFrom(ctx)
+		if details == nil || details.Tag == "" {
+			return "the payload does not give the tag"
+		}
+		if !pattern.MatchString(details.Tag) {
+			return fmt.Sprintf("tag %q is not matched by tagPattern", details.Tag)
+		}
+		return ""
+	}
+}
+
+// skipFilter drops git changes whose head commit's message has any of
+// the markers given (e.g., "[skip flux]"), ignoring case, as CI
+// systems skip builds. A change for which the payload doesn't give the
+// message is accepted.
+func skipFilter(markers []string) changeFilter {
+	return func(ctx context.Context, change fluxapi_v9.Change) string {
+		if _, ok := change.Source.(fluxapi_v9.GitUpdate); !ok {
+			return ""
+		}
+		details := pushDetailsFrom(ctx)
+		if details == nil {
+			return ""
+		}
+		message := strings.ToLower(details.HeadCommit.Message)
+		for _, marker := range markers {
+			if strings.Contains(message, strings.ToLower(marker)) {
+				return fmt.Sprintf("head commit message has %q", marker)
+			}
+		}
+		return ""
+	}
+}
+
+// endpointServer wraps the downstream API with whatever filtering
+// (and rewriting) the endpoint asks for.
+func endpointServer(s fluxapi.Server, ep Endpoint) (fluxapi.Server, error) {
+	if len(ep.GitURLRewrites) > 0 || len(ep.ImageRewrites) > 0 {
+		rules, err := compileGitURLRewrites(ep.GitURLRewrites)
+		if err != nil {
+			return nil, err
+		}
+		s = rewritingServer{Server: s, gitURLRules: rules, imageRules: ep.ImageRewrites}
+	}
+	filters := []changeFilter{eventFilter(endpointEvents(ep))}
+	if ep.Allow != "" {
+		allow, err := compileAllow(ep.Allow)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, func(_ context.Context, change fluxapi_v9.Change) string {
+			if !allow.MatchString(changeSubject(change)) {
+				return "not matched by allow"
+			}
+			return ""
+		})
+	}
+	if len(ep.Branches) > 0 {
+		filters = append(filters, branchFilter(ep.Branches))
+	}
+	if ep.Repos != nil {
+		filter, err := ep.Repos.filter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if ep.DefaultBranchOnly {
+		filters = append(filters, defaultBranchFilter)
+	}
+	if len(ep.SkipMarkers) > 0 {
+		filters = append(filters, skipFilter(ep.SkipMarkers))
+	}
+	if len(ep.IgnoreAuthors) > 0 || len(ep.IgnoreCommitters) > 0 {
+		filter, err := authorFilter(ep.IgnoreAuthors, ep.IgnoreCommitters)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if ep.TagPattern != "" {
+		pattern, err := compileTagPattern(ep.TagPattern)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, tagFilter(pattern))
+	}
+	return filteringServer{
+		Server:  s,
+		source:  ep.Source,
+		filters: filters,
+	}, nil
+}
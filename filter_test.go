@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
+)
+
+// recordingServer keeps the changes it's notified of.
+type recordingServer struct {
+	fluxapi.Server
+	changes []fluxapi_v9.Change
+}
+
+func (s *recordingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	s.changes = append(s.changes, change)
+	return nil
+}
+
+func gitChange(url, branch string) fluxapi_v9.Change {
+	return fluxapi_v9.Change{Kind: fluxapi_v9.GitChange, Source: fluxapi_v9.GitUpdate{URL: url, Branch: branch}}
+}
+
+func imageChange(t *testing.T, name string) fluxapi_v9.Change {
+	ref, err := image.ParseRef(name)
+	assert.NoError(t, err)
+	return fluxapi_v9.Change{Kind: fluxapi_v9.ImageChange, Source: fluxapi_v9.ImageUpdate{Name: ref.Name}}
+}
+
+// notified gives the changes the endpoint passes on.
+func notified(t *testing.T, ep Endpoint, changes ...fluxapi_v9.Change) []fluxapi_v9.Change {
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, ep)
+	assert.NoError(t, err)
+	for _, c := range changes {
+		assert.NoError(t, s.NotifyChange(context.Background(), c))
+	}
+	return downstream.changes
+}
+
+func TestBranchFilter(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	ep := Endpoint{Source: GitHub, Branches: []string{"main", "release/*"}}
+	assert.Equal(t, []fluxapi_v9.Change{gitChange(repo, "main"), gitChange(repo, "release/1.2")},
+		notified(t, ep,
+			gitChange(repo, "main"),
+			gitChange(repo, "feature/thing"),
+			gitChange(repo, "release/1.2"),
+			gitChange(repo, "release/1.2/hotfix"), // * doesn't match /
+			gitChange(repo, "refs/tags/v1.2.0"),
+		))
+
+	// image changes don't have a branch, so aren't filtered
+	assert.Len(t, notified(t, ep, imageChange(t, "example/app")), 1)
+
+	assert.NoError(t, validateBranches([]string{"main", "release/*", "v[0-9]*"}))
+	assert.Error(t, validateBranches([]string{"release/["}))
+	assert.Error(t, validateBranches([]string{""}))
+}
+
+func TestDefaultBranchFilter(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, Endpoint{Source: GitHub, DefaultBranchOnly: true})
+	assert.NoError(t, err)
+
+	ctx := withPushDetails(context.Background(), &pushDetails{DefaultBranch: "main"})
+	assert.NoError(t, s.NotifyChange(ctx, gitChange(repo, "main")))
+	assert.NoError(t, s.NotifyChange(ctx, gitChange(repo, "feature/thing")))
+	// without the default branch, it can't be told, so it's dropped
+	assert.NoError(t, s.NotifyChange(context.Background(), gitChange(repo, "main")))
+	assert.Equal(t, []fluxapi_v9.Change{gitChange(repo, "main")}, downstream.changes)
+}
+
+func TestSkipFilter(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, Endpoint{Source: GitHub, SkipMarkers: []string{"[skip flux]", "[ci skip]"}})
+	assert.NoError(t, err)
+
+	commit := func(message string) context.Context {
+		return withPushDetails(context.Background(), &pushDetails{HeadCommit: commitDetails{Message: message}})
+	}
+	assert.NoError(t, s.NotifyChange(commit("Bump the chart version [CI SKIP]"), gitChange(repo, "main")))
+	assert.NoError(t, s.NotifyChange(commit("Update the deployment\n\n[skip flux]"), gitChange(repo, "main")))
+	assert.NoError(t, s.NotifyChange(commit("Update the deployment"), gitChange(repo, "dev")))
+	// without the message, the change is forwarded
+	assert.NoError(t, s.NotifyChange(context.Background(), gitChange(repo, "feature/thing")))
+	assert.Equal(t, []fluxapi_v9.Change{gitChange(repo, "dev"), gitChange(repo, "feature/thing")}, downstream.changes)
+}
+
+func TestReposFilter(t *testing.T) {
+	ep := Endpoint{Source: GitHub, Repos: &Repos{
+		Allow: []string{"git@github.com:example-org/*", `/https://gitlab\.com/example-group/.*-config\.git/`},
+		Deny:  []string{"git@github.com:example-org/sandbox*"},
+	}}
+	assert.Equal(t, []fluxapi_v9.Change{
+		gitChange("git@github.com:example-org/config.git", "main"),
+		gitChange("https://gitlab.com/example-group/team/app-config.git", "main"),
+	}, notified(t, ep,
+		gitChange("git@github.com:example-org/config.git", "main"),
+		gitChange("git@github.com:example-org/sandbox-config.git", "main"),
+		gitChange("git@github.com:other-org/config.git", "main"),
+		gitChange("https://gitlab.com/example-group/team/app-config.git", "main"),
+		gitChange("https://gitlab.com/example-group/team/app.git", "main"),
+	))
+
+	// with only deny, the rest are allowed
+	ep.Repos = &Repos{Deny: []string{"git@github.com:example-org/sandbox*"}}
+	assert.Len(t, notified(t, ep,
+		gitChange("git@github.com:example-org/sandbox.git", "main"),
+		gitChange("git@github.com:other-org/config.git", "main"),
+	), 1)
+
+	assert.Error(t, (&Repos{}).validate())
+	assert.Error(t, (&Repos{Allow: []string{"/(unclosed/"}}).validate())
+	assert.Error(t, (&Repos{Deny: []string{"git@github.com:[example"}}).validate())
+}
+
+func TestTagFilter(t *testing.T) {
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, Endpoint{Source: DockerHub, TagPattern: `v\d+\.\d+\.\d+`})
+	assert.NoError(t, err)
+
+	for _, tag := range []string{"v1.2.3", "latest", "dev-abc123", "pr-42", "v1.2.3-rc1", ""} {
+		ctx := withPushDetails(context.Background(), &pushDetails{Tag: tag})
+		assert.NoError(t, s.NotifyChange(ctx, imageChange(t, "example/app")))
+	}
+	assert.Len(t, downstream.changes, 1)
+	// git changes have no tag, so aren't filtered
+	assert.NoError(t, s.NotifyChange(context.Background(), gitChange("git@github.com:example/config.git", "main")))
+	assert.Len(t, downstream.changes, 2)
+}
+
+func TestEventFilter(t *testing.T) {
+	const repo = "git@github.com:example/config.git"
+	downstream := &recordingServer{}
+	s, err := endpointServer(downstream, Endpoint{Source: GitHub})
+	assert.NoError(t, err)
+
+	// by default, GitHub endpoints accept pushes and tags
+	for _, event := range []string{eventPush, eventTag, eventRelease, eventPipeline, ""} {
+		ctx := withPushDetails(context.Background(), &pushDetails{Event: event})
+		assert.NoError(t, s.NotifyChange(ctx, gitChange(repo, "main")))
+	}
+	assert.Len(t, downstream.changes, 3)
+
+	downstream = &recordingServer{}
+	s, err = endpointServer(downstream, Endpoint{Source: GitHub, Events: []string{eventRelease}})
+	assert.NoError(t, err)
+	for _, event := range []string{eventPush, eventTag, eventRelease} {
+		ctx := withPushDetails(context.Background(), &pushDetails{Event: event})
+		assert.NoError(t, s.NotifyChange(ctx, gitChange(repo, "main")))
+	}
+	assert.Len(t, downstream.changes, 1)
+
+	assert.NoError(t, validateEvents(GitLab, []string{eventTag, eventPipeline}))
+	assert.Error(t, validateEvents(DockerHub, []string{eventRelease}))
+	assert.Error(t, validateEvents(GitHub, []string{"issues"}))
+}
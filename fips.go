@@ -0,0 +1,16 @@
+package main
+
+import "errors"
+
+// In FIPS mode (when built with BoringCrypto), only FIPS-approved
+// algorithms are used. Beyond what BoringCrypto (and
+// crypto/tls/fipsonly) restrict, this means:
+//  - SHA1 signatures are not accepted, even if asked for
+//  - files encrypted with age or SOPS can't be decrypted, since age
+//    uses X25519 and ChaCha20-Poly1305
+
+var errNotFIPSApproved = errors.New("not available in FIPS mode, since it uses algorithms that are not FIPS-approved")
+
+// fipsSignatureAlgorithms are the signature algorithms allowed in
+// FIPS mode.
+var fipsSignatureAlgorithms = map[string]bool{"sha256": true, "sha512": true}
@@ -0,0 +1,22 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// restricts TLS to FIPS-approved versions, cipher suites and
+	// curves
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsBuild is true when built with BoringCrypto; see `make
+// bin-fips`.
+const fipsBuild = true
+
+func cryptoMode() (string, bool) {
+	if !boring.Enabled() {
+		return "built for FIPS mode, but BoringCrypto is not enabled", false
+	}
+	return "BoringCrypto (FIPS mode)", true
+}
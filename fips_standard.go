@@ -0,0 +1,12 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package main
+
+// fipsBuild is true when built with BoringCrypto; see `make
+// bin-fips`.
+const fipsBuild = false
+
+func cryptoMode() (string, bool) {
+	return "standard Go crypto", true
+}
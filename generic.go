@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// For the long tail of systems that send webhooks but don't have a
+// handler here, the Generic source is configured with where to find
+// the repo URL and branch (or the image name and tag) in the JSON
+// payload, as JSONPath expressions (see jsonpath.go) or a template
+// (see template.go), and how requests are authenticated: with an HMAC
+// signature of the payload, a token in a header, or neither, relying
+// only on the secret in the hook path (as with DockerHub).
+
+const Generic = "Generic"
+
+const (
+	genericAuthHMAC  = "hmac"
+	genericAuthToken = "token"
+	genericAuthNone  = "none"
+
+	defaultGenericSignatureHeader = "X-Hub-Signature-256"
+	defaultGenericTokenHeader     = "X-Webhook-Token"
+)
+
+func init() {
+	// the handler is given by the endpoint's mapping; this is so the
+	// source is known
+	Sources[Generic] = handleGenericUnmapped
+	ImageTagSources[Generic] = true
+	CommitMessageSources[Generic] = true
+	CommitAuthorSources[Generic] = true
+	CommitCommitterSources[Generic] = true
+	SourceEvents[Generic] = []string{eventPush}
+	DefaultEvents[Generic] = []string{eventPush}
+}
+
+// GenericMapping is how a Generic endpoint gets a change from a
+// payload.
+type GenericMapping struct {
+	// Auth is how requests are authenticated: "hmac" (the default),
+	// "token", or "none"
+	Auth string `json:"auth,omitempty"`
+	// SignatureHeader is the header with the HMAC of the payload, as
+	// `<algorithm>=<hex>` or just the hex of a SHA256 HMAC; the
+	// default is X-Hub-Signature-256
+	SignatureHeader string `json:"signatureHeader,omitempty"`
+	// TokenHeader is the header with the token, which must be the
+	// endpoint's key, possibly after "Bearer "; the default is
+	// X-Webhook-Token
+	TokenHeader string `json:"tokenHeader,omitempty"`
+	// TimestampHeader, if given, is the header with the time the
+	// request was sent, in Unix seconds; the signature is then of
+	// `<timestamp>.<payload>`, and requests sent further from now
+	// than the endpoint's timestampTolerance are refused
+	TimestampHeader string `json:"timestampHeader,omitempty"`
+	// Git, if given, is where to find a git change in the payload
+	Git *GenericGit `json:"git,omitempty"`
+	// Image, if given, is where to find an image change in the
+	// payload
+	Image *GenericImage `json:"image,omitempty"`
+	// Template, if given, is a Go template rendering the change from
+	// the payload and headers
+	Template string `json:"template,omitempty"`
+}
+
+// GenericGit gives JSONPath expressions for the fields of a git
+// change.
+type GenericGit struct {
+	URL string `json:"url"`
+	// Branch, if given, is where to find the branch; a leading
+	// "refs/heads/" is removed
+	Branch string `json:"branch,omitempty"`
+	// Message, if given, is where to find the head commit's message,
+	// for skipMarkers
+	Message string `json:"message,omitempty"`
+	// SHA, if given, is where to find the head commit's SHA, for
+	// extendedNotifications
+	SHA string `json:"sha,omitempty"`
+	// Author and Committer, if given, are where to find the head
+	// commit's author and committer (e.g., the username or email),
+	// for ignoreAuthors and ignoreCommitters
+	Author    string `json:"author,omitempty"`
+	Committer string `json:"committer,omitempty"`
+}
+
+// GenericImage gives JSONPath expressions for the fields of an image
+// change.
+type GenericImage struct {
+	Name string `json:"name"`
+	// Tag, if given, is where to find the tag pushed, for tagPattern
+	Tag string `json:"tag,omitempty"`
+	// Digest, if given, is where to find the digest of the image
+	// pushed, for extendedNotifications
+	Digest string `json:"digest,omitempty"`
+}
+
+func (g *GenericMapping) auth() string {
+	if g.Auth == "" {
+		return genericAuthHMAC
+	}
+	return g.Auth
+}
+
+// payloadMapping is a GenericMapping, ready to be used.
+type payloadMapping struct {
+	auth, signatureHeader, tokenHeader, timestampHeader string
+	// for git changes
+	url, branch, sha, message, author, committer *jsonPath
+	// for image changes
+	name, tag, digest *jsonPath
+	// for changes rendered by a template
+	template *template.Template
+}
+
+// compileGeneric checks the mapping and gets it ready to be used.
+func compileGeneric(g *GenericMapping) (*payloadMapping, error) {
+	m := &payloadMapping{
+		auth:            g.auth(),
+		signatureHeader: g.SignatureHeader,
+		tokenHeader:     g.TokenHeader,
+		timestampHeader: g.TimestampHeader,
+	}
+	switch m.auth {
+	case genericAuthHMAC, genericAuthToken, genericAuthNone:
+	default:
+		return nil, fmt.Errorf("generic: auth %q is not one of hmac, token, or none", g.Auth)
+	}
+	if m.timestampHeader != "" && m.auth != genericAuthHMAC {
+		return nil, fmt.Errorf("generic: timestampHeader needs auth hmac, since the timestamp is signed")
+	}
+	if m.signatureHeader == "" {
+		m.signatureHeader = defaultGenericSignatureHeader
+	}
+	if m.tokenHeader == "" {
+		m.tokenHeader = defaultGenericTokenHeader
+	}
+
+	type path struct {
+		expr string
+		into **jsonPath
+	}
+	var paths []path
+	switch {
+	case countGiven(g.Git != nil, g.Image != nil, g.Template != "") != 1:
+		return nil, fmt.Errorf("generic: exactly one of git, image, and template must be given")
+	case g.Template != "":
+		t, err := compileTemplate(g.Template)
+		if err != nil {
+			return nil, fmt.Errorf("generic: %s", err.Error())
+		}
+		m.template = t
+	case g.Git != nil:
+		if g.Git.URL == "" {
+			return nil, fmt.Errorf("generic: git needs url")
+		}
+		paths = append(paths, path{g.Git.URL, &m.url})
+		if g.Git.Branch != "" {
+			paths = append(paths, path{g.Git.Branch, &m.branch})
+		}
+		if g.Git.SHA != "" {
+			paths = append(paths, path{g.Git.SHA, &m.sha})
+		}
+		if g.Git.Message != "" {
+			paths = append(paths, path{g.Git.Message, &m.message})
+		}
+		if g.Git.Author != "" {
+			paths = append(paths, path{g.Git.Author, &m.author})
+		}
+		if g.Git.Committer != "" {
+			paths = append(paths, path{g.Git.Committer, &m.committer})
+		}
+	default:
+		if g.Image.Name == "" {
+			return nil, fmt.Errorf("generic: image needs name")
+		}
+		paths = append(paths, path{g.Image.Name, &m.name})
+		if g.Image.Tag != "" {
+			paths = append(paths, path{g.Image.Tag, &m.tag})
+		}
+		if g.Image.Digest != "" {
+			paths = append(paths, path{g.Image.Digest, &m.digest})
+		}
+	}
+	for _, p := range paths {
+		parsed, err := parseJSONPath(p.expr)
+		if err != nil {
+			return nil, fmt.Errorf("generic: %s", err.Error())
+		}
+		*p.into = parsed
+	}
+	return m, nil
+}
+
+// signsPayloads reports whether requests to the endpoint have a
+// signature of the payload, and so whether signatureAlgorithms means
+// anything for it.
+func signsPayloads(ep Endpoint) bool {
+	if ep.Source == Generic {
+		return ep.Generic != nil && ep.Generic.auth() == genericAuthHMAC
+	}
+	return SignedSources[ep.Source]
+}
+
+// signsTimestamps reports whether requests to the endpoint have a
+// signed timestamp, and so whether timestampTolerance means anything
+// for it.
+func signsTimestamps(ep Endpoint) bool {
+	return signsPayloads(ep) && ep.Source == Generic && ep.Generic.TimestampHeader != ""
+}
+
+func handleGenericUnmapped(_ fluxapi.Server, _ Verification, w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "The endpoint has no mapping for payloads", http.StatusInternalServerError)
+	level.Error(requestLogger(r)).Log("msg", "Generic endpoint without generic mapping")
+}
+
+// handler gives the source handler for an endpoint with the mapping.
+func (m *payloadMapping) handler() HookHandler {
+	return func(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			if bodyTooLarge(w, r, err) || payloadNotAcceptable(w, r, err) {
+				return
+			}
+			http.Error(w, "Unable to read payload", http.StatusBadRequest)
+			level.Warn(requestLogger(r)).Log("msg", "unable to read payload", "err", err)
+			return
+		}
+		if err := m.authenticate(r, v, body); err != nil {
+			http.Error(w, "The request could not be authenticated", http.StatusUnauthorized)
+			level.Warn(requestLogger(r)).Log("msg", "request not authenticated", "auth", m.auth, "err", err)
+			return
+		}
+
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			http.Error(w, "Unable to decode payload as JSON", http.StatusBadRequest)
+			logPayload(r, body, "msg", "unable to decode payload", "err", err)
+			reportError(r.Context(), "could not parse payload", err)
+			return
+		}
+		var fields map[string]string
+		if m.template != nil {
+			fields, err = renderChange(m.template, doc, r.Header)
+		} else {
+			fields, err = m.extract(doc)
+		}
+		if err != nil {
+			http.Error(w, "Unable to find the change in the payload", http.StatusBadRequest)
+			logPayload(r, body, "msg", "unable to find change in payload", "err", err)
+			return
+		}
+		if fields == nil {
+			ignoreEvent(w, r, "rendered no change")
+			return
+		}
+
+		if _, ok := fields["name"]; ok {
+			doImageNotify(s, w, r, fields["name"], &pushDetails{Tag: fields["tag"], Digest: fields["digest"]})
+			return
+		}
+		change := fluxapi_v9.Change{
+			Kind: fluxapi_v9.GitChange,
+			Source: fluxapi_v9.GitUpdate{
+				URL:    fields["url"],
+				Branch: strings.TrimPrefix(fields["branch"], "refs/heads/"),
+			},
+		}
+		ctx := withPushDetails(r.Context(), &pushDetails{
+			Event: eventPush,
+			HeadCommit: commitDetails{
+				SHA:       fields["sha"],
+				Message:   fields["message"],
+				Author:    parsePerson(fields["author"]),
+				Committer: parsePerson(fields["committer"]),
+			},
+		})
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := s.NotifyChange(ctx, change); err != nil {
+			http.Error(w, "Error forwarding hook", http.StatusInternalServerError)
+			level.Error(requestLogger(r)).Log("msg", "error from downstream", "err", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+// authenticate checks the request is genuine, by the mapping's auth.
+func (m *payloadMapping) authenticate(r *http.Request, v Verification, body []byte) error {
+	switch m.auth {
+	case genericAuthToken:
+		token := strings.TrimPrefix(r.Header.Get(m.tokenHeader), "Bearer ")
+		if !checkToken(token, v) {
+			return fmt.Errorf("missing or incorrect token in %s", m.tokenHeader)
+		}
+		return nil
+	case genericAuthNone:
+		return nil
+	}
+
+	sig := r.Header.Get(m.signatureHeader)
+	if sig == "" {
+		return fmt.Errorf("missing signature in %s", m.signatureHeader)
+	}
+	alg := "sha256"
+	if parts := strings.SplitN(sig, "=", 2); len(parts) == 2 {
+		alg, sig = parts[0], parts[1]
+	}
+	algorithms := v.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultSignatureAlgorithms
+	}
+	if !containsString(algorithms, alg) {
+		return fmt.Errorf("signature algorithm %q is not one of those accepted (%s)", alg, strings.Join(algorithms, ", "))
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("cannot decode signature in %s: %s", m.signatureHeader, err.Error())
+	}
+	check := &signatureCheck{sig: mac}
+	for _, key := range v.Keys {
+		check.macs = append(check.macs, hmac.New(hmacAlgorithms[alg], key))
+	}
+	if m.timestampHeader == "" {
+		check.Write(body)
+		return check.verify()
+	}
+
+	stamp := r.Header.Get(m.timestampHeader)
+	sent, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed timestamp in %s", m.timestampHeader)
+	}
+	check.Write([]byte(stamp + "."))
+	check.Write(body)
+	if err := check.verify(); err != nil {
+		return err
+	}
+	// only once it's known to be genuine is the time worth checking
+	skew := time.Since(time.Unix(sent, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > v.TimestampTolerance {
+		return fmt.Errorf("timestamp in %s is %s from now, more than the tolerance of %s", m.timestampHeader, skew.Round(time.Second), v.TimestampTolerance)
+	}
+	return nil
+}
+
+// extract finds the fields of the change in the payload. The repo URL
+// or image name must be there; the others may be missing.
+func (m *payloadMapping) extract(doc interface{}) (map[string]string, error) {
+	fields := map[string]string{}
+	for _, f := range []struct {
+		field    string
+		path     *jsonPath
+		required bool
+	}{
+		{"url", m.url, true},
+		{"branch", m.branch, false},
+		{"sha", m.sha, false},
+		{"message", m.message, false},
+		{"author", m.author, false},
+		{"committer", m.committer, false},
+		{"name", m.name, true},
+		{"tag", m.tag, false},
+		{"digest", m.digest, false},
+	} {
+		if f.path == nil {
+			continue
+		}
+		value, ok, err := f.path.eval(doc)
+		if err != nil {
+			return nil, err
+		}
+		if !ok && f.required {
+			return nil, fmt.Errorf("no value for %s at %s", f.field, f.path.expr)
+		}
+		fields[f.field] = value
+	}
+	return fields, nil
+}
+
+// countGiven gives how many of the options are given.
+func countGiven(given ...bool) int {
+	var n int
+	for _, g := range given {
+		if g {
+			n++
+		}
+	}
+	return n
+}
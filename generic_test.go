@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that a Generic endpoint finds the change in the payload where
+// its mapping says, and authenticates requests as it says.
+func TestGenericSource(t *testing.T) {
+	const payload = `{"project": {"clone": "git@example.com:config.git"}, "ref": "refs/heads/main"}`
+	const expected = `{"Kind":"git","Source":{"URL":"git@example.com:config.git","Branch":"main"}}`
+	git := &GenericGit{URL: "$.project.clone", Branch: "$.ref"}
+
+	for _, tt := range []struct {
+		desc    string
+		mapping GenericMapping
+		payload string
+		headers map[string]string
+		status  int
+	}{
+		{
+			desc:    "signed",
+			mapping: GenericMapping{Git: git},
+			headers: map[string]string{"X-Hub-Signature-256": "sign"},
+			status:  200,
+		},
+		{
+			desc:    "signed, bare hex in another header",
+			mapping: GenericMapping{Git: git, SignatureHeader: "X-Signature"},
+			headers: map[string]string{"X-Signature": "sign-hex"},
+			status:  200,
+		},
+		{
+			desc:    "not signed",
+			mapping: GenericMapping{Git: git},
+			status:  401,
+		},
+		{
+			desc:    "token",
+			mapping: GenericMapping{Git: git, Auth: genericAuthToken, TokenHeader: "Authorization"},
+			headers: map[string]string{"Authorization": "Bearer key"},
+			status:  200,
+		},
+		{
+			desc:    "wrong token",
+			mapping: GenericMapping{Git: git, Auth: genericAuthToken},
+			headers: map[string]string{"X-Webhook-Token": "not the key"},
+			status:  401,
+		},
+		{
+			desc:    "no auth",
+			mapping: GenericMapping{Git: git, Auth: genericAuthNone},
+			status:  200,
+		},
+		{
+			desc:    "no repo URL in payload",
+			mapping: GenericMapping{Git: &GenericGit{URL: "$.repository.url"}, Auth: genericAuthNone},
+			status:  400,
+		},
+		{
+			desc:    "not JSON",
+			mapping: GenericMapping{Git: git, Auth: genericAuthNone},
+			payload: "ref=refs/heads/main",
+			status:  400,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expected, &called)
+			defer downstream.Close()
+
+			mapping := tt.mapping
+			endpoint := Endpoint{Source: Generic, KeyPath: "gitlab_key", Generic: &mapping}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			body := tt.payload
+			if body == "" {
+				body = payload
+			}
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, strings.NewReader(body))
+			assert.NoError(t, err)
+			key := loadFixture(t, "gitlab_key")
+			for header, value := range tt.headers {
+				switch value {
+				case "sign":
+					value = hubSignature("sha256", []byte(body), key)
+				case "sign-hex":
+					value = strings.TrimPrefix(hubSignature("sha256", []byte(body), key), "sha256=")
+				case "Bearer key":
+					value = "Bearer " + string(key)
+				}
+				req.Header.Set(header, value)
+			}
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == 200, called)
+		})
+	}
+}
+
+// Test that a Generic endpoint with a timestampHeader checks the
+// timestamp is signed along with the payload, and recent enough.
+func TestGenericTimestamp(t *testing.T) {
+	const payload = `{"project": {"clone": "git@example.com:config.git"}, "ref": "refs/heads/main"}`
+	const expected = `{"Kind":"git","Source":{"URL":"git@example.com:config.git","Branch":"main"}}`
+	now := time.Now().Unix()
+	stale := time.Now().Add(-10 * time.Minute).Unix()
+
+	for _, tt := range []struct {
+		desc      string
+		tolerance string
+		signed    int64
+		sent      int64
+		status    int
+	}{
+		{desc: "recent", signed: now, sent: now, status: 200},
+		{desc: "stale", signed: stale, sent: stale, status: 401},
+		{desc: "stale, within the tolerance", tolerance: "1h", signed: stale, sent: stale, status: 200},
+		{desc: "timestamp changed after signing", signed: stale, sent: now, status: 401},
+		{desc: "no timestamp", signed: now, status: 401},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expected, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{
+				Source:             Generic,
+				KeyPath:            "gitlab_key",
+				TimestampTolerance: tt.tolerance,
+				Generic: &GenericMapping{
+					Git:             &GenericGit{URL: "$.project.clone", Branch: "$.ref"},
+					TimestampHeader: "X-Webhook-Timestamp",
+				},
+			}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, strings.NewReader(payload))
+			assert.NoError(t, err)
+			signed := fmt.Sprintf("%d.%s", tt.signed, payload)
+			req.Header.Set("X-Hub-Signature-256", hubSignature("sha256", []byte(signed), loadFixture(t, "gitlab_key")))
+			if tt.sent != 0 {
+				req.Header.Set("X-Webhook-Timestamp", fmt.Sprintf("%d", tt.sent))
+			}
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == 200, called)
+		})
+	}
+}
+
+func TestGenericImage(t *testing.T) {
+	const payload = `{"artifact": {"repository": "svendowideit/testhook", "tag": "latest"}}`
+	var called bool
+	downstream := newDownstream(t, expectedDockerhub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{
+		Source:     Generic,
+		KeyPath:    "dockerhub_key",
+		TagPattern: "latest",
+		Generic: &GenericMapping{
+			Auth:  genericAuthNone,
+			Image: &GenericImage{Name: "$.artifact.repository", Tag: "$.artifact.tag"},
+		},
+	}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	res, err := hookServer.Client().Post(hookServer.URL+"/hook/"+fp, "application/json", strings.NewReader(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.True(t, called)
+}
+
+// Test that a Generic endpoint with a template forwards the change it
+// renders, and ignores requests for which it renders nothing.
+func TestGenericTemplate(t *testing.T) {
+	const expected = `{"Kind":"git","Source":{"URL":"git@example.com:example/config.git","Branch":"main"}}`
+	const template = `{{ if eq (.Headers.Get "X-Event") "push" -}}
+{"url": "git@example.com:{{ .Payload.project }}.git", "branch": {{ json .Payload.branch }}}
+{{- end }}`
+	for _, event := range []string{"push", "comment"} {
+		t.Run(event, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expected, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: Generic, KeyPath: "gitlab_key", Generic: &GenericMapping{Auth: genericAuthNone, Template: template}}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, strings.NewReader(`{"project": "example/config", "branch": "main"}`))
+			assert.NoError(t, err)
+			req.Header.Set("X-Event", event)
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, res.StatusCode)
+			assert.Equal(t, event == "push", called)
+		})
+	}
+}
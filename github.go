@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 
+	"github.com/go-kit/kit/log/level"
 	"github.com/google/go-github/v28/github"
 
 	fluxapi "github.com/fluxcd/flux/pkg/api"
@@ -15,58 +19,186 @@ import (
 const GitHub = "GitHub"
 
 func init() {
+	SignedSources[GitHub] = true
+	DeliveryIDSources[GitHub] = true
+	DefaultBranchSources[GitHub] = true
+	CommitMessageSources[GitHub] = true
+	CommitAuthorSources[GitHub] = true
+	CommitCommitterSources[GitHub] = true
+	SourceEvents[GitHub] = []string{eventPush, eventTag, eventRelease, eventPipeline}
+	DefaultEvents[GitHub] = []string{eventPush, eventTag}
 	Sources[GitHub] = handleGithubPush
 }
 
-func handleGithubPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request) {
-	payload, err := github.ValidatePayload(r, key)
+// githubEvent is the part of an event payload used here, for each
+// kind of event handled; the rest (e.g., the commits) is skipped as
+// it's read.
+type githubEvent struct {
+	Ref        string       `json:"ref"`
+	Action     string       `json:"action"`
+	HeadCommit githubCommit `json:"head_commit"`
+	Repository struct {
+		SSHURL        string `json:"ssh_url"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Release struct {
+		TagName string `json:"tag_name"`
+	} `json:"release"`
+	WorkflowRun struct {
+		HeadBranch string       `json:"head_branch"`
+		Conclusion string       `json:"conclusion"`
+		HeadCommit githubCommit `json:"head_commit"`
+	} `json:"workflow_run"`
+}
+
+// githubCommit is the part of a commit in an event payload used here.
+type githubCommit struct {
+	ID        string       `json:"id"`
+	Message   string       `json:"message"`
+	Author    githubPerson `json:"author"`
+	Committer githubPerson `json:"committer"`
+}
+
+type githubPerson struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+func (c githubCommit) details() commitDetails {
+	return commitDetails{
+		SHA:       c.ID,
+		Message:   c.Message,
+		Author:    commitPerson(c.Author),
+		Committer: commitPerson(c.Committer),
+	}
+}
+
+func handleGithubPush(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request) {
+	eventType := github.WebHookType(r)
+	var event githubEvent
+	payload, decodeErr, err := validateGithubPayload(r, v, &event)
 	if err != nil {
+		if unreadableBody(w, r, err) {
+			return
+		}
 		http.Error(w, "The GitHub signature header is invalid.", 401)
-		log(GitHub, "invalid signature:", err.Error())
+		level.Warn(requestLogger(r)).Log("msg", "invalid signature", "err", err)
 		return
 	}
-
-	hook, err := github.ParseWebHook(github.WebHookType(r), payload)
-	if err != nil {
+	if eventType == "" {
+		decodeErr = fmt.Errorf("missing X-GitHub-Event header")
+	}
+	if decodeErr != nil {
 		http.Error(w, "Cannot parse payload", http.StatusBadRequest)
-		log(GitHub, "could not parse payload:", err.Error())
+		logPayload(r, payload, "msg", "could not parse payload", "err", decodeErr)
+		reportError(r.Context(), "could not parse payload", decodeErr)
 		return
 	}
 
-	switch hook := hook.(type) {
-	case *github.PingEvent:
+	details := &pushDetails{DefaultBranch: event.Repository.DefaultBranch}
+	update := fluxapi_v9.GitUpdate{URL: event.Repository.SSHURL}
+	switch eventType {
+	case "ping":
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Pong"))
-	case *github.PushEvent:
-		update := fluxapi_v9.GitUpdate{
-			URL:    *hook.Repo.SSHURL,
-			Branch: strings.TrimPrefix(*hook.Ref, "refs/heads/"),
+		return
+	case "push":
+		details.Event = eventPush
+		if strings.HasPrefix(event.Ref, "refs/tags/") {
+			details.Event = eventTag
+		}
+		update.Branch = strings.TrimPrefix(event.Ref, "refs/heads/")
+		details.HeadCommit = event.HeadCommit.details()
+	case "release":
+		if event.Action != "published" {
+			ignoreEvent(w, r, eventType+" "+event.Action)
+			return
 		}
-		change := fluxapi_v9.Change{
-			Kind:   fluxapi_v9.GitChange,
-			Source: update,
+		details.Event = eventRelease
+		update.Branch = "refs/tags/" + event.Release.TagName
+	case "workflow_run":
+		if event.Action != "completed" || event.WorkflowRun.Conclusion != "success" {
+			ignoreEvent(w, r, eventType+" "+event.Action)
+			return
 		}
-		ctx := r.Context()
-		ctx, cancel := context.WithTimeout(ctx, timeout)
-		defer cancel()
+		details.Event = eventPipeline
+		update.Branch = event.WorkflowRun.HeadBranch
+		details.HeadCommit = event.WorkflowRun.HeadCommit.details()
+	default:
+		ignoreEvent(w, r, eventType)
+		return
+	}
+	if update.URL == "" {
+		http.Error(w, "Payload has no repository.ssh_url", http.StatusBadRequest)
+		logPayload(r, payload, "msg", "payload has no repository URL")
+		return
+	}
+
+	change := fluxapi_v9.Change{
+		Kind:   fluxapi_v9.GitChange,
+		Source: update,
+	}
+	ctx := withPushDetails(r.Context(), details)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := s.NotifyChange(ctx, change); err != nil {
+		select {
+		case <-ctx.Done():
+			http.Error(w, "Timed out waiting for response from downstream API", http.StatusRequestTimeout)
+			level.Error(requestLogger(r)).Log("msg", "timed out waiting for downstream")
+		default:
+			http.Error(w, "Error while calling downstream API", http.StatusInternalServerError)
+			level.Error(requestLogger(r)).Log("msg", "error from downstream", "err", err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// validateGithubPayload reads the request body, checks its signature,
+// and decodes the JSON payload from it into out. This does the same
+// job as github.ValidatePayload, except that it will use the
+// X-Hub-Signature-256 header if present, only accepts the signature
+// algorithms given in v, and (for JSON bodies) doesn't hold the whole
+// body in memory. It returns the start of the payload, for logging,
+// and the error from decoding it separately, since it's only
+// meaningful if the signature is valid.
+func validateGithubPayload(r *http.Request, v Verification, out interface{}) ([]byte, error, error) {
+	body, err := newSignedBody(r, v, true)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		err := s.NotifyChange(ctx, change)
+	switch ct := r.Header.Get("Content-Type"); ct {
+	case "application/json":
+		decodeErr := decodeJSONObject(body, out)
+		if err := body.verify(r.Context()); err != nil {
+			return nil, nil, err
+		}
+		return body.head, decodeErr, nil
+	case "application/x-www-form-urlencoded":
+		// the JSON payload is in the form parameter "payload", so
+		// the form is read whole
+		data, err := ioutil.ReadAll(body)
 		if err != nil {
-			select {
-			case <-ctx.Done():
-				http.Error(w, "Timed out waiting for response from downstream API", http.StatusRequestTimeout)
-				log(GitHub, "timed out")
-			default:
-				http.Error(w, "Error while calling downstream API", http.StatusInternalServerError)
-				log(GitHub, "error:", err.Error())
-			}
-			return
+			return nil, nil, bodyReadError{err}
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+		if err := body.verify(r.Context()); err != nil {
+			return nil, nil, err
+		}
+		form, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		payload := []byte(form.Get("payload"))
+		return payload, json.Unmarshal(payload, out), nil
 	default:
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("unexpected hook kind, but OK"))
-		log(GitHub, "unexpected webhook payload", fmt.Sprintf("received webhook: %T\n%s", hook, github.Stringify(hook)))
+		if err := body.verify(r.Context()); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("webhook request has unsupported Content-Type %q", ct)
 	}
 }
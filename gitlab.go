@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/go-kit/kit/log/level"
+
 	fluxapi "github.com/fluxcd/flux/pkg/api"
 	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
 )
@@ -14,47 +16,123 @@ const GitLab = "GitLab"
 
 func init() {
 	Sources[GitLab] = handleGitlabPush
+	DefaultBranchSources[GitLab] = true
+	DeliveryIDSources[GitLab] = true
+	CommitMessageSources[GitLab] = true
+	CommitAuthorSources[GitLab] = true
+	SourceEvents[GitLab] = []string{eventPush, eventTag, eventRelease, eventPipeline}
+	DefaultEvents[GitLab] = []string{eventPush}
 }
 
-func handleGitlabPush(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-Gitlab-Token") != string(key) {
+func handleGitlabPush(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request) {
+	if !checkToken(r.Header.Get("X-Gitlab-Token"), v) {
 		http.Error(w, "The Gitlab token does not match", http.StatusUnauthorized)
-		log(GitLab, "missing or incorrect X-Gitlab-Token header (!= shared secret)")
+		level.Warn(requestLogger(r)).Log("msg", "missing or incorrect X-Gitlab-Token header (!= shared secret)")
 		return
 	}
-	if event := r.Header.Get("X-Gitlab-Event"); event != "Push Hook" {
+	eventType := r.Header.Get("X-Gitlab-Event")
+	if eventType == "" {
 		http.Error(w, "Unexpected or missing X-Gitlab-Event", http.StatusBadRequest)
-		log(GitLab, "unknown gitlab event header:", event)
+		level.Warn(requestLogger(r)).Log("msg", "missing gitlab event header")
 		return
 	}
 
+	type gitlabCommit struct {
+		ID      string
+		Message string
+		Author  struct {
+			Name, Email string
+		}
+	}
+	headCommit := func(c gitlabCommit) commitDetails {
+		return commitDetails{
+			SHA:     c.ID,
+			Message: c.Message,
+			Author:  commitPerson{Name: c.Author.Name, Email: c.Author.Email},
+		}
+	}
 	type gitlabPayload struct {
-		Ref     string
+		Ref         string
+		Tag         string
+		CheckoutSHA string `json:"checkout_sha"`
+		Commits     []gitlabCommit
+		// for pipelines
+		Commit  gitlabCommit
 		Project struct {
-			SSHURL string `json:"git_ssh_url"`
+			SSHURL        string `json:"git_ssh_url"`
+			DefaultBranch string `json:"default_branch"`
 		}
+		// for releases
+		Action string
+		// for pipelines
+		ObjectAttributes struct {
+			Ref    string
+			Tag    bool
+			Status string
+		} `json:"object_attributes"`
 	}
 
 	var payload gitlabPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		if bodyTooLarge(w, r, err) {
+			return
+		}
 		http.Error(w, "Unable to parse hook payload", http.StatusBadRequest)
-		log(GitLab, "unable to parse payload:", err.Error())
+		level.Warn(requestLogger(r)).Log("msg", "unable to parse payload", "err", err)
+		reportError(r.Context(), "could not parse payload", err)
 		return
 	}
 
+	details := &pushDetails{DefaultBranch: payload.Project.DefaultBranch}
+	update := fluxapi_v9.GitUpdate{URL: payload.Project.SSHURL}
+	switch eventType {
+	case "Push Hook":
+		details.Event = eventPush
+		update.Branch = strings.TrimPrefix(payload.Ref, "refs/heads/")
+		// the commits are oldest first, and the head is that checked
+		// out
+		details.HeadCommit.SHA = payload.CheckoutSHA
+		for _, c := range payload.Commits {
+			if c.ID == payload.CheckoutSHA {
+				details.HeadCommit = headCommit(c)
+			}
+		}
+	case "Tag Push Hook":
+		details.Event = eventTag
+		update.Branch = payload.Ref
+	case "Release Hook":
+		if payload.Action != "create" {
+			ignoreEvent(w, r, eventType+" "+payload.Action)
+			return
+		}
+		details.Event = eventRelease
+		update.Branch = "refs/tags/" + payload.Tag
+	case "Pipeline Hook":
+		if payload.ObjectAttributes.Status != "success" {
+			ignoreEvent(w, r, eventType+" "+payload.ObjectAttributes.Status)
+			return
+		}
+		details.Event = eventPipeline
+		update.Branch = payload.ObjectAttributes.Ref
+		details.HeadCommit = headCommit(payload.Commit)
+		if payload.ObjectAttributes.Tag {
+			update.Branch = "refs/tags/" + update.Branch
+		}
+	default:
+		ignoreEvent(w, r, eventType)
+		return
+	}
 	change := fluxapi_v9.Change{
-		Kind: fluxapi_v9.GitChange,
-		Source: fluxapi_v9.GitUpdate{
-			URL:    payload.Project.SSHURL,
-			Branch: strings.TrimPrefix(payload.Ref, "refs/heads/"),
-		},
+		Kind:   fluxapi_v9.GitChange,
+		Source: update,
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	ctx := withPushDetails(r.Context(), details)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	if err := s.NotifyChange(ctx, change); err != nil {
 		http.Error(w, "Error forwarding hook", http.StatusInternalServerError)
-		log(GitLab, "error from downstream:", err.Error())
+		level.Error(requestLogger(r)).Log("msg", "error from downstream", "err", err)
 		return
 	}
 
@@ -5,11 +5,20 @@ go 1.13
 require (
 	github.com/fluxcd/flux v1.15.0
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-kit/kit v0.9.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/go-github/v28 v28.1.1
+	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
-	gopkg.in/yaml.v2 v2.2.5 // indirect
+	github.com/xeipuuv/gojsonschema v0.0.0-20180816142147-da425ebb7609
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	gopkg.in/yaml.v2 v2.2.5
 )
 
 replace github.com/docker/distribution => github.com/2opremio/distribution v0.0.0-20190419185413-6c9727e5e5de
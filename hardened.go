@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// These are used with --hardened, for deployments exposed to the
+// internet.
+
+// hardenedHeaders are set on every response. Since nothing served is
+// meant for a browser, they deny everything.
+var hardenedHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":         "no-referrer",
+	"Cache-Control":           "no-store",
+}
+
+// hstsHeader is set as well, when serving HTTPS.
+const hstsHeader = "max-age=31536000"
+
+// minimalErrorWriter replaces the body of error responses with just
+// the status text, so that nothing about why a request was refused
+// is given away.
+type minimalErrorWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	suppress    bool
+}
+
+func (w *minimalErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status < 400 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.suppress = true
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write([]byte(http.StatusText(status) + "\n"))
+}
+
+func (w *minimalErrorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.suppress {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withHardening sets security headers on responses, refuses TRACE
+// and TRACK requests, and gives minimal error responses.
+func withHardening(tls bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range hardenedHeaders {
+			w.Header().Set(k, v)
+		}
+		if tls {
+			w.Header().Set("Strict-Transport-Security", hstsHeader)
+		}
+		w = &minimalErrorWriter{ResponseWriter: w}
+		if r.Method == "TRACE" || r.Method == "TRACK" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hardenServer gives the server conservative timeouts and limits, so
+// that slow or idle clients can't hold connections open.
+func hardenServer(s *http.Server) {
+	s.ReadHeaderTimeout = 10 * time.Second
+	s.ReadTimeout = 30 * time.Second
+	s.WriteTimeout = 30 * time.Second
+	s.IdleTimeout = 60 * time.Second
+	s.MaxHeaderBytes = 64 << 10
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardening(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "The detail of what went wrong", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	send := func(h http.Handler, method, path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(method, path, nil))
+		return res
+	}
+
+	h := withHardening(true, inner)
+	res := send(h, "POST", "/ok")
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "OK", res.Body.String())
+	assert.Equal(t, "nosniff", res.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", res.Header().Get("X-Frame-Options"))
+	assert.NotEmpty(t, res.Header().Get("Strict-Transport-Security"))
+
+	res = send(h, "POST", "/fail")
+	assert.Equal(t, 429, res.Code)
+	assert.Equal(t, "Too Many Requests\n", res.Body.String())
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+
+	for _, method := range []string{"TRACE", "TRACK"} {
+		res = send(h, method, "/ok")
+		assert.Equal(t, 405, res.Code)
+	}
+
+	res = send(withHardening(false, inner), "POST", "/ok")
+	assert.Empty(t, res.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxhttp "github.com/fluxcd/flux/pkg/http"
+	fluxclient "github.com/fluxcd/flux/pkg/http/client"
+)
+
+// Each listener (or the admin listener, with --listen-admin) answers
+// at /healthz for liveness -- if it answers at all, the process is
+// alive -- and at /readyz for readiness, which needs the listener's
+// (or all listeners') endpoints to be loaded, and, with
+// --ready-probe-downstream, fluxd to answer a ping. Once shutting
+// down, it's never ready.
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	// readyProbeTimeout bounds the time spent pinging fluxd
+	readyProbeTimeout = 5 * time.Second
+)
+
+// probeDownstream is whether readiness depends on fluxd answering.
+var probeDownstream bool
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyz constructs the readiness handler for a listener, whose
+// endpoints are routed by hooks (or for all listeners; see
+// hookRouters).
+func readyz(hooks interface{ count() int }, apiBase string) http.Handler {
+	var downstream fluxapi.Server
+	if probeDownstream {
+		downstream = fluxclient.New(downstreamClient, fluxhttp.NewAPIRouter(), apiBase, fluxclient.Token(""))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isShuttingDown() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if hooks.count() == 0 {
+			http.Error(w, "No endpoints are loaded", http.StatusServiceUnavailable)
+			return
+		}
+		if downstream != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), readyProbeTimeout)
+			defer cancel()
+			if err := downstream.Ping(ctx); err != nil {
+				http.Error(w, "Downstream API is not reachable", http.StatusServiceUnavailable)
+				level.Warn(logger).Log("msg", "not ready: could not ping downstream", "err", err)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+}
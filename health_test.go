@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	fluxdUp := true
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fluxdUp {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	defer func() { probeDownstream = false }()
+	probeDownstream = true
+	hooks := newHookRouter()
+	handler := readyz(hooks, downstream.URL)
+
+	status := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", readyzPath, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, status(), "no endpoints loaded")
+	hooks.set("abc", http.NotFoundHandler())
+	assert.Equal(t, http.StatusOK, status())
+	fluxdUp = false
+	assert.Equal(t, http.StatusServiceUnavailable, status(), "fluxd not answering")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Providers that send many deliveries (and meshes between flux-recv
+// and whatever is in front of it) can multiplex them over one
+// connection with HTTP/2. It's negotiated by ALPN on listeners served
+// over TLS; on those serving plain HTTP, it's only used if h2c
+// (HTTP/2 over cleartext) is enabled, since clients have to know to
+// use it.
+
+// configureHTTP2 sets up the server, once its handler, timeouts, and
+// TLS config are set, to serve HTTP/2 as well as HTTP/1.1. This fails
+// if the TLS config doesn't allow a cipher suite HTTP/2 needs.
+func configureHTTP2(server *http.Server, cleartext bool) error {
+	h2 := &http2.Server{IdleTimeout: server.IdleTimeout}
+	if server.TLSConfig != nil {
+		return http2.ConfigureServer(server, h2)
+	}
+	if cleartext {
+		// connections taken over for HTTP/2 are no longer subject to
+		// the server's timeouts, other than that for idling, given
+		// above
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+	}
+	return nil
+}
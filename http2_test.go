@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-http2")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeCert(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "127.0.0.1")
+
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	serve := func(server *http.Server) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() {
+			if server.TLSConfig != nil {
+				server.ServeTLS(l, "", "")
+				return
+			}
+			server.Serve(l)
+		}()
+		return l.Addr().String()
+	}
+	get := func(c *http.Client, url string) string {
+		res, err := c.Get(url)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// over TLS, it's negotiated
+	tlsConfig, _, err := TLSConfigFor(dir, &TLS{CertFile: "tls.crt", KeyFile: "tls.key"})
+	assert.NoError(t, err)
+	server := &http.Server{Handler: proto, TLSConfig: tlsConfig}
+	assert.NoError(t, configureHTTP2(server, false))
+	defer server.Close()
+	addr := serve(server)
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	h2Client := &http.Client{Transport: &http2.Transport{TLSClientConfig: insecure}}
+	assert.Equal(t, "HTTP/2.0", get(h2Client, "https://"+addr))
+	h1Client := &http.Client{Transport: &http.Transport{TLSClientConfig: insecure}}
+	assert.Equal(t, "HTTP/1.1", get(h1Client, "https://"+addr))
+
+	// in cleartext, only with h2c
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	server = &http.Server{Handler: proto}
+	assert.NoError(t, configureHTTP2(server, true))
+	defer server.Close()
+	addr = serve(server)
+	assert.Equal(t, "HTTP/2.0", get(h2cClient, "http://"+addr))
+	assert.Equal(t, "HTTP/1.1", get(http.DefaultClient, "http://"+addr))
+
+	server = &http.Server{Handler: proto}
+	assert.NoError(t, configureHTTP2(server, false))
+	defer server.Close()
+	addr = serve(server)
+	_, err = h2cClient.Get("http://" + addr)
+	assert.Error(t, err)
+
+	// HTTP/2 needs one of the AES-128-GCM cipher suites
+	tlsConfig, _, err = TLSConfigFor(dir, &TLS{CertFile: "tls.crt", KeyFile: "tls.key", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}})
+	assert.NoError(t, err)
+	assert.Error(t, configureHTTP2(&http.Server{Handler: proto, TLSConfig: tlsConfig}, false))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	// minSecretLength is the shortest key or secret that's not
+	// warned about
+	minSecretLength = 16
+	// minSecretEntropyBits is the least total entropy a key or
+	// secret can have without being warned about, as estimated from
+	// the frequency of each byte in it
+	minSecretEntropyBits = 64
+)
+
+// checkSecrets looks for problems with the keys and secrets used in
+// the config: files that anyone can read, and values that are short
+// or easily guessed. It returns a description of each problem found.
+func checkSecrets(configDir string, config Config) []string {
+	var problems []string
+	seen := map[string]bool{}
+	// what says where the file is used, e.g., `endpoint for source "GitHub"`
+	checkFile := func(what, path string) {
+		if path == "" || seen[path] {
+			return
+		}
+		seen[path] = true
+		fullPath := resolvePath(configDir, path)
+		// os.Stat rather than Lstat, since e.g., Kubernetes mounts
+		// secrets as symlinks
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			// this will be reported when the endpoint is constructed
+			return
+		}
+		content, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			return
+		}
+		// encrypted files are meant to be kept where others can see
+		// them, e.g., in git
+		secret, encrypted, err := decryptFile(content)
+		if err != nil {
+			return
+		}
+		if !encrypted && runtime.GOOS != "windows" && info.Mode().Perm()&0004 != 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s is readable by anyone (mode %s)", what, fullPath, info.Mode().Perm()))
+		}
+		problems = append(problems, checkSecretValue(what, fullPath, secret)...)
+	}
+
+	checkFile("apiSigningKeyPath", config.APISigningKeyPath)
+	if config.Admin != nil {
+		checkFile("admin", config.Admin.TokenPath)
+	}
+
+	for _, l := range config.ListenersWithDefault("") {
+		for _, ep := range l.Endpoints {
+			what := fmt.Sprintf("endpoint for source %q", ep.Source)
+			if ep.Key != "" {
+				if key, err := ep.InlineKey(); err == nil {
+					problems = append(problems, checkSecretValue(what, "inline key", key)...)
+				}
+			}
+			checkFile(what, ep.KeyPath)
+			for _, path := range ep.KeyPaths {
+				checkFile(what, path)
+			}
+			for _, path := range ep.SecretPaths {
+				checkFile(what, path)
+			}
+			if ep.BasicAuth != nil {
+				checkFile(what, ep.BasicAuth.PasswordPath)
+			}
+			if ep.QueryToken != nil {
+				checkFile(what, ep.QueryToken.TokenPath)
+			}
+		}
+	}
+	return problems
+}
+
+func checkSecretValue(what, desc string, secret []byte) []string {
+	var problems []string
+	// a trailing line ending is likely an artefact of how the file
+	// was written, so doesn't count
+	s := strings.TrimRight(string(secret), "\r\n")
+	if len(s) < minSecretLength {
+		problems = append(problems, fmt.Sprintf("%s: %s is shorter than %d bytes", what, desc, minSecretLength))
+	} else if bits := entropyBits(s); bits < minSecretEntropyBits {
+		problems = append(problems, fmt.Sprintf("%s: %s looks easy to guess (about %.0f bits of entropy)", what, desc, bits))
+	}
+	return problems
+}
+
+// entropyBits estimates the entropy of s, from the frequency of each
+// byte in it. This overestimates for things like dictionary words, but
+// catches repetition and small alphabets.
+func entropyBits(s string) float64 {
+	counts := map[byte]int{}
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var perByte float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * float64(len(s))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string, mode os.FileMode) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		// in case of umask
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("good", "3f7c8e1a9b2d4c6e8f0a1b3c5d7e9f1a2b4c6d8e\n", 0600)
+	write("readable", "3f7c8e1a9b2d4c6e8f0a1b3c5d7e9f1a2b4c6d8e\n", 0644)
+	write("short", "s3cret\n", 0600)
+	write("repetitive", "abababababababababababab\n", 0600)
+
+	check := func(path string) []string {
+		return checkSecrets(dir, Config{
+			Endpoints: []Endpoint{{Source: GitHub, KeyPath: path}},
+		})
+	}
+
+	assert.Empty(t, check("good"))
+	if runtime.GOOS != "windows" {
+		problems := check("readable")
+		assert.Len(t, problems, 1)
+		assert.Contains(t, problems[0], "readable by anyone")
+	}
+	problems := check("short")
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "shorter than")
+	problems = check("repetitive")
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "easy to guess")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sources retry a delivery when they don't get a response in time,
+// even if it was handled; and with `idempotentResponses` on an
+// endpoint, a retry is answered with the response given to the
+// delivery the first time, rather than notifying fluxd again. Only
+// successful responses are kept, so a delivery that failed is handled
+// afresh when it's retried; and each is kept for a limited time, and
+// only so many are kept. Unlike `rejectReplays`, which refuses retries
+// outright, this lets a source see its redeliveries succeed. (To
+// share the record of deliveries between replicas, use `dedup`.)
+
+const (
+	defaultIdempotencyTTL        = time.Hour
+	defaultIdempotencyMaxEntries = 1000
+	// maxIdempotentResponseBytes is the largest response body kept;
+	// responses larger than this aren't replayed
+	maxIdempotentResponseBytes = 64 << 10
+)
+
+// IdempotentResponses gives how long, and how many, responses to
+// deliveries are kept to be replayed.
+type IdempotentResponses struct {
+	// TTL is how long a response is kept (e.g., "30m"); the default
+	// is 1h
+	TTL string `json:"ttl,omitempty"`
+	// MaxEntries is the most responses kept; once there are this
+	// many, the oldest is dropped. The default is 1000.
+	MaxEntries int `json:"maxEntries,omitempty"`
+}
+
+func (c *IdempotentResponses) validate() error {
+	if c.TTL != "" {
+		if ttl, err := time.ParseDuration(c.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("idempotentResponses: ttl %q is not a positive duration", c.TTL)
+		}
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("idempotentResponses: maxEntries must not be negative")
+	}
+	return nil
+}
+
+var idempotentReplays = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "flux_recv",
+	Name:      "idempotent_responses_replayed_total",
+	Help:      "Retried deliveries answered with the response given the first time, by source.",
+}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(idempotentReplays)
+}
+
+// cachedResponse is a response kept to be replayed; until the request
+// it's for is finished, only its done channel is set.
+type cachedResponse struct {
+	id          string
+	expires     time.Time
+	status      int
+	contentType string
+	body        []byte
+	done        chan struct{} // closed once the response is recorded, or dropped
+}
+
+// responseCache keeps the responses for delivery IDs, evicting the
+// oldest once it's full, and each once it expires.
+type responseCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// newResponseCache constructs a cache from a (validated) config.
+func newResponseCache(config IdempotentResponses) *responseCache {
+	c := &responseCache{
+		ttl:     defaultIdempotencyTTL,
+		size:    defaultIdempotencyMaxEntries,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if config.TTL != "" {
+		c.ttl, _ = time.ParseDuration(config.TTL)
+	}
+	if config.MaxEntries > 0 {
+		c.size = config.MaxEntries
+	}
+	return c
+}
+
+// claim gives the entry for the ID, and whether it's newly made --
+// in which case the caller must record or drop it.
+func (c *responseCache) claim(id string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		cached := e.Value.(*cachedResponse)
+		if cached.expires.IsZero() || now.Before(cached.expires) {
+			return cached, false
+		}
+		c.order.Remove(e)
+		delete(c.entries, id)
+	}
+	cached := &cachedResponse{id: id, done: make(chan struct{})}
+	c.entries[id] = c.order.PushBack(cached)
+	for c.order.Len() > c.size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).id)
+	}
+	return cached, true
+}
+
+// record keeps the response for the entry claimed.
+func (c *responseCache) record(cached *cachedResponse, status int, contentType string, body []byte, now time.Time) {
+	c.mu.Lock()
+	cached.status, cached.contentType, cached.body = status, contentType, body
+	cached.expires = now.Add(c.ttl)
+	c.mu.Unlock()
+	close(cached.done)
+}
+
+// drop forgets the entry claimed, so the next request with the ID is
+// handled.
+func (c *responseCache) drop(cached *cachedResponse) {
+	c.mu.Lock()
+	if e, ok := c.entries[cached.id]; ok && e.Value == cached {
+		c.order.Remove(e)
+		delete(c.entries, cached.id)
+	}
+	c.mu.Unlock()
+	close(cached.done)
+}
+
+// responseRecorder passes a response through, keeping a copy of it.
+type responseRecorder struct {
+	statusRecorder
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentResponseBytes {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.statusRecorder.Write(b)
+}
+
+// withIdempotentResponses answers a delivery whose ID has already had
+// a successful response with that response again. A retry that
+// arrives while the delivery is still being handled waits for it.
+// Requests without a delivery ID are passed through.
+func withIdempotentResponses(source string, cache *responseCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := deliveryID(r)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for {
+			cached, isNew := cache.claim(id, time.Now())
+			if isNew {
+				rec := &responseRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+				next.ServeHTTP(rec, r)
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				if status >= 200 && status <= 299 && !rec.overflow {
+					cache.record(cached, status, w.Header().Get("Content-Type"), rec.body.Bytes(), time.Now())
+				} else {
+					cache.drop(cached)
+				}
+				return
+			}
+			select {
+			case <-cached.done:
+			case <-r.Context().Done():
+				return
+			}
+			if cached.expires.IsZero() {
+				// the first attempt failed, and was dropped; try to
+				// claim it again
+				continue
+			}
+			idempotentReplays.WithLabelValues(source).Inc()
+			level.Info(requestLogger(r)).Log("msg", "answered retried delivery with the response it had before")
+			if cached.contentType != "" {
+				w.Header().Set("Content-Type", cached.contentType)
+			}
+			w.WriteHeader(cached.status)
+			w.Write(cached.body)
+			return
+		}
+	})
+}
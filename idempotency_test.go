@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentResponses(t *testing.T) {
+	var handled int32
+	fail := false
+	handler := withIdempotentResponses(GitHub, newResponseCache(IdempotentResponses{}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&handled, 1)
+		if fail {
+			http.Error(w, "downstream failed", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "handled %d", n)
+	}))
+	deliver := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hook/abc", nil)
+		if id != "" {
+			req.Header.Set("X-GitHub-Delivery", id)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	before := testutil.ToFloat64(idempotentReplays.WithLabelValues(GitHub))
+
+	res := deliver("one")
+	assert.Equal(t, "handled 1", res.Body.String())
+	// a retry gets the same response, without being handled again
+	res = deliver("one")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "text/plain", res.Header().Get("Content-Type"))
+	assert.Equal(t, "handled 1", res.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+	assert.Equal(t, before+1, testutil.ToFloat64(idempotentReplays.WithLabelValues(GitHub)))
+
+	// other deliveries, and those without an ID, are handled
+	assert.Equal(t, "handled 2", deliver("two").Body.String())
+	assert.Equal(t, "handled 3", deliver("").Body.String())
+	assert.Equal(t, "handled 4", deliver("").Body.String())
+
+	// failures aren't kept, so a retry is handled afresh
+	fail = true
+	assert.Equal(t, http.StatusBadGateway, deliver("three").Code)
+	fail = false
+	assert.Equal(t, "handled 6", deliver("three").Body.String())
+}
+
+func TestIdempotentResponsesWaitForFirst(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	var handled int32
+	handler := withIdempotentResponses(GitHub, newResponseCache(IdempotentResponses{}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handled, 1)
+		entered <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	deliver := func(done chan<- string) {
+		req := httptest.NewRequest("POST", "/hook/abc", nil)
+		req.Header.Set("X-GitHub-Delivery", "one")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		done <- res.Body.String()
+	}
+
+	first, retry := make(chan string), make(chan string)
+	go deliver(first)
+	<-entered
+	go deliver(retry)
+	select {
+	case <-retry:
+		t.Fatal("retry was answered before the first delivery finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.Equal(t, "ok", <-first)
+	assert.Equal(t, "ok", <-retry)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+}
+
+func TestResponseCacheLimits(t *testing.T) {
+	c := newResponseCache(IdempotentResponses{TTL: "1m", MaxEntries: 2})
+	now := time.Now()
+	for _, id := range []string{"a", "b", "c"} {
+		cached, isNew := c.claim(id, now)
+		assert.True(t, isNew)
+		c.record(cached, http.StatusOK, "", nil, now)
+	}
+	// "a" was evicted, to make room
+	_, isNew := c.claim("a", now)
+	assert.True(t, isNew)
+	_, isNew = c.claim("c", now)
+	assert.False(t, isNew)
+	// and "c" expires
+	_, isNew = c.claim("c", now.Add(2*time.Minute))
+	assert.True(t, isNew)
+}
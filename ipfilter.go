@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// trustedProxies are the IP ranges of proxies that are trusted to
+// give the address of the client in the forwardedHeader; it's set
+// from the config by main.
+var trustedProxies []*net.IPNet
+
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerForwarded     = "Forwarded"
+)
+
+// forwardedHeader is the header the trusted proxies add the client's
+// address to: X-Forwarded-For (the default) or Forwarded. Only that
+// one is read, since a proxy passes the other on as the client sent
+// it. It's set from the config by main.
+var forwardedHeader = headerXForwardedFor
+
+// clientIP gives the IP address of the client making the request.
+// This is the peer's address, unless the peer is a trusted proxy (or
+// the request came in on a Unix socket, so the peer is a local
+// proxy): then the addresses the proxies have added to the
+// forwardedHeader are taken from the last, for as long as they are
+// trusted proxies too.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	trusted := fromUnixSocket(r) || containsIP(trustedProxies, ip)
+	if !trusted {
+		return ip
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0 && trusted; i-- {
+		hop := parseForwardedAddr(hops[i])
+		if hop == nil {
+			// e.g., "unknown", or an obfuscated identifier; what's
+			// before it can't be followed
+			break
+		}
+		ip, trusted = hop, containsIP(trustedProxies, hop)
+	}
+	return ip
+}
+
+// forwardedFor gives the addresses a request was forwarded for, by
+// each proxy, from the forwardedHeader.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if forwardedHeader == headerForwarded {
+		values := h[headerForwarded]
+		if len(values) == 0 {
+			return nil
+		}
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			var hop string
+			for _, pair := range strings.Split(element, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = kv[1]
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, hop := range strings.Split(strings.Join(h[headerXForwardedFor], ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address as given in `Forwarded` or
+// `X-Forwarded-For`, which may be quoted, and have a port (with IPv6
+// addresses in brackets, if so).
+func parseForwardedAddr(s string) net.IP {
+	s = strings.Trim(s, `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCIDRs refuses requests from IP addresses in any of the deny
+// ranges, or not in any of the allow ranges (if there are any).
+func withCIDRs(source string, allow, deny []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if containsIP(deny, ip) || (len(allow) > 0 && !containsIP(allow, ip)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request from an address denied, or not allowed, by the endpoint's CIDRs", "ip", ip)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// -- IP ranges published by providers
+
+// providerIPRefresh is how often the IP ranges published by providers
+// are fetched again.
+const providerIPRefresh = time.Hour
+
+// providerIPRanges says where to get the IP ranges from which each
+// source's webhooks are sent, and how to get the CIDRs from the
+// response.
+var providerIPRanges = map[string]struct {
+	URL   string
+	parse func([]byte) ([]string, error)
+}{
+	// https://docs.github.com/en/rest/meta
+	GitHub: {
+		URL: "https://api.github.com/meta",
+		parse: func(body []byte) ([]string, error) {
+			var meta struct {
+				Hooks []string `json:"hooks"`
+			}
+			err := json.Unmarshal(body, &meta)
+			return meta.Hooks, err
+		},
+	},
+	// https://support.atlassian.com/organization-administration/docs/ip-addresses-and-domains-for-atlassian-cloud-products/
+	// These cover all of Atlassian's products, in both directions,
+	// and some of them run customers' code; so only the ranges
+	// Bitbucket sends from are used.
+	BitbucketCloud: {
+		URL: "https://ip-ranges.atlassian.com/",
+		parse: func(body []byte) ([]string, error) {
+			var ranges struct {
+				Items []struct {
+					CIDR      string   `json:"cidr"`
+					Product   []string `json:"product"`
+					Direction []string `json:"direction"`
+				} `json:"items"`
+			}
+			err := json.Unmarshal(body, &ranges)
+			var cidrs []string
+			for _, item := range ranges.Items {
+				if containsString(item.Product, "bitbucket") && containsString(item.Direction, "egress") {
+					cidrs = append(cidrs, item.CIDR)
+				}
+			}
+			return cidrs, err
+		},
+	},
+}
+
+// publishedRanges keeps the IP ranges published by a provider,
+// fetching them again when they are out of date.
+type publishedRanges struct {
+	source string
+	url    string
+	parse  func([]byte) ([]string, error)
+
+	mu         sync.Mutex
+	nets       []*net.IPNet
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+func newPublishedRanges(source string) (*publishedRanges, error) {
+	provider, ok := providerIPRanges[source]
+	if !ok {
+		return nil, fmt.Errorf("source %q does not publish the IP addresses it sends webhooks from", source)
+	}
+	p := &publishedRanges{source: source, url: provider.URL, parse: provider.parse}
+	// If this fails, requests are refused until it succeeds; but it's
+	// not a reason to refuse to start.
+	if err := p.refresh(); err != nil {
+		level.Error(sourceLogger(source)).Log("msg", "could not fetch published IP ranges", "err", err)
+	}
+	return p, nil
+}
+
+// providerIPClient fetches the published IP ranges; it has a timeout,
+// since the first fetch holds up starting.
+var providerIPClient = &http.Client{Timeout: 10 * time.Second}
+
+func (p *publishedRanges) refresh() error {
+	resp, err := providerIPClient.Get(p.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", p.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	cidrs, err := p.parse(body)
+	if err != nil {
+		return err
+	}
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.nets, p.fetchedAt = nets, time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// contains reports whether the IP is in the published ranges. If the
+// ranges are out of date, they are fetched again in the background.
+func (p *publishedRanges) contains(ip net.IP) bool {
+	p.mu.Lock()
+	if !p.refreshing && time.Since(p.fetchedAt) > providerIPRefresh {
+		p.refreshing = true
+		go func() {
+			if err := p.refresh(); err != nil {
+				level.Error(sourceLogger(p.source)).Log("msg", "could not refresh published IP ranges", "err", err)
+			}
+			p.mu.Lock()
+			p.refreshing = false
+			p.mu.Unlock()
+		}()
+	}
+	nets := p.nets
+	p.mu.Unlock()
+	return containsIP(nets, ip)
+}
+
+// withProviderIPs only allows requests that come from the IP ranges
+// published by the provider for the source.
+func withProviderIPs(ranges *publishedRanges, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !ranges.contains(ip) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request from an address not in the provider's published IP ranges", "ip", ip)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderIPs(t *testing.T) {
+	hooksCIDR := "127.0.0.0/8"
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"hooks": [%q], "web": ["0.0.0.0/0"]}`, hooksCIDR)
+	}))
+	defer meta.Close()
+
+	provider := providerIPRanges[GitHub]
+	defer func() { providerIPRanges[GitHub] = provider }()
+	testProvider := provider
+	testProvider.URL = meta.URL
+	providerIPRanges[GitHub] = testProvider
+
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	payload := loadFixture(t, "github_payload")
+	send := func(handler http.Handler) int {
+		hookServer := httptest.NewTLSServer(handler)
+		defer hookServer.Close()
+		req, err := http.NewRequest("POST", hookServer.URL, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", hubSignature("sha256", payload, loadFixture(t, "github_key")))
+		res, err := hookServer.Client().Do(req)
+		assert.NoError(t, err)
+		return res.StatusCode
+	}
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key", ProviderIPs: true}
+
+	// the test requests come from 127.0.0.1, so are in the ranges
+	_, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, send(handler))
+	assert.True(t, called)
+
+	// .. and now they are not
+	hooksCIDR = "192.0.2.0/24"
+	called = false
+	_, handler, err = HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, send(handler))
+	assert.False(t, called)
+
+	// DockerHub doesn't publish its IP ranges
+	_, _, err = HandlerFromEndpoint("test/fixtures", downstream.URL, Endpoint{Source: DockerHub, KeyPath: "dockerhub_key", ProviderIPs: true})
+	assert.Error(t, err)
+}
+
+// Test that only the ranges Bitbucket sends from are taken from
+// Atlassian's ranges, which cover all of its products.
+func TestBitbucketCloudRanges(t *testing.T) {
+	cidrs, err := providerIPRanges[BitbucketCloud].parse([]byte(`{"items": [
+  {"cidr": "192.0.2.0/24", "product": ["bitbucket"], "direction": ["egress", "ingress"]},
+  {"cidr": "198.51.100.0/24", "product": ["bitbucket"], "direction": ["ingress"]},
+  {"cidr": "203.0.113.0/24", "product": ["jira", "confluence"], "direction": ["egress"]},
+  {"cidr": "2001:db8::/32"}
+]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/24"}, cidrs)
+}
+
+func TestCIDRs(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mustParse := func(cidrs ...string) []*net.IPNet {
+		nets, err := parseCIDRs(cidrs)
+		assert.NoError(t, err)
+		return nets
+	}
+
+	for _, tt := range []struct {
+		desc        string
+		allow, deny []*net.IPNet
+		remote      string
+		status      int
+	}{
+		{desc: "allowed", allow: mustParse("10.0.0.0/8"), remote: "10.1.2.3:4567", status: 200},
+		{desc: "not allowed", allow: mustParse("10.0.0.0/8"), remote: "192.0.2.1:4567", status: 403},
+		{desc: "denied", deny: mustParse("192.0.2.0/24"), remote: "192.0.2.1:4567", status: 403},
+		{desc: "not denied", deny: mustParse("192.0.2.0/24"), remote: "198.51.100.1:4567", status: 200},
+		{desc: "allowed but denied", allow: mustParse("10.0.0.0/8"), deny: mustParse("10.1.0.0/16"), remote: "10.1.2.3:4567", status: 403},
+		{desc: "IPv6", allow: mustParse("2001:db8::/32"), remote: "[2001:db8::1]:4567", status: 200},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook/abc", nil)
+			req.RemoteAddr = tt.remote
+			res := httptest.NewRecorder()
+			withCIDRs(GitHub, tt.allow, tt.deny, ok).ServeHTTP(res, req)
+			assert.Equal(t, tt.status, res.Code)
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	var err error
+	trustedProxies, err = parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	assert.NoError(t, err)
+	defer func() { trustedProxies = nil }()
+
+	for _, tt := range []struct {
+		desc    string
+		header  string // the forwardedHeader, if not the default
+		remote  string
+		headers map[string]string
+		ip      string
+	}{
+		{desc: "direct", remote: "192.0.2.1:4567", ip: "192.0.2.1"},
+		{desc: "untrusted peer", remote: "192.0.2.1:4567", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, ip: "192.0.2.1"},
+		{desc: "trusted proxy", remote: "10.0.0.1:4567", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, ip: "198.51.100.1"},
+		{desc: "spoofed by client", remote: "10.0.0.1:4567", headers: map[string]string{"X-Forwarded-For": "10.9.9.9, 198.51.100.1"}, ip: "198.51.100.1"},
+		{desc: "chain of proxies", remote: "10.0.0.1:4567", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, ip: "198.51.100.1"},
+		{desc: "trusted, without header", remote: "10.0.0.1:4567", ip: "10.0.0.1"},
+		// a client's own Forwarded is passed on by a proxy that only
+		// adds to X-Forwarded-For, so it's not believed
+		{desc: "Forwarded, from the client", remote: "10.0.0.1:4567", headers: map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "198.51.100.1"}, ip: "198.51.100.1"},
+		{desc: "Forwarded", header: "Forwarded", remote: "10.0.0.1:4567", headers: map[string]string{"Forwarded": `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`}, ip: "192.0.2.60"},
+		{desc: "X-Forwarded-For, from the client", header: "Forwarded", remote: "10.0.0.1:4567", headers: map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "198.51.100.1"}, ip: "192.0.2.60"},
+		{desc: "Forwarded unknown", header: "Forwarded", remote: "10.0.0.1:4567", headers: map[string]string{"Forwarded": "for=192.0.2.60, for=unknown"}, ip: "10.0.0.1"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.header != "" {
+				forwardedHeader = tt.header
+				defer func() { forwardedHeader = headerXForwardedFor }()
+			}
+			req := httptest.NewRequest("POST", "/hook/abc", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.ip, clientIP(req).String())
+		})
+	}
+}
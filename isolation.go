@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// By default, endpoints share what's used to handle deliveries: the
+// global quota, and the downstream workers (with `downstream.workers`),
+// so a source that floods flux-recv (e.g., a registry sending a hook
+// for every layer) could take all of them, and deliveries for other
+// endpoints would be refused or wait. With `isolation` on an endpoint,
+// it gets its own: a limit on the requests to it handled at once, and
+// workers and a queue of its own for its notifications, so that it
+// can only use up what it's given.
+
+// Isolation gives an endpoint resources of its own.
+type Isolation struct {
+	// MaxConcurrent is the most requests to the endpoint handled at
+	// once; zero means no limit
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// Workers, if given, is how many of the endpoint's notifications
+	// are sent at once, by workers of its own rather than those of
+	// `downstream.workers`
+	Workers int `json:"workers,omitempty"`
+	// QueueSize is how many of the endpoint's notifications can wait
+	// for one of its workers; if zero, defaultDownstreamQueueSize
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+func (iso *Isolation) validate() error {
+	if iso.MaxConcurrent < 0 || iso.Workers < 0 || iso.QueueSize < 0 {
+		return fmt.Errorf("isolation: maxConcurrent, workers, and queueSize must not be negative")
+	}
+	if iso.QueueSize > 0 && iso.Workers == 0 {
+		return fmt.Errorf("isolation: queueSize needs workers")
+	}
+	if iso.MaxConcurrent == 0 && iso.Workers == 0 {
+		return fmt.Errorf("isolation needs maxConcurrent or workers")
+	}
+	return nil
+}
+
+var (
+	endpointQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "endpoint_queue_length",
+		Help:      "Notifications queued for one of an isolated endpoint's workers.",
+	}, []string{"source", "endpoint"})
+	endpointQueueFull = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "endpoint_queue_full_total",
+		Help:      "Notifications that failed because an isolated endpoint's queue was full.",
+	}, []string{"source", "endpoint"})
+)
+
+func init() {
+	prometheus.MustRegister(endpointQueueLength, endpointQueueFull)
+}
+
+// newEndpointPool starts the workers for an endpoint's notifications,
+// if it's given any; otherwise it gives the shared pool (which may be
+// nil). The endpoint is labelled in the metrics by the digest of its
+// first key.
+func newEndpointPool(source, digest string, iso *Isolation) *notifyPool {
+	if iso == nil || iso.Workers == 0 {
+		return downstreamPool
+	}
+	queueSize := iso.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultDownstreamQueueSize
+	}
+	endpoint := endpointLabel(digest)
+	return startNotifyPool(iso.Workers, queueSize,
+		endpointQueueLength.WithLabelValues(source, endpoint),
+		endpointQueueFull.WithLabelValues(source, endpoint))
+}
+
+// withEndpointConcurrency refuses requests to the endpoint while as
+// many as it has slots are being handled, with 429 Too Many Requests.
+// The slots are shared by all the routes to the endpoint.
+func withEndpointConcurrency(source string, slots chan struct{}, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			tooManyRequests(w, concurrencyRetryAfter)
+			level.Warn(requestLogger(r)).Log("msg", "refused request, with too many in flight for the endpoint")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+func TestEndpointPool(t *testing.T) {
+	assert.Nil(t, newEndpointPool(DockerHub, "abcdef", nil))
+	assert.Nil(t, newEndpointPool(DockerHub, "abcdef", &Isolation{MaxConcurrent: 5}))
+
+	flooded := &blockingServer{release: make(chan struct{})}
+	other := &blockingServer{release: make(chan struct{})}
+	close(other.release)
+	pool := newEndpointPool(DockerHub, "isolated-endpoint", &Isolation{Workers: 1, QueueSize: 1})
+	shared := newNotifyPool(1, 1)
+	change := fluxapi_v9.Change{Kind: fluxapi_v9.GitChange, Source: fluxapi_v9.GitUpdate{URL: "git@github.com:example/config.git"}}
+
+	before := testutil.ToFloat64(endpointQueueFull.WithLabelValues(DockerHub, "isolated-end"))
+
+	// one is sent, and one waits in the endpoint's queue ..
+	go pool.notify(context.Background(), flooded, change)
+	for atomic.LoadInt32(&flooded.inFlight) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go pool.notify(context.Background(), flooded, change)
+	for len(pool.jobs) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// .. so the endpoint's next notification is refused, and counted
+	// against it
+	assert.Equal(t, errNotifyQueueFull, pool.notify(context.Background(), flooded, change))
+	assert.Equal(t, before+1, testutil.ToFloat64(endpointQueueFull.WithLabelValues(DockerHub, "isolated-end")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(endpointQueueLength.WithLabelValues(DockerHub, "isolated-end")))
+	// but other endpoints' notifications still go
+	assert.NoError(t, shared.notify(context.Background(), other, change))
+	close(flooded.release)
+}
+
+func TestEndpointConcurrency(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := withEndpointConcurrency(DockerHub, slots, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+		done <- res.Code
+	}()
+	<-entered
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// defaultMaxJSONDepth is how deeply JSON payloads may nest, if
+	// the endpoint doesn't say; webhook payloads are rarely more
+	// than ten deep
+	defaultMaxJSONDepth = 64
+	// defaultMaxJSONArrayLength is how many elements an array in a
+	// JSON payload may have, if the endpoint doesn't say
+	defaultMaxJSONArrayLength = 10000
+)
+
+// checkJSONStructure scans the JSON in data without unmarshalling
+// it, and returns an error if it nests more deeply than maxDepth or
+// has an array longer than maxArrayLength.
+func checkJSONStructure(data []byte, maxDepth, maxArrayLength int) error {
+	return checkJSONStructureFrom(bytes.NewReader(data), maxDepth, maxArrayLength)
+}
+
+// checkJSONStructureFrom is checkJSONStructure for JSON read from r.
+func checkJSONStructureFrom(r io.Reader, maxDepth, maxArrayLength int) error {
+	dec := json.NewDecoder(r)
+	// the number of elements so far in each array being scanned; -1
+	// for objects
+	var counts []int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if len(counts) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n := len(counts); n > 0 && counts[n-1] >= 0 {
+			if d, ok := tok.(json.Delim); !ok || (d != ']' && d != '}') {
+				counts[n-1]++
+				if counts[n-1] > maxArrayLength {
+					return fmt.Errorf("array is longer than %d elements", maxArrayLength)
+				}
+			}
+		}
+		switch tok {
+		case json.Delim('['):
+			counts = append(counts, 0)
+		case json.Delim('{'):
+			counts = append(counts, -1)
+		case json.Delim(']'), json.Delim('}'):
+			counts = counts[:len(counts)-1]
+		}
+		if len(counts) > maxDepth {
+			return fmt.Errorf("nested more than %d deep", maxDepth)
+		}
+	}
+}
+
+// isJSONContentType reports whether the media type is JSON (e.g.,
+// `application/json`, or `application/vnd.foo+json`).
+func isJSONContentType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// errPayloadStructure is returned, wrapped, from reading a body that
+// checkedJSONBody finds is not acceptable JSON.
+var errPayloadStructure = errors.New("payload is not acceptable JSON")
+
+// checkedJSONBody checks the structure of the JSON in the body as
+// it's read, in another goroutine, rather than reading it all first.
+// Once the body has been read to the end, reading it gives an error
+// wrapping errPayloadStructure if the check failed -- or earlier, if
+// it failed earlier.
+type checkedJSONBody struct {
+	io.ReadCloser
+	pw     *io.PipeWriter
+	result chan error
+	err    error
+}
+
+func newCheckedJSONBody(body io.ReadCloser, maxDepth, maxArrayLength int) *checkedJSONBody {
+	pr, pw := io.Pipe()
+	b := &checkedJSONBody{ReadCloser: body, pw: pw, result: make(chan error, 1)}
+	go func() {
+		err := checkJSONStructureFrom(pr, maxDepth, maxArrayLength)
+		if err != nil {
+			err = fmt.Errorf("%w: %s", errPayloadStructure, err.Error())
+		}
+		// stop the writes, if it gave up early
+		pr.CloseWithError(err)
+		b.result <- err
+	}()
+	return b
+}
+
+func (b *checkedJSONBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := b.pw.Write(p[:n]); werr != nil {
+			b.err = <-b.result
+			return n, b.err
+		}
+	}
+	if err == io.EOF {
+		b.pw.Close()
+		if b.err = <-b.result; b.err == nil {
+			b.err = io.EOF
+		}
+		return n, b.err
+	}
+	if err != nil {
+		// e.g., the body is too large; stop the check
+		b.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+// payloadNotAcceptable checks whether the error (from reading the
+// request body) is because checkedJSONBody refused it, and if so,
+// responds accordingly.
+func payloadNotAcceptable(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errPayloadStructure) {
+		return false
+	}
+	http.Error(w, "Payload is not acceptable JSON", http.StatusBadRequest)
+	level.Warn(requestLogger(r)).Log("msg", "rejected payload", "err", err)
+	return true
+}
+
+// withJSONLimits reads the request body and checks the structure of
+// the JSON in it before it's given to the source handler, so that a
+// pathological payload is refused before it's parsed in full. If
+// bodySpool is set, a large body is kept on disk while that's done
+// (see spool.go). Form encoded bodies (as GitHub can send) are checked
+// in the `payload` field. If the limits say so, any other content type
+// is refused.
+//
+// The handlers for signed sources read the body as it's streamed (see
+// stream.go), and don't act on it until they've read it all; so for
+// those, JSON bodies are checked as they're read instead.
+func withJSONLimits(source string, limits JSONLimits, next http.Handler) http.Handler {
+	maxDepth, maxArrayLength := limits.MaxDepth, limits.MaxArrayLength
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxJSONDepth
+	}
+	if maxArrayLength <= 0 {
+		maxArrayLength = defaultMaxJSONArrayLength
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		isForm := mediaType == "application/x-www-form-urlencoded"
+		if limits.RequireContentType && !isForm && !isJSONContentType(mediaType) {
+			http.Error(w, "Expected a JSON payload", http.StatusUnsupportedMediaType)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request with content type other than JSON", "content_type", mediaType)
+			return
+		}
+
+		if SignedSources[source] && !isForm {
+			body := newCheckedJSONBody(r.Body, maxDepth, maxArrayLength)
+			r.Body = body
+			next.ServeHTTP(w, r)
+			// end the check, if the body wasn't read to the end
+			body.pw.Close()
+			return
+		}
+
+		unreadable := func(err error) {
+			if bodyTooLarge(w, r, err) {
+				return
+			}
+			http.Error(w, "Unable to read payload", http.StatusBadRequest)
+			level.Warn(requestLogger(r)).Log("msg", "unable to read payload", "err", err)
+		}
+
+		// a form has to be parsed in memory anyway
+		if bodySpool != nil && !isForm {
+			body, err := bodySpool.spool(source, r.Body)
+			if errors.Is(err, errSpool) {
+				http.Error(w, "Unable to handle payload", http.StatusInternalServerError)
+				level.Error(requestLogger(r)).Log("msg", "could not spool payload to disk", "err", err)
+				return
+			}
+			if err != nil {
+				unreadable(err)
+				return
+			}
+			defer body.Close()
+			if err := checkJSONStructureFrom(body, maxDepth, maxArrayLength); err != nil {
+				http.Error(w, "Payload is not acceptable JSON", http.StatusBadRequest)
+				level.Warn(requestLogger(r)).Log("msg", "rejected payload", "err", err)
+				return
+			}
+			if err := body.rewind(); err != nil {
+				unreadable(err)
+				return
+			}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			unreadable(err)
+			return
+		}
+		payload := body
+		if isForm {
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				http.Error(w, "Unable to parse form", http.StatusBadRequest)
+				level.Warn(requestLogger(r)).Log("msg", "unable to parse form", "err", err)
+				return
+			}
+			payload = []byte(form.Get("payload"))
+		}
+		if err := checkJSONStructure(payload, maxDepth, maxArrayLength); err != nil {
+			http.Error(w, "Payload is not acceptable JSON", http.StatusBadRequest)
+			level.Warn(requestLogger(r)).Log("msg", "rejected payload", "err", err)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
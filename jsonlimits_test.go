@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckJSONStructure(t *testing.T) {
+	for _, ok := range []string{
+		``,
+		`{"a": [1, 2, 3], "b": {"c": [1, 2]}}`,
+		`[[[]]]`,
+		`[1, 2, 3, 4]`,
+		`[{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}]`,
+	} {
+		assert.NoError(t, checkJSONStructure([]byte(ok), 3, 4), ok)
+	}
+	for _, bad := range []string{
+		`[[[[]]]]`,
+		`{"a": {"b": {"c": {}}}}`,
+		`[1, 2, 3, 4, 5]`,
+		`{"a": [[1], [1, 2, 3, 4, 5]]}`,
+		`{"a":`,
+	} {
+		assert.Error(t, checkJSONStructure([]byte(bad), 3, 4), bad)
+	}
+}
+
+func TestJSONLimits(t *testing.T) {
+	var got string
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		got = string(body)
+	})
+	send := func(h http.Handler, contentType, body string) int {
+		req := httptest.NewRequest("POST", "/hook/abc", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	h := withJSONLimits(DockerHub, JSONLimits{MaxDepth: 2}, ok)
+	assert.Equal(t, 200, send(h, "application/json", `{"a": [1]}`))
+	// the handler still gets the whole body
+	assert.Equal(t, `{"a": [1]}`, got)
+	assert.Equal(t, 400, send(h, "application/json", `{"a": [[1]]}`))
+	assert.Equal(t, 200, send(h, "", `{"a": 1}`))
+
+	form := url.Values{"payload": {`[[[1]]]`}}.Encode()
+	assert.Equal(t, 400, send(h, "application/x-www-form-urlencoded", form))
+
+	// for signed sources, JSON is checked as the handler reads it
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if payloadNotAcceptable(w, r, err) {
+			return
+		}
+		assert.NoError(t, err)
+		got = string(body)
+	})
+	h = withJSONLimits(GitHub, JSONLimits{MaxDepth: 2}, streaming)
+	assert.Equal(t, 200, send(h, "application/json", `{"b": [2]}`))
+	assert.Equal(t, `{"b": [2]}`, got)
+	assert.Equal(t, 400, send(h, "application/json", `{"a": [[1]]}`))
+	assert.Equal(t, 400, send(h, "application/json", `{"a": [1]`))
+	assert.Equal(t, 400, send(h, "application/x-www-form-urlencoded", form))
+
+	h = withJSONLimits(GitHub, JSONLimits{RequireContentType: true}, ok)
+	assert.Equal(t, 200, send(h, "application/json; charset=utf-8", `{}`))
+	assert.Equal(t, 200, send(h, "application/vnd.docker.distribution.events.v1+json", `{}`))
+	assert.Equal(t, 415, send(h, "text/plain", `{}`))
+	assert.Equal(t, 415, send(h, "", `{}`))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The Generic source is given JSONPath expressions for where to find
+// e.g., the repo URL in a payload. Only the part of JSONPath that
+// picks out a single value is supported: the root `$`, followed by
+// any of `.name`, `['name']` (or `["name"]`), and `[index]`, with a
+// negative index counting from the end of an array. There are no
+// wildcards, slices, unions, filters or recursive descent, since those
+// give more than one value; an expression using them is refused when
+// the config is loaded, with an error naming what isn't supported.
+
+// jsonPath is a parsed JSONPath expression; each step is a member of
+// an object or an element of an array.
+type jsonPath struct {
+	expr  string
+	steps []jsonPathStep
+}
+
+type jsonPathStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// unsupportedJSONPathSubscript names the unsupported kind of
+// subscript the inside of `[...]` is, or gives "" if it isn't one.
+func unsupportedJSONPathSubscript(inner string) string {
+	inner = strings.TrimSpace(inner)
+	switch {
+	case inner == "*":
+		return "wildcards (*)"
+	case strings.HasPrefix(inner, "?"):
+		return "filters ([?(...)])"
+	case strings.HasPrefix(inner, "("):
+		return "script expressions ([(...)])"
+	}
+	if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+		// a quote inside is where one name ends and another starts
+		if strings.ContainsRune(inner[1:len(inner)-1], rune(inner[0])) {
+			return "unions ([a,b])"
+		}
+		return ""
+	}
+	switch {
+	case strings.Contains(inner, ","):
+		return "unions ([a,b])"
+	case strings.Contains(inner, ":"):
+		return "slices ([start:end])"
+	}
+	return ""
+}
+
+func isJSONPathNameChar(c byte) bool {
+	return c == '_' || c == '-' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// parseJSONPath parses the expression, or returns an error saying
+// what's wrong with it.
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath %q does not start with $", expr)
+	}
+	p := &jsonPath{expr: expr}
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			if strings.HasPrefix(rest, "..") {
+				return nil, fmt.Errorf("JSONPath %q: recursive descent (..) is not supported", expr)
+			}
+			if strings.HasPrefix(rest, ".*") {
+				return nil, fmt.Errorf("JSONPath %q: wildcards (*) are not supported", expr)
+			}
+			i := 1
+			for i < len(rest) && isJSONPathNameChar(rest[i]) {
+				i++
+			}
+			if i == 1 {
+				return nil, fmt.Errorf("JSONPath %q: expected a name after '.'", expr)
+			}
+			p.steps = append(p.steps, jsonPathStep{name: rest[1:i]})
+			rest = rest[i:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: unclosed '['", expr)
+			}
+			inner := rest[1:end]
+			if unsupported := unsupportedJSONPathSubscript(inner); unsupported != "" {
+				return nil, fmt.Errorf("JSONPath %q: %s are not supported", expr, unsupported)
+			}
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.steps = append(p.steps, jsonPathStep{name: inner[1 : len(inner)-1]})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("JSONPath %q: %q is neither a quoted name nor an index", expr, inner)
+				}
+				p.steps = append(p.steps, jsonPathStep{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", expr, rest[0])
+		}
+	}
+	return p, nil
+}
+
+// eval finds the value at the path in the document given (as decoded
+// with json.Decoder.UseNumber), and gives it as a string. It's an
+// error if the value is an object or array; a value that's missing
+// (or null) gives ok as false.
+func (p *jsonPath) eval(doc interface{}) (value string, ok bool, err error) {
+	for _, step := range p.steps {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			if step.isIndex {
+				return "", false, nil
+			}
+			doc = v[step.name]
+		case []interface{}:
+			if !step.isIndex {
+				return "", false, nil
+			}
+			i := step.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return "", false, nil
+			}
+			doc = v[i]
+		default:
+			return "", false, nil
+		}
+	}
+	switch v := doc.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case json.Number:
+		return v.String(), true, nil
+	case bool:
+		return strconv.FormatBool(v), true, nil
+	default:
+		return "", false, fmt.Errorf("%s is not a string, number or boolean", p.expr)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPath(t *testing.T) {
+	const payload = `{
+  "repo": {"clone-url": "git@example.com:config.git", "private": true},
+  "refs": [{"name": "refs/heads/main"}, {"name": "refs/heads/dev"}],
+  "build": {"number": 42, "image": null}
+}`
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.UseNumber()
+	var doc interface{}
+	assert.NoError(t, dec.Decode(&doc))
+
+	for _, tt := range []struct {
+		expr  string
+		value string
+		ok    bool
+	}{
+		{expr: "$.repo.clone-url", value: "git@example.com:config.git", ok: true},
+		{expr: "$['repo'][\"clone-url\"]", value: "git@example.com:config.git", ok: true},
+		{expr: "$.refs[0].name", value: "refs/heads/main", ok: true},
+		{expr: "$.refs[-1].name", value: "refs/heads/dev", ok: true},
+		{expr: "$.build.number", value: "42", ok: true},
+		{expr: "$.repo.private", value: "true", ok: true},
+		{expr: "$.build.image"},
+		{expr: "$.refs[2].name"},
+		{expr: "$.repo[0]"},
+		{expr: "$.nothing.here"},
+	} {
+		p, err := parseJSONPath(tt.expr)
+		assert.NoError(t, err, tt.expr)
+		value, ok, err := p.eval(doc)
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.ok, ok, tt.expr)
+		assert.Equal(t, tt.value, value, tt.expr)
+	}
+
+	// a value that isn't a scalar is an error
+	p, err := parseJSONPath("$.repo")
+	assert.NoError(t, err)
+	_, _, err = p.eval(doc)
+	assert.Error(t, err)
+
+	for _, bad := range []string{"repo.name", "$.", "$[0", "$[name]", "$..name", "$.refs[*]"} {
+		_, err := parseJSONPath(bad)
+		assert.Error(t, err, bad)
+	}
+
+	// what isn't supported is named
+	for expr, unsupported := range map[string]string{
+		"$..name":               "recursive descent",
+		"$.repo.*":              "wildcards",
+		"$.refs[*].name":        "wildcards",
+		"$.refs[0:1]":           "slices",
+		"$.refs[-1:]":           "slices",
+		"$.refs[0,1]":           "unions",
+		"$['repo','refs']":      "unions",
+		"$.refs[?(@.name)]":     "filters",
+		"$.refs[(@.length-1)]":  "script expressions",
+		"$['a,b']":              "",
+		"$.refs[?(@.x[0] > 1)]": "filters",
+	} {
+		_, err := parseJSONPath(expr)
+		if unsupported == "" {
+			assert.NoError(t, err, expr)
+			continue
+		}
+		if assert.Error(t, err, expr) {
+			assert.Contains(t, err.Error(), unsupported+" ", expr)
+			assert.Contains(t, err.Error(), "not supported", expr)
+		}
+	}
+}
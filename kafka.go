@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Kafka producer, just enough of one to send audit events: it asks
+// a broker for the topic's partitions (Metadata v1), then sends each
+// message to the leader of a partition (Produce v3, with a v2 record
+// batch), waiting for all in-sync replicas to have it. There's no
+// batching, compression, or SASL; the audit events are few, and small.
+// The protocol is described at https://kafka.apache.org/protocol.
+
+const (
+	defaultKafkaPort = "9092"
+	kafkaClientID    = "flux-recv"
+	kafkaTimeout     = 10 * time.Second
+	// maxKafkaResponseBytes bounds the responses read from brokers
+	maxKafkaResponseBytes = 1 << 20
+
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+	// kafkaAcksAll means the leader waits for the in-sync replicas
+	kafkaAcksAll = -1
+)
+
+var kafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	29: "topic authorization failed",
+}
+
+func kafkaError(code int16) error {
+	if msg, ok := kafkaErrors[code]; ok {
+		return fmt.Errorf("Kafka error %d (%s)", code, msg)
+	}
+	return fmt.Errorf("Kafka error %d", code)
+}
+
+// parseKafkaURL parses a URL of the form
+// kafka://host[:port][,host[:port]...]/topic, or kafka+tls:// for
+// connecting to the brokers with TLS. Since the producer can't
+// authenticate with SASL, a URL with credentials (or options, which
+// might ask for SASL) is refused, rather than failing at each send.
+func parseKafkaURL(rawurl string) (brokers []string, topic string, useTLS bool, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", false, err
+	}
+	switch u.Scheme {
+	case "kafka":
+	case "kafka+tls":
+		useTLS = true
+	default:
+		return nil, "", false, fmt.Errorf("the scheme %q is not kafka or kafka+tls", u.Scheme)
+	}
+	if u.User != nil {
+		return nil, "", false, errors.New("the Kafka URL has credentials, but SASL authentication is not supported")
+	}
+	if u.RawQuery != "" {
+		return nil, "", false, fmt.Errorf("the Kafka URL has options (%q), but none are supported", u.RawQuery)
+	}
+	topic = strings.TrimPrefix(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, "", false, errors.New("the Kafka URL needs a topic, e.g., kafka://kafka:9092/flux-recv-audit")
+	}
+	for _, b := range strings.Split(u.Host, ",") {
+		if b == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, defaultKafkaPort)
+		}
+		brokers = append(brokers, b)
+	}
+	if len(brokers) == 0 {
+		return nil, "", false, errors.New("the Kafka URL has no brokers")
+	}
+	return brokers, topic, useTLS, nil
+}
+
+type kafkaHeader struct {
+	key, value string
+}
+
+type kafkaProducer struct {
+	brokers []string
+	topic   string
+	tls     *tls.Config
+
+	mu            sync.Mutex
+	correlationID int32
+	// partitions gives the address of the leader of each partition,
+	// as last seen in the metadata
+	partitions []string
+	conns      map[string]net.Conn
+}
+
+// newKafkaProducer constructs a producer for the Kafka URL given.
+func newKafkaProducer(rawurl string) (*kafkaProducer, error) {
+	brokers, topic, useTLS, err := parseKafkaURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p := &kafkaProducer{brokers: brokers, topic: topic, conns: map[string]net.Conn{}}
+	if useTLS {
+		p.tls = &tls.Config{}
+	}
+	return p, nil
+}
+
+// produce sends a message to the topic, at the partition given by
+// the key. If it fails, it's tried once more with fresh metadata,
+// since that's what's needed if the leader has moved.
+func (p *kafkaProducer) produce(key, value []byte, headers []kafkaHeader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.tryProduce(key, value, headers)
+	if err != nil {
+		p.reset()
+		err = p.tryProduce(key, value, headers)
+	}
+	if err != nil {
+		p.reset()
+	}
+	return err
+}
+
+// reset forgets the metadata, and closes the connections.
+func (p *kafkaProducer) reset() {
+	p.partitions = nil
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+func (p *kafkaProducer) tryProduce(key, value []byte, headers []kafkaHeader) error {
+	if p.partitions == nil {
+		if err := p.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := int32(crc32.ChecksumIEEE(key) % uint32(len(p.partitions)))
+	leader := p.partitions[partition]
+	if leader == "" {
+		return kafkaError(5)
+	}
+
+	var req kafkaEncoder
+	req.nullableString(nil) // transactional ID
+	req.int16(kafkaAcksAll)
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(p.topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(kafkaRecordBatch(key, value, headers, time.Now()))
+
+	res, err := p.roundTrip(leader, kafkaAPIProduce, 3, req.Bytes())
+	if err != nil {
+		return err
+	}
+	for topics := res.int32(); topics > 0; topics-- {
+		res.string()
+		for parts := res.int32(); parts > 0; parts-- {
+			res.int32()
+			code := res.int16()
+			res.int64() // base offset
+			res.int64() // log append time
+			if res.err == nil && code != 0 {
+				return kafkaError(code)
+			}
+		}
+	}
+	return res.err
+}
+
+// refreshMetadata asks the brokers, in turn, for the partitions of
+// the topic.
+func (p *kafkaProducer) refreshMetadata() error {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(p.topic)
+
+	var err error
+	for _, broker := range p.brokers {
+		var res *kafkaDecoder
+		if res, err = p.roundTrip(broker, kafkaAPIMetadata, 1, req.Bytes()); err != nil {
+			continue
+		}
+		if err = p.parseMetadata(res); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *kafkaProducer) parseMetadata(res *kafkaDecoder) error {
+	addrs := map[int32]string{}
+	for brokers := res.int32(); brokers > 0 && res.err == nil; brokers-- {
+		id := res.int32()
+		host := res.string()
+		port := res.int32()
+		res.nullableString() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	res.int32() // controller
+	var partitions []string
+	for topics := res.int32(); topics > 0 && res.err == nil; topics-- {
+		code := res.int16()
+		name := res.string()
+		res.int8() // internal
+		parts := res.int32()
+		if parts < 0 || parts > maxKafkaResponseBytes/4 {
+			return fmt.Errorf("metadata has %d partitions", parts)
+		}
+		leaders := make([]string, parts)
+		for i := int32(0); i < parts && res.err == nil; i++ {
+			res.int16()
+			index := res.int32()
+			leader := res.int32()
+			res.int32Array() // replicas
+			res.int32Array() // in-sync replicas
+			if index >= 0 && index < parts {
+				leaders[index] = addrs[leader]
+			}
+		}
+		if name != p.topic {
+			continue
+		}
+		if code != 0 {
+			return kafkaError(code)
+		}
+		partitions = leaders
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if len(partitions) == 0 {
+		return kafkaError(3)
+	}
+	p.partitions = partitions
+	return nil
+}
+
+// roundTrip sends a request to the broker at addr, and reads the
+// response to it.
+func (p *kafkaProducer) roundTrip(addr string, api, version int16, body []byte) (*kafkaDecoder, error) {
+	conn, ok := p.conns[addr]
+	if !ok {
+		dialer := &net.Dialer{Timeout: kafkaTimeout}
+		var err error
+		if p.tls != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, p.tls)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.conns[addr] = conn
+	}
+	// the broker is given longer than the produce timeout, so it can
+	// say that it timed out
+	conn.SetDeadline(time.Now().Add(2 * kafkaTimeout))
+
+	p.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // the size, filled in below
+	req.int16(api)
+	req.int16(version)
+	req.int32(p.correlationID)
+	req.string(kafkaClientID)
+	req.Write(body)
+	frame := req.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	res, err := p.exchange(conn, frame)
+	if err != nil {
+		conn.Close()
+		delete(p.conns, addr)
+		return nil, fmt.Errorf("Kafka broker %s: %s", addr, err.Error())
+	}
+	return res, nil
+}
+
+func (p *kafkaProducer) exchange(conn net.Conn, frame []byte) (*kafkaDecoder, error) {
+	if _, err := conn.Write(frame); err != nil {
+		return nil, err
+	}
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > maxKafkaResponseBytes {
+		return nil, fmt.Errorf("response of %d bytes is out of bounds", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	res := &kafkaDecoder{buf: buf}
+	if id := res.int32(); id != p.correlationID {
+		return nil, fmt.Errorf("response is for request %d, not %d", id, p.correlationID)
+	}
+	return res, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch encodes a record batch (v2) with the one record.
+func kafkaRecordBatch(key, value []byte, headers []kafkaHeader, now time.Time) []byte {
+	var rec kafkaEncoder
+	rec.int8(0)   // attributes
+	rec.varint(0) // timestamp delta
+	rec.varint(0) // offset delta
+	rec.varbytes(key)
+	rec.varbytes(value)
+	rec.varint(int64(len(headers)))
+	for _, h := range headers {
+		rec.varbytes([]byte(h.key))
+		rec.varbytes([]byte(h.value))
+	}
+
+	// everything after the CRC, which covers it
+	var tail kafkaEncoder
+	ts := now.UnixNano() / int64(time.Millisecond)
+	tail.int16(0) // attributes
+	tail.int32(0) // last offset delta
+	tail.int64(ts)
+	tail.int64(ts)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.varint(int64(rec.Len()))
+	tail.Write(rec.Bytes())
+
+	var batch kafkaEncoder
+	batch.int64(0)                             // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len())) // the length of what follows
+	batch.int32(-1)                            // partition leader epoch
+	batch.int8(2)                              // magic
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), castagnoli)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaEncoder writes the primitive types of the Kafka protocol.
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) { e.WriteByte(byte(v)) }
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) nullableString(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint writes a zigzag-encoded variable length integer, as used in
+// records.
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// varbytes writes bytes with a varint length; nil is encoded as a
+// length of -1.
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+// kafkaDecoder reads the primitive types of the Kafka protocol. The
+// first error is kept, and after it everything reads as zero.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() *string {
+	n := d.int16()
+	if n < 0 {
+		return nil
+	}
+	s := string(d.next(int(n)))
+	return &s
+}
+
+func (d *kafkaDecoder) int32Array() []int32 {
+	var a []int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		a = append(a, d.int32())
+	}
+	return a
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Each endpoint's key is checked when it's loaded (and reloaded):
+// that it isn't empty, and that verifying works with it -- a payload
+// signed with the key, using each accepted algorithm, passes, and one
+// signed otherwise doesn't; or for sources that send the key as a
+// token, that the token is accepted. The result is in the metrics, so
+// that a key that won't verify anything shows up in monitoring before
+// the source gets 401s.
+
+var endpointKeyOK = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "flux_recv",
+	Name:      "endpoint_key_ok",
+	Help:      "Whether each endpoint's key loaded and passed its self-check (1), or not (0).",
+}, []string{"source", "endpoint"})
+
+func init() {
+	prometheus.MustRegister(endpointKeyOK)
+}
+
+// selfCheckPayload is what's signed to check a key.
+var selfCheckPayload = []byte(`{"flux-recv":"self-check"}`)
+
+// selfCheckVerification checks that requests to the source can be
+// verified with the first key in v.
+func selfCheckVerification(source string, v Verification) error {
+	if len(v.Keys) == 0 || len(v.Keys[0]) == 0 {
+		return errors.New("key is empty")
+	}
+	key := v.Keys[0]
+	if !SignedSources[source] {
+		if !checkToken(string(key), v) {
+			return errors.New("key is not accepted as a token")
+		}
+		return nil
+	}
+
+	algorithms := v.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultSignatureAlgorithms
+	}
+	for _, alg := range algorithms {
+		newHash, ok := hmacAlgorithms[alg]
+		if !ok {
+			return fmt.Errorf("signature algorithm %q is not supported", alg)
+		}
+		sign := func(key []byte) *http.Request {
+			mac := hmac.New(newHash, key)
+			mac.Write(selfCheckPayload)
+			r, _ := http.NewRequest("POST", hookPrefix, bytes.NewReader(selfCheckPayload))
+			r.Header.Set("X-Hub-Signature", alg+"="+hex.EncodeToString(mac.Sum(nil)))
+			return r
+		}
+		if err := validateSignature(sign(key), selfCheckPayload, v); err != nil {
+			return fmt.Errorf("a payload signed with the key (%s) does not verify: %s", alg, err.Error())
+		}
+		if validateSignature(sign(append([]byte("not-"), key...)), selfCheckPayload, v) == nil {
+			return fmt.Errorf("a payload signed with another key (%s) verifies", alg)
+		}
+	}
+	return nil
+}
+
+// recordKeyCheck checks the key for the endpoint with the digest
+// given, and records the result.
+func recordKeyCheck(source, digest string, v Verification) {
+	ok := 1.0
+	if err := selfCheckVerification(source, v); err != nil {
+		ok = 0
+		level.Error(sourceLogger(source)).Log("msg", "key failed self-check", "endpoint", endpointLabel(digest), "err", err)
+	}
+	endpointKeyOK.WithLabelValues(source, endpointLabel(digest)).Set(ok)
+}
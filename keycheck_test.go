@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfCheckVerification(t *testing.T) {
+	key := []byte("s3cr3t-webhook-key")
+	assert.NoError(t, selfCheckVerification(GitHub, Verification{Keys: [][]byte{key}}))
+	assert.NoError(t, selfCheckVerification(GitHub, Verification{Keys: [][]byte{key}, Algorithms: []string{"sha1", "sha512"}}))
+	assert.NoError(t, selfCheckVerification(GitLab, Verification{Keys: [][]byte{key}}))
+	assert.NoError(t, selfCheckVerification(DockerHub, Verification{Keys: [][]byte{key}}))
+
+	assert.Error(t, selfCheckVerification(GitHub, Verification{Keys: [][]byte{{}}}))
+	assert.Error(t, selfCheckVerification(GitLab, Verification{}))
+	assert.Error(t, selfCheckVerification(BitbucketServer, Verification{Keys: [][]byte{key}, Algorithms: []string{"md5"}}))
+}
+
+func TestEndpointKeyOK(t *testing.T) {
+	var fluxdCalled bool
+	downstream := newDownstream(t, expectedGithub, &fluxdCalled)
+	defer downstream.Close()
+
+	fp, _, err := HandlerFromEndpoint("test/fixtures", downstream.URL, Endpoint{Source: GitHub, KeyPath: "github_key"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(endpointKeyOK.WithLabelValues(GitHub, endpointLabel(fp))))
+
+	recordKeyCheck(GitHub, fp, Verification{Keys: [][]byte{{}}})
+	assert.Equal(t, 0.0, testutil.ToFloat64(endpointKeyOK.WithLabelValues(GitHub, endpointLabel(fp))))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The Kubernetes API is used (for Events and leader election) with
+// the service account mounted in the Pod.
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubeAPITimeout bounds the time spent on each API request
+	kubeAPITimeout = 10 * time.Second
+)
+
+// kubeAPI makes requests to the Kubernetes API at url, with the
+// bearer token in the file at tokenPath (which is read for each
+// request, since service account tokens are rotated).
+type kubeAPI struct {
+	url       string
+	client    *http.Client
+	tokenPath string
+}
+
+// inClusterKubeAPI constructs a client for the API from the service
+// account mounted in the Pod, and gives the namespace of the Pod
+// ($POD_NAMESPACE, or else the service account's).
+func inClusterKubeAPI() (*kubeAPI, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", errors.New("not running in a Kubernetes cluster ($KUBERNETES_SERVICE_HOST and $KUBERNETES_SERVICE_PORT are not set)")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, "", err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", errors.New("no certificates found in the service account's ca.crt")
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, "", err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	client := &http.Client{
+		Timeout:   kubeAPITimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return &kubeAPI{url: "https://" + net.JoinHostPort(host, port), client: client, tokenPath: serviceAccountDir + "/token"}, namespace, nil
+}
+
+// podName gives the name of the Pod, from $POD_NAME, or else the
+// hostname (which is the Pod's name, unless it's been changed).
+func podName() string {
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod
+	}
+	return hostname()
+}
+
+func hostname() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+// kubeAPIError is an error response from the API server.
+type kubeAPIError struct {
+	status int
+	msg    string
+}
+
+func (e kubeAPIError) Error() string {
+	return fmt.Sprintf("Kubernetes API responded with %d: %s", e.status, e.msg)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(kubeAPIError)
+	return ok && apiErr.status == http.StatusNotFound
+}
+
+// isConflict reports whether the error is from updating an object
+// that's been changed since it was read.
+func isConflict(err error) bool {
+	apiErr, ok := err.(kubeAPIError)
+	return ok && apiErr.status == http.StatusConflict
+}
+
+// do sends a request to the API, with in (if not nil) as the JSON
+// body, and decodes the response into out (if not nil).
+func (k *kubeAPI) do(method, path, contentType string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	token, err := ioutil.ReadFile(k.tokenPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPITimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, k.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= 300 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = res.Status
+		}
+		return kubeAPIError{status: res.StatusCode, msg: status.Message}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With `leaderElection` in the config, replicas of flux-recv elect a
+// leader using a Kubernetes Lease, and only the leader handles hooks
+// (and so notifies fluxd). The others either pass each hook on to the
+// leader, at the URL it advertises in the Lease (`followers: queue`,
+// the default), holding it for a short time while there's no leader
+// to pass it to; or redirect it to the leader (`followers: redirect`).
+// Either way, a hook that isn't handled gets `503 Service
+// Unavailable`, so the source will retry it. This gives replicas for
+// availability, while only ever notifying fluxd from one at a time.
+//
+// The election is the same as client-go's: the leader renews the
+// Lease every so often, and another replica takes it over if it's not
+// been renewed (as observed by that replica, so clocks don't need to
+// agree) for the lease duration. On shutdown, the leader gives up the
+// Lease, so another can take over straight away.
+//
+// The service account needs to be able to get, create, and update
+// leases.
+
+const (
+	defaultLeaseName     = "flux-recv"
+	defaultLeaseDuration = 15 * time.Second
+	defaultQueueTimeout  = 5 * time.Second
+
+	followersQueue    = "queue"
+	followersRedirect = "redirect"
+
+	// leaderURLAnnotation is the annotation on the Lease giving the
+	// URL of the leader, for passing hooks on, or redirecting them
+	leaderURLAnnotation = "flux-recv.fluxcd.io/leader-url"
+	// forwardedByHeader is set (to its identity) by a follower passing
+	// a hook on to the leader, so that a replica that's not the leader
+	// (any more) doesn't pass it on again
+	forwardedByHeader = "X-Flux-Recv-Forwarded-By"
+	// kubeMicroTime is the format of times in a Lease
+	kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// LeaderElection is the config for electing a leader among replicas.
+type LeaderElection struct {
+	// Lease is the name of the Lease, in the namespace of the Pod;
+	// the default is "flux-recv"
+	Lease string `json:"lease,omitempty"`
+	// Followers is what replicas other than the leader do with
+	// hooks: "queue" (the default), to pass them on to the leader,
+	// or "redirect"
+	Followers string `json:"followers,omitempty"`
+	// AdvertiseURL is the URL other replicas pass hooks on to, or
+	// redirect them to, when this one is the leader; environment
+	// variables in it (e.g., $POD_IP) are expanded.
+	AdvertiseURL string `json:"advertiseURL"`
+	// LeaseDuration is how long a leader holds the Lease without
+	// renewing it; the default is 15s
+	LeaseDuration string `json:"leaseDuration,omitempty"`
+	// QueueTimeout is how long a follower holds a hook while there's
+	// no leader to pass it on to; the default is 5s
+	QueueTimeout string `json:"queueTimeout,omitempty"`
+}
+
+func (le *LeaderElection) validate() error {
+	switch le.Followers {
+	case "", followersQueue, followersRedirect:
+	default:
+		return fmt.Errorf("leaderElection: followers %q is not queue or redirect", le.Followers)
+	}
+	// without it, a follower would have nowhere to send hooks, and
+	// would refuse each of them
+	if le.AdvertiseURL == "" {
+		return fmt.Errorf("leaderElection: advertiseURL is needed, so that followers can pass hooks on to the leader")
+	}
+	if u, err := url.Parse(os.ExpandEnv(le.AdvertiseURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("leaderElection: advertiseURL %q is not an http(s) URL", le.AdvertiseURL)
+	}
+	for name, value := range map[string]string{
+		"leaseDuration": le.LeaseDuration,
+		"queueTimeout":  le.QueueTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("leaderElection: %s %q is not a positive duration", name, value)
+		}
+	}
+	if le.LeaseDuration != "" {
+		if d, _ := time.ParseDuration(le.LeaseDuration); d < time.Second {
+			return fmt.Errorf("leaderElection: leaseDuration must be at least 1s")
+		}
+	}
+	return nil
+}
+
+var isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "flux_recv",
+	Name:      "leader",
+	Help:      "Whether this replica is the leader (1) or not (0).",
+})
+
+func init() {
+	prometheus.MustRegister(isLeader)
+}
+
+// leaderElector holds or watches the Lease, if leader election is
+// configured; otherwise it's nil.
+var leaderElector *leaderElection
+
+type leaderElection struct {
+	api       *kubeAPI
+	namespace string
+	name      string
+	identity  string
+	advertise string
+	followers string
+	duration  time.Duration
+	queueFor  time.Duration
+
+	mu        sync.Mutex
+	leading   bool
+	leaderURL string
+	// changed is closed when this replica becomes the leader, or the
+	// leader's URL changes
+	changed chan struct{}
+	// renewed is when the Lease was last renewed by this replica
+	renewed time.Time
+	// observed is the Lease as last seen, and when it was first seen
+	// that way
+	observed   leaseSpec
+	observedAt time.Time
+}
+
+// kubeLease is a coordination.k8s.io/v1 Lease.
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec leaseSpec `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// newLeaderElection constructs an election using the API given, in
+// the namespace given, from a (validated) config. This replica is
+// identified by its Pod's name.
+func newLeaderElection(api *kubeAPI, namespace string, config LeaderElection) *leaderElection {
+	e := &leaderElection{
+		api:       api,
+		namespace: namespace,
+		name:      config.Lease,
+		identity:  podName(),
+		advertise: os.ExpandEnv(config.AdvertiseURL),
+		followers: config.Followers,
+		duration:  defaultLeaseDuration,
+		queueFor:  defaultQueueTimeout,
+		changed:   make(chan struct{}),
+	}
+	if e.name == "" {
+		e.name = defaultLeaseName
+	}
+	if e.followers == "" {
+		e.followers = followersQueue
+	}
+	if config.LeaseDuration != "" {
+		e.duration, _ = time.ParseDuration(config.LeaseDuration)
+	}
+	if config.QueueTimeout != "" {
+		e.queueFor, _ = time.ParseDuration(config.QueueTimeout)
+	}
+	return e
+}
+
+// inClusterLeaderElection constructs an election from the service
+// account mounted in the Pod.
+func inClusterLeaderElection(config LeaderElection) (*leaderElection, error) {
+	api, namespace, err := inClusterKubeAPI()
+	if err != nil {
+		return nil, fmt.Errorf("leader election: %s", err.Error())
+	}
+	return newLeaderElection(api, namespace, config), nil
+}
+
+func (e *leaderElection) leasePath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + e.namespace + "/leases"
+}
+
+// retryPeriod is how often the Lease is renewed, or checked.
+func (e *leaderElection) retryPeriod() time.Duration {
+	return e.duration / 5
+}
+
+// run tries to acquire or renew the Lease, every retry period, until
+// shutdown.
+func (e *leaderElection) run() {
+	tick := time.NewTicker(e.retryPeriod())
+	defer tick.Stop()
+	for ; !isShuttingDown(); <-tick.C {
+		now := time.Now()
+		if err := e.tryAcquireOrRenew(now); err != nil {
+			level.Warn(logger).Log("component", "leader-election", "msg", "could not acquire or renew lease", "lease", e.name, "err", err)
+			e.mu.Lock()
+			// give up leading before the Lease could be taken over
+			expiring := e.leading && now.Sub(e.renewed) > e.duration*2/3
+			e.mu.Unlock()
+			if expiring {
+				e.follow("", "")
+			}
+		}
+	}
+}
+
+// tryAcquireOrRenew reads the Lease, then renews it if it's held by
+// this replica, or takes it over if it's not held, or has expired.
+func (e *leaderElection) tryAcquireOrRenew(now time.Time) error {
+	var lease kubeLease
+	err := e.api.do("GET", e.leasePath()+"/"+e.name, "", nil, &lease)
+	if isNotFound(err) {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Namespace = e.name, e.namespace
+		e.hold(&lease, now)
+		if err := e.api.do("POST", e.leasePath(), "application/json", lease, nil); err != nil {
+			if isConflict(err) {
+				// created by another replica
+				return nil
+			}
+			return err
+		}
+		e.lead(lease.Spec, now)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	if lease.Spec != e.observed {
+		e.observed, e.observedAt = lease.Spec, now
+	}
+	observedAt := e.observedAt
+	e.mu.Unlock()
+	holder := lease.Spec.HolderIdentity
+	held := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	if holder != "" && holder != e.identity && now.Before(observedAt.Add(held)) {
+		e.follow(holder, lease.Metadata.Annotations[leaderURLAnnotation])
+		return nil
+	}
+
+	e.hold(&lease, now)
+	if err := e.api.do("PUT", e.leasePath()+"/"+e.name, "application/json", lease, nil); err != nil {
+		if isConflict(err) {
+			// changed by another replica since it was read; check
+			// again next time
+			return nil
+		}
+		return err
+	}
+	e.lead(lease.Spec, now)
+	return nil
+}
+
+// hold makes this replica the holder of the Lease, as of now.
+func (e *leaderElection) hold(lease *kubeLease, now time.Time) {
+	if lease.Spec.HolderIdentity != e.identity {
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+		if lease.Spec.HolderIdentity != "" || lease.Spec.RenewTime != "" {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.HolderIdentity = e.identity
+	lease.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = map[string]string{}
+	}
+	if e.advertise != "" {
+		lease.Metadata.Annotations[leaderURLAnnotation] = e.advertise
+	} else {
+		delete(lease.Metadata.Annotations, leaderURLAnnotation)
+	}
+}
+
+func (e *leaderElection) lead(spec leaseSpec, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observed, e.observedAt, e.renewed = spec, now, now
+	e.leaderURL = e.advertise
+	if !e.leading {
+		e.leading = true
+		e.notifyChanged()
+		isLeader.Set(1)
+		level.Info(logger).Log("component", "leader-election", "msg", "became the leader", "lease", e.name, "identity", e.identity)
+	}
+}
+
+// follow records that the leader is the holder given (or unknown, if
+// empty), at the URL given.
+func (e *leaderElection) follow(holder, leaderURL string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leading || leaderURL != e.leaderURL {
+		e.notifyChanged()
+	}
+	e.leaderURL = leaderURL
+	if e.leading {
+		e.leading = false
+		isLeader.Set(0)
+		level.Info(logger).Log("component", "leader-election", "msg", "stopped being the leader", "lease", e.name, "leader", holder)
+	}
+}
+
+// notifyChanged wakes those waiting on the state; e.mu must be held.
+func (e *leaderElection) notifyChanged() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// release gives up the Lease, if held, so another replica can take
+// over without waiting for it to expire.
+func (e *leaderElection) release() error {
+	e.mu.Lock()
+	leading := e.leading
+	e.mu.Unlock()
+	if !leading {
+		return nil
+	}
+	e.follow("", "")
+	var lease kubeLease
+	if err := e.api.do("GET", e.leasePath()+"/"+e.name, "", nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != e.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = time.Now().UTC().Format(kubeMicroTime)
+	delete(lease.Metadata.Annotations, leaderURLAnnotation)
+	return e.api.do("PUT", e.leasePath()+"/"+e.name, "application/json", lease, nil)
+}
+
+// state gives whether this replica is the leader, a channel closed
+// when that or the leader's URL changes, and the leader's URL, if
+// known.
+func (e *leaderElection) state() (bool, <-chan struct{}, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading, e.changed, e.leaderURL
+}
+
+// withLeadership handles hooks only if this replica is the leader;
+// otherwise, it passes them on to the leader, or redirects them to
+// it, as configured. A follower that would pass a hook on holds it
+// while the leader isn't known (e.g., while the Lease is changing
+// hands), until this replica or another becomes the leader, or for
+// the queue timeout.
+func withLeadership(e *leaderElection, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(e.queueFor)
+		defer timer.Stop()
+	wait:
+		for {
+			leading, changed, leaderURL := e.state()
+			if leading {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch {
+			case e.followers == followersRedirect:
+				if leaderURL != "" {
+					level.Debug(requestLogger(r)).Log("msg", "redirecting hook to the leader", "leader", leaderURL)
+					http.Redirect(w, r, leaderURL+hookBasePath+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+					return
+				}
+				break wait
+			case r.Header.Get(forwardedByHeader) != "":
+				// passed on by a replica that thinks this one leads;
+				// passing it on again could go round in circles
+				break wait
+			case leaderURL != "":
+				e.forward(leaderURL, w, r)
+				return
+			}
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			case <-timer.C:
+				break wait
+			}
+		}
+		level.Info(requestLogger(r)).Log("msg", "refused hook, since this replica is not the leader")
+		e.refuse(w)
+	})
+}
+
+// forward passes the hook on to the leader, at the URL given, and
+// responds with the leader's response.
+func (e *leaderElection) forward(leaderURL string, w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(leaderURL)
+	if err != nil {
+		level.Warn(requestLogger(r)).Log("msg", "could not pass hook on to the leader", "leader", leaderURL, "err", err)
+		e.refuse(w)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+			req.URL.Path, req.URL.RawPath = strings.TrimSuffix(target.Path, "/")+hookBasePath+req.URL.Path, ""
+			req.Host = target.Host
+			req.Header.Set(forwardedByHeader, e.identity)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			level.Warn(requestLogger(r)).Log("msg", "could not pass hook on to the leader", "leader", leaderURL, "err", err)
+			e.refuse(w)
+		},
+	}
+	level.Debug(requestLogger(r)).Log("msg", "passing hook on to the leader", "leader", leaderURL)
+	proxy.ServeHTTP(w, r)
+}
+
+func (e *leaderElection) refuse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(e.duration/time.Second)))
+	http.Error(w, "Not the leader; try again later", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLeases is an API server with just Leases, which refuses
+// updates of out-of-date versions, as the real one does.
+type fakeLeases struct {
+	mu      sync.Mutex
+	leases  map[string]kubeLease
+	version int
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const prefix = "/apis/coordination.k8s.io/v1/namespaces/fluxcd/leases"
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var lease kubeLease
+	json.NewDecoder(r.Body).Decode(&lease)
+	existing, exists := f.leases[name]
+	switch {
+	case r.Method == "GET" && !exists:
+		http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+		return
+	case r.Method == "GET":
+		json.NewEncoder(w).Encode(existing)
+		return
+	case r.Method == "POST" && f.leases[lease.Metadata.Name].Metadata.Name != "":
+		http.Error(w, `{"message":"already exists"}`, http.StatusConflict)
+		return
+	case r.Method == "POST":
+		name = lease.Metadata.Name
+	case r.Method == "PUT" && existing.Metadata.ResourceVersion != lease.Metadata.ResourceVersion:
+		http.Error(w, `{"message":"the object has been modified"}`, http.StatusConflict)
+		return
+	}
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[name] = lease
+	json.NewEncoder(w).Encode(lease)
+}
+
+func (f *fakeLeases) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leases["flux-recv"].Spec.HolderIdentity
+}
+
+func TestLeaderElection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenPath, []byte("sa-token\n"), 0600))
+
+	leases := &fakeLeases{leases: map[string]kubeLease{}}
+	server := httptest.NewServer(leases)
+	defer server.Close()
+	api := &kubeAPI{url: server.URL, client: server.Client(), tokenPath: tokenPath}
+
+	replica := func(identity string) *leaderElection {
+		e := newLeaderElection(api, "fluxcd", LeaderElection{AdvertiseURL: "http://" + identity + ":8080"})
+		e.identity = identity
+		return e
+	}
+	a, b := replica("flux-recv-a"), replica("flux-recv-b")
+	leading := func(e *leaderElection) bool {
+		l, _, _ := e.state()
+		return l
+	}
+
+	// the first to try creates the Lease, and leads
+	now := time.Now()
+	assert.NoError(t, a.tryAcquireOrRenew(now))
+	assert.NoError(t, b.tryAcquireOrRenew(now))
+	assert.True(t, leading(a))
+	assert.False(t, leading(b))
+	assert.Equal(t, "flux-recv-a", leases.holder())
+	_, _, leaderURL := b.state()
+	assert.Equal(t, "http://flux-recv-a:8080", leaderURL)
+
+	// while it's renewed, the other keeps following
+	now = now.Add(defaultLeaseDuration / 2)
+	assert.NoError(t, a.tryAcquireOrRenew(now))
+	now = now.Add(defaultLeaseDuration / 2)
+	assert.NoError(t, b.tryAcquireOrRenew(now))
+	assert.False(t, leading(b))
+
+	// once it's not been renewed for the lease duration, the other
+	// takes over
+	now = now.Add(defaultLeaseDuration + time.Second)
+	assert.NoError(t, b.tryAcquireOrRenew(now))
+	assert.True(t, leading(b))
+	assert.NoError(t, a.tryAcquireOrRenew(now))
+	assert.False(t, leading(a))
+	assert.Equal(t, 1, leases.leases["flux-recv"].Spec.LeaseTransitions)
+
+	// releasing it lets the other take over straight away
+	assert.NoError(t, b.release())
+	assert.False(t, leading(b))
+	assert.Equal(t, "", leases.holder())
+	assert.NoError(t, a.tryAcquireOrRenew(now))
+	assert.True(t, leading(a))
+}
+
+func TestWithLeadership(t *testing.T) {
+	var handled int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+
+	e := newLeaderElection(nil, "fluxcd", LeaderElection{Followers: followersRedirect, AdvertiseURL: "http://flux-recv-a:8080"})
+	e.identity = "flux-recv-b"
+	e.follow("flux-recv-a", "http://flux-recv-a:8080")
+	handler := withLeadership(e, next)
+
+	// a follower redirects to the leader
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/hook/abc?x=1", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "http://flux-recv-a:8080/hook/abc?x=1", w.Header().Get("Location"))
+	// or if the leader isn't known, refuses
+	e.follow("", "")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "15", w.Header().Get("Retry-After"))
+	assert.Equal(t, 0, handled)
+
+	// a follower that queues holds the hook until it leads
+	e.followers = followersQueue
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/hook/abc", nil))
+		done <- w.Code
+	}()
+	time.Sleep(10 * time.Millisecond)
+	e.lead(leaseSpec{HolderIdentity: e.identity}, time.Now())
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, 1, handled)
+
+	// or until the queue timeout
+	e.follow("flux-recv-a", "")
+	e.queueFor = 10 * time.Millisecond
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 1, handled)
+
+	// the leader handles hooks
+	e.lead(leaseSpec{HolderIdentity: e.identity}, time.Now())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, 2, handled)
+}
+
+func TestFollowerPassesHooksOn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenPath, []byte("sa-token\n"), 0600))
+
+	leases := &fakeLeases{leases: map[string]kubeLease{}}
+	server := httptest.NewServer(leases)
+	defer server.Close()
+	api := &kubeAPI{url: server.URL, client: server.Client(), tokenPath: tokenPath}
+
+	// two replicas, each serving hooks, with their own elections
+	var handled []string
+	var mu sync.Mutex
+	serve := func(identity string) (*leaderElection, *httptest.Server) {
+		var e *leaderElection
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			withLeadership(e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				handled = append(handled, identity+" "+r.URL.Path+" "+string(body)+" "+r.Header.Get(forwardedByHeader))
+				mu.Unlock()
+				w.WriteHeader(http.StatusAccepted)
+			})).ServeHTTP(w, r)
+		})
+		replica := httptest.NewServer(handler)
+		e = newLeaderElection(api, "fluxcd", LeaderElection{AdvertiseURL: replica.URL})
+		e.identity = identity
+		return e, replica
+	}
+	a, replicaA := serve("flux-recv-a")
+	defer replicaA.Close()
+	b, replicaB := serve("flux-recv-b")
+	defer replicaB.Close()
+
+	// in the steady state, a leads and b follows
+	now := time.Now()
+	assert.NoError(t, a.tryAcquireOrRenew(now))
+	assert.NoError(t, b.tryAcquireOrRenew(now))
+
+	// a hook sent to the follower is handled by the leader, straight
+	// away
+	b.queueFor = time.Minute
+	start := time.Now()
+	res, err := http.Post(replicaB.URL+"/hook/abc", "application/json", strings.NewReader(`{"ok":true}`))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, []string{`flux-recv-a /hook/abc {"ok":true} flux-recv-b`}, handled)
+
+	// one passed on to a replica that isn't the leader (any more) is
+	// refused, rather than passed on again
+	req, _ := http.NewRequest("POST", replicaB.URL+"/hook/abc", nil)
+	req.Header.Set(forwardedByHeader, "flux-recv-a")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	// and if the leader can't be reached, the hook is refused so the
+	// source retries it
+	replicaA.Close()
+	res, err = http.Post(replicaB.URL+"/hook/abc", "application/json", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Len(t, handled, 1)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// `flux-recv loadtest` sends hooks to a running flux-recv at a steady
+// rate, and reports how they were answered and how long that took. It
+// is for tuning `loadShedding` and `quota` (see shed.go and
+// quota.go): raise the rate until requests start being shed, and see
+// where the latencies become unacceptable. Point it at a test
+// deployment, since each hook accepted is passed on to fluxd.
+
+const loadTestUsage = `usage:
+  flux-recv loadtest --url <hook URL> [--payload <file>] [--key-file <file>] [--header "<name>: <value>" ...] [--rate <per second>] [--duration <duration>] [--concurrency <n>]`
+
+type loadTestOptions struct {
+	URL         string
+	Payload     []byte
+	Key         []byte // if not empty, payloads are signed with this
+	Header      http.Header
+	Rate        float64
+	Duration    time.Duration
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// loadTestResult is what happened to the requests sent.
+type loadTestResult struct {
+	Sent      int
+	Skipped   int // because Concurrency requests were in flight
+	Errors    int // no response
+	Codes     map[int]int
+	Latencies []time.Duration // of responses; sorted
+	Elapsed   time.Duration
+}
+
+func loadTestCommand(args []string) {
+	var (
+		opts        loadTestOptions
+		payloadFile string
+		keyFile     string
+		headers     []string
+	)
+	flags := flag.NewFlagSet("flux-recv loadtest", flag.ExitOnError)
+	flags.StringVar(&opts.URL, "url", "", "the URL of the hook to send requests to")
+	flags.StringVar(&payloadFile, "payload", "", "a file with the body to send; if not given, an empty JSON object")
+	flags.StringVar(&keyFile, "key-file", "", "if given, sign each body with the key in this file, in an X-Hub-Signature-256 header (as GitHub does)")
+	flags.StringArrayVar(&headers, "header", nil, `a header to send with each request, as "<name>: <value>"; may be given more than once`)
+	flags.Float64Var(&opts.Rate, "rate", 10, "requests to send per second")
+	flags.DurationVar(&opts.Duration, "duration", 30*time.Second, "how long to send requests for")
+	flags.IntVar(&opts.Concurrency, "concurrency", 100, "the most requests in flight at once; requests due when this many are in flight are skipped")
+	flags.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "how long to wait for each response")
+	flags.Parse(args)
+
+	if opts.URL == "" || opts.Rate <= 0 || opts.Concurrency <= 0 {
+		bail(loadTestUsage)
+	}
+	opts.Payload = []byte(`{}`)
+	if payloadFile != "" {
+		b, err := ioutil.ReadFile(payloadFile)
+		if err != nil {
+			bail(err.Error())
+		}
+		opts.Payload = b
+	}
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			bail(err.Error())
+		}
+		opts.Key = bytes.TrimSpace(b)
+	}
+	opts.Header = http.Header{}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			bail(fmt.Sprintf("header %q is not <name>: <value>", h))
+		}
+		opts.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	res := loadTest(opts)
+	res.report(os.Stdout)
+}
+
+// loadTest sends requests as given by opts, and collects the results.
+func loadTest(opts loadTestOptions) loadTestResult {
+	body := opts.Payload
+	header := opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	if len(opts.Key) > 0 {
+		mac := hmac.New(sha256.New, opts.Key)
+		mac.Write(body)
+		header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+
+	var (
+		mu  sync.Mutex
+		res = loadTestResult{Codes: map[int]int{}}
+		wg  sync.WaitGroup
+	)
+	slots := make(chan struct{}, opts.Concurrency)
+	send := func() {
+		defer func() { <-slots; wg.Done() }()
+		req, _ := http.NewRequest("POST", opts.URL, bytes.NewReader(body))
+		req.Header = header.Clone()
+		start := time.Now()
+		resp, err := client.Do(req)
+		took := time.Since(start)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			res.Errors++
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		res.Codes[resp.StatusCode]++
+		res.Latencies = append(res.Latencies, took)
+	}
+
+	interval := time.Duration(float64(time.Second) / opts.Rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	deadline := time.After(opts.Duration)
+loop:
+	for {
+		select {
+		case slots <- struct{}{}:
+			res.Sent++
+			wg.Add(1)
+			go send()
+		default:
+			res.Skipped++
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			break loop
+		}
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	sort.Slice(res.Latencies, func(i, j int) bool { return res.Latencies[i] < res.Latencies[j] })
+	return res
+}
+
+// percentile gives the latency under which the fraction p of
+// responses came, or zero if there were none.
+func (r loadTestResult) percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(r.Latencies)-1))
+	return r.Latencies[i]
+}
+
+func (r loadTestResult) report(w io.Writer) {
+	fmt.Fprintf(w, "sent %d requests in %s (%.1f/s)", r.Sent, r.Elapsed.Round(time.Millisecond), float64(r.Sent)/r.Elapsed.Seconds())
+	if r.Skipped > 0 {
+		fmt.Fprintf(w, "; skipped %d, with too many in flight", r.Skipped)
+	}
+	fmt.Fprintln(w)
+	var codes []int
+	for code := range r.Codes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d %s: %d\n", code, http.StatusText(code), r.Codes[code])
+	}
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "  no response: %d\n", r.Errors)
+	}
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(w, "latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			r.percentile(0.5).Round(time.Microsecond),
+			r.percentile(0.9).Round(time.Microsecond),
+			r.percentile(0.99).Round(time.Microsecond),
+			r.Latencies[len(r.Latencies)-1].Round(time.Microsecond))
+	}
+}
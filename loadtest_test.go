@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTest(t *testing.T) {
+	s := newLoadShedder(LoadShedding{MaxInFlight: 2})
+	server := httptest.NewServer(s.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sha256=", r.Header.Get("X-Hub-Signature-256")[:7])
+		assert.Equal(t, "push", r.Header.Get("X-GitHub-Event"))
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	res := loadTest(loadTestOptions{
+		URL:         server.URL,
+		Payload:     []byte(`{}`),
+		Key:         []byte("secret"),
+		Header:      http.Header{"X-Github-Event": {"push"}},
+		Rate:        200,
+		Duration:    200 * time.Millisecond,
+		Concurrency: 10,
+		Timeout:     time.Second,
+	})
+	assert.True(t, res.Sent > 10)
+	assert.Equal(t, 0, res.Errors)
+	assert.True(t, res.Codes[http.StatusOK] > 0)
+	assert.True(t, res.Codes[http.StatusServiceUnavailable] > 0)
+	assert.Equal(t, res.Sent, res.Codes[http.StatusOK]+res.Codes[http.StatusServiceUnavailable])
+	assert.Len(t, res.Latencies, res.Sent)
+}
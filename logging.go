@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Logs are written to stderr (or the event log, for a Windows
+// service), in logfmt ("console") or JSON, each
+// line with a level. Lines about a request are tagged with the
+// source, the endpoint (by the same fingerprint as in metrics), and
+// the request's correlation ID.
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+var logLevels = map[string]level.Option{
+	"debug": level.AllowDebug(),
+	"info":  level.AllowInfo(),
+	"warn":  level.AllowWarn(),
+	"error": level.AllowError(),
+}
+
+// logOutput is where logs are written: stderr, except when running as
+// a Windows service, when it's the event log (see
+// service_windows.go).
+var logOutput io.Writer = os.Stderr
+
+// logger is the logger for everything not about a particular request.
+var logger = newLogger(logOutput, logFormatConsole, level.AllowInfo())
+
+func newLogger(w io.Writer, format string, allow level.Option) kitlog.Logger {
+	var l kitlog.Logger
+	if format == logFormatJSON {
+		l = kitlog.NewJSONLogger(kitlog.NewSyncWriter(w))
+	} else {
+		l = kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(w))
+	}
+	l = kitlog.With(l, "ts", kitlog.DefaultTimestampUTC)
+	return level.NewFilter(l, allow)
+}
+
+// setupLogging sets the format (console or json) and the level
+// (debug, info, warn, or error) of the logs.
+func setupLogging(format, lvl string) error {
+	if format != logFormatConsole && format != logFormatJSON {
+		return fmt.Errorf("log format %q is not one of %s, %s", format, logFormatConsole, logFormatJSON)
+	}
+	allow, ok := logLevels[lvl]
+	if !ok {
+		return fmt.Errorf("log level %q is not one of debug, info, warn, error", lvl)
+	}
+	logger = newLogger(logOutput, format, allow)
+	return nil
+}
+
+// sourceLogger gives a logger for things about a source that aren't
+// about a particular request (e.g., fetching its IP ranges).
+func sourceLogger(source string) kitlog.Logger {
+	return kitlog.With(logger, "source", source)
+}
+
+type loggerContextKey struct{}
+
+// withRequestLogger puts a logger for the request in its context,
+// tagged with the source, endpoint, and correlation ID, and logs the
+// outcome of the request. It goes inside withCorrelationID.
+//
+// If sampling is more than 1, only one in that many successful
+// requests is logged: the lines about the others are kept back until
+// it's known how the request went, then dropped if it succeeded
+// without any warnings or errors.
+func withRequestLogger(source, digest string, sampling int, next http.Handler) http.Handler {
+	endpoint := endpointLabel(digest)
+	var count uint64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var base kitlog.Logger = logger
+		var held *heldLogger
+		if sampling > 1 && atomic.AddUint64(&count, 1)%uint64(sampling) != 1 {
+			held = &heldLogger{}
+			base = held
+		}
+		l := kitlog.With(base, "source", source, "endpoint", endpoint)
+		if id := correlationID(r.Context()); id != "" {
+			l = kitlog.With(l, "correlation", id)
+		}
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, l)))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level.Info(l).Log("msg", "handled delivery", "status", status, "duration", time.Since(start).String())
+
+		if held != nil {
+			if status < 300 && !held.important {
+				if sample, ok := r.Context().Value(logSampleKey{}).(*logSample); ok {
+					sample.skipped = true
+				}
+				return
+			}
+			held.flush(logger)
+		}
+	})
+}
+
+type logSampleKey struct{}
+
+// logSample says whether the lines about a request were left out, by
+// sampling; the access log then leaves out its line too.
+type logSample struct {
+	skipped bool
+}
+
+// heldLogger keeps the lines logged, to be written or dropped later.
+type heldLogger struct {
+	mu    sync.Mutex
+	lines [][]interface{}
+	// important is true if any line is a warning or an error
+	important bool
+}
+
+func (h *heldLogger) Log(keyvals ...interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == level.Key() && (keyvals[i+1] == level.WarnValue() || keyvals[i+1] == level.ErrorValue()) {
+			h.important = true
+		}
+	}
+	h.lines = append(h.lines, append([]interface{}{}, keyvals...))
+	return nil
+}
+
+func (h *heldLogger) flush(to kitlog.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, keyvals := range h.lines {
+		to.Log(keyvals...)
+	}
+	h.lines = nil
+}
+
+// requestLogger gives the logger for the request, or the logger for
+// everything else if there isn't one.
+func requestLogger(r *http.Request) kitlog.Logger {
+	return contextLogger(r.Context())
+}
+
+func contextLogger(ctx context.Context) kitlog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(kitlog.Logger); ok {
+		return l
+	}
+	return logger
+}
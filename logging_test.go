@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l kitlog.Logger) { logger = l }(logger)
+	logger = newLogger(&buf, logFormatJSON, level.AllowInfo())
+
+	handler := withCorrelationID(withRequestLogger(GitHub, "0123456789abcdef0123", 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level.Debug(requestLogger(r)).Log("msg", "not logged")
+		level.Warn(requestLogger(r)).Log("msg", "rejected")
+	})))
+	req := httptest.NewRequest("POST", "/hook/0123456789abcdef0123", nil)
+	req.Header.Set("X-GitHub-Delivery", "d-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the debug line isn't logged, and the outcome is
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"msg":"handled delivery"`)
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	assert.Equal(t, "warn", line["level"])
+	assert.Equal(t, "rejected", line["msg"])
+	assert.Equal(t, GitHub, line["source"])
+	assert.Equal(t, "0123456789ab", line["endpoint"])
+	assert.Equal(t, "d-1", line["correlation"])
+	assert.Contains(t, line, "ts")
+}
+
+func TestLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l kitlog.Logger) { logger = l }(logger)
+	logger = newLogger(&buf, logFormatConsole, level.AllowInfo())
+
+	status := http.StatusOK
+	handler := withAccessLog("", withRequestLogger(GitHub, "0123456789abcdef0123", 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level.Info(requestLogger(r)).Log("msg", "notified")
+		w.WriteHeader(status)
+	})))
+	send := func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hook/0123456789abcdef0123", nil))
+	}
+
+	for i := 0; i < 6; i++ {
+		send()
+	}
+	// one in three is logged, with its access log line
+	assert.Equal(t, 2, strings.Count(buf.String(), "msg=notified"))
+	assert.Equal(t, 2, strings.Count(buf.String(), "component=access"))
+
+	// failures are all logged
+	buf.Reset()
+	status = http.StatusBadGateway
+	for i := 0; i < 3; i++ {
+		send()
+	}
+	assert.Equal(t, 3, strings.Count(buf.String(), "msg=notified"))
+	assert.Equal(t, 3, strings.Count(buf.String(), "component=access"))
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer setupLogging(logFormatConsole, "info")
+	assert.NoError(t, setupLogging(logFormatJSON, "debug"))
+	assert.Error(t, setupLogging("xml", "info"))
+	assert.Error(t, setupLogging(logFormatConsole, "verbose"))
+}
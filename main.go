@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	flag "github.com/spf13/pflag"
 )
 
@@ -15,48 +19,577 @@ func main() {
 	mainArgs(os.Args[1:])
 }
 
+func bail(msg string) {
+	fmt.Fprintln(logOutput, msg)
+	os.Exit(1)
+}
+
 func mainArgs(args []string) {
+	if len(args) > 0 && args[0] == "config" {
+		configCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "check" {
+		checkCommand(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "loadtest" {
+		loadTestCommand(args[1:])
+		return
+	}
+
 	var (
-		configFile string
-		listen     string
+		configFile      string
+		configSHA256    string
+		listen          string
+		adminListen     string
+		allowInlineKeys bool
+		tlsCert         string
+		tlsKey          string
+		auditLogPath    string
+		strictSecrets   bool
+		ageIdentity     string
+		hardened        bool
+		logPayloads     bool
+		otlpEndpoint    string
+		logFormat       string
+		logLevel        string
+		readyProbe      bool
+		sentryDSN       string
+		enablePprof     bool
+		showVersion     bool
+		kubeEvents      bool
+		kubeEventsObj   string
+		pushMetricsURL  string
+		pushFormat      string
+		pushInterval    time.Duration
+		drainTimeout    time.Duration
+		runSelfTest     bool
+		injectFaults    bool
 	)
 
 	flags := flag.NewFlagSet("flux-recv", flag.ExitOnError)
 
-	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv") // TODO(michael): `flux-recv help config`
-	flags.StringVar(&listen, "listen", ":8080", "address to listen on")
+	flags.StringVar(&configFile, "config", "fluxrecv.yaml", "path to config file for flux-recv; or, - for stdin, or an http(s) URL") // TODO(michael): `flux-recv help config`
+	flags.StringVar(&configSHA256, "config-sha256", "", "if given, the config must have this (hex-encoded) SHA256 digest; use this to pin a config fetched from a URL")
+	flags.StringVar(&listen, "listen", ":8080", "address to listen on, for endpoints not given a listener in the config")
+	flags.StringVar(&adminListen, "listen-admin", "", "if given, serve metrics, health and version endpoints, and the admin API, on this address, rather than on each listener alongside the hooks")
+	flags.StringVar(&tlsCert, "tls-cert", "", "path to a TLS certificate, to serve HTTPS on the --listen address; reloaded when it changes")
+	flags.StringVar(&tlsKey, "tls-key", "", "path to the key for the TLS certificate given in --tls-cert")
+	flags.StringVar(&auditLogPath, "audit-log", "", "if given, append a record of each delivery, as JSON lines, to this file; or, - for stdout; or send each to a syslog server, given as syslog://host:port (UDP), syslog+tcp://host:port, or syslog+tls://host:port")
+	flags.StringVar(&ageIdentity, "age-identity", os.Getenv("SOPS_AGE_KEY_FILE"), "path to a file of age identities, for decrypting the config and key files when encrypted with age or SOPS; defaults to $SOPS_AGE_KEY_FILE")
+	flags.BoolVar(&strictSecrets, "strict-secrets", false, "refuse to start if keys or secrets are readable by anyone, short, or easy to guess, rather than just warning")
+	flags.BoolVar(&hardened, "hardened", false, "for deployments exposed to the internet: set strict security headers, refuse TRACE and TRACK, give minimal error responses, and use conservative timeouts")
+	flags.StringVar(&otlpEndpoint, "otlp-endpoint", otlpTracesEndpoint(), "if given, send traces of each delivery to this OpenTelemetry collector endpoint, using OTLP/HTTP (e.g., http://otel-collector:4318/v1/traces); defaults to $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or $OTEL_EXPORTER_OTLP_ENDPOINT with /v1/traces")
+	flags.StringVar(&logFormat, "log-format", logFormatConsole, "format for logs: console (logfmt), or json")
+	flags.StringVar(&logLevel, "log-level", "info", "the least severe level of log to write: debug, info, warn, or error")
+	flags.StringVar(&sentryDSN, "sentry-dsn", os.Getenv("SENTRY_DSN"), "if given, report panics, payloads that can't be parsed, and repeated failures to notify fluxd to Sentry, with this DSN; defaults to $SENTRY_DSN")
+	flags.StringVar(&pushMetricsURL, "push-metrics", "", "if given, push the metrics to this URL on an interval, for when Prometheus can't scrape flux-recv: a Pushgateway (e.g., http://pushgateway:9091), or an OTLP/HTTP collector (e.g., http://otel-collector:4318/v1/metrics) with --push-metrics-format=otlp")
+	flags.StringVar(&pushFormat, "push-metrics-format", metricsPushPushgateway, "how to push metrics: pushgateway, or otlp")
+	flags.DurationVar(&pushInterval, "push-metrics-interval", 30*time.Second, "how often to push metrics")
+	flags.BoolVar(&kubeEvents, "kube-events", false, "when running in Kubernetes, record verification failures and failures to notify fluxd as Events on the flux-recv Pod (or the object given in --kube-events-object)")
+	flags.StringVar(&kubeEventsObj, "kube-events-object", "", "the object to record Events on, as <kind>/<name> in the namespace of the Pod, e.g., deployment/flux; defaults to the Pod, named by $POD_NAME")
+	flags.BoolVar(&enablePprof, "pprof", false, "serve profiles (as from net/http/pprof) under /admin/debug/pprof/; needs the admin API to be enabled in the config")
+	flags.BoolVar(&logPayloads, "log-payloads", false, "when a payload can't be handled, log the start of it, with credentials redacted, for debugging")
+	flags.BoolVar(&readyProbe, "ready-probe-downstream", false, "report ready at /readyz only if the downstream API answers a ping")
+	flags.DurationVar(&drainTimeout, "drain-timeout", defaultDrainTimeout, "on SIGTERM, how long to wait for requests in flight, and callbacks and other background sends queued, before exiting")
+	flags.BoolVar(&showVersion, "version", false, "print the version of flux-recv, and exit")
+	flags.BoolVar(&injectFaults, "inject-faults", false, "inject the faults given for endpoints in the config (for testing only)")
+	flags.BoolVar(&runSelfTest, "self-test", false, "check the config, that the downstream API answers, and that each endpoint's keys load and verify requests, then exit (non-zero if anything failed), rather than serving")
+	flags.BoolVar(&allowInlineKeys, "allow-inline-keys", false, "allow keys to be given inline in the config (for development and testing only)")
+
+	flags.Parse(args)
 
-	bail := func(msg string) {
-		fmt.Fprintln(os.Stderr, msg)
-		os.Exit(1)
+	if showVersion {
+		info := currentBuildInfo()
+		fmt.Printf("flux-recv %s (commit %s, %s)\n", info.Version, info.Commit, info.GoVersion)
+		return
 	}
 
-	flags.Parse(args)
+	if err := setupLogging(logFormat, logLevel); err != nil {
+		bail(err.Error())
+	}
+	setBuildInfoMetric()
+	level.Info(logger).Log("msg", "starting", "version", version, "commit", commit)
+
+	if (tlsCert == "") != (tlsKey == "") {
+		bail("--tls-cert and --tls-key must be given together")
+	}
+
+	mode, ok := cryptoMode()
+	if !ok {
+		bail(mode)
+	}
+	level.Info(logger).Log("msg", "crypto mode", "crypto", mode)
 
-	config, err := ConfigFromFile(configFile)
+	if err := useAgeIdentities(ageIdentity); err != nil {
+		bail(err.Error())
+	}
+
+	config, configDir, err := LoadConfig(configFile, configSHA256)
 	if err != nil {
 		bail(err.Error())
 	}
 
-	configDir := filepath.Dir(configFile)
+	// inline keys are safe enough when encrypted in the config. This
+	// is checked again on restarting with SIGUSR2 (the only way the
+	// config is reloaded), since the new process starts here.
+	if err := checkInlineKeys(config, allowInlineKeys); err != nil {
+		bail(err.Error())
+	}
+
+	if config.HasFaults() {
+		if !injectFaults {
+			bail("the config has endpoints with `faults`; faults are only injected with --inject-faults, for testing")
+		}
+		if hardened {
+			bail("--inject-faults is for testing, and cannot be used with --hardened")
+		}
+		level.Warn(logger).Log("msg", "injecting faults into deliveries, for testing")
+	}
+
+	if problems := checkSecrets(configDir, config); len(problems) > 0 {
+		for _, p := range problems {
+			level.Warn(logger).Log("msg", p)
+		}
+		if strictSecrets {
+			bail("refusing to start because of the problems with secrets above (--strict-secrets)")
+		}
+	}
+
+	probeDownstream = readyProbe
+
+	if logPayloads {
+		if payloadRedactor, err = newRedactor(config.RedactKeys); err != nil {
+			bail(err.Error())
+		}
+	}
+
+	if enablePprof && config.Admin == nil {
+		bail("--pprof needs the admin API, which is enabled with `admin` in the config")
+	}
+	pprofEnabled = enablePprof
+	if config.Admin != nil {
+		if adminToken, err = loadAdminToken(configDir, config.Admin); err != nil {
+			bail(err.Error())
+		}
+		size := config.Admin.RecentDeliveries
+		if size == 0 {
+			size = defaultRecentDeliveries
+		}
+		var path string
+		if config.Admin.DeliveriesPath != "" {
+			path = resolvePath(configDir, config.Admin.DeliveriesPath)
+		}
+		if recentDeliveries, err = newDeliveryLog(size, path); err != nil {
+			bail("admin: cannot load recent deliveries: " + err.Error())
+		}
+		if rejectedPayloads, err = newRejectedStore(config.RedactKeys); err != nil {
+			bail(err.Error())
+		}
+	}
+
+	var signingKey []byte
+	if config.APISigningKeyPath != "" {
+		if signingKey, _, err = loadKey(configDir, config.APISigningKeyPath); err != nil {
+			bail(err.Error())
+		}
+	}
+	if signingKey != nil || config.DownstreamPolicy != nil || config.Downstream != nil {
+		downstreamClient = newDownstreamClient(config.DownstreamPolicy, config.Downstream, signingKey)
+	}
 
 	apiBase := config.API
 	if apiBase == "" {
 		apiBase = defaultApiBase
 	}
+	if err := config.DownstreamPolicy.checkURL(apiBase); err != nil {
+		bail("api: " + err.Error())
+	}
+	if tenants, err = loadTenants(configDir, apiBase, config); err != nil {
+		bail(err.Error())
+	}
+
+	if tlsCert != "" {
+		// these are relative to the working directory, rather than
+		// the config
+		tlsCert, _ = filepath.Abs(tlsCert)
+		tlsKey, _ = filepath.Abs(tlsKey)
+		config.TLS = &TLS{CertFile: tlsCert, KeyFile: tlsKey}
+	}
+
+	if runSelfTest {
+		if problems := selfTest(configDir, apiBase, config.ListenersWithDefault(listen)); problems > 0 {
+			bail(fmt.Sprintf("self-test failed, with %d problem(s)", problems))
+		}
+		level.Info(logger).Log("msg", "self-test passed")
+		return
+	}
+
+	var audit *auditLog
+	if auditLogPath != "" {
+		if audit, err = openAuditLog(auditLogPath); err != nil {
+			bail(err.Error())
+		}
+	}
+
+	if otlpEndpoint != "" {
+		service := os.Getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "flux-recv"
+		}
+		activeTracer = newTracer(otlpEndpoint, service)
+		go activeTracer.run()
+		level.Info(logger).Log("msg", "sending traces", "endpoint", otlpEndpoint)
+	}
+
+	if sentryDSN != "" {
+		if errorReporter, err = newSentryReporter(sentryDSN, os.Getenv("SENTRY_ENVIRONMENT")); err != nil {
+			bail(err.Error())
+		}
+		go errorReporter.run()
+		level.Info(logger).Log("msg", "reporting errors to Sentry")
+	}
+
+	if pushMetricsURL != "" {
+		activePusher, err = newMetricsPusher(pushMetricsURL, pushFormat, pushInterval)
+		if err != nil {
+			bail(err.Error())
+		}
+		go activePusher.run()
+		level.Info(logger).Log("msg", "pushing metrics", "url", redactURL(pushMetricsURL), "format", pushFormat, "interval", pushInterval)
+	}
+
+	if kubeEvents {
+		if kubeEventRecorder, err = inClusterKubeEvents(kubeEventsObj); err != nil {
+			bail(err.Error())
+		}
+		go kubeEventRecorder.run()
+		level.Info(logger).Log("msg", "recording Kubernetes events", "object", kubeEventRecorder.object.Kind+"/"+kubeEventRecorder.object.Name)
+	}
 
-	for _, ep := range config.Endpoints {
-		digest, handler, err := HandlerFromEndpoint(configDir, apiBase, ep)
+	if config.Alerts != nil {
+		failureAlerts = newAlerter(*config.Alerts)
+		go failureAlerts.run()
+	}
+
+	if config.SLO != nil {
+		sloBurnRates = newSLOTracker(*config.SLO)
+		prometheus.MustRegister(sloBurnRates)
+	}
+
+	if config.Callback != "" {
+		deliveryCallbacks = newCallbackSender(config.Callback)
+		go deliveryCallbacks.run()
+	}
+
+	if config.AuditEvents != "" {
+		if auditEvents, err = newAuditEventSender(config.AuditEvents); err != nil {
+			bail(err.Error())
+		}
+		go auditEvents.run()
+		level.Info(logger).Log("msg", "sending audit events", "sink", redactURL(config.AuditEvents))
+	}
+
+	if d := config.Downstream; d != nil && d.Workers > 0 {
+		queueSize := d.QueueSize
+		if queueSize == 0 {
+			queueSize = defaultDownstreamQueueSize
+		}
+		downstreamPool = newNotifyPool(d.Workers, queueSize)
+		level.Info(logger).Log("msg", "sending notifications with a worker pool", "workers", d.Workers, "queue", queueSize)
+	}
+
+	hookBasePath = config.BasePath
+
+	if config.ForwardedHeader != "" {
+		forwardedHeader = config.ForwardedHeader
+	}
+	if len(config.TrustedProxies) > 0 {
+		// these were checked when the config was loaded
+		trustedProxies, _ = parseCIDRs(config.TrustedProxies)
+		level.Info(logger).Log("msg", "taking client addresses from "+forwardedHeader+", when from a trusted proxy", "proxies", fmt.Sprint(config.TrustedProxies))
+	}
+
+	if config.Spool != nil {
+		if bodySpool, err = newSpooler(configDir, *config.Spool); err != nil {
+			bail(err.Error())
+		}
+		level.Info(logger).Log("msg", "spooling large request bodies to disk", "threshold", config.Spool.ThresholdBytes, "dir", bodySpool.dir)
+	}
+
+	if config.Dedup != nil {
+		if sharedDedup, err = newDeliveryDedup(*config.Dedup); err != nil {
+			bail(err.Error())
+		}
+		level.Info(logger).Log("msg", "deduplicating deliveries across replicas", "redis", redactURL(config.Dedup.Redis))
+	}
+
+	if le := config.LeaderElection; le != nil {
+		if leaderElector, err = inClusterLeaderElection(*le); err != nil {
+			bail(err.Error())
+		}
+		go leaderElector.run()
+		level.Info(logger).Log("msg", "electing a leader to handle hooks", "lease", leaderElector.name, "identity", leaderElector.identity, "followers", leaderElector.followers)
+	}
+
+	if config.LoadShedding != nil {
+		loadShed = newLoadShedder(*config.LoadShedding)
+		go loadShed.monitor(nil)
+		level.Info(logger).Log("msg", "shedding load when overloaded", "inflight", config.LoadShedding.MaxInFlight, "latency", loadShed.maxLatency)
+	}
+
+	// the quota is shared by all listeners
+	globalQuota := newQuota(config.Quota)
+
+	listeners := config.ListenersWithDefault(listen)
+	var (
+		servers  []*http.Server
+		allHooks []*hookRouter
+		// the servers whose connections start with a PROXY protocol
+		// preface
+		proxied = map[*http.Server]bool{}
+	)
+	for i, l := range listeners {
+		if i > 0 && l.Listen == listeners[0].Listen {
+			bail(fmt.Sprintf("listener address %q is already in use by the default listener (see --listen)", l.Listen))
+		}
+		if l.Listen == adminListen {
+			bail(fmt.Sprintf("listener address %q is the same as --listen-admin", l.Listen))
+		}
+		var mux *http.ServeMux
+		if adminListen != "" {
+			var hooks *hookRouter
+			mux, hooks, err = hookMuxFromListener(configDir, apiBase, l, audit, globalQuota)
+			allHooks = append(allHooks, hooks)
+		} else {
+			mux, err = MuxFromListener(configDir, apiBase, l, audit, globalQuota)
+		}
 		if err != nil {
 			bail(err.Error())
 		}
-		route := "/hook/" + digest
-		http.Handle(route, handler)
-		println("endpoint", ep.Source, "using key", filepath.Join(configDir, ep.KeyPath), "at", route)
+		var handler http.Handler = mux
+		if l.AccessLog || l.AccessLogFormat != "" {
+			handler = withAccessLog(l.AccessLogFormat, handler)
+		}
+		server := &http.Server{Addr: l.Listen, Handler: handler}
+		if hardened {
+			server.Handler = withHardening(l.TLS != nil, handler)
+			hardenServer(server)
+		}
+		applyServerTimeouts(server, l.Timeouts)
+		proxied[server] = l.ProxyProtocol
+		if l.TLS != nil {
+			tlsConfig, challenges, err := TLSConfigFor(configDir, l.TLS)
+			if err != nil {
+				bail(err.Error())
+			}
+			server.TLSConfig = tlsConfig
+			if challenges != nil {
+				// answer ACME HTTP-01 challenges for this listener
+				challengeServer := &http.Server{Addr: l.TLS.Autocert.HTTPListen, Handler: challenges}
+				if hardened {
+					hardenServer(challengeServer)
+				}
+				applyServerTimeouts(challengeServer, nil)
+				servers = append(servers, challengeServer)
+			}
+		}
+		if err := configureHTTP2(server, l.H2C); err != nil {
+			bail(fmt.Sprintf("listener %q: %s", l.Listen, err.Error()))
+		}
+		servers = append(servers, server)
+	}
+
+	if adminListen != "" {
+		server := &http.Server{Addr: adminListen, Handler: opsMux(apiBase, allHooks)}
+		if hardened {
+			server.Handler = withHardening(false, server.Handler)
+			hardenServer(server)
+		}
+		applyServerTimeouts(server, config.Timeouts)
+		servers = append(servers, server)
+		level.Info(logger).Log("msg", "serving metrics, health, and admin endpoints on a separate listener", "listen", adminListen)
+	}
+
+	activated, err := systemdListeners()
+	if err != nil {
+		bail(err.Error())
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		bail(err.Error())
+	}
+	// the sockets listened on, by address, to pass on when restarting
+	listening := map[string]net.Listener{}
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		server := servers[i]
+		ln, ok := inherited[server.Addr]
+		if !ok {
+			if ln, err = listenOn(server.Addr, activated); err != nil {
+				bail(err.Error())
+			}
+		}
+		listening[server.Addr] = ln
+		switch {
+		case ok:
+			level.Info(logger).Log("msg", "serving on socket passed by previous process", "listen", server.Addr, "addr", ln.Addr())
+		case isSystemdAddr(server.Addr):
+			level.Info(logger).Log("msg", "serving on socket passed by systemd", "listen", server.Addr, "addr", ln.Addr())
+		}
+		if proxied[server] {
+			ln = proxyListener{ln}
+		}
+		go func() {
+			if server.TLSConfig != nil {
+				// the certificate comes from TLSConfig.GetCertificate
+				errs <- server.ServeTLS(ln, "", "")
+				return
+			}
+			errs <- server.Serve(ln)
+		}()
+	}
+
+	signalRestarted()
+
+	controls := make(chan control, 1)
+	notifyControl(controls)
+	for {
+		select {
+		case err := <-errs:
+			bail(err.Error())
+		case c := <-controls:
+			if !c.restart {
+				level.Info(logger).Log("msg", "shutting down", "signal", c.reason, "drain-timeout", drainTimeout)
+				break
+			}
+			level.Info(logger).Log("msg", "restarting, passing listeners to a new process", "signal", c.reason)
+			pid, err := restart(listening)
+			if err != nil {
+				level.Error(logger).Log("msg", "could not restart; carrying on serving", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "new process is serving; shutting down", "pid", pid, "drain-timeout", drainTimeout)
+		}
+		if err := shutdown(servers, drainTimeout); err != nil {
+			level.Warn(logger).Log("msg", "did not drain before the timeout", "err", err)
+		}
+		level.Info(logger).Log("msg", "shut down")
+		controlDone()
+		return
+	}
+}
+
+// MuxFromListener constructs a handler for all the endpoints of a
+// listener, each routed at `/hook/<digest>`, and the metrics, health,
+// version, and admin endpoints. If audit is not nil, each delivery is
+// recorded in it; if quota is not nil, requests over it are refused.
+func MuxFromListener(configDir, apiBase string, l Listener, audit *auditLog, quota *quota) (*http.ServeMux, error) {
+	mux, hooks, err := hookMuxFromListener(configDir, apiBase, l, audit, quota)
+	if err != nil {
+		return nil, err
 	}
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handleOps(mux, apiBase, hooks)
+	return mux, nil
+}
+
+// hookMuxFromListener constructs a handler for just the endpoints of
+// a listener (see MuxFromListener), and gives the router they are in.
+func hookMuxFromListener(configDir, apiBase string, l Listener, audit *auditLog, quota *quota) (*http.ServeMux, *hookRouter, error) {
+	mux := http.NewServeMux()
+	hooks := newHookRouter()
+	for _, ep := range l.Endpoints {
+		epAPI, epTenant := apiBase, endpointTenantOf(ep)
+		if epTenant != nil {
+			epAPI = epTenant.api
+		}
+		routes, err := RoutesFromEndpoint(configDir, epAPI, ep)
+		if err != nil {
+			return nil, nil, err
+		}
+		served := servedEndpoints.register(l.Listen, epAPI, ep, hooks)
+		source, sampling := ep.Source, ep.LogSampling
+		wrap := func(digest string, handler http.Handler) http.Handler {
+			if epTenant != nil {
+				endpointTenant.WithLabelValues(source, endpointLabel(digest), epTenant.name).Set(1)
+			}
+			if leaderElector != nil {
+				handler = withLeadership(leaderElector, handler)
+			}
+			handler = withMetrics(source, digest, handler)
+			handler = withStats(deliveryStats, l.Listen, source, digest, handler)
+			if rejectedPayloads != nil {
+				handler = withRejectedPayloads(rejectedPayloads, source, digest, handler)
+			}
+			var sinks []func(*deliveryRecord)
+			if recentDeliveries != nil {
+				sinks = append(sinks, recentDeliveries.add)
+			}
+			if deliveryCallbacks != nil {
+				sinks = append(sinks, deliveryCallbacks.add)
+			}
+			if auditEvents != nil {
+				sinks = append(sinks, auditEvents.add)
+			}
+			if sloBurnRates != nil {
+				sinks = append(sinks, sloBurnRates.add)
+			}
+			if failureAlerts != nil {
+				sinks = append(sinks, failureAlerts.add)
+			}
+			if kubeEventRecorder != nil {
+				sinks = append(sinks, kubeEventRecorder.add)
+			}
+			handler = withDeliveryRecords(source, digest, handler, sinks...)
+			if audit != nil {
+				handler = withAudit(audit, source, digest, handler)
+			}
+			handler = withErrorReporting(source, digest, handler)
+			handler = withTracing(source, digest, handler)
+			handler = withRequestLogger(source, digest, sampling, handler)
+			handler = withCorrelationID(handler)
+			if epTenant != nil {
+				// this is within the global quota, so a request refused
+				// by that doesn't count against the tenant's
+				handler = epTenant.quota.wrap(handler)
+			}
+			return handler
+		}
+		for _, r := range routes {
+			if hooks.has(r.Digest) {
+				return nil, nil, fmt.Errorf("the same key is used more than once on listener %q (route %s)", l.Listen, r.Digest)
+			}
+			hooks.set(r.Digest, wrap(r.Digest, r.Handler))
+			servedEndpoints.addRoute(served, r.Digest, r.KeyPath)
+			keyDesc := "inline key"
+			if r.KeyPath != "" {
+				keyDesc = "key " + filepath.Join(configDir, r.KeyPath)
+			}
+			level.Info(sourceLogger(ep.Source)).Log("msg", "serving endpoint", "key", keyDesc, "path", hookPath(r.Digest), "listen", l.Listen)
+		}
+		if ep.RotationGracePeriod != "" {
+			grace, _ := ep.rotationGracePeriod() // already validated
+			for _, r := range routes {
+				if r.KeyPath == "" {
+					continue
+				}
+				handlerFor, keyPath := r.handlerFor, r.KeyPath
+				rotation := newKeyRotation(ep.Source, configDir, r, grace, hooks, func(digest string, key []byte) http.Handler {
+					servedEndpoints.addRoute(served, digest, keyPath)
+					return wrap(digest, handlerFor(key))
+				})
+				go rotation.run()
+			}
+		}
+	}
+	if hookBasePath != "" {
+		mux.Handle(hookPath(""), http.StripPrefix(hookBasePath, loadShed.wrap(quota.wrap(hooks))))
+	} else {
+		mux.Handle(hookPrefix, loadShed.wrap(quota.wrap(hooks)))
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 	})
-
-	http.ListenAndServe(listen, nil)
+	return mux, hooks, nil
 }
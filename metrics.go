@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// Metrics are served at /metrics on each listener, in the Prometheus
+// exposition format; or in the OpenMetrics format, if asked for, which
+// includes the exemplars (trace IDs) for downstream latencies when
+// tracing is enabled.
+
+const metricsPath = "/metrics"
+
+var (
+	requestsShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "requests_shed_total",
+		Help:      "Requests refused because they were over the global quota, or shed under overload, by the limit exceeded.",
+	}, []string{"reason"})
+
+	hooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "hooks_received_total",
+		Help:      "Requests received by each endpoint.",
+	}, []string{"source", "endpoint"})
+	hooksVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "hooks_verified_total",
+		Help:      "Requests to each endpoint that passed its checks.",
+	}, []string{"source", "endpoint"})
+	hooksRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "hooks_rejected_total",
+		Help:      "Requests to each endpoint that were refused, by response status.",
+	}, []string{"source", "endpoint", "code"})
+
+	downstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "flux_recv",
+		Name:      "downstream_request_duration_seconds",
+		Help:      "Time taken to notify the API of each change, by result (ok or error).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "result"})
+	downstreamInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "downstream_requests_in_flight",
+		Help:      "Notifications waiting on a response from the API.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsShed, hooksReceived, hooksVerified, hooksRejected, downstreamDuration, downstreamInFlight)
+}
+
+// metricsHandler serves the metrics.
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+}
+
+// endpointLabel gives the label for an endpoint in metrics: the start
+// of its digest, which is enough to tell endpoints apart, but not to
+// find their URLs (anyone who can reach the endpoints can see the
+// metrics).
+func endpointLabel(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+// notificationsInFlight is the same as downstreamInFlight, for the
+// dashboard.
+var notificationsInFlight int64
+
+type metricsContextKey struct{}
+
+// deliveryProgress notes whether a request got as far as notifying
+// downstream, i.e., it passed all the checks.
+type deliveryProgress struct {
+	notified int32
+}
+
+// instrumentedServer times (and traces) each notification sent
+// downstream.
+type instrumentedServer struct {
+	fluxapi.Server
+	source string
+}
+
+func (s instrumentedServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if p, ok := ctx.Value(metricsContextKey{}).(*deliveryProgress); ok {
+		atomic.StoreInt32(&p.notified, 1)
+	}
+	ctx, span := startSpan(ctx, "notify", spanKindClient)
+	defer span.finish()
+	span.setAttr("flux_recv.change", changeSubject(change))
+
+	downstreamInFlight.Inc()
+	defer downstreamInFlight.Dec()
+	atomic.AddInt64(&notificationsInFlight, 1)
+	defer atomic.AddInt64(&notificationsInFlight, -1)
+	start := time.Now()
+	err := s.Server.NotifyChange(ctx, change)
+	result := "ok"
+	if err != nil {
+		result = "error"
+		span.setError(err.Error())
+	}
+	observer := downstreamDuration.WithLabelValues(s.source, result)
+	if ex, ok := observer.(prometheus.ExemplarObserver); ok && span != nil {
+		// the exemplar links the observation to the trace
+		ex.ObserveWithExemplar(time.Since(start).Seconds(), prometheus.Labels{"trace_id": span.traceIDHex()})
+	} else {
+		observer.Observe(time.Since(start).Seconds())
+	}
+	errorReporter.downstreamResult(ctx, s.source, err)
+	return err
+}
+
+// withMetrics counts the requests to an endpoint, and whether they
+// were verified or rejected. Like withAudit, it goes outside the
+// checks. A request that passes the checks counts as verified, even
+// if notifying downstream then fails (which shows in
+// flux_recv_downstream_request_duration_seconds).
+func withMetrics(source, digest string, next http.Handler) http.Handler {
+	endpoint := endpointLabel(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hooksReceived.WithLabelValues(source, endpoint).Inc()
+		progress := &deliveryProgress{}
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), metricsContextKey{}, progress)))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if atomic.LoadInt32(&progress.notified) == 1 || status < 300 {
+			hooksVerified.WithLabelValues(source, endpoint).Inc()
+		} else {
+			hooksRejected.WithLabelValues(source, endpoint, strconv.Itoa(status)).Inc()
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// downstreamCount gives the number of notifications timed in
+// flux_recv_downstream_request_duration_seconds for the source and
+// result given.
+func downstreamCount(t *testing.T, source, result string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "flux_recv_downstream_request_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["source"] == source && labels["result"] == result {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedDockerhub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	handler = withMetrics(DockerHub, fp, handler)
+	label := endpointLabel(fp)
+	assert.Len(t, label, 12)
+
+	notified := downstreamCount(t, DockerHub, "ok")
+
+	req := httptest.NewRequest("POST", "/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.True(t, called)
+	assert.Equal(t, float64(1), testutil.ToFloat64(hooksReceived.WithLabelValues(DockerHub, label)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(hooksVerified.WithLabelValues(DockerHub, label)))
+	assert.Equal(t, notified+1, downstreamCount(t, DockerHub, "ok"))
+
+	req = httptest.NewRequest("POST", "/hook/"+fp, bytes.NewReader([]byte("not JSON")))
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, 400, res.Code)
+	assert.Equal(t, float64(2), testutil.ToFloat64(hooksReceived.WithLabelValues(DockerHub, label)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(hooksVerified.WithLabelValues(DockerHub, label)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(hooksRejected.WithLabelValues(DockerHub, label, "400")))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The metrics, health and version endpoints, and the admin API (with
+// pprof), are served on each listener, alongside the hooks -- unless
+// --listen-admin is given, in which case they are served only on that
+// address, and the listeners serve only `/hook/...`. That way, the
+// port exposed to the internet needn't expose anything else.
+
+// handleOps adds the metrics, health, version, and admin endpoints
+// to the mux. It's ready once each of the hook routers given has
+// endpoints.
+func handleOps(mux *http.ServeMux, apiBase string, hooks ...*hookRouter) {
+	mux.Handle(metricsPath, metricsHandler())
+	mux.HandleFunc(healthzPath, healthz)
+	mux.HandleFunc(versionPath, serveVersion)
+	if adminToken != "" {
+		mux.Handle(adminPrefix, adminHandler(adminToken))
+	}
+	mux.Handle(readyzPath, readyz(hookRouters(hooks), apiBase))
+}
+
+// opsMux constructs a handler for just the metrics, health, version,
+// and admin endpoints, for the listeners whose hooks are given.
+func opsMux(apiBase string, hooks []*hookRouter) *http.ServeMux {
+	mux := http.NewServeMux()
+	handleOps(mux, apiBase, hooks...)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+// hookRouters are the routers of more than one listener.
+type hookRouters []*hookRouter
+
+// count gives the fewest endpoints routed by any of the routers, so
+// it's zero if any listener has none.
+func (hs hookRouters) count() int {
+	if len(hs) == 0 {
+		return 0
+	}
+	least := hs[0].count()
+	for _, h := range hs[1:] {
+		if n := h.count(); n < least {
+			least = n
+		}
+	}
+	return least
+}
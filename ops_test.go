@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeparateAdminListener(t *testing.T) {
+	defer func(reg *endpointRegistry) { servedEndpoints = reg }(servedEndpoints)
+	servedEndpoints = &endpointRegistry{}
+
+	l := Listener{Listen: ":8080", Endpoints: []Endpoint{{Source: GitHub, KeyPath: "github_key"}}}
+	hookMux, hooks, err := hookMuxFromListener("test/fixtures", defaultApiBase, l, nil, nil)
+	assert.NoError(t, err)
+	get := func(h http.Handler, path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	// the hook listener serves only hooks
+	for _, path := range []string{metricsPath, healthzPath, readyzPath, versionPath} {
+		assert.Equal(t, http.StatusNotFound, get(hookMux, path), path)
+	}
+	assert.Equal(t, http.StatusUnauthorized, get(hookMux, hookPrefix+keyDigest(loadFixture(t, "github_key"))))
+
+	ops := opsMux(defaultApiBase, []*hookRouter{hooks})
+	for _, path := range []string{metricsPath, healthzPath, readyzPath, versionPath} {
+		assert.Equal(t, http.StatusOK, get(ops, path), path)
+	}
+	assert.Equal(t, http.StatusNotFound, get(ops, hookPrefix+keyDigest(loadFixture(t, "github_key"))))
+
+	// it's ready only once every listener has endpoints
+	ops = opsMux(defaultApiBase, []*hookRouter{hooks, newHookRouter()})
+	assert.Equal(t, http.StatusServiceUnavailable, get(ops, readyzPath))
+}
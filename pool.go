@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// With `downstream.workers` in the config, notifications are sent to
+// fluxd by a fixed number of workers, from a bounded queue, so that a
+// burst of hooks can't open hundreds of connections to fluxd at once.
+// A request still waits for its notifications to be sent (so its
+// response says whether they were), but if the queue is full, the
+// notification fails straight away, and the source will retry.
+
+// defaultDownstreamQueueSize is the length of the queue, if not given.
+const defaultDownstreamQueueSize = 100
+
+var errNotifyQueueFull = errors.New("too many notifications are queued for the downstream API")
+
+var (
+	downstreamQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "downstream_queue_length",
+		Help:      "Notifications queued for a downstream worker.",
+	})
+	downstreamQueueFull = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "downstream_queue_full_total",
+		Help:      "Notifications that failed because the downstream queue was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(downstreamQueueLength, downstreamQueueFull)
+}
+
+// downstreamPool sends the notifications, if configured; otherwise
+// it's nil, and each request notifies fluxd itself.
+var downstreamPool *notifyPool
+
+type notifyJob struct {
+	ctx    context.Context
+	server fluxapi.Server
+	change fluxapi_v9.Change
+	done   chan error
+}
+
+type notifyPool struct {
+	jobs chan notifyJob
+	// length and full are the metrics for the queue
+	length prometheus.Gauge
+	full   prometheus.Counter
+}
+
+// newNotifyPool starts the workers given, taking notifications from a
+// queue of the size given.
+func newNotifyPool(workers, queueSize int) *notifyPool {
+	return startNotifyPool(workers, queueSize, downstreamQueueLength, downstreamQueueFull)
+}
+
+// startNotifyPool starts a pool, recording the length of its queue,
+// and when it's full, in the metrics given.
+func startNotifyPool(workers, queueSize int, length prometheus.Gauge, full prometheus.Counter) *notifyPool {
+	p := &notifyPool{jobs: make(chan notifyJob, queueSize), length: length, full: full}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *notifyPool) work() {
+	for job := range p.jobs {
+		p.length.Dec()
+		if err := job.ctx.Err(); err != nil {
+			// the request gave up while this was queued
+			job.done <- err
+			continue
+		}
+		job.done <- job.server.NotifyChange(job.ctx, job.change)
+	}
+}
+
+// notify sends the notification using a worker, and waits for the
+// result; with no pool, it's sent directly.
+func (p *notifyPool) notify(ctx context.Context, server fluxapi.Server, change fluxapi_v9.Change) error {
+	if p == nil {
+		return server.NotifyChange(ctx, change)
+	}
+	job := notifyJob{ctx: ctx, server: server, change: change, done: make(chan error, 1)}
+	p.length.Inc()
+	select {
+	case p.jobs <- job:
+	default:
+		p.length.Dec()
+		p.full.Inc()
+		return errNotifyQueueFull
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pooledServer sends notifications through the pool.
+type pooledServer struct {
+	fluxapi.Server
+	pool *notifyPool
+}
+
+func (s pooledServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	return s.pool.notify(ctx, s.Server, change)
+}
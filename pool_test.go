@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// blockingServer counts the notifications in flight, and holds each
+// until released.
+type blockingServer struct {
+	fluxapi.Server
+	inFlight, most int32
+	release        chan struct{}
+}
+
+func (s *blockingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		most := atomic.LoadInt32(&s.most)
+		if n <= most || atomic.CompareAndSwapInt32(&s.most, most, n) {
+			break
+		}
+	}
+	<-s.release
+	return nil
+}
+
+func TestNotifyPool(t *testing.T) {
+	server := &blockingServer{release: make(chan struct{})}
+	pool := newNotifyPool(2, 1)
+	change := fluxapi_v9.Change{Kind: fluxapi_v9.GitChange, Source: fluxapi_v9.GitUpdate{URL: "git@github.com:example/config.git"}}
+
+	// two are sent, and one waits in the queue
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pooledServer{Server: server, pool: pool}.NotifyChange(context.Background(), change)
+		}()
+	}
+	for atomic.LoadInt32(&server.inFlight) < 2 || len(pool.jobs) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// so the next is refused
+	assert.Equal(t, errNotifyQueueFull, pool.notify(context.Background(), server, change))
+
+	close(server.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.most))
+
+	// one that gave up while queued isn't sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	pool.jobs <- notifyJob{ctx: ctx, done: done}
+	assert.Equal(t, context.Canceled, <-done)
+
+	// with no pool, notifications are sent directly
+	assert.NoError(t, (*notifyPool)(nil).notify(context.Background(), server, change))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// With --pprof, the profiles from net/http/pprof are served under
+// /admin/debug/pprof/, behind the admin token, so that a long-running
+// flux-recv can be looked into (e.g., for goroutine leaks) without
+// rebuilding it.
+
+// pprofEnabled is whether to serve the profiles.
+var pprofEnabled bool
+
+// pprofHandler serves the profiles, for paths under
+// adminPrefix+"debug/pprof/".
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// pprof.Index expects the paths to start with /debug/pprof/
+	return http.StripPrefix(adminPrefix[:len(adminPrefix)-1], mux)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Behind a TCP load balancer (e.g., an AWS NLB, or HAProxy in TCP
+// mode), the peer of each connection is the load balancer, rather
+// than the client. With the PROXY protocol, the load balancer starts
+// each connection with a preface giving the client's address, which
+// is then used as the connection's remote address -- so it's what's
+// logged, and what the IP allowlists and rate limits see.
+//
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+const (
+	// proxyHeaderTimeout is how long a connection has to send its
+	// PROXY protocol preface
+	proxyHeaderTimeout = 10 * time.Second
+	// proxyV1MaxLength is the longest a version 1 preface can be,
+	// including the CRLF
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener expects the PROXY protocol preface at the start of
+// each connection it accepts. The preface is read on the first use of
+// the connection, rather than in Accept, so a slow client doesn't
+// hold up others.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol preface.
+// If the preface is missing or can't be parsed, reading from the
+// connection gives the error.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readPreface() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyPreface(c.r)
+		if err != nil {
+			c.err = fmt.Errorf("PROXY protocol preface from %s: %s", c.remote, err.Error())
+			level.Debug(logger).Log("msg", "closing connection without a valid PROXY protocol preface", "peer", c.remote, "err", err)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readPreface()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr gives the client's address, as given in the preface; or,
+// if the preface says the connection is from the load balancer itself
+// (e.g., for a health check), the peer's address.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readPreface()
+	return c.remote
+}
+
+// readProxyPreface reads a version 1 or version 2 PROXY protocol
+// preface, and gives the source address; this is nil if it's a
+// connection made by the proxy itself, or for a protocol other than
+// TCP.
+func readProxyPreface(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case 'P':
+		return readProxyV1(r)
+	case '\r':
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no PROXY protocol preface")
+}
+
+// readProxyV1 reads the human-readable preface, e.g.,
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("version 1 preface is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("malformed version 1 preface")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q in version 1 preface", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed version 1 preface")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed source address in version 1 preface")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary preface: the signature, a byte each
+// for the version and command, and the address family and protocol,
+// then the length of the addresses (and any TLVs, which are skipped)
+// that follow.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("no PROXY protocol preface")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d in version 2 preface", header[12]>>4)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	switch command := header[12] & 0xf; command {
+	case 0x0: // LOCAL, e.g., a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown command %d in version 2 preface", command)
+	}
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default: // e.g., UDP, or a Unix socket
+		return nil, nil
+	}
+	// source address, destination address, source port, destination
+	// port
+	if len(rest) < 2*ipLen+4 {
+		return nil, errors.New("version 2 preface is too short for its addresses")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, rest[:ipLen])
+	port := binary.BigEndian.Uint16(rest[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientIP(r).String()))
+	})}
+	go server.Serve(proxyListener{l})
+	defer server.Close()
+
+	// sends the preface then a request, and gives the client IP seen
+	// by the handler
+	clientIPWith := func(preface string) (string, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		conn.Write([]byte(preface + "GET / HTTP/1.0\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return "", errors.New(res.Status)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	ip, err := clientIPWith("PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip)
+	ip, err = clientIPWith("PROXY TCP6 2001:db8::1 ::1 56324 443\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+	ip, err = clientIPWith("PROXY UNKNOWN\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	v2 := string(proxyV2Signature) + "\x21\x11\x00\x0c" + // PROXY, TCP over IPv4, 12 bytes
+		"\xc0\x00\x02\x07" + "\x7f\x00\x00\x01" + "\xdb\xc4" + "\x01\xbb"
+	ip, err = clientIPWith(v2)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.7", ip)
+	local := string(proxyV2Signature) + "\x20\x00\x00\x00" // LOCAL
+	ip, err = clientIPWith(local)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	// the request is refused if there's no preface, or it's
+	// malformed
+	for _, bad := range []string{"", "PROXY TCP4 nonsense\r\n", string(proxyV2Signature) + "\x31\x11\x00\x00"} {
+		_, err = clientIPWith(bad)
+		assert.Error(t, err, bad)
+	}
+}
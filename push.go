@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+)
+
+// Some filters need to know more about a push than is in the change
+// sent to fluxd: e.g., the repo's default branch, or the tag of an
+// image pushed. The source handlers that can tell put what the
+// payload says in the context in which the change is notified, as
+// pushDetails, for the filters to find.
+
+// pushDetails are what the payload of a push says, beyond the change
+// itself. Those a source doesn't give are left empty.
+type pushDetails struct {
+	// Event is the kind of event the change is from (see
+	// eventtypes.go)
+	Event string
+	// DefaultBranch is the repo's default branch
+	DefaultBranch string
+	// Tag is the tag of the image pushed
+	Tag string
+	// Digest is the digest of the image pushed
+	Digest string
+	// HeadCommit is the commit the branch (or tag) is now at
+	HeadCommit commitDetails
+}
+
+// commitDetails are what the payload says about a commit.
+type commitDetails struct {
+	SHA       string
+	Message   string
+	Author    commitPerson
+	Committer commitPerson
+}
+
+// commitPerson is the author or committer of a commit; a source may
+// give only some of the fields (e.g., not the username).
+type commitPerson struct {
+	Name, Email, Username string
+}
+
+// DefaultBranchSources are the sources whose push payloads give the
+// repo's default branch, and so for which defaultBranchOnly is
+// meaningful.
+var DefaultBranchSources = map[string]bool{}
+
+// ImageTagSources are the sources whose payloads give the tag of the
+// image pushed, and so for which tagPattern is meaningful.
+var ImageTagSources = map[string]bool{}
+
+// CommitMessageSources are the sources whose payloads give the head
+// commit's message, and so for which skipMarkers is meaningful.
+var CommitMessageSources = map[string]bool{}
+
+// CommitAuthorSources are the sources whose payloads give the head
+// commit's author, and so for which ignoreAuthors is meaningful.
+var CommitAuthorSources = map[string]bool{}
+
+// CommitCommitterSources are the sources whose payloads give the head
+// commit's committer, as well as its author, and so for which
+// ignoreCommitters is meaningful.
+var CommitCommitterSources = map[string]bool{}
+
+type pushDetailsKey struct{}
+
+// withPushDetails gives the context the details of the push the
+// change notified in it is from.
+func withPushDetails(ctx context.Context, details *pushDetails) context.Context {
+	return context.WithValue(ctx, pushDetailsKey{}, details)
+}
+
+// pushDetailsFrom gives the details of the push, or nil if the
+// source gave none.
+func pushDetailsFrom(ctx context.Context) *pushDetails {
+	details, _ := ctx.Value(pushDetailsKey{}).(*pushDetails)
+	return details
+}
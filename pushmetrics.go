@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Where Prometheus can't reach flux-recv to scrape it (e.g., in an
+// edge cluster that only allows outgoing connections), the metrics can
+// be pushed on an interval instead: to a Prometheus Pushgateway, or to
+// an OpenTelemetry collector using OTLP over HTTP with the JSON
+// encoding. For OTLP, the metrics gathered for /metrics are
+// translated, with counters and histograms as cumulative sums and
+// histograms.
+
+const (
+	metricsPushPushgateway = "pushgateway"
+	metricsPushOTLP        = "otlp"
+
+	// metricsPushJob is the job the metrics are pushed to the
+	// Pushgateway as
+	metricsPushJob = "flux_recv"
+
+	otlpTemporalityCumulative = 2
+)
+
+// activePusher pushes the metrics, if --push-metrics is given;
+// otherwise it's nil. It's used to push them one last time at
+// shutdown.
+var activePusher *metricsPusher
+
+type metricsPusher struct {
+	url      string
+	format   string
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	instance string
+	// start is when the cumulative metrics started counting
+	start time.Time
+}
+
+// newMetricsPusher constructs a pusher sending the metrics to url
+// every interval, in the format given (pushgateway or otlp).
+func newMetricsPusher(url, format string, interval time.Duration) (*metricsPusher, error) {
+	if format != metricsPushPushgateway && format != metricsPushOTLP {
+		return nil, fmt.Errorf("metrics push format %q is not one of %s, %s", format, metricsPushPushgateway, metricsPushOTLP)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("metrics push interval must be positive")
+	}
+	instance, _ := os.Hostname()
+	return &metricsPusher{
+		url:      url,
+		format:   format,
+		interval: interval,
+		gatherer: prometheus.DefaultGatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		instance: instance,
+		start:    time.Now(),
+	}, nil
+}
+
+// run pushes the metrics, periodically.
+func (p *metricsPusher) run() {
+	for range time.Tick(p.interval) {
+		if err := p.push(); err != nil {
+			level.Error(logger).Log("component", "metrics", "msg", "could not push metrics", "url", redactURL(p.url), "err", err)
+		}
+	}
+}
+
+func (p *metricsPusher) push() error {
+	if p.format == metricsPushPushgateway {
+		// this replaces the metrics pushed before, for this instance
+		return push.New(p.url, metricsPushJob).
+			Gatherer(p.gatherer).
+			Grouping("instance", p.instance).
+			Client(p.client).
+			Push()
+	}
+
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(p.otlpRequest(families, time.Now()))
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of metrics, as much of it as is needed here.
+type (
+	otlpNumberPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          float64        `json:"asDouble"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"`
+		Sum               float64        `json:"sum"`
+		BucketCounts      []string       `json:"bucketCounts"`
+		ExplicitBounds    []float64      `json:"explicitBounds"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+	otlpSummaryPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"`
+		Sum               float64        `json:"sum"`
+		QuantileValues    []otlpQuantile `json:"quantileValues,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryPoint `json:"dataPoints"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+	}
+	otlpScopeMetrics struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpMetricsRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+)
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpLabels(m *dto.Metric) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for _, l := range m.GetLabel() {
+		attrs = append(attrs, otlpAttr(l.GetName(), l.GetValue()))
+	}
+	return attrs
+}
+
+// finite is false for the values JSON can't encode (e.g., a quantile
+// of a summary with no observations).
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// otlpRequest translates the metric families gathered to OTLP.
+func (p *metricsPusher) otlpRequest(families []*dto.MetricFamily, now time.Time) otlpMetricsRequest {
+	start, ts := unixNano(p.start), unixNano(now)
+	var scope otlpScopeMetrics
+	scope.Scope.Name = "flux-recv"
+	for _, f := range families {
+		out := otlpMetric{Name: f.GetName(), Description: f.GetHelp()}
+		switch f.GetType() {
+		case dto.MetricType_COUNTER:
+			out.Sum = &otlpSum{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+			for _, m := range f.GetMetric() {
+				out.Sum.DataPoints = append(out.Sum.DataPoints, otlpNumberPoint{Attributes: otlpLabels(m), StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: m.GetCounter().GetValue()})
+			}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			out.Gauge = &otlpGauge{}
+			for _, m := range f.GetMetric() {
+				v := m.GetGauge().GetValue()
+				if f.GetType() == dto.MetricType_UNTYPED {
+					v = m.GetUntyped().GetValue()
+				}
+				if finite(v) {
+					out.Gauge.DataPoints = append(out.Gauge.DataPoints, otlpNumberPoint{Attributes: otlpLabels(m), TimeUnixNano: ts, AsDouble: v})
+				}
+			}
+		case dto.MetricType_HISTOGRAM:
+			out.Histogram = &otlpHistogram{AggregationTemporality: otlpTemporalityCumulative}
+			for _, m := range f.GetMetric() {
+				h := m.GetHistogram()
+				point := otlpHistogramPoint{
+					Attributes:        otlpLabels(m),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      ts,
+					Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+					Sum:               h.GetSampleSum(),
+				}
+				// Prometheus buckets are cumulative, and the +Inf
+				// bucket is implied; OTLP buckets aren't, and it's not
+				var below uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-below, 10))
+					below = b.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-below, 10))
+				out.Histogram.DataPoints = append(out.Histogram.DataPoints, point)
+			}
+		case dto.MetricType_SUMMARY:
+			out.Summary = &otlpSummary{}
+			for _, m := range f.GetMetric() {
+				s := m.GetSummary()
+				point := otlpSummaryPoint{
+					Attributes:        otlpLabels(m),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      ts,
+					Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.GetQuantile() {
+					if finite(q.GetValue()) {
+						point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+					}
+				}
+				out.Summary.DataPoints = append(out.Summary.DataPoints, point)
+			}
+		default:
+			continue
+		}
+		scope.Metrics = append(scope.Metrics, out)
+	}
+
+	var resource otlpResourceMetrics
+	resource.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", "flux-recv")}
+	if p.instance != "" {
+		resource.Resource.Attributes = append(resource.Resource.Attributes, otlpAttr("service.instance.id", p.instance))
+	}
+	resource.ScopeMetrics = []otlpScopeMetrics{scope}
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{resource}}
+}
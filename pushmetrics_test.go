@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGatherer() prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_hooks_total", Help: "Hooks."}, []string{"source"})
+	counter.WithLabelValues(GitHub).Add(3)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds", Help: "Durations.", Buckets: []float64{0.1, 1}})
+	for _, v := range []float64{0.05, 0.5, 0.6, 5} {
+		histogram.Observe(v)
+	}
+	reg.MustRegister(counter, histogram)
+	return reg
+}
+
+func TestPushMetricsPushgateway(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer gateway.Close()
+
+	p, err := newMetricsPusher(gateway.URL, metricsPushPushgateway, time.Minute)
+	assert.NoError(t, err)
+	p.gatherer, p.instance = testGatherer(), "flux-recv-0"
+	assert.NoError(t, p.push())
+	assert.Equal(t, "PUT", method)
+	assert.Equal(t, "/metrics/job/flux_recv/instance/flux-recv-0", path)
+	assert.Contains(t, body, "test_hooks_total")
+}
+
+func TestPushMetricsOTLP(t *testing.T) {
+	var request otlpMetricsRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+	}))
+	defer collector.Close()
+
+	p, err := newMetricsPusher(collector.URL, metricsPushOTLP, time.Minute)
+	assert.NoError(t, err)
+	p.gatherer, p.instance = testGatherer(), "flux-recv-0"
+	assert.NoError(t, p.push())
+
+	assert.Len(t, request.ResourceMetrics, 1)
+	resource := request.ResourceMetrics[0]
+	assert.Contains(t, resource.Resource.Attributes, otlpAttr("service.instance.id", "flux-recv-0"))
+	metrics := map[string]otlpMetric{}
+	for _, m := range resource.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	sum := metrics["test_hooks_total"].Sum
+	assert.NotNil(t, sum)
+	assert.True(t, sum.IsMonotonic)
+	assert.Equal(t, otlpTemporalityCumulative, sum.AggregationTemporality)
+	assert.Equal(t, 3.0, sum.DataPoints[0].AsDouble)
+	assert.Equal(t, []otlpKeyValue{otlpAttr("source", GitHub)}, sum.DataPoints[0].Attributes)
+
+	// the buckets are no longer cumulative, and there's one for
+	// everything over the last bound
+	histogram := metrics["test_duration_seconds"].Histogram
+	assert.NotNil(t, histogram)
+	point := histogram.DataPoints[0]
+	assert.Equal(t, "4", point.Count)
+	assert.Equal(t, []float64{0.1, 1}, point.ExplicitBounds)
+	assert.Equal(t, []string{"1", "2", "1"}, point.BucketCounts)
+
+	_, err = newMetricsPusher(collector.URL, "statsd", time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// quota limits the requests handled at once, and per second, across
+// all endpoints and listeners. Requests over the quota are refused
+// with 429 Too Many Requests straight away, rather than waiting, so
+// that a burst of deliveries can't pile up unboundedly; the providers
+// will retry (or let someone know).
+type quota struct {
+	slots   chan struct{} // nil means no limit on concurrent requests
+	limiter *rate.Limiter // nil means no limit on the rate
+	// tenant is the tenant whose quota this is, if it's not the
+	// global quota
+	tenant string
+}
+
+// concurrencyRetryAfter is the Retry-After given when there are too
+// many requests in flight; there's no way to tell when one will
+// finish, so this is a guess.
+const concurrencyRetryAfter = time.Second
+
+func newQuota(q *Quota) *quota {
+	if q == nil {
+		return nil
+	}
+	res := &quota{}
+	if q.MaxConcurrent > 0 {
+		res.slots = make(chan struct{}, q.MaxConcurrent)
+	}
+	if q.RateLimit != nil {
+		res.limiter = newLimiter(q.RateLimit)
+	}
+	return res
+}
+
+// wrap refuses requests over the quota, and counts them in the
+// requestsShed metric (or for a tenant, tenantRequestsShed). These
+// aren't logged, since logging each of them would only add to the
+// load.
+func (q *quota) wrap(next http.Handler) http.Handler {
+	if q == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q.limiter != nil {
+			if ok, retryAfter := allow(q.limiter); !ok {
+				q.shed("rate")
+				tooManyRequests(w, retryAfter)
+				return
+			}
+		}
+		if q.slots != nil {
+			select {
+			case q.slots <- struct{}{}:
+				defer func() { <-q.slots }()
+			default:
+				q.shed("concurrency")
+				tooManyRequests(w, concurrencyRetryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (q *quota) shed(reason string) {
+	if q.tenant != "" {
+		tenantRequestsShed.WithLabelValues(q.tenant, reason).Inc()
+		return
+	}
+	requestsShed.WithLabelValues(reason).Inc()
+}
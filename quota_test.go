@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaRate(t *testing.T) {
+	q := newQuota(&Quota{RateLimit: &RateLimit{PerSecond: 0.5, Burst: 1}})
+	handler := q.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	before := testutil.ToFloat64(requestsShed.WithLabelValues("rate"))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/def", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "2", res.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(requestsShed.WithLabelValues("rate")))
+}
+
+func TestQuotaConcurrency(t *testing.T) {
+	q := newQuota(&Quota{MaxConcurrent: 1})
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := q.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	before := testutil.ToFloat64(requestsShed.WithLabelValues("concurrency"))
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+		done <- res.Code
+	}()
+	<-entered
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(requestsShed.WithLabelValues("concurrency")))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// the slot is free again
+	go func() { <-entered }()
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+}
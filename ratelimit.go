@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/time/rate"
+)
+
+// ipLimiterExpiry is how long a per-IP limiter is kept after the
+// last request from that IP.
+const ipLimiterExpiry = 10 * time.Minute
+
+func newLimiter(l *RateLimit) *rate.Limiter {
+	burst := l.Burst
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(l.PerSecond)))
+	}
+	return rate.NewLimiter(rate.Limit(l.PerSecond), burst)
+}
+
+// ipLimiters keeps a limiter for each client IP.
+type ipLimiters struct {
+	limit *RateLimit
+
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastPrune time.Time
+}
+
+type ipLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiters(l *RateLimit) *ipLimiters {
+	return &ipLimiters{limit: l, limiters: map[string]*ipLimiter{}}
+}
+
+func (l *ipLimiters) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastPrune) > ipLimiterExpiry {
+		for k, v := range l.limiters {
+			if now.Sub(v.lastSeen) > ipLimiterExpiry {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	lim, ok := l.limiters[ip]
+	if !ok {
+		lim = &ipLimiter{Limiter: newLimiter(l.limit)}
+		l.limiters[ip] = lim
+	}
+	lim.lastSeen = now
+	return lim.Limiter
+}
+
+// allow reports whether the limiter has room for a request now, and
+// if not, how long until it will.
+func allow(lim *rate.Limiter) (bool, time.Duration) {
+	res := lim.Reserve()
+	if !res.OK() {
+		return false, time.Second
+	}
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// tooManyRequests responds with 429, and a Retry-After header saying
+// (in whole seconds) when to try again.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// withRateLimits refuses requests over the endpoint's rate limit,
+// and over the per-IP rate limit; either may be nil, meaning no
+// limit.
+func withRateLimits(source string, endpoint *rate.Limiter, perIP *ipLimiters, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if perIP != nil {
+			ip := clientIP(r).String()
+			if ok, retryAfter := allow(perIP.get(ip)); !ok {
+				tooManyRequests(w, retryAfter)
+				level.Warn(requestLogger(r)).Log("msg", "rate limited requests from client", "ip", ip)
+				return
+			}
+		}
+		if endpoint != nil {
+			if ok, retryAfter := allow(endpoint); !ok {
+				tooManyRequests(w, retryAfter)
+				level.Warn(requestLogger(r)).Log("msg", "rate limited requests to endpoint")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimits(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(h http.Handler, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hook/abc", nil)
+		req.RemoteAddr = remote
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("per endpoint", func(t *testing.T) {
+		h := withRateLimits(GitHub, newLimiter(&RateLimit{PerSecond: 0.5, Burst: 2}), nil, ok)
+		assert.Equal(t, 200, send(h, "10.0.0.1:1234").Code)
+		assert.Equal(t, 200, send(h, "10.0.0.2:1234").Code)
+		res := send(h, "10.0.0.3:1234")
+		assert.Equal(t, 429, res.Code)
+		assert.Equal(t, "2", res.Header().Get("Retry-After"))
+	})
+
+	t.Run("per IP", func(t *testing.T) {
+		h := withRateLimits(GitHub, nil, newIPLimiters(&RateLimit{PerSecond: 1}), ok)
+		assert.Equal(t, 200, send(h, "10.0.0.1:1234").Code)
+		assert.Equal(t, 429, send(h, "10.0.0.1:5678").Code)
+		assert.Equal(t, 200, send(h, "10.0.0.2:1234").Code)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+// With the admin API enabled, the most recent deliveries are kept,
+// much like the delivery log a source like GitHub shows, and served at
+// /admin/deliveries. They can be persisted to a file, so they survive
+// a restart.
+
+// defaultRecentDeliveries is how many deliveries are kept, if not
+// given in the config.
+const defaultRecentDeliveries = 100
+
+// recentDeliveries keeps the recent deliveries, if the admin API is
+// enabled; otherwise it's nil.
+var recentDeliveries *deliveryLog
+
+// deliveryRecord is what's kept of a delivery.
+type deliveryRecord struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	Endpoint   string    `json:"endpoint"`
+	DeliveryID string    `json:"deliveryID,omitempty"`
+	// CorrelationID is the delivery ID, or one made up if the source
+	// didn't give one
+	CorrelationID string `json:"correlationID,omitempty"`
+	ClientIP      string `json:"clientIP"`
+	Status        int    `json:"status"`
+	Reason        string `json:"reason,omitempty"`
+	// DurationMillis is the time taken to handle the request,
+	// including notifying downstream
+	DurationMillis int64 `json:"durationMillis"`
+	// Changes are the changes parsed from the payload, with the
+	// result of notifying downstream of each
+	Changes []auditChange `json:"changes,omitempty"`
+
+	mu sync.Mutex
+}
+
+// deliveryLog is a ring buffer of deliveries. A record isn't changed
+// once it's added.
+type deliveryLog struct {
+	mu      sync.Mutex
+	records []*deliveryRecord
+	next    int
+	full    bool
+
+	// path is the file the deliveries are persisted to, if any
+	path  string
+	dirty chan struct{}
+}
+
+// newDeliveryLog constructs a log keeping the last size deliveries.
+// If path is given, deliveries are loaded from it, if it exists, and
+// written to it as they are added.
+func newDeliveryLog(size int, path string) (*deliveryLog, error) {
+	d := &deliveryLog{records: make([]*deliveryRecord, size), path: path}
+	if path == "" {
+		return d, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		var saved []*deliveryRecord
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, err
+		}
+		for _, rec := range saved {
+			d.add(rec)
+		}
+	}
+	d.dirty = make(chan struct{}, 1)
+	go d.persist()
+	return d, nil
+}
+
+func (d *deliveryLog) add(rec *deliveryRecord) {
+	d.mu.Lock()
+	d.records[d.next] = rec
+	d.next = (d.next + 1) % len(d.records)
+	if d.next == 0 {
+		d.full = true
+	}
+	d.mu.Unlock()
+	if d.dirty != nil {
+		select {
+		case d.dirty <- struct{}{}:
+		default: // already due to be written
+		}
+	}
+}
+
+// list gives the deliveries kept, most recent first.
+func (d *deliveryLog) list() []*deliveryRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.next
+	if d.full {
+		n = len(d.records)
+	}
+	out := make([]*deliveryRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, d.records[(d.next-i+len(d.records))%len(d.records)])
+	}
+	return out
+}
+
+// persist writes the deliveries to the file whenever there's been
+// another; writes are coalesced, so a burst of deliveries doesn't
+// mean a burst of writes.
+func (d *deliveryLog) persist() {
+	for range d.dirty {
+		if err := d.save(); err != nil {
+			level.Error(logger).Log("component", "deliveries", "msg", "could not save recent deliveries", "err", err)
+		}
+	}
+}
+
+func (d *deliveryLog) save() error {
+	list := d.list()
+	// oldest first, so they're added back in order when loaded
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), ".deliveries")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+type recentContextKey struct{}
+
+// recentChangeResult adds the result of notifying a change to the
+// record of the delivery, if there is one.
+func recentChangeResult(ctx context.Context, change fluxapi_v9.Change, result string) {
+	rec, ok := ctx.Value(recentContextKey{}).(*deliveryRecord)
+	if !ok {
+		return
+	}
+	rec.mu.Lock()
+	rec.Changes = append(rec.Changes, newAuditChange(change, result))
+	rec.mu.Unlock()
+}
+
+// failedChanges gives the changes that fluxd could not be notified
+// of, with the error from each.
+func (rec *deliveryRecord) failedChanges() []string {
+	var failed []string
+	for _, c := range rec.Changes {
+		if c.Result != "ok" && c.Result != "filtered" {
+			failed = append(failed, c.Subject+": "+c.Result)
+		}
+	}
+	return failed
+}
+
+// withDeliveryRecords makes a record of each request to the endpoint,
+// and gives it to each of the sinks (e.g., the log of recent
+// deliveries) once the request is handled. Like withAudit, it goes
+// outside the checks.
+func withDeliveryRecords(source, digest string, next http.Handler, sinks ...func(*deliveryRecord)) http.Handler {
+	if len(sinks) == 0 {
+		return next
+	}
+	endpoint := endpointLabel(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &deliveryRecord{
+			Time:          start.UTC(),
+			Source:        source,
+			Endpoint:      endpoint,
+			DeliveryID:    deliveryID(r),
+			CorrelationID: correlationID(r.Context()),
+			ClientIP:      clientIP(r).String(),
+		}
+		aw := &auditResponseWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), recentContextKey{}, rec)))
+
+		rec.mu.Lock()
+		rec.Status = aw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		if rec.Status >= 400 {
+			rec.Reason = aw.reasonText()
+		}
+		rec.DurationMillis = int64(time.Since(start) / time.Millisecond)
+		rec.mu.Unlock()
+		for _, sink := range sinks {
+			sink(rec)
+		}
+	})
+}
+
+// adminDeliveries responds with the recent deliveries, most recent
+// first.
+func adminDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var list []*deliveryRecord
+	if recentDeliveries != nil {
+		list = scopedDeliveries(r, recentDeliveries.list())
+	}
+	writeJSON(w, struct {
+		Deliveries []*deliveryRecord `json:"deliveries"`
+	}{list})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentDeliveries(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+
+	recent, err := newDeliveryLog(defaultRecentDeliveries, "")
+	assert.NoError(t, err)
+	hookServer := httptest.NewServer(withDeliveryRecords(GitHub, fp, handler, recent.add))
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "github_payload")
+	send := func(signature string) {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", "d-1")
+		req.Header.Set("X-Hub-Signature", signature)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	send(xHubSignature(payload, loadFixture(t, "github_key")))
+	send(xHubSignature(payload, []byte("wrong key")))
+
+	list := recent.list()
+	if !assert.Len(t, list, 2) {
+		return
+	}
+	// most recent first
+	bad, ok := list[0], list[1]
+	assert.Equal(t, 200, ok.Status)
+	assert.Equal(t, endpointLabel(fp), ok.Endpoint)
+	assert.Equal(t, "d-1", ok.DeliveryID)
+	assert.Equal(t, []auditChange{{Kind: "git", Subject: "git@github.com:Codertocat/Hello-World.git", Result: "ok"}}, ok.Changes)
+	assert.Equal(t, 401, bad.Status)
+	assert.Equal(t, "The GitHub signature header is invalid.", bad.Reason)
+	assert.Empty(t, bad.Changes)
+}
+
+func TestDeliveryLogRing(t *testing.T) {
+	recent, err := newDeliveryLog(3, "")
+	assert.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		recent.add(&deliveryRecord{Status: i})
+	}
+	var statuses []int
+	for _, rec := range recent.list() {
+		statuses = append(statuses, rec.Status)
+	}
+	assert.Equal(t, []int{5, 4, 3}, statuses)
+}
+
+func TestDeliveryLogPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-deliveries")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deliveries.json")
+
+	recent, err := newDeliveryLog(10, path)
+	assert.NoError(t, err)
+	recent.add(&deliveryRecord{Source: GitHub, Status: 200})
+	recent.add(&deliveryRecord{Source: GitLab, Status: 401})
+	assert.NoError(t, recent.save())
+
+	loaded, err := newDeliveryLog(10, path)
+	assert.NoError(t, err)
+	list := loaded.list()
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, GitLab, list[0].Source)
+		assert.Equal(t, GitHub, list[1].Source)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Payloads are only logged, for debugging, with --log-payloads; and
+// then they are redacted first, since they can contain credentials
+// (e.g., a token in a repository URL, or a secret in the webhook
+// settings echoed back by the provider).
+
+// defaultRedactKeys are the patterns for keys whose values are always
+// redacted; the config can add to these with `redactKeys`.
+var defaultRedactKeys = []string{
+	"token",
+	"passw(or)?d",
+	"secret",
+	"authorization",
+	"credential",
+	"api[_-]?key",
+	"private[_-]?key",
+}
+
+// maxLoggedPayloadBytes is how much of a (redacted) payload is logged.
+const maxLoggedPayloadBytes = 512
+
+// payloadRedactor is used to redact payloads before they are logged;
+// if it's nil, payloads are not logged.
+var payloadRedactor *redactor
+
+type redactor struct {
+	keys *regexp.Regexp
+	// fields matches `key: value` or `key=value` in text that can't
+	// be parsed as JSON
+	fields *regexp.Regexp
+}
+
+var urlCredentialsRE = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s"]+@`)
+
+// newRedactor constructs a redactor for the default key patterns plus
+// those given, which are (case-insensitive) regular expressions.
+func newRedactor(keys []string) (*redactor, error) {
+	for _, k := range keys {
+		if _, err := regexp.Compile(k); err != nil {
+			return nil, fmt.Errorf("redactKeys: %q is not a valid regular expression: %s", k, err.Error())
+		}
+	}
+	alternatives := "(?:" + strings.Join(append(append([]string{}, defaultRedactKeys...), keys...), ")|(?:") + ")"
+	return &redactor{
+		keys:   regexp.MustCompile(`(?i)` + alternatives),
+		fields: regexp.MustCompile(`(?i)("?[\w.-]*(?:` + alternatives + `)[\w.-]*"?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^\s,&}\]]+)`),
+	}, nil
+}
+
+// redact gives the payload with the values of matching keys, and any
+// credentials in URLs, redacted.
+func (r *redactor) redact(payload []byte) string {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil && !dec.More() {
+		if out, err := json.Marshal(r.redactValue(v)); err == nil {
+			return string(out)
+		}
+	}
+	s := r.fields.ReplaceAllString(string(payload), `${1}"`+redacted+`"`)
+	return urlCredentialsRE.ReplaceAllString(s, "${1}"+redacted+"@")
+}
+
+func (r *redactor) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if r.keys.MatchString(k) {
+				v[k] = redacted
+			} else {
+				v[k] = r.redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	case string:
+		return urlCredentialsRE.ReplaceAllString(v, "${1}"+redacted+"@")
+	}
+	return v
+}
+
+// fragment gives the start of the redacted payload, for logging.
+func (r *redactor) fragment(payload []byte) string {
+	s := r.redact(payload)
+	if len(s) > maxLoggedPayloadBytes {
+		return fmt.Sprintf("%s... (%d bytes)", s[:maxLoggedPayloadBytes], len(payload))
+	}
+	return s
+}
+
+// redactURL gives the URL with any credentials in it redacted, for
+// logging.
+func redactURL(u string) string {
+	return urlCredentialsRE.ReplaceAllString(u, "${1}"+redacted+"@")
+}
+
+// logPayload logs a warning about the request, with the keyvals
+// given, and a redacted fragment of the payload if logging payloads
+// is enabled.
+func logPayload(r *http.Request, payload []byte, keyvals ...interface{}) {
+	if payloadRedactor != nil {
+		keyvals = append(keyvals, "payload", payloadRedactor.fragment(payload))
+	}
+	level.Warn(requestLogger(r)).Log(keyvals...)
+}
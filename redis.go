@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Redis client, just enough of one for deduplicating deliveries
+// across replicas: it sends commands in the RESP protocol over one
+// connection, which is reconnected if it fails. Commands are sent one
+// at a time; deliveries are few enough that this isn't a bottleneck.
+
+const redisTimeout = 5 * time.Second
+
+// errRedisNil is the reply to e.g., GET of a key that isn't there.
+var errRedisNil = errors.New("redis: nil")
+
+type redisClient struct {
+	addr     string
+	tls      *tls.Config
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient constructs a client for a URL of the form
+// redis://[:password@]host[:port][/db], or rediss:// for TLS. It
+// doesn't connect until the first command.
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisClient{}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("the scheme %q is not redis or rediss", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("the Redis URL has no host")
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("the Redis database %q is not a number", db)
+		}
+	}
+	return c, nil
+}
+
+// do sends the command, and reads the reply: a string, an int64, or
+// nil for a nil reply (along with errRedisNil). If the connection
+// fails, the command is tried once more on a new connection; so it's
+// only for commands that give the same result when repeated.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	return c.exec(args, true)
+}
+
+// doNotRepeated is do for commands that mustn't be repeated, e.g., SET
+// with NX: the connection may fail after the command took effect, and
+// repeating it would then give a different result. If the connection
+// fails, the error is returned.
+func (c *redisClient) doNotRepeated(args ...string) (interface{}, error) {
+	return c.exec(args, false)
+}
+
+func (c *redisClient) exec(args []string, retry bool) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply, err := c.doOnce(args)
+	if _, isNet := err.(net.Error); isNet || err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.close()
+		if retry {
+			reply, err = c.doOnce(args)
+		}
+	}
+	return reply, err
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+func (c *redisClient) doOnce(args []string) (interface{}, error) {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return c.roundTrip(args)
+}
+
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTrip([]string{"AUTH", c.password}); err != nil {
+			c.close()
+			return fmt.Errorf("redis: could not authenticate: %s", err.Error())
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// readRedisReply reads a reply, other than an array (which none of
+// the commands used give).
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// setNX sets the key to the value, with the expiry given, if it's not
+// already set; it reports whether it was set.
+func (c *redisClient) setNX(key, value string, expiry time.Duration) (bool, error) {
+	_, err := c.doNotRepeated("SET", key, value, "NX", "PX", strconv.FormatInt(int64(expiry/time.Millisecond), 10))
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// set sets the key to the value, with the expiry given.
+func (c *redisClient) set(key, value string, expiry time.Duration) error {
+	_, err := c.do("SET", key, value, "PX", strconv.FormatInt(int64(expiry/time.Millisecond), 10))
+	return err
+}
+
+// get gives the value of the key, or errRedisNil if it's not set.
+func (c *redisClient) get(key string) (string, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	s, _ := reply.(string)
+	return s, nil
+}
+
+func (c *redisClient) del(key string) error {
+	_, err := c.do("DEL", key)
+	return err
+}
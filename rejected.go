@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With the admin API enabled, the last payload each endpoint rejected
+// -- because it couldn't be parsed, or failed verification -- is kept
+// in memory, redacted and cut short, and served at /admin/rejected, so
+// there's more to go on than the status given to the source.
+
+// maxRejectedPayloadBytes is how much of a rejected payload is kept.
+const maxRejectedPayloadBytes = 16 << 10
+
+// rejectedPayloads keeps the last payload rejected by each endpoint,
+// if the admin API is enabled; otherwise it's nil.
+var rejectedPayloads *rejectedStore
+
+// rejectedPayload is what's kept of a rejected request.
+type rejectedPayload struct {
+	Time          time.Time `json:"time"`
+	Source        string    `json:"source"`
+	Endpoint      string    `json:"endpoint"`
+	CorrelationID string    `json:"correlationID,omitempty"`
+	Status        int       `json:"status"`
+	Reason        string    `json:"reason,omitempty"`
+	// Headers are those of interest (as in the access log), with
+	// secrets redacted
+	Headers string `json:"headers,omitempty"`
+	// Bytes is the size of the payload, of which the first
+	// maxRejectedPayloadBytes are kept, before redacting
+	Bytes     int    `json:"bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Payload   string `json:"payload"`
+}
+
+type rejectedStore struct {
+	redactor *redactor
+
+	mu   sync.Mutex
+	last map[string]*rejectedPayload
+}
+
+// newRejectedStore constructs a store redacting payloads with the
+// default key patterns plus those given.
+func newRejectedStore(redactKeys []string) (*rejectedStore, error) {
+	r, err := newRedactor(redactKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &rejectedStore{redactor: r, last: map[string]*rejectedPayload{}}, nil
+}
+
+func (s *rejectedStore) list() []*rejectedPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*rejectedPayload, 0, len(s.last))
+	for _, p := range s.last {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Source != list[j].Source {
+			return list[i].Source < list[j].Source
+		}
+		return list[i].Endpoint < list[j].Endpoint
+	})
+	return list
+}
+
+// capturingBody keeps the start of the body as it's read.
+type capturingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	bytes int
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += n
+	if room := maxRejectedPayloadBytes - b.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		b.buf.Write(p[:room])
+	}
+	return n, err
+}
+
+// rejectedStatus says whether a response with the status means the
+// payload was rejected; a request refused before it was looked at
+// (e.g., because of a rate limit) doesn't count.
+func rejectedStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests && status != http.StatusNotFound
+}
+
+// withRejectedPayloads keeps the payload of each request to the
+// endpoint that's rejected. Like withAudit, it goes outside the checks.
+func withRejectedPayloads(store *rejectedStore, source, digest string, next http.Handler) http.Handler {
+	endpoint := endpointLabel(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &capturingBody{ReadCloser: r.Body}
+		r.Body = body
+		aw := &auditResponseWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(aw, r)
+
+		// if the body wasn't read, the request was refused before
+		// the payload mattered, and there's nothing to keep
+		if !rejectedStatus(aw.status) || body.bytes == 0 {
+			return
+		}
+		rejected := &rejectedPayload{
+			Time:          start.UTC(),
+			Source:        source,
+			Endpoint:      endpoint,
+			CorrelationID: correlationID(r.Context()),
+			Status:        aw.status,
+			Reason:        aw.reasonText(),
+			Headers:       redactedHeaders(r.Header),
+			Bytes:         body.bytes,
+			Truncated:     body.bytes > body.buf.Len(),
+			Payload:       store.redactor.redact(body.buf.Bytes()),
+		}
+		store.mu.Lock()
+		store.last[source+"/"+endpoint] = rejected
+		store.mu.Unlock()
+	})
+}
+
+// adminRejected responds with the last rejected payload of each
+// endpoint; or of one endpoint, given by fingerprint in the query
+// parameter `endpoint`.
+func adminRejected(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []*rejectedPayload{}
+	if rejectedPayloads != nil {
+		for _, p := range rejectedPayloads.list() {
+			if e := r.URL.Query().Get("endpoint"); (e == "" || e == p.Endpoint) && inAdminScope(r, p.Endpoint) {
+				list = append(list, p)
+			}
+		}
+	}
+	writeJSON(w, struct {
+		Rejected []*rejectedPayload `json:"rejected"`
+	}{list})
+}
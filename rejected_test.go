@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectedPayloads(t *testing.T) {
+	var fluxdCalled bool
+	downstream := newDownstream(t, expectedGithub, &fluxdCalled)
+	defer downstream.Close()
+
+	store, err := newRejectedStore(nil)
+	assert.NoError(t, err)
+	defer func(s *rejectedStore) { rejectedPayloads = s }(rejectedPayloads)
+	rejectedPayloads = store
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewServer(withRejectedPayloads(store, GitHub, fp, handler))
+	defer hookServer.Close()
+
+	send := func(payload []byte, signature string) int {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature", signature)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	bad := []byte(`{"ref":"refs/heads/master","hook":{"config":{"secret":"hunter2"}}}`)
+	assert.Equal(t, 401, send(bad, xHubSignature(bad, []byte("wrong key"))))
+	// one that's delivered doesn't replace it
+	payload := loadFixture(t, "github_payload")
+	assert.Equal(t, 200, send(payload, xHubSignature(payload, loadFixture(t, "github_key"))))
+
+	rec := httptest.NewRecorder()
+	adminRejected(rec, httptest.NewRequest("GET", adminPrefix+"rejected?endpoint="+endpointLabel(fp), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		Rejected []rejectedPayload `json:"rejected"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Rejected, 1)
+	rejected := body.Rejected[0]
+	assert.Equal(t, 401, rejected.Status)
+	assert.Equal(t, "The GitHub signature header is invalid.", rejected.Reason)
+	assert.Equal(t, len(bad), rejected.Bytes)
+	assert.False(t, rejected.Truncated)
+	assert.NotContains(t, rejected.Payload, "hunter2")
+	assert.Contains(t, rejected.Payload, `"secret":"REDACTED"`)
+	assert.Contains(t, rejected.Headers, "X-GitHub-Event: push")
+	assert.Contains(t, rejected.Headers, "X-Hub-Signature: REDACTED")
+
+	// only the start of a large payload is kept
+	large := []byte(`{"ref":"` + strings.Repeat("x", 2*maxRejectedPayloadBytes) + `"}`)
+	assert.Equal(t, 401, send(large, "sha1=0000"))
+	list := store.list()
+	assert.Len(t, list, 1)
+	assert.Equal(t, len(large), list[0].Bytes)
+	assert.True(t, list[0].Truncated)
+	assert.True(t, len(list[0].Payload) <= maxRejectedPayloadBytes)
+
+	rec = httptest.NewRecorder()
+	adminRejected(rec, httptest.NewRequest("GET", adminPrefix+"rejected?endpoint=000000000000", nil))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Rejected, 0)
+}
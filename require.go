@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The checks an endpoint can list in `require`, to give the order in
+// which they are made. Each of these (except clientCert and
+// signature) is configured by the field of the same name; `cidrs` is
+// for allowCIDRs and denyCIDRs.
+const (
+	requireCIDRs       = "cidrs"
+	requireProviderIPs = "providerIPs"
+	requireClientCert  = "clientCert"
+	requireJWT         = "jwt"
+	requireQueryToken  = "queryToken"
+	requireBasicAuth   = "basicAuth"
+	// requireSignature is the source's own verification of the
+	// payload, which is made by the source handler, so always last;
+	// listing it means a signature is required (as with
+	// requireSignature).
+	requireSignature = "signature"
+)
+
+// configuredChecks gives the checks that are configured for the
+// endpoint, on a listener with the TLS config given.
+func (ep Endpoint) configuredChecks(tls *TLS) map[string]bool {
+	checks := map[string]bool{
+		requireCIDRs:       len(ep.AllowCIDRs) > 0 || len(ep.DenyCIDRs) > 0,
+		requireProviderIPs: ep.ProviderIPs,
+		requireClientCert:  tls != nil && tls.ClientCAFile != "",
+		requireJWT:         ep.JWT != nil,
+		requireQueryToken:  ep.QueryToken != nil,
+		requireBasicAuth:   ep.BasicAuth != nil,
+		requireSignature:   SignedSources[ep.Source],
+	}
+	for name, configured := range checks {
+		if !configured {
+			delete(checks, name)
+		}
+	}
+	return checks
+}
+
+// checkOrder gives the checks made on requests to the endpoint, in
+// the order they're made.
+func (ep Endpoint) checkOrder() []string {
+	if len(ep.Require) > 0 {
+		order := append([]string(nil), ep.Require...)
+		if SignedSources[ep.Source] && !requires(order, requireSignature) {
+			order = append(order, requireSignature)
+		}
+		return order
+	}
+	configured := ep.configuredChecks(nil)
+	var order []string
+	for _, name := range []string{requireCIDRs, requireProviderIPs, requireJWT, requireQueryToken, requireBasicAuth, requireSignature} {
+		if configured[name] {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// validateRequire checks that `require` lists only checks that are
+// configured, and all of those that are (apart from the signature,
+// which sources that sign payloads always check).
+func (ep Endpoint) validateRequire(tls *TLS) error {
+	if len(ep.Require) == 0 {
+		return nil
+	}
+	configured := ep.configuredChecks(tls)
+	listed := map[string]bool{}
+	for i, name := range ep.Require {
+		if listed[name] {
+			return fmt.Errorf("require lists %q more than once", name)
+		}
+		listed[name] = true
+		if !configured[name] {
+			switch name {
+			case requireCIDRs, requireProviderIPs, requireClientCert, requireJWT, requireQueryToken, requireBasicAuth, requireSignature:
+			default:
+				return fmt.Errorf("require lists %q, which is not a known check", name)
+			}
+			switch name {
+			case requireClientCert:
+				return fmt.Errorf("require lists %q, but the listener has no tls.clientCAFile", name)
+			case requireSignature:
+				return fmt.Errorf("require lists %q, but the source does not sign payloads", name)
+			case requireCIDRs:
+				return fmt.Errorf("require lists %q, but neither allowCIDRs nor denyCIDRs is given", name)
+			}
+			return fmt.Errorf("require lists %q, but it is not configured", name)
+		}
+		if name == requireSignature && i != len(ep.Require)-1 {
+			return fmt.Errorf("require lists %q, which must come last, since it's checked by the source", name)
+		}
+	}
+	for name := range configured {
+		if !listed[name] && name != requireSignature {
+			return fmt.Errorf("%q is configured, but not listed in require", name)
+		}
+	}
+	return nil
+}
+
+func requires(checks []string, name string) bool {
+	for _, c := range checks {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withClientCert refuses requests without a verified client
+// certificate. The listener refuses connections without one anyway;
+// this is so it can be given a place among the endpoint's checks.
+func withClientCert(source string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "A verified client certificate is required", http.StatusForbidden)
+			level.Warn(requestLogger(r)).Log("msg", "rejected request without a verified client certificate")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
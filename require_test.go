@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRequire(t *testing.T) {
+	withCA := &TLS{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt"}
+	basicAuth := &BasicAuth{Username: "hook", PasswordPath: "password"}
+	for name, testcase := range map[string]struct {
+		ep  Endpoint
+		tls *TLS
+		ok  bool
+	}{
+		"not given": {
+			ep: Endpoint{Source: DockerHub, BasicAuth: basicAuth},
+			ok: true,
+		},
+		"all listed": {
+			ep:  Endpoint{Source: GitHub, AllowCIDRs: []string{"10.0.0.0/8"}, Require: []string{"clientCert", "cidrs", "signature"}},
+			tls: withCA,
+			ok:  true,
+		},
+		"signature left out": {
+			ep: Endpoint{Source: GitHub, ProviderIPs: true, Require: []string{"providerIPs"}},
+			ok: true,
+		},
+		"configured but not listed": {
+			ep: Endpoint{Source: DockerHub, BasicAuth: basicAuth, AllowCIDRs: []string{"10.0.0.0/8"}, Require: []string{"cidrs"}},
+		},
+		"listed but not configured": {
+			ep: Endpoint{Source: DockerHub, BasicAuth: basicAuth, Require: []string{"basicAuth", "jwt"}},
+		},
+		"clientCert without CA": {
+			ep:  Endpoint{Source: DockerHub, Require: []string{"clientCert"}},
+			tls: &TLS{CertFile: "tls.crt", KeyFile: "tls.key"},
+		},
+		"signature for unsigned source": {
+			ep: Endpoint{Source: DockerHub, BasicAuth: basicAuth, Require: []string{"basicAuth", "signature"}},
+		},
+		"signature not last": {
+			ep:  Endpoint{Source: GitHub, Require: []string{"signature", "clientCert"}},
+			tls: withCA,
+		},
+		"unknown check": {
+			ep: Endpoint{Source: GitHub, Require: []string{"vibes"}},
+		},
+		"listed twice": {
+			ep: Endpoint{Source: DockerHub, BasicAuth: basicAuth, Require: []string{"basicAuth", "basicAuth"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := testcase.ep.validateRequire(testcase.tls)
+			if testcase.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestRequireOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"key", "password"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("the contents of "+f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ep := Endpoint{
+		Source:     DockerHub,
+		KeyPath:    "key",
+		BasicAuth:  &BasicAuth{Username: "hook", PasswordPath: "password"},
+		AllowCIDRs: []string{"10.0.0.0/8"},
+	}
+	// a request from outside allowCIDRs, without credentials
+	send := func(ep Endpoint) int {
+		fp, handler, err := HandlerFromEndpoint(dir, "http://127.0.0.1:1/api/flux", ep)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("POST", "/hook/"+fp, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// by default, the CIDRs are checked first
+	assert.Equal(t, 403, send(ep))
+
+	ep.Require = []string{"basicAuth", "cidrs"}
+	assert.Equal(t, 401, send(ep))
+
+	ep.Require = []string{"cidrs", "basicAuth"}
+	assert.Equal(t, 403, send(ep))
+
+	// without TLS, there's no client certificate
+	ep.AllowCIDRs = nil
+	ep.Require = []string{"clientCert", "basicAuth"}
+	assert.Equal(t, 403, send(ep))
+}
@@ -0,0 +1,145 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// On SIGUSR2, flux-recv starts a new process from its executable --
+// which may since have been replaced with a new version -- with the
+// same arguments, and passes it the sockets it's listening on. Once
+// the new process is serving, the old one shuts down gracefully, as
+// for SIGTERM. Connections made in the meantime wait to be accepted,
+// rather than being refused, so an upgrade on a bare host doesn't
+// lose deliveries. If the new process fails to start, the old one
+// keeps serving.
+
+const (
+	// inheritedListenersEnv gives the addresses of the sockets passed
+	// to a new process, in order from file descriptor 3
+	inheritedListenersEnv = "FLUX_RECV_INHERITED_LISTENERS"
+	// restartReadyEnv gives the file descriptor the new process
+	// writes to, once it's serving
+	restartReadyEnv = "FLUX_RECV_RESTART_READY_FD"
+	// restartTimeout is how long the new process has to start
+	// serving
+	restartTimeout = 30 * time.Second
+)
+
+// inheritedListeners gives the sockets passed by the process that
+// started this one, if it's restarting, by address. The environment
+// variable is unset, so they aren't passed on.
+func inheritedListeners() (map[string]net.Listener, error) {
+	s := os.Getenv(inheritedListenersEnv)
+	os.Unsetenv(inheritedListenersEnv)
+	if s == "" {
+		return nil, nil
+	}
+	var addrs []string
+	if err := json.Unmarshal([]byte(s), &addrs); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", inheritedListenersEnv, err.Error())
+	}
+	listeners := map[string]net.Listener{}
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(systemdFirstFD+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket for %q passed by previous process: %s", addr, err.Error())
+		}
+		listeners[addr] = l
+	}
+	return listeners, nil
+}
+
+// signalRestarted tells the process that started this one, if it's
+// restarting, that it's now serving.
+func signalRestarted() {
+	s := os.Getenv(restartReadyEnv)
+	os.Unsetenv(restartReadyEnv)
+	if fd, err := strconv.Atoi(s); err == nil {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte("ready"))
+		f.Close()
+	}
+}
+
+// restart starts a new process with the listeners given (by address),
+// and waits for it to be serving.
+func restart(listeners map[string]net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		addrs []string
+		files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	)
+	for addr, l := range listeners {
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("cannot pass the socket for %q", addr)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		addrs = append(addrs, addr)
+		files = append(files, f)
+	}
+	addrsJSON, _ := json.Marshal(addrs)
+
+	// the new process writes to this when it's serving; if it exits
+	// first, it's closed without being written to
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+	env := append(os.Environ(),
+		inheritedListenersEnv+"="+string(addrsJSON),
+		restartReadyEnv+"="+strconv.Itoa(len(files)-1),
+	)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	signalled := make(chan bool, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(ready)
+		signalled <- len(b) > 0
+	}()
+	select {
+	case ok := <-signalled:
+		if !ok {
+			state, _ := proc.Wait()
+			return 0, fmt.Errorf("new process exited without serving (%s)", state)
+		}
+		// the sockets are the new process's now, so closing them
+		// here mustn't remove them
+		for _, l := range listeners {
+			if l, ok := l.(*net.UnixListener); ok {
+				l.SetUnlinkOnClose(false)
+			}
+		}
+		proc.Release()
+		return proc.Pid, nil
+	case <-time.After(restartTimeout):
+		proc.Kill()
+		return 0, errors.New("new process did not start serving in time")
+	}
+}
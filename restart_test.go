@@ -0,0 +1,78 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const restartTestEnv = "FLUX_RECV_TEST_RESTART"
+
+func TestRestart(t *testing.T) {
+	if os.Getenv(restartTestEnv) != "" {
+		t.Skip("running as the restarted process")
+	}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{os.Args[0], "-test.run=^TestRestartedProcess$"}
+	defer os.Unsetenv(restartTestEnv)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	// the new process fails to start
+	os.Setenv(restartTestEnv, "fail")
+	_, err = restart(map[string]net.Listener{"test": l})
+	assert.Error(t, err)
+
+	os.Setenv(restartTestEnv, "serve")
+	pid, err := restart(map[string]net.Listener{"test": l})
+	assert.NoError(t, err)
+	assert.NotEqual(t, os.Getpid(), pid)
+	// this process stops listening; the new one is, on the same
+	// socket
+	assert.NoError(t, l.Close())
+	res, err := http.Get("http://" + l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "restarted", string(body))
+}
+
+// TestRestartedProcess is run by TestRestart, as the new process.
+func TestRestartedProcess(t *testing.T) {
+	switch os.Getenv(restartTestEnv) {
+	case "fail":
+		return
+	case "serve":
+	default:
+		t.Skip("only run by TestRestart")
+	}
+	listeners, err := inheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("restarted"))
+		close(served)
+	})}
+	go server.Serve(listeners["test"])
+	signalRestarted()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+	}
+	server.Shutdown(context.Background())
+}
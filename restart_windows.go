@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Restarting by passing the sockets to a new process (see restart.go)
+// is not supported on Windows.
+
+func inheritedListeners() (map[string]net.Listener, error) { return nil, nil }
+
+func signalRestarted() {}
+
+func restart(listeners map[string]net.Listener) (int, error) {
+	return 0, errors.New("restarting is not supported on Windows")
+}
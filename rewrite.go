@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+
+	fluxapi "github.com/fluxcd/flux/pkg/api"
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+	"github.com/fluxcd/flux/pkg/image"
+)
+
+// fluxd acts on a notification only if the repo URL is exactly that
+// it's configured with; so if e.g., the source gives an HTTPS URL and
+// fluxd clones over SSH, or through a host alias, the notification
+// does nothing, and says nothing about it. An endpoint can be given
+// rules to rewrite the repo URL of each change into the form fluxd
+// has, after the filters (which see the URL as the source gave it).
+// Likewise, image names can be rewritten, so that an image pushed to
+// e.g., a registry behind a pull-through cache or mirror is notified
+// with the name the workloads use.
+
+// GitURLRewrite is a rule for rewriting repo URLs. The rules an
+// endpoint has are applied in order, each to the result of those
+// before it.
+type GitURLRewrite struct {
+	// Match, if given, is a regular expression which must match the
+	// whole URL for the rule to apply
+	Match string `json:"match,omitempty"`
+	// Replace, if given, replaces the URL matched (and needs
+	// Match); it can refer to groups in Match with e.g., `$1`
+	Replace *string `json:"replace,omitempty"`
+	// Format, if given, is the form the URL is put in: "ssh"
+	// (ssh://git@host/path), "scp" (git@host:path), or "https"
+	Format string `json:"format,omitempty"`
+	// Host, if given, replaces the host
+	Host string `json:"host,omitempty"`
+	// Port, if given, is put in the URL; the scp form can't have a
+	// port, so it's put in the ssh form instead
+	Port int `json:"port,omitempty"`
+	// User, if given, is the user in the ssh and scp forms; the
+	// default is the user already in the URL, or "git"
+	User string `json:"user,omitempty"`
+}
+
+const (
+	gitURLFormatSSH   = "ssh"
+	gitURLFormatSCP   = "scp"
+	gitURLFormatHTTPS = "https"
+)
+
+// gitURLRewrite is a GitURLRewrite, ready to be used.
+type gitURLRewrite struct {
+	match *regexp.Regexp
+	GitURLRewrite
+}
+
+func compileGitURLRewrites(rules []GitURLRewrite) ([]gitURLRewrite, error) {
+	var compiled []gitURLRewrite
+	for i, rule := range rules {
+		c := gitURLRewrite{GitURLRewrite: rule}
+		if rule.Match != "" {
+			re, err := regexp.Compile("^(?:" + rule.Match + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("gitURLRewrites[%d]: match %q is not a valid regular expression: %s", i, rule.Match, err.Error())
+			}
+			c.match = re
+		} else if rule.Replace != nil {
+			return nil, fmt.Errorf("gitURLRewrites[%d]: replace needs match", i)
+		}
+		switch rule.Format {
+		case "", gitURLFormatSSH, gitURLFormatSCP, gitURLFormatHTTPS:
+		default:
+			return nil, fmt.Errorf("gitURLRewrites[%d]: format %q is not one of ssh, scp, or https", i, rule.Format)
+		}
+		if rule.Port < 0 || rule.Port > 65535 {
+			return nil, fmt.Errorf("gitURLRewrites[%d]: port %d is out of range", i, rule.Port)
+		}
+		if rule.Port != 0 && rule.Format == gitURLFormatSCP {
+			return nil, fmt.Errorf("gitURLRewrites[%d]: the scp format cannot have a port", i)
+		}
+		if rule.Replace == nil && rule.Format == "" && rule.Host == "" && rule.Port == 0 && rule.User == "" {
+			return nil, fmt.Errorf("gitURLRewrites[%d]: rule does not rewrite anything", i)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// gitURL is a repo URL taken apart.
+type gitURL struct {
+	format, user, host, port, path string
+}
+
+// parseGitURL takes apart an ssh://, https:// (or http://), or
+// scp-like repo URL. The path is without the leading slash.
+func parseGitURL(s string) (gitURL, bool) {
+	if !strings.Contains(s, "://") {
+		// user@host:path
+		at := strings.Index(s, "@")
+		colon := strings.Index(s, ":")
+		if colon < 0 || at > colon {
+			return gitURL{}, false
+		}
+		g := gitURL{format: gitURLFormatSCP, host: s[at+1 : colon], path: strings.TrimPrefix(s[colon+1:], "/")}
+		if at >= 0 {
+			g.user = s[:at]
+		}
+		return g, true
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return gitURL{}, false
+	}
+	g := gitURL{host: u.Hostname(), port: u.Port(), path: strings.TrimPrefix(u.Path, "/")}
+	switch u.Scheme {
+	case "ssh":
+		g.format = gitURLFormatSSH
+	case "https", "http":
+		g.format = gitURLFormatHTTPS
+	default:
+		return gitURL{}, false
+	}
+	if u.User != nil {
+		g.user = u.User.Username()
+	}
+	return g, true
+}
+
+func (g gitURL) String() string {
+	hostPort := g.host
+	if g.port != "" {
+		hostPort += ":" + g.port
+	}
+	switch g.format {
+	case gitURLFormatHTTPS:
+		return "https://" + hostPort + "/" + g.path
+	case gitURLFormatSSH:
+		return "ssh://" + g.user + "@" + hostPort + "/" + g.path
+	default:
+		return g.user + "@" + g.host + ":" + g.path
+	}
+}
+
+// apply gives the URL rewritten by the rule, or the URL as it was if
+// the rule doesn't apply to it.
+func (rule gitURLRewrite) apply(s string) string {
+	if rule.match != nil {
+		if !rule.match.MatchString(s) {
+			return s
+		}
+		if rule.Replace != nil {
+			s = rule.match.ReplaceAllString(s, *rule.Replace)
+		}
+	}
+	if rule.Format == "" && rule.Host == "" && rule.Port == 0 && rule.User == "" {
+		return s
+	}
+	g, ok := parseGitURL(s)
+	if !ok {
+		return s
+	}
+	if rule.Format != "" {
+		g.format = rule.Format
+	}
+	if rule.Host != "" {
+		g.host = rule.Host
+	}
+	if rule.Port != 0 {
+		g.port = strconv.Itoa(rule.Port)
+		if g.format == gitURLFormatSCP {
+			g.format = gitURLFormatSSH
+		}
+	}
+	switch {
+	case g.format == gitURLFormatHTTPS:
+		g.user = ""
+	case rule.User != "":
+		g.user = rule.User
+	case g.user == "":
+		g.user = "git"
+	}
+	if g.format == gitURLFormatSCP {
+		// the port doesn't survive in the scp form
+		g.port = ""
+	}
+	return g.String()
+}
+
+// ImageRewrite is a rule for rewriting image names. The first of an
+// endpoint's rules that matches an image is applied to it.
+type ImageRewrite struct {
+	// From is a registry (e.g., `registry.internal:5000`), possibly
+	// with a path in it (e.g., `registry.internal:5000/team`), which
+	// the image name must start with
+	From string `json:"from"`
+	// To replaces From in the image name
+	To string `json:"to"`
+}
+
+func validateImageRewrites(rules []ImageRewrite) error {
+	for i, rule := range rules {
+		for field, value := range map[string]string{"from": rule.From, "to": rule.To} {
+			if value == "" || strings.HasPrefix(value, "/") || strings.HasSuffix(value, "/") {
+				return fmt.Errorf("imageRewrites[%d]: %s must be a registry or path, without a leading or trailing slash", i, field)
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteImage gives the image name rewritten by the first rule that
+// matches it, and whether any did. The rules are matched against both
+// the name as given and its canonical form, so e.g.,
+// `docker.io/library` matches `nginx`.
+func rewriteImage(rules []ImageRewrite, name image.Name) (image.Name, bool) {
+	canonical := name.CanonicalName()
+	forms := []string{name.String(), canonical.String()}
+	if canonical.Domain == "index.docker.io" {
+		// which is more often written docker.io
+		forms = append(forms, "docker.io/"+canonical.Image)
+	}
+	for _, rule := range rules {
+		for _, given := range forms {
+			var rest string
+			switch {
+			case given == rule.From:
+			case strings.HasPrefix(given, rule.From+"/"):
+				rest = given[len(rule.From):]
+			default:
+				continue
+			}
+			ref, err := image.ParseRef(rule.To + rest)
+			if err != nil {
+				return name, false
+			}
+			return ref.Name, true
+		}
+	}
+	return name, false
+}
+
+// rewritingServer wraps the downstream API, rewriting the repo URL of
+// each git change, or the name of each image, by the endpoint's rules.
+type rewritingServer struct {
+	fluxapi.Server
+	gitURLRules []gitURLRewrite
+	imageRules  []ImageRewrite
+}
+
+func (s rewritingServer) NotifyChange(ctx context.Context, change fluxapi_v9.Change) error {
+	if update, ok := change.Source.(fluxapi_v9.GitUpdate); ok && len(s.gitURLRules) > 0 {
+		rewritten := update.URL
+		for _, rule := range s.gitURLRules {
+			rewritten = rule.apply(rewritten)
+		}
+		if rewritten != update.URL {
+			level.Debug(contextLogger(ctx)).Log("msg", "rewrote repo URL", "from", update.URL, "to", rewritten)
+			update.URL = rewritten
+			change.Source = update
+		}
+	}
+	if update, ok := change.Source.(fluxapi_v9.ImageUpdate); ok && len(s.imageRules) > 0 {
+		if rewritten, ok := rewriteImage(s.imageRules, update.Name); ok {
+			level.Debug(contextLogger(ctx)).Log("msg", "rewrote image name", "from", update.Name.String(), "to", rewritten.String())
+			update.Name = rewritten
+			change.Source = update
+		}
+	}
+	return s.Server.NotifyChange(ctx, change)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	fluxapi_v9 "github.com/fluxcd/flux/pkg/api/v9"
+)
+
+func TestGitURLRewrites(t *testing.T) {
+	replace := func(s string) *string { return &s }
+	for _, tt := range []struct {
+		desc     string
+		rules    []GitURLRewrite
+		url      string
+		expected string
+	}{
+		{
+			desc:     "https to scp",
+			rules:    []GitURLRewrite{{Format: "scp"}},
+			url:      "https://github.com/example/config.git",
+			expected: "git@github.com:example/config.git",
+		},
+		{
+			desc:     "scp to https",
+			rules:    []GitURLRewrite{{Format: "https"}},
+			url:      "git@github.com:example/config.git",
+			expected: "https://github.com/example/config.git",
+		},
+		{
+			desc:     "host alias",
+			rules:    []GitURLRewrite{{Host: "github-config"}},
+			url:      "git@github.com:example/config.git",
+			expected: "git@github-config:example/config.git",
+		},
+		{
+			desc:     "port, on an scp URL",
+			rules:    []GitURLRewrite{{Port: 2222}},
+			url:      "git@git.example.com:example/config.git",
+			expected: "ssh://git@git.example.com:2222/example/config.git",
+		},
+		{
+			desc:     "only where matched",
+			rules:    []GitURLRewrite{{Match: `git@gitlab\.example\.com:.*`, Host: "gitlab.internal", Port: 2222}},
+			url:      "git@github.com:example/config.git",
+			expected: "git@github.com:example/config.git",
+		},
+		{
+			desc: "replace, then convert",
+			rules: []GitURLRewrite{
+				{Match: `https://git\.example\.com/scm/(.*)`, Replace: replace("https://git.example.com/$1")},
+				{Format: "ssh", User: "deploy"},
+			},
+			url:      "https://git.example.com/scm/team/config.git",
+			expected: "ssh://deploy@git.example.com/team/config.git",
+		},
+		{
+			desc:     "not a URL that can be taken apart",
+			rules:    []GitURLRewrite{{Format: "ssh"}},
+			url:      "/srv/git/config.git",
+			expected: "/srv/git/config.git",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			rules, err := compileGitURLRewrites(tt.rules)
+			assert.NoError(t, err)
+			url := tt.url
+			for _, rule := range rules {
+				url = rule.apply(url)
+			}
+			assert.Equal(t, tt.expected, url)
+		})
+	}
+
+	for _, bad := range [][]GitURLRewrite{
+		{{Match: "("}},
+		{{Replace: replace("git@example.com:config.git")}},
+		{{Format: "git"}},
+		{{Format: "scp", Port: 2222}},
+		{{Match: ".*"}},
+	} {
+		_, err := compileGitURLRewrites(bad)
+		assert.Error(t, err)
+	}
+}
+
+// Test that an endpoint's filters see the URL from the source, and
+// fluxd the URL rewritten.
+func TestRewritingServer(t *testing.T) {
+	ep := Endpoint{
+		Source:         GitHub,
+		Allow:          "https://github.com/example/.*",
+		GitURLRewrites: []GitURLRewrite{{Format: "scp"}},
+	}
+	assert.Equal(t, []fluxapi_v9.Change{
+		gitChange("git@github.com:example/config.git", "main"),
+	}, notified(t, ep, gitChange("https://github.com/example/config.git", "main"), gitChange("https://github.com/other/config.git", "main")))
+}
+
+func TestImageRewrites(t *testing.T) {
+	rules := []ImageRewrite{
+		{From: "registry.internal:5000", To: "harbor.example.com"},
+		{From: "docker.io/library", To: "mirror.example.com/dockerhub"},
+	}
+	ep := Endpoint{Source: DockerHub, ImageRewrites: rules}
+	assert.NoError(t, validateImageRewrites(rules))
+	assert.Equal(t, []fluxapi_v9.Change{
+		imageChange(t, "harbor.example.com/team/app"),
+		imageChange(t, "mirror.example.com/dockerhub/nginx"),
+		imageChange(t, "registry.internal:50000/team/app"),
+		imageChange(t, "example/app"),
+	}, notified(t, ep,
+		imageChange(t, "registry.internal:5000/team/app"),
+		imageChange(t, "nginx"),
+		// only whole parts of the name match
+		imageChange(t, "registry.internal:50000/team/app"),
+		imageChange(t, "example/app"),
+	))
+
+	for _, bad := range []ImageRewrite{{From: "registry.internal:5000/"}, {To: "harbor.example.com"}} {
+		assert.Error(t, validateImageRewrites([]ImageRewrite{bad}))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// keyRotation watches the file for one of an endpoint's keys. When
+// the key changes, the new digest is routed to the endpoint, and the
+// previous digest keeps being routed to it -- but verified with the
+// new key -- for the grace period, so that the webhook URLs
+// registered with the source needn't be changed at the same moment.
+type keyRotation struct {
+	source  string
+	path    string
+	grace   time.Duration
+	router  *hookRouter
+	handler func(digest string, key []byte) http.Handler
+
+	mu       sync.Mutex
+	digest   string
+	modTime  time.Time
+	previous map[string]time.Time // digest -> when it stops being routed
+}
+
+func newKeyRotation(source, configDir string, r Route, grace time.Duration, router *hookRouter, handler func(string, []byte) http.Handler) *keyRotation {
+	k := &keyRotation{
+		source:   source,
+		path:     filepath.Join(configDir, r.KeyPath),
+		grace:    grace,
+		router:   router,
+		handler:  handler,
+		digest:   r.Digest,
+		previous: map[string]time.Time{},
+	}
+	if info, err := os.Stat(k.path); err == nil {
+		k.modTime = info.ModTime()
+	}
+	return k
+}
+
+// run checks for changes to the key, and expires previous digests,
+// until the process exits.
+func (k *keyRotation) run() {
+	for now := range time.Tick(certCheckInterval) {
+		k.check(now)
+	}
+}
+
+func (k *keyRotation) check(now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for digest, until := range k.previous {
+		if now.After(until) {
+			k.router.remove(digest)
+			delete(k.previous, digest)
+			endpointKeyOK.DeleteLabelValues(k.source, endpointLabel(digest))
+			level.Info(sourceLogger(k.source)).Log("msg", "grace period over for previous key digest", "digest", digest)
+		}
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil || info.ModTime().Equal(k.modTime) {
+		return
+	}
+	k.modTime = info.ModTime()
+	key, digest, err := loadKey("", k.path)
+	if err != nil {
+		level.Error(sourceLogger(k.source)).Log("msg", "key not reloaded", "err", err)
+		// the endpoint still works with the key it has, but won't after
+		// a restart
+		endpointKeyOK.WithLabelValues(k.source, endpointLabel(k.digest)).Set(0)
+		return
+	}
+	if digest == k.digest {
+		return
+	}
+	if _, ours := k.previous[digest]; !ours && k.router.has(digest) {
+		level.Warn(sourceLogger(k.source)).Log("msg", "key changed, but its digest is already routed to another endpoint; ignoring it", "key", k.path)
+		return
+	}
+
+	until := now.Add(k.grace)
+	k.previous[k.digest] = until
+	delete(k.previous, digest)
+	k.router.set(digest, k.handler(digest, key))
+	for d := range k.previous {
+		k.router.set(d, k.handler(d, key))
+	}
+	level.Info(sourceLogger(k.source)).Log("msg", "key changed", "key", k.path, "route", hookPath(digest), "previous", hookPath(k.digest), "previous_until", until.Format(time.RFC3339))
+	k.digest = digest
+}
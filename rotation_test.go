@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "key")
+	writeKey := func(key string, modTime time.Time) {
+		if err := ioutil.WriteFile(keyPath, []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(keyPath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	writeKey("old key", start)
+
+	// the handler says which key it verifies with
+	handlerFor := func(key []byte) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(key)
+		})
+	}
+	route := Route{Digest: keyDigest([]byte("old key")), KeyPath: "key", Handler: handlerFor([]byte("old key"))}
+	router := newHookRouter()
+	router.set(route.Digest, route.Handler)
+	rotation := newKeyRotation(GitHub, dir, route, time.Hour, router, func(_ string, key []byte) http.Handler {
+		return handlerFor(key)
+	})
+
+	get := func(digest string) (int, string) {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("POST", hookPrefix+digest, nil))
+		return res.Code, res.Body.String()
+	}
+
+	// nothing changed
+	rotation.check(start.Add(time.Minute))
+	code, body := get(route.Digest)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "old key", body)
+
+	writeKey("new key", start.Add(2*time.Minute))
+	rotation.check(start.Add(2 * time.Minute))
+	newDigest := keyDigest([]byte("new key"))
+	code, body = get(newDigest)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "new key", body)
+	// the previous digest is still routed, but verified with the new key
+	code, body = get(route.Digest)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "new key", body)
+
+	// after the grace period, only the new digest is routed
+	rotation.check(start.Add(2*time.Minute + time.Hour + time.Second))
+	code, _ = get(route.Digest)
+	assert.Equal(t, 404, code)
+	code, _ = get(newDigest)
+	assert.Equal(t, 200, code)
+}
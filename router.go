@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// hookPrefix is the path under which endpoints are routed, by digest.
+const hookPrefix = "/hook/"
+
+// hookBasePath, if not empty, is a path that all the hook routes are
+// under, e.g., `/webhooks` to route endpoints at
+// `/webhooks/hook/<digest>`; it's set from the config by main.
+var hookBasePath string
+
+// hookPath gives the path at which the digest is routed.
+func hookPath(digest string) string {
+	return hookBasePath + hookPrefix + digest
+}
+
+// hookRouter routes requests for `/hook/<digest>` to the handler for
+// the digest (after hookBasePath has been stripped from the path).
+// Unlike with http.ServeMux, routes can be replaced and removed while
+// serving, as is needed when keys are rotated.
+type hookRouter struct {
+	mu     sync.RWMutex
+	routes map[string]http.Handler
+}
+
+func newHookRouter() *hookRouter {
+	return &hookRouter{routes: map[string]http.Handler{}}
+}
+
+func (h *hookRouter) has(digest string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.routes[digest]
+	return ok
+}
+
+func (h *hookRouter) set(digest string, handler http.Handler) {
+	h.mu.Lock()
+	h.routes[digest] = handler
+	h.mu.Unlock()
+}
+
+func (h *hookRouter) remove(digest string) {
+	h.mu.Lock()
+	delete(h.routes, digest)
+	h.mu.Unlock()
+}
+
+func (h *hookRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	digest := strings.TrimPrefix(r.URL.Path, hookPrefix)
+	h.mu.RLock()
+	handler, ok := h.routes[digest]
+	h.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// count gives the number of routes.
+func (h *hookRouter) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.routes)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasePath(t *testing.T) {
+	defer func(reg *endpointRegistry) { servedEndpoints = reg }(servedEndpoints)
+	servedEndpoints = &endpointRegistry{}
+	hookBasePath = "/webhooks"
+	defer func() { hookBasePath = "" }()
+
+	l := Listener{Listen: ":8080", Endpoints: []Endpoint{{Source: GitHub, KeyPath: "github_key"}}}
+	mux, err := MuxFromListener("test/fixtures", defaultApiBase, l, nil, nil)
+	assert.NoError(t, err)
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec.Code
+	}
+
+	digest := keyDigest(loadFixture(t, "github_key"))
+	// it gets as far as checking the signature
+	assert.Equal(t, http.StatusUnauthorized, post("/webhooks/hook/"+digest))
+	assert.Equal(t, http.StatusNotFound, post("/hook/"+digest))
+	assert.Equal(t, http.StatusNotFound, post("/webhooks/hook/0123"))
+
+	served := servedEndpoints.list()
+	assert.Equal(t, "/webhooks/hook/"+digest[:12]+"...", served[0].Routes[0].Path)
+	assert.Equal(t, "/webhooks/hook/"+digest[:12]+"...", redactedPath("/webhooks/hook/"+digest))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema needed to describe the
+// config format.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+}
+
+// ConfigSchema generates a JSON Schema for the config file, from the
+// Go types it's decoded into; so it can't get out of step.
+func ConfigSchema() *jsonSchema {
+	schema := schemaForType(reflect.TypeOf(Config{}))
+	schema.Schema = "http://json-schema.org/draft-07/schema#"
+	schema.Title = "flux-recv configuration (fluxrecv.yaml)"
+	// either the current apiVersion, or the legacy fluxRecvVersion: 1
+	schema.Properties["apiVersion"].Enum = []string{CurrentAPIVersion}
+	schema.AnyOf = []*jsonSchema{
+		{Required: []string{"apiVersion"}},
+		{Required: []string{"fluxRecvVersion"}},
+	}
+
+	var sources []string
+	for s := range Sources {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+	endpoint := schemaForType(reflect.TypeOf(Endpoint{}))
+	endpoint.Properties["source"].Enum = sources
+	endpoint.Properties["events"].Items.Enum = []string{eventPush, eventTag, eventRelease, eventPipeline}
+	endpoint.Properties["generic"].Properties["auth"].Enum = []string{genericAuthHMAC, genericAuthToken, genericAuthNone}
+	endpoint.Required = []string{"source"}
+
+	schema.Properties["endpoints"].Items = endpoint
+	schema.Properties["listeners"].Items.Properties["endpoints"].Items = endpoint
+	return schema
+}
+
+func schemaForType(t reflect.Type) *jsonSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaForType(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object"}
+	case reflect.Struct:
+		no := false
+		schema := &jsonSchema{
+			Type:                 "object",
+			Properties:           map[string]*jsonSchema{},
+			AdditionalProperties: &no,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" || f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			schema.Properties[name] = schemaForType(f.Type)
+		}
+		return schema
+	}
+	return &jsonSchema{}
+}
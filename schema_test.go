@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+func TestConfigSchema(t *testing.T) {
+	schemaBytes, err := json.Marshal(ConfigSchema())
+	assert.NoError(t, err)
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schemaBytes))
+	assert.NoError(t, err)
+
+	validate := func(config string) bool {
+		configJSON, err := yaml.YAMLToJSON([]byte(config))
+		assert.NoError(t, err)
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(configJSON))
+		assert.NoError(t, err)
+		return result.Valid()
+	}
+
+	for name, config := range map[string]string{
+		"minimal":     minimalConfig,
+		"full config": fullConfig,
+		"listeners":   listenersConfig,
+		"apiVersion":  currentVersionConfig,
+	} {
+		assert.True(t, validate(config), name)
+	}
+
+	for name, config := range map[string]string{
+		"missing version":    missingVersion,
+		"wrong kind of file": completelyDifferentFile,
+		"unknown apiVersion": unknownAPIVersion,
+		"unknown source": `
+fluxRecvVersion: 1
+endpoints:
+- source: Subversion
+  keyPath: foo
+`,
+	} {
+		assert.False(t, validate(config), name)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	fluxhttp "github.com/fluxcd/flux/pkg/http"
+	fluxclient "github.com/fluxcd/flux/pkg/http/client"
+	"github.com/go-kit/kit/log/level"
+)
+
+// With --self-test, flux-recv checks what it would need to serve
+// hooks, rather than serving them: that the downstream API's host
+// resolves, and fluxd answers a ping (and likewise for each tenant's
+// API); that each endpoint's keys load
+// and verify requests (see keycheck.go), and the endpoint can be
+// constructed; and that each listener's TLS certificate loads. It
+// exits non-zero if anything fails, so it can be used as an init
+// container, or to gate a deploy.
+
+// selfTestTimeout bounds each of the checks made of the downstream
+// API.
+const selfTestTimeout = 10 * time.Second
+
+// selfTest makes the checks, logging each problem found, and gives
+// the number of problems.
+func selfTest(configDir, apiBase string, listeners []Listener) int {
+	var problems int
+	problem := func(keyvals ...interface{}) {
+		problems++
+		level.Error(logger).Log(keyvals...)
+	}
+
+	if err := selfTestDownstream(apiBase); err != nil {
+		problem("msg", "self-test: downstream API is not reachable", "api", redactURL(apiBase), "err", err)
+	} else {
+		level.Info(logger).Log("msg", "self-test: downstream API answered", "api", redactURL(apiBase))
+	}
+	var names []string
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tested := map[string]bool{apiBase: true}
+	for _, name := range names {
+		api := tenants[name].api
+		if tested[api] {
+			continue
+		}
+		tested[api] = true
+		if err := selfTestDownstream(api); err != nil {
+			problem("msg", "self-test: tenant's API is not reachable", "tenant", name, "api", redactURL(api), "err", err)
+		} else {
+			level.Info(logger).Log("msg", "self-test: tenant's API answered", "tenant", name, "api", redactURL(api))
+		}
+	}
+
+	for _, l := range listeners {
+		if l.TLS != nil && l.TLS.Autocert == nil {
+			if _, _, err := TLSConfigFor(configDir, l.TLS); err != nil {
+				problem("msg", "self-test: cannot load TLS certificate", "listen", l.Listen, "err", err)
+			}
+		}
+		for _, ep := range l.Endpoints {
+			epAPI := apiBase
+			if t := endpointTenantOf(ep); t != nil {
+				epAPI = t.api
+			}
+			n := selfTestEndpoint(configDir, epAPI, l.Listen, ep)
+			problems += n
+			if n == 0 {
+				level.Info(sourceLogger(ep.Source)).Log("msg", "self-test: endpoint is good", "listen", l.Listen)
+			}
+		}
+	}
+	return problems
+}
+
+// selfTestDownstream resolves the downstream API's host, then pings
+// fluxd.
+func selfTestDownstream(apiBase string) error {
+	u, err := url.Parse(apiBase)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	if host := u.Hostname(); net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return fmt.Errorf("cannot resolve %q: %s", host, err.Error())
+		}
+	}
+	server := fluxclient.New(downstreamClient, fluxhttp.NewAPIRouter(), apiBase, fluxclient.Token(""))
+	if err := server.Ping(ctx); err != nil {
+		return fmt.Errorf("ping failed: %s", err.Error())
+	}
+	return nil
+}
+
+// selfTestEndpoint checks the endpoint's keys, then that it can be
+// constructed with the API it would send to, and gives the number of
+// problems.
+func selfTestEndpoint(configDir, apiBase, listen string, ep Endpoint) int {
+	log := level.Error(sourceLogger(ep.Source))
+	if _, ok := Sources[ep.Source]; !ok {
+		log.Log("msg", "self-test: unknown source", "listen", listen)
+		return 1
+	}
+	keys, err := loadEndpointKeys(configDir, ep)
+	if err != nil {
+		log.Log("msg", "self-test: cannot load key", "listen", listen, "err", err)
+		return 1
+	}
+	secrets, err := loadSecrets(configDir, ep)
+	if err != nil {
+		log.Log("msg", "self-test: cannot load secrets", "listen", listen, "err", err)
+		return 1
+	}
+	var problems int
+	for _, k := range keys {
+		if err := selfCheckVerification(ep.Source, endpointVerification(ep, k.key, secrets)); err != nil {
+			log.Log("msg", "self-test: key failed self-check", "listen", listen, "endpoint", endpointLabel(k.digest), "err", err)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return problems
+	}
+	if _, err := RoutesFromEndpoint(configDir, apiBase, ep); err != nil {
+		log.Log("msg", "self-test: cannot construct endpoint", "listen", listen, "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	fluxdUp := true
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fluxdUp {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	good := []Listener{{Listen: ":8080", Endpoints: []Endpoint{
+		{Source: GitHub, KeyPath: "github_key"},
+		{Source: DockerHub, KeyPath: "dockerhub_key"},
+	}}}
+	assert.Equal(t, 0, selfTest("test/fixtures", downstream.URL, good))
+
+	bad := []Listener{{Listen: ":8080", Endpoints: []Endpoint{
+		{Source: GitHub, KeyPath: "missing_key"},
+		{Source: "Nonesuch", KeyPath: "github_key"},
+		{Source: GitHub, KeyPath: "github_key", SignatureAlgorithms: []string{"md5"}},
+	}}}
+	assert.Equal(t, 3, selfTest("test/fixtures", downstream.URL, bad))
+
+	fluxdUp = false
+	assert.Equal(t, 1, selfTest("test/fixtures", downstream.URL, good))
+	assert.Equal(t, 1, selfTest("test/fixtures", "http://flux.invalid:3030/api/flux", good))
+}
+
+func TestSelfTestTenants(t *testing.T) {
+	var pinged []string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pinged = append(pinged, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	defer func(ts map[string]*tenant) { tenants = ts }(tenants)
+	tenants = map[string]*tenant{
+		"team-a": {name: "team-a", api: downstream.URL + "/team-a"},
+		"team-b": {name: "team-b", api: downstream.URL + "/team-b"},
+		"team-c": {name: "team-c", api: downstream.URL},
+	}
+	good := []Listener{{Listen: ":8080", Endpoints: []Endpoint{
+		{Source: GitHub, KeyPath: "github_key", Tenant: "team-a"},
+	}}}
+	assert.Equal(t, 0, selfTest("test/fixtures", downstream.URL, good))
+	assert.Len(t, pinged, 3)
+
+	tenants["team-b"].api = "http://flux.invalid:3030/api/flux"
+	assert.Equal(t, 1, selfTest("test/fixtures", downstream.URL, good))
+}
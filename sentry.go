@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Errors worth a person's attention -- panics, payloads that can't be
+// parsed, and repeated failures to notify fluxd -- can be reported to
+// Sentry (https://sentry.io), tagged with the source and endpoint,
+// using Sentry's store API.
+
+const (
+	// downstreamErrorThreshold is how many notifications from a
+	// source must fail in a row before it's reported
+	downstreamErrorThreshold = 5
+	// maxPendingReports bounds the events waiting to be sent; any
+	// more are dropped
+	maxPendingReports = 100
+)
+
+// errorReporter sends events to Sentry, if enabled; otherwise it's
+// nil, and reporting does nothing.
+var errorReporter *sentryReporter
+
+type sentryReporter struct {
+	storeURL    string
+	auth        string
+	environment string
+	client      *http.Client
+	events      chan *sentryEvent
+
+	mu sync.Mutex
+	// downstreamErrors counts the notifications that have failed in
+	// a row, for each source
+	downstreamErrors map[string]int
+}
+
+// newSentryReporter constructs a reporter for the DSN given, e.g.,
+// `https://<key>@o0.ingest.sentry.io/<project>`.
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("sentry: %q is not a DSN (https://<key>@<host>/<project>)", dsn)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndexByte(path, '/')
+	project := path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("sentry: DSN %q has no project", dsn)
+	}
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path[:i] + "/api/" + project + "/store/"}
+	auth := "Sentry sentry_version=7, sentry_client=flux-recv/1, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return &sentryReporter{
+		storeURL:         store.String(),
+		auth:             auth,
+		environment:      environment,
+		client:           &http.Client{Timeout: 10 * time.Second},
+		events:           make(chan *sentryEvent, maxPendingReports),
+		downstreamErrors: map[string]int{},
+	}, nil
+}
+
+// sentryEvent is an event, as much of it as is used here.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type reportTagsKey struct{}
+
+// withErrorReporting tags the errors reported for requests to an
+// endpoint, and reports panics.
+func withErrorReporting(source, digest string, next http.Handler) http.Handler {
+	if errorReporter == nil {
+		return next
+	}
+	tags := map[string]string{"source": source, "endpoint": endpointLabel(digest)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), reportTagsKey{}, tags))
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				errorReporter.report(r.Context(), "fatal", fmt.Sprintf("panic: %v", p), map[string]string{"stack": string(debug.Stack())})
+				level.Error(requestLogger(r)).Log("msg", "panic handling request", "panic", fmt.Sprint(p))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportError reports an error in handling the request.
+func reportError(ctx context.Context, msg string, err error) {
+	errorReporter.report(ctx, "error", msg+": "+err.Error(), nil)
+}
+
+// downstreamResult counts failures to notify downstream, reporting
+// when there have been downstreamErrorThreshold in a row.
+func (s *sentryReporter) downstreamResult(ctx context.Context, source string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if err == nil {
+		delete(s.downstreamErrors, source)
+		s.mu.Unlock()
+		return
+	}
+	s.downstreamErrors[source]++
+	n := s.downstreamErrors[source]
+	s.mu.Unlock()
+	if n == downstreamErrorThreshold {
+		s.report(ctx, "error", fmt.Sprintf("%d notifications in a row failed: %s", n, err.Error()), nil)
+	}
+}
+
+func (s *sentryReporter) report(ctx context.Context, lvl, msg string, extra map[string]string) {
+	if s == nil {
+		return
+	}
+	var id [16]byte
+	rand.Read(id[:])
+	host, _ := os.Hostname()
+	ev := &sentryEvent{
+		EventID:     hex.EncodeToString(id[:]),
+		Timestamp:   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:       lvl,
+		Platform:    "go",
+		Logger:      "flux-recv",
+		ServerName:  host,
+		Environment: s.environment,
+		Message:     msg,
+		Extra:       extra,
+	}
+	if tags, ok := ctx.Value(reportTagsKey{}).(map[string]string); ok {
+		ev.Tags = tags
+	}
+	if id := correlationID(ctx); id != "" {
+		if ev.Extra == nil {
+			ev.Extra = map[string]string{}
+		}
+		ev.Extra["correlation"] = id
+	}
+	queuedSend("sentry")
+	select {
+	case s.events <- ev:
+	default:
+		sentQueued("sentry")
+		level.Warn(logger).Log("component", "sentry", "msg", "dropped error report, since Sentry isn't keeping up")
+	}
+}
+
+// run sends the events reported.
+func (s *sentryReporter) run() {
+	for ev := range s.events {
+		if err := s.send(ev); err != nil {
+			level.Error(logger).Log("component", "sentry", "msg", "could not send error report", "err", err)
+		}
+		sentQueued("sentry")
+	}
+}
+
+func (s *sentryReporter) send(ev *sentryEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded with %s", res.Status)
+	}
+	return nil
+}
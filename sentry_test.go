@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSentryDSN(t *testing.T) {
+	s, err := newSentryReporter("https://abc123@o1.ingest.sentry.io/prefix/42", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://o1.ingest.sentry.io/prefix/api/42/store/", s.storeURL)
+	assert.Contains(t, s.auth, "sentry_key=abc123")
+
+	for _, dsn := range []string{"not a url", "https://o1.ingest.sentry.io/42", "https://abc@o1.ingest.sentry.io/"} {
+		_, err := newSentryReporter(dsn, "")
+		assert.Error(t, err, dsn)
+	}
+}
+
+func TestSentryReporting(t *testing.T) {
+	events := make(chan sentryEvent, 10)
+	sentry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/1/store/", r.URL.Path)
+		assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=public")
+		var ev sentryEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		events <- ev
+	}))
+	defer sentry.Close()
+
+	defer func(r *sentryReporter) { errorReporter = r }(errorReporter)
+	var err error
+	errorReporter, err = newSentryReporter("http://public@"+sentry.Listener.Addr().String()+"/1", "test")
+	assert.NoError(t, err)
+	go errorReporter.run()
+
+	handler := withCorrelationID(withErrorReporting(GitHub, "0123456789abcdef", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})))
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/hook/0123456789abcdef", nil)
+	req.Header.Set("X-GitHub-Delivery", "d-1")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	ev := <-events
+	assert.Equal(t, "fatal", ev.Level)
+	assert.Equal(t, "panic: oops", ev.Message)
+	assert.Equal(t, "test", ev.Environment)
+	assert.Equal(t, map[string]string{"source": GitHub, "endpoint": "0123456789ab"}, ev.Tags)
+	assert.Equal(t, "d-1", ev.Extra["correlation"])
+	assert.Contains(t, ev.Extra["stack"], "sentry_test.go")
+
+	// one failure to notify isn't reported, but a run of them is, once
+	ctx := context.Background()
+	for i := 0; i < downstreamErrorThreshold*2; i++ {
+		errorReporter.downstreamResult(ctx, GitHub, errors.New("connection refused"))
+	}
+	ev = <-events
+	assert.Contains(t, ev.Message, "notifications in a row failed: connection refused")
+	assert.Len(t, events, 0)
+}
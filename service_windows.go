@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// flux-recv can run as a Windows service. When it's started by the
+// service control manager, rather than from a console, it logs to the
+// Application event log (under the source serviceName), and shuts
+// down gracefully when the service is stopped, or Windows shuts down.
+// From a console, Ctrl-C (and closing the console) shuts it down.
+
+const (
+	// serviceName is the name the service is expected to be
+	// installed under, and the event log source
+	serviceName = "flux-recv"
+	// eventID is given for every event logged; there's no message
+	// file, so the event is all in the text
+	eventID = 1
+)
+
+var (
+	// runningAsService is true if started by the service control
+	// manager
+	runningAsService bool
+	// serving is closed once flux-recv is ready to be told to stop
+	serving = make(chan struct{})
+	// serviceControls gets the service control manager's requests to
+	// stop
+	serviceControls = make(chan control, 1)
+	// stopped is closed once flux-recv has shut down, and
+	// serviceExited once the service control manager has been told
+	stopped       = make(chan struct{})
+	serviceExited = make(chan struct{})
+)
+
+func init() {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil || interactive {
+		return
+	}
+	runningAsService = true
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		logOutput = eventLogWriter{elog}
+		logger = newLogger(logOutput, logFormatConsole, level.AllowInfo())
+	}
+	// the service control manager needs to hear from the process
+	// soon after it starts, so this can't wait until main is serving
+	go func() {
+		defer close(serviceExited)
+		if err := svc.Run(serviceName, serviceHandler{}); err != nil {
+			level.Error(logger).Log("msg", "could not run as a service", "err", err)
+		}
+	}()
+}
+
+// notifyControl sends a control to c for each request to shut down:
+// Ctrl-C, closing the console, and when running as a service,
+// stopping it. Restarting isn't supported on Windows.
+func notifyControl(c chan<- control) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				c <- control{reason: sig.String()}
+			case ctl := <-serviceControls:
+				c <- ctl
+			}
+		}
+	}()
+	close(serving)
+}
+
+// controlDone tells the service control manager, if running as a
+// service, that the service has stopped, and waits for that to be
+// done.
+func controlDone() {
+	close(stopped)
+	if runningAsService {
+		<-serviceExited
+	}
+}
+
+type serviceHandler struct{}
+
+// Execute reports the service as starting until flux-recv is serving,
+// then passes on requests to stop it, and reports it as stopped once
+// it's shut down.
+func (serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	<-serving
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				reason := "service stopped"
+				if req.Cmd == svc.Shutdown {
+					reason = "system shutting down"
+				}
+				select {
+				case serviceControls <- control{reason: reason}:
+				default: // already stopping
+				}
+			}
+		case <-stopped:
+			return false, 0
+		}
+	}
+}
+
+// eventLogWriter writes each log line as an event, of the line's
+// level. Lines without a level (e.g., from bail) are errors.
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(msg, "level=info"), strings.Contains(msg, `"level":"info"`),
+		strings.Contains(msg, "level=debug"), strings.Contains(msg, `"level":"debug"`):
+		err = w.log.Info(eventID, msg)
+	case strings.Contains(msg, "level=warn"), strings.Contains(msg, `"level":"warn"`):
+		err = w.log.Warning(eventID, msg)
+	default:
+		err = w.log.Error(eventID, msg)
+	}
+	return len(p), err
+}
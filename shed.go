@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Under overload -- more requests than can be handled promptly, or
+// too little CPU to handle them -- it's better to refuse some hooks
+// straight away, so the providers try again later, than to handle
+// all of them slowly until they time out. With `loadShedding` in the
+// config, requests for hooks are refused with 503 Service Unavailable
+// while too many are in flight, or while the Go scheduler is running
+// behind (measured by how late a sleeping goroutine wakes). Unlike the
+// quota, which is a fixed budget, this responds to how the process is
+// actually coping; `flux-recv loadtest` (see loadtest.go) helps find
+// thresholds that suit a deployment.
+
+// LoadShedding gives when to refuse requests for hooks because
+// flux-recv is overloaded.
+type LoadShedding struct {
+	// MaxInFlight is the most requests for hooks handled at once
+	// before shedding; zero means no limit
+	MaxInFlight int `json:"maxInFlight,omitempty"`
+	// MaxSchedulerLatency is how far behind the scheduler can run
+	// (e.g., "100ms") before shedding; if not given, there's no limit
+	MaxSchedulerLatency string `json:"maxSchedulerLatency,omitempty"`
+	// RetryAfter is the Retry-After given in responses to shed
+	// requests; if not given, defaultShedRetryAfter
+	RetryAfter string `json:"retryAfter,omitempty"`
+}
+
+func (s *LoadShedding) validate() error {
+	if s.MaxInFlight < 0 {
+		return fmt.Errorf("loadShedding: maxInFlight must not be negative")
+	}
+	if s.MaxInFlight == 0 && s.MaxSchedulerLatency == "" {
+		return fmt.Errorf("loadShedding needs maxInFlight or maxSchedulerLatency")
+	}
+	for name, value := range map[string]string{
+		"maxSchedulerLatency": s.MaxSchedulerLatency,
+		"retryAfter":          s.RetryAfter,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("loadShedding: %s %q is not a positive duration", name, value)
+		}
+	}
+	return nil
+}
+
+const (
+	defaultShedRetryAfter = 5 * time.Second
+	// schedulerProbeInterval is how long the goroutine measuring the
+	// scheduler's latency sleeps for each time
+	schedulerProbeInterval = 50 * time.Millisecond
+)
+
+var (
+	hookRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "hook_requests_in_flight",
+		Help:      "Requests for hooks being handled, when load shedding is enabled.",
+	})
+	schedulerLatency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "scheduler_latency_seconds",
+		Help:      "How late a sleeping goroutine wakes, smoothed, when load shedding is enabled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(hookRequestsInFlight, schedulerLatency)
+}
+
+// loadShed refuses requests for hooks under overload, if configured;
+// otherwise it's nil. It's set from the config by main.
+var loadShed *loadShedder
+
+type loadShedder struct {
+	maxInFlight int64
+	maxLatency  time.Duration // zero means no limit
+	retryAfter  time.Duration
+
+	inFlight int64 // atomic
+	latency  int64 // atomic; nanoseconds
+}
+
+func newLoadShedder(config LoadShedding) *loadShedder {
+	// the durations were checked when the config was loaded
+	s := &loadShedder{
+		maxInFlight: int64(config.MaxInFlight),
+		retryAfter:  defaultShedRetryAfter,
+	}
+	if config.MaxSchedulerLatency != "" {
+		s.maxLatency, _ = time.ParseDuration(config.MaxSchedulerLatency)
+	}
+	if config.RetryAfter != "" {
+		s.retryAfter, _ = time.ParseDuration(config.RetryAfter)
+	}
+	return s
+}
+
+// monitor measures the scheduler's latency until stop is closed.
+func (s *loadShedder) monitor(stop <-chan struct{}) {
+	timer := time.NewTimer(schedulerProbeInterval)
+	defer timer.Stop()
+	for {
+		start := time.Now()
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		s.observe(time.Since(start) - schedulerProbeInterval)
+		timer.Reset(schedulerProbeInterval)
+	}
+}
+
+// observe records a measurement of the scheduler's latency. It's
+// smoothed, so one late wake-up (e.g., a GC pause) doesn't start
+// shedding, but a run of them does.
+func (s *loadShedder) observe(late time.Duration) {
+	if late < 0 {
+		late = 0
+	}
+	prev := atomic.LoadInt64(&s.latency)
+	smoothed := prev + (int64(late)-prev)/4
+	atomic.StoreInt64(&s.latency, smoothed)
+	schedulerLatency.Set(time.Duration(smoothed).Seconds())
+}
+
+// wrap refuses requests while overloaded, and counts them in the
+// requestsShed metric. Like those over the quota, these aren't
+// logged.
+func (s *loadShedder) wrap(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&s.inFlight, 1)
+		hookRequestsInFlight.Inc()
+		defer func() {
+			atomic.AddInt64(&s.inFlight, -1)
+			hookRequestsInFlight.Dec()
+		}()
+		if s.maxInFlight > 0 && n > s.maxInFlight {
+			requestsShed.WithLabelValues("in-flight").Inc()
+			s.shed(w)
+			return
+		}
+		if s.maxLatency > 0 && time.Duration(atomic.LoadInt64(&s.latency)) > s.maxLatency {
+			requestsShed.WithLabelValues("scheduler-latency").Inc()
+			s.shed(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shed responds with 503, and a Retry-After header saying (in whole
+// seconds) when to try again.
+func (s *loadShedder) shed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds()))))
+	http.Error(w, "Overloaded; try again later", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedInFlight(t *testing.T) {
+	s := newLoadShedder(LoadShedding{MaxInFlight: 1})
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := s.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	before := testutil.ToFloat64(requestsShed.WithLabelValues("in-flight"))
+
+	done := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+		done <- res.Code
+	}()
+	<-entered
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "5", res.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, testutil.ToFloat64(requestsShed.WithLabelValues("in-flight")))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestLoadShedSchedulerLatency(t *testing.T) {
+	s := newLoadShedder(LoadShedding{MaxSchedulerLatency: "100ms", RetryAfter: "1500ms"})
+	handler := s.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("POST", "/hook/abc", nil))
+		return res
+	}
+
+	// one late wake-up isn't enough to start shedding
+	s.observe(time.Second / 5)
+	assert.Equal(t, http.StatusOK, serve().Code)
+
+	for i := 0; i < 5; i++ {
+		s.observe(time.Second / 5)
+	}
+	res := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "2", res.Header().Get("Retry-After"))
+
+	// and once it's caught up, requests are let through again
+	for i := 0; i < 10; i++ {
+		s.observe(0)
+	}
+	assert.Equal(t, http.StatusOK, serve().Code)
+}
+
+func TestLoadShedMonitor(t *testing.T) {
+	s := newLoadShedder(LoadShedding{MaxSchedulerLatency: "1s"})
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.monitor(stop)
+		close(done)
+	}()
+	time.Sleep(3 * schedulerProbeInterval)
+	close(stop)
+	<-done
+	// an idle test process shouldn't be anywhere near that far behind
+	assert.True(t, time.Duration(atomic.LoadInt64(&s.latency)) < time.Second)
+}
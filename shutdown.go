@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// On SIGTERM (or an interrupt), flux-recv shuts down gracefully, so
+// that a rolling update doesn't drop hooks: it reports not ready,
+// stops accepting connections, lets the requests in flight -- which
+// includes notifying fluxd -- finish, gives up the leader's Lease (see
+// leader.go), then waits for what's queued to be sent in the
+// background (callbacks, audit events, alerts, and so on). It exits
+// once all that's done, or the drain timeout is up; whatever is left
+// unsent then is logged, and recorded in the shutdown_unsent gauge
+// (pushed one last time, with --push-metrics), so operators can tell
+// whether anything was left behind.
+
+const (
+	defaultDrainTimeout = 25 * time.Second
+	// drainPollInterval is how often the background queues are
+	// checked, while draining
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// shuttingDown is set (to 1) once shutdown has started.
+var shuttingDown int32
+
+// backgroundQueues counts what's been queued to be sent in the
+// background, and not yet sent (or given up on), by queue (e.g.,
+// "callback").
+type backgroundQueues struct {
+	mu     sync.Mutex
+	queued map[string]int64
+}
+
+func newBackgroundQueues() *backgroundQueues {
+	return &backgroundQueues{queued: map[string]int64{}}
+}
+
+func (q *backgroundQueues) add(queue string, n int64) {
+	q.mu.Lock()
+	q.queued[queue] += n
+	q.mu.Unlock()
+}
+
+// pending gives the total queued, and how many in each queue.
+func (q *backgroundQueues) pending() (int64, map[string]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var total int64
+	byQueue := map[string]int64{}
+	for queue, n := range q.queued {
+		total += n
+		byQueue[queue] = n
+	}
+	return total, byQueue
+}
+
+var backgroundSends = newBackgroundQueues()
+
+// queuedSend is called when something is queued to be sent in the
+// background, and sentQueued once it's been dealt with.
+func queuedSend(queue string) { backgroundSends.add(queue, 1) }
+func sentQueued(queue string) { backgroundSends.add(queue, -1) }
+
+var shutdownUnsent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "flux_recv",
+	Name:      "shutdown_unsent",
+	Help:      "What was left unsent when shutting down, by queue; \"spool\" counts the spooled bodies of requests still in flight.",
+}, []string{"queue"})
+
+func init() {
+	prometheus.MustRegister(shutdownUnsent)
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// shutdown stops the servers gracefully, then waits for the
+// background sends, all within the timeout, and records what's left.
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("requests to %s still in flight: %s", server.Addr, err.Error())
+				}
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	defer recordUnsent(backgroundSends, bodySpool)
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if leaderElector != nil {
+		if err := leaderElector.release(); err != nil {
+			level.Error(logger).Log("component", "leader-election", "msg", "could not release lease", "err", err)
+		}
+	}
+	if activeTracer != nil {
+		if err := activeTracer.exportPending(); err != nil {
+			level.Error(logger).Log("component", "tracing", "msg", "could not export spans", "err", err)
+		}
+	}
+	return drainBackgroundSends(ctx, backgroundSends)
+}
+
+// drainBackgroundSends waits until nothing is counted as queued to be
+// sent in the background, or the context is done.
+func drainBackgroundSends(ctx context.Context, sends *backgroundQueues) error {
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+	for {
+		n, byQueue := sends.pending()
+		if n <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			var queues []string
+			for queue, n := range byQueue {
+				if n > 0 {
+					queues = append(queues, fmt.Sprintf("%s: %d", queue, n))
+				}
+			}
+			sort.Strings(queues)
+			return fmt.Errorf("gave up on %d background sends still queued (%s)", n, strings.Join(queues, ", "))
+		case <-tick.C:
+		}
+	}
+}
+
+// recordUnsent removes the spooled bodies of any requests still in
+// flight, since nothing else will once the process has exited, and
+// records how many of those, and of each queue of background sends,
+// are left unsent.
+func recordUnsent(sends *backgroundQueues, spool *spooler) {
+	_, byQueue := sends.pending()
+	if spool != nil {
+		byQueue["spool"] = int64(spool.removeAll())
+	}
+	var queues []string
+	for queue := range byQueue {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	keyvals := []interface{}{"msg", "left unsent at shutdown"}
+	var total int64
+	for _, queue := range queues {
+		n := byQueue[queue]
+		shutdownUnsent.WithLabelValues(queue).Set(float64(n))
+		if n > 0 {
+			keyvals = append(keyvals, queue, n)
+			total += n
+		}
+	}
+	if total > 0 {
+		level.Warn(logger).Log(keyvals...)
+	}
+	if activePusher != nil {
+		if err := activePusher.push(); err != nil {
+			level.Error(logger).Log("component", "metrics", "msg", "could not push metrics", "url", redactURL(activePusher.url), "err", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	// other tests leave things queued, with no sender running
+	defer func(q *backgroundQueues) { backgroundSends = q }(backgroundSends)
+	backgroundSends = newBackgroundQueues()
+
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(l)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		results <- result{body: string(body)}
+	}()
+
+	<-started
+	assert.NoError(t, shutdown([]*http.Server{server}, 5*time.Second))
+	assert.True(t, isShuttingDown())
+	res := <-results
+	assert.NoError(t, res.err)
+	assert.Equal(t, "ok", res.body)
+
+	// the server no longer accepts connections
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestDrainBackgroundSends(t *testing.T) {
+	sends := newBackgroundQueues()
+	sends.add("callback", 1)
+	sends.add("alerts", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := drainBackgroundSends(ctx, sends)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 background sends")
+	assert.Contains(t, err.Error(), "(alerts: 1, callback: 1)")
+
+	// it waits for them to be sent
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sends.add("callback", -1)
+		time.Sleep(100 * time.Millisecond)
+		sends.add("alerts", -1)
+	}()
+	start := time.Now()
+	assert.NoError(t, drainBackgroundSends(context.Background(), sends))
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
+// Test that what's left unsent at shutdown is recorded, and spooled
+// bodies still open are removed.
+func TestRecordUnsent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spool, err := newSpooler("", Spool{ThresholdBytes: 4, Dir: dir})
+	assert.NoError(t, err)
+	body, err := spool.spool(GitHub, strings.NewReader("more than four bytes"))
+	assert.NoError(t, err)
+	defer body.Close()
+
+	sends := newBackgroundQueues()
+	sends.add("callback", 2)
+	sends.add("alerts", 1)
+	sends.add("alerts", -1)
+	recordUnsent(sends, spool)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(shutdownUnsent.WithLabelValues("callback")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(shutdownUnsent.WithLabelValues("alerts")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(shutdownUnsent.WithLabelValues("spool")))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestNotReadyWhenShuttingDown(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	hooks := newHookRouter()
+	hooks.set("abc", http.NotFoundHandler())
+	handler := readyz(hooks, defaultApiBase)
+	status := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", readyzPath, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status())
+	atomic.StoreInt32(&shuttingDown, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// hmacAlgorithms are the hash algorithms that can be used for HMAC
+// signatures, by the names used in signature headers (e.g.,
+// `X-Hub-Signature: sha256=...`) and in the config.
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// defaultSignatureAlgorithms are those accepted when an endpoint
+// doesn't give signatureAlgorithms. SHA1 is left out, since it's no
+// longer considered safe; but some servers (e.g., older GitHub
+// Enterprise, some Gitea versions) only sign with SHA1, so it can be
+// given explicitly for those endpoints.
+var defaultSignatureAlgorithms = []string{"sha256", "sha512"}
+
+// SignedSources are the sources that sign payloads, and so for which
+// signatureAlgorithms is meaningful.
+var SignedSources = map[string]bool{}
+
+// signatureHeaders are the headers that may carry a signature, in
+// order of preference. GitHub sends both -- X-Hub-Signature-256 is
+// always SHA256, while X-Hub-Signature is (for GitHub) SHA1.
+var signatureHeaders = []string{"X-Hub-Signature-256", "X-Hub-Signature"}
+
+// validateSignature checks the HMAC signature of body given in the
+// request headers, using the keys and accepted algorithms from v. The
+// first signature header present that uses an accepted algorithm is
+// the one checked, and it's valid if it matches using any of the
+// keys.
+func validateSignature(r *http.Request, body []byte, v Verification) (err error) {
+	_, span := startSpan(r.Context(), "verify signature", spanKindInternal)
+	defer func() {
+		if err != nil {
+			span.setError(err.Error())
+		}
+		span.finish()
+	}()
+
+	check, err := newSignatureCheck(r, v)
+	if err != nil {
+		return err
+	}
+	check.Write(body)
+	return check.verify()
+}
+
+// signatureCheck computes the HMAC of a body, with each of the keys,
+// as it's written, to check against the signature from the request
+// headers; so the body doesn't need to be held in memory to check it.
+type signatureCheck struct {
+	sig  []byte
+	macs []hash.Hash
+}
+
+// newSignatureCheck finds the signature to check in the request
+// headers, as validateSignature does.
+func newSignatureCheck(r *http.Request, v Verification) (*signatureCheck, error) {
+	algorithms := v.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultSignatureAlgorithms
+	}
+
+	var rejected []string
+	for _, header := range signatureHeaders {
+		sig := r.Header.Get(header)
+		if sig == "" {
+			continue
+		}
+		parts := strings.SplitN(sig, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("cannot parse signature in %s", header)
+		}
+		alg := parts[0]
+		if !containsString(algorithms, alg) {
+			rejected = append(rejected, header+" ("+alg+")")
+			continue
+		}
+		mac, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode signature in %s: %s", header, err.Error())
+		}
+		check := &signatureCheck{sig: mac}
+		for _, key := range v.Keys {
+			check.macs = append(check.macs, hmac.New(hmacAlgorithms[alg], key))
+		}
+		return check, nil
+	}
+
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("no signature using an accepted algorithm (%s); got %s", strings.Join(algorithms, ", "), strings.Join(rejected, ", "))
+	}
+	return nil, errors.New("missing signature")
+}
+
+func (c *signatureCheck) Write(p []byte) (int, error) {
+	for _, mac := range c.macs {
+		mac.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks the signature against what's been written, which
+// must be the whole body.
+func (c *signatureCheck) verify() error {
+	for _, mac := range c.macs {
+		if hmac.Equal(c.sig, mac.Sum(nil)) {
+			return nil
+		}
+	}
+	return errors.New("payload signature check failed")
+}
+
+// hasSignature reports whether the request has a signature header.
+func hasSignature(r *http.Request) bool {
+	for _, header := range signatureHeaders {
+		if r.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkToken reports whether the token (e.g., from a header) is one
+// of the keys in v.
+func checkToken(token string, v Verification) bool {
+	for _, key := range v.Keys {
+		if subtle.ConstantTimeCompare([]byte(token), key) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With `slo` in the config, flux-recv exports the rate at which each
+// endpoint is burning its error budget, over the windows used for
+// multiwindow burn-rate alerts (see "Alerting on SLOs" in the Google
+// SRE workbook), so you can alert on them without writing recording
+// rules. A burn rate of 1 uses up the error budget in exactly the
+// period of the SLO; 14.4 over an hour uses 2% of a 30 day budget.
+//
+// A delivery is bad, for the availability SLO, if flux-recv failed
+// to handle it (a 5xx response), timed out, or couldn't notify fluxd
+// of a change; requests refused for the source's reasons (e.g., a bad
+// signature) don't count against it. For the latency SLO, a delivery
+// is bad if it took longer than the threshold.
+
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+	// defaultLatencyObjective is the fraction of deliveries that
+	// should be within the latency threshold, if not given
+	defaultLatencyObjective = 0.99
+	// sloBucketCount is how many one minute buckets are kept; enough
+	// for the longest window
+	sloBucketCount = 6 * 60
+)
+
+// sloWindows are the windows burn rates are given over.
+var sloWindows = []struct {
+	label   string
+	minutes int64
+}{
+	{"5m", 5},
+	{"30m", 30},
+	{"1h", 60},
+	{"6h", 6 * 60},
+}
+
+var (
+	sloBurnRateDesc = prometheus.NewDesc("flux_recv_slo_burn_rate",
+		"The rate at which each endpoint is using up the error budget of the SLO, over the window.",
+		[]string{"source", "endpoint", "slo", "window"}, nil)
+	sloObjectiveDesc = prometheus.NewDesc("flux_recv_slo_objective",
+		"The fraction of deliveries that should be good, for the SLO.",
+		[]string{"slo"}, nil)
+)
+
+// sloBurnRates counts deliveries for the SLO, if one is given;
+// otherwise it's nil.
+var sloBurnRates *sloTracker
+
+type sloBucket struct {
+	minute           int64
+	total, bad, slow uint64
+}
+
+type sloSeries struct {
+	source, endpoint string
+	buckets          [sloBucketCount]sloBucket
+}
+
+// sloTracker counts deliveries in one minute buckets, and is a
+// prometheus.Collector giving the burn rates.
+type sloTracker struct {
+	availability     float64
+	latency          time.Duration
+	latencyObjective float64
+	now              func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*sloSeries
+}
+
+// newSLOTracker constructs a tracker for the (validated) SLO.
+func newSLOTracker(slo SLO) *sloTracker {
+	t := &sloTracker{
+		availability:     slo.Availability,
+		latencyObjective: slo.LatencyObjective,
+		now:              time.Now,
+		series:           map[string]*sloSeries{},
+	}
+	if slo.Latency != "" {
+		t.latency, _ = time.ParseDuration(slo.Latency)
+		if t.latencyObjective == 0 {
+			t.latencyObjective = defaultLatencyObjective
+		}
+	}
+	return t
+}
+
+// add counts the delivery; it's a sink for withDeliveryRecords.
+func (t *sloTracker) add(rec *deliveryRecord) {
+	bad := rec.Status >= 500 || rec.Status == 408 || len(rec.failedChanges()) > 0
+	slow := t.latency > 0 && time.Duration(rec.DurationMillis)*time.Millisecond > t.latency
+	minute := t.now().Unix() / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := rec.Source + "/" + rec.Endpoint
+	s, ok := t.series[key]
+	if !ok {
+		s = &sloSeries{source: rec.Source, endpoint: rec.Endpoint}
+		t.series[key] = s
+	}
+	b := &s.buckets[minute%sloBucketCount]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+func (t *sloTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloBurnRateDesc
+	ch <- sloObjectiveDesc
+}
+
+func (t *sloTracker) Collect(ch chan<- prometheus.Metric) {
+	if t.availability > 0 {
+		ch <- prometheus.MustNewConstMetric(sloObjectiveDesc, prometheus.GaugeValue, t.availability, sloAvailability)
+	}
+	if t.latency > 0 {
+		ch <- prometheus.MustNewConstMetric(sloObjectiveDesc, prometheus.GaugeValue, t.latencyObjective, sloLatency)
+	}
+
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.series {
+		for _, w := range sloWindows {
+			var total, bad, slow uint64
+			for i := range s.buckets {
+				if b := &s.buckets[i]; b.minute > minute-w.minutes && b.minute <= minute {
+					total += b.total
+					bad += b.bad
+					slow += b.slow
+				}
+			}
+			if t.availability > 0 {
+				ch <- prometheus.MustNewConstMetric(sloBurnRateDesc, prometheus.GaugeValue, burnRate(bad, total, t.availability), s.source, s.endpoint, sloAvailability, w.label)
+			}
+			if t.latency > 0 {
+				ch <- prometheus.MustNewConstMetric(sloBurnRateDesc, prometheus.GaugeValue, burnRate(slow, total, t.latencyObjective), s.source, s.endpoint, sloLatency, w.label)
+			}
+		}
+	}
+}
+
+// burnRate gives the ratio of bad deliveries to those the objective
+// allows; with no deliveries, nothing is burned.
+func burnRate(bad, total uint64, objective float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - objective)
+}
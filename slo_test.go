@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// burnRates gathers the burn rates, by `<slo> <window>`.
+func burnRates(t *testing.T, tracker *sloTracker) map[string]float64 {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(tracker)
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	rates := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "flux_recv_slo_burn_rate" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			rates[labels["slo"]+" "+labels["window"]] = m.GetGauge().GetValue()
+		}
+	}
+	return rates
+}
+
+func TestSLOBurnRates(t *testing.T) {
+	tracker := newSLOTracker(SLO{Availability: 0.9, Latency: "1s"})
+	assert.Equal(t, defaultLatencyObjective, tracker.latencyObjective)
+	now := time.Date(2019, 11, 20, 10, 0, 30, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	record := func(status int, millis int64, changes ...auditChange) *deliveryRecord {
+		return &deliveryRecord{Source: GitHub, Endpoint: "0123456789ab", Status: status, DurationMillis: millis, Changes: changes}
+	}
+	ok, slow, failed, rejected := record(200, 100), record(200, 1500), record(500, 100), record(401, 1)
+
+	// an hour ago, all bad; that's only in the longest window
+	now = now.Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		tracker.add(failed)
+	}
+	now = now.Add(time.Hour)
+	// now, one in ten failed and one in ten was slow; refusing a
+	// request isn't a failure
+	for _, rec := range []*deliveryRecord{failed, slow, ok, ok, ok, ok, ok, ok, ok, rejected} {
+		tracker.add(rec)
+	}
+
+	rates := burnRates(t, tracker)
+	assert.Len(t, rates, 8)
+	for _, w := range []string{"5m", "30m", "1h"} {
+		assert.InDelta(t, 1, rates["availability "+w], 1e-9, w)
+		assert.InDelta(t, 10, rates["latency "+w], 1e-9, w)
+	}
+	assert.InDelta(t, 5.5, rates["availability 6h"], 1e-9)
+	assert.InDelta(t, 5, rates["latency 6h"], 1e-9)
+
+	// failing to notify fluxd is bad too
+	tracker.add(record(200, 100, auditChange{Subject: "git@github.com:Codertocat/Hello-World.git", Result: "connection refused"}))
+	assert.InDelta(t, 2.0/11/0.1, burnRates(t, tracker)["availability 5m"], 1e-9)
+
+	// once the windows have passed, there's nothing to burn
+	now = now.Add(7 * time.Hour)
+	for slo, rate := range burnRates(t, tracker) {
+		assert.Equal(t, 0.0, rate, slo)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// This decrypts files encrypted with SOPS
+// (https://github.com/getsops/sops), using age keys. SOPS encrypts
+// each value in a YAML or JSON document with a data key, authenticated
+// with the path to the value; the data key is encrypted for each
+// recipient, and a MAC over all the values is kept in the `sops`
+// metadata.
+
+// sopsMetadata is the part of the `sops` metadata needed to decrypt.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified            string `yaml:"lastmodified"`
+	MAC                     string `yaml:"mac"`
+	MACOnlyEncrypted        bool   `yaml:"mac_only_encrypted"`
+	UnencryptedSuffix       string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix         string `yaml:"encrypted_suffix"`
+	UnencryptedRegex        string `yaml:"unencrypted_regex"`
+	EncryptedRegex          string `yaml:"encrypted_regex"`
+	UnencryptedCommentRegex string `yaml:"unencrypted_comment_regex"`
+	EncryptedCommentRegex   string `yaml:"encrypted_comment_regex"`
+}
+
+// sopsMACOnlyEncryptedInit starts the MAC when only encrypted values
+// are included, so it differs from the MAC over all values.
+var sopsMACOnlyEncryptedInit = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+var sopsValueRE = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// parseSOPS parses a YAML or JSON document, returning it without
+// the `sops` metadata, and the metadata. If the document has no
+// `sops` metadata, ok is false.
+func parseSOPS(data []byte) (doc yaml.MapSlice, meta sopsMetadata, ok bool) {
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, meta, false
+	}
+	for i, item := range doc {
+		if item.Key != "sops" {
+			continue
+		}
+		raw, err := yaml.Marshal(item.Value)
+		if err != nil || yaml.Unmarshal(raw, &meta) != nil || meta.MAC == "" {
+			return nil, meta, false
+		}
+		return append(doc[:i:i], doc[i+1:]...), meta, true
+	}
+	return nil, meta, false
+}
+
+// sopsInlineKeysEncrypted reports whether each key given inline in a
+// SOPS-encrypted config (as `key` in an item of `endpoints`) is itself
+// encrypted, rather than left in plaintext by the file's rules.
+func sopsInlineKeysEncrypted(data []byte) bool {
+	doc, _, ok := parseSOPS(data)
+	return ok && inlineKeysEncrypted(doc, false)
+}
+
+func inlineKeysEncrypted(v interface{}, endpoint bool) bool {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for _, item := range v {
+			name := fmt.Sprint(item.Key)
+			if !endpoint || name != "key" {
+				if !inlineKeysEncrypted(item.Value, name == "endpoints") {
+					return false
+				}
+				continue
+			}
+			switch key := item.Value.(type) {
+			case nil:
+			case string:
+				if key != "" && !sopsValueRE.MatchString(key) {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !inlineKeysEncrypted(item, endpoint) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isSOPSEncrypted reports whether data is a SOPS-encrypted document.
+func isSOPSEncrypted(data []byte) bool {
+	_, _, ok := parseSOPS(data)
+	return ok
+}
+
+// sopsDecrypt decrypts a SOPS-encrypted YAML or JSON document, using
+// the age identities given, and checks its MAC.
+func sopsDecrypt(data []byte, ids []ageIdentity) (yaml.MapSlice, error) {
+	doc, meta, ok := parseSOPS(data)
+	if !ok {
+		return nil, errors.New("sops: not a SOPS-encrypted file")
+	}
+	if meta.UnencryptedCommentRegex != "" || meta.EncryptedCommentRegex != "" {
+		return nil, errors.New("sops: files using encrypted_comment_regex or unencrypted_comment_regex are not supported")
+	}
+
+	var dataKey []byte
+	for _, recipient := range meta.Age {
+		key, err := ageDecrypt([]byte(recipient.Enc), ids)
+		if err == nil {
+			dataKey = key
+			break
+		}
+	}
+	if dataKey == nil {
+		return nil, errors.New("sops: the file is not encrypted for any of the age identities given")
+	}
+
+	d := sopsDecrypter{key: dataKey, meta: meta, mac: sha512.New()}
+	if meta.MACOnlyEncrypted {
+		d.mac.Write(sopsMACOnlyEncryptedInit)
+	}
+	decrypted, err := d.walk(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := d.decryptValue(meta.MAC, meta.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("sops: cannot decrypt MAC: %s", err.Error())
+	}
+	if fmt.Sprintf("%X", d.mac.Sum(nil)) != expected {
+		return nil, errors.New("sops: MAC check failed; the file may have been tampered with")
+	}
+	return decrypted.(yaml.MapSlice), nil
+}
+
+type sopsDecrypter struct {
+	key  []byte
+	meta sopsMetadata
+	mac  hash.Hash
+}
+
+// walk decrypts the values in the document, in order, adding each to
+// the MAC.
+func (d *sopsDecrypter) walk(v interface{}, path []string) (interface{}, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		out := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			key, ok := item.Key.(string)
+			if !ok {
+				key = fmt.Sprint(item.Key)
+			}
+			value, err := d.walk(item.Value, append(path[:len(path):len(path)], key))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = yaml.MapItem{Key: item.Key, Value: value}
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := d.walk(item, path)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value
+		}
+		return out, nil
+	case nil:
+		return nil, nil
+	}
+
+	encrypted := d.shouldBeEncrypted(path)
+	value := v
+	if encrypted {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("sops: value at %s is not encrypted", strings.Join(path, "."))
+		}
+		plain, err := d.decryptValue(s, strings.Join(path, ":")+":")
+		if err != nil {
+			return nil, fmt.Errorf("sops: cannot decrypt value at %s: %s", strings.Join(path, "."), err.Error())
+		}
+		var typed interface{}
+		if typed, err = sopsTyped(plain, s); err != nil {
+			return nil, err
+		}
+		value = typed
+	}
+	if encrypted || !d.meta.MACOnlyEncrypted {
+		d.mac.Write([]byte(sopsMACBytes(value)))
+	}
+	return value, nil
+}
+
+func (d *sopsDecrypter) shouldBeEncrypted(path []string) bool {
+	anyMatch := func(f func(string) bool) bool {
+		for _, p := range path {
+			if f(p) {
+				return true
+			}
+		}
+		return false
+	}
+	encrypted := true
+	if suffix := d.meta.UnencryptedSuffix; suffix != "" && anyMatch(func(p string) bool { return strings.HasSuffix(p, suffix) }) {
+		encrypted = false
+	}
+	if suffix := d.meta.EncryptedSuffix; suffix != "" {
+		encrypted = anyMatch(func(p string) bool { return strings.HasSuffix(p, suffix) })
+	}
+	if expr := d.meta.UnencryptedRegex; expr != "" && anyMatch(func(p string) bool { ok, _ := regexp.MatchString(expr, p); return ok }) {
+		encrypted = false
+	}
+	if expr := d.meta.EncryptedRegex; expr != "" {
+		encrypted = anyMatch(func(p string) bool { ok, _ := regexp.MatchString(expr, p); return ok })
+	}
+	return encrypted
+}
+
+// decryptValue decrypts a single `ENC[...]` value, returning the
+// plaintext as a string.
+func (d *sopsDecrypter) decryptValue(value, additionalData string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	m := sopsValueRE.FindStringSubmatch(value)
+	if m == nil {
+		return "", errors.New("not a SOPS encrypted value")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return "", err
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", errors.New("authentication failed")
+	}
+	return string(plain), nil
+}
+
+// sopsTyped converts the plaintext of a value to the type recorded
+// in the encrypted value.
+func sopsTyped(plain, encrypted string) (interface{}, error) {
+	typ := ""
+	if m := sopsValueRE.FindStringSubmatch(encrypted); m != nil {
+		typ = m[4]
+	}
+	switch typ {
+	case "int":
+		return strconv.Atoi(plain)
+	case "float":
+		return strconv.ParseFloat(plain, 64)
+	case "bool":
+		return strconv.ParseBool(plain)
+	}
+	return plain, nil
+}
+
+// sopsMACBytes gives the value as it's written to the MAC.
+func sopsMACBytes(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// sopsDecryptBinary decrypts a file that SOPS encrypted as binary
+// (`--input-type binary`), i.e., the whole of the file is in `data`.
+func sopsDecryptBinary(data []byte, ids []ageIdentity) ([]byte, error) {
+	doc, err := sopsDecrypt(data, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) != 1 || doc[0].Key != "data" {
+		return nil, errors.New("sops: a key file must be encrypted as binary (sops --input-type binary)")
+	}
+	s, ok := doc[0].Value.(string)
+	if !ok {
+		return nil, errors.New("sops: a key file must be encrypted as binary (sops --input-type binary)")
+	}
+	return []byte(s), nil
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 
@@ -15,9 +14,30 @@ import (
 	fluxhttp "github.com/fluxcd/flux/pkg/http"
 	fluxclient "github.com/fluxcd/flux/pkg/http/client"
 	"github.com/fluxcd/flux/pkg/image"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/time/rate"
 )
 
-type HookHandler func(s fluxapi.Server, key []byte, w http.ResponseWriter, r *http.Request)
+// Verification is what a source handler is given to check that a
+// request is genuine.
+type Verification struct {
+	// Keys are the shared secrets accepted for the endpoint; the
+	// first is the key for the route, and any others are given by
+	// `secretPaths`
+	Keys [][]byte
+	// Algorithms are the hash algorithms accepted for signatures,
+	// for those sources which sign payloads (empty means the
+	// defaults)
+	Algorithms []string
+	// RequireSignature is true if requests must be signed, for
+	// sources that sign payloads only if asked to
+	RequireSignature bool
+	// TimestampTolerance is how far from now a signed timestamp can
+	// be, for sources that sign the time a request was sent
+	TimestampTolerance time.Duration
+}
+
+type HookHandler func(s fluxapi.Server, v Verification, w http.ResponseWriter, r *http.Request)
 
 var Sources = map[string]HookHandler{}
 
@@ -25,43 +45,341 @@ var Sources = map[string]HookHandler{}
 
 const timeout = 10 * time.Second
 
-func log(msg ...interface{}) {
-	fmt.Fprintln(os.Stderr, msg...)
-}
-
 // --
 
+// HandlerFromEndpoint constructs a handler for the endpoint, and
+// returns it along with the digest of the endpoint's key, by which
+// it's routed. To get a handler for each of the endpoint's keys, use
+// RoutesFromEndpoint.
 func HandlerFromEndpoint(baseDir, apiUrl string, ep Endpoint) (string, http.Handler, error) {
+	routes, err := RoutesFromEndpoint(baseDir, apiUrl, ep)
+	if err != nil {
+		return "", nil, err
+	}
+	return routes[0].Digest, routes[0].Handler, nil
+}
+
+// Route is a handler for an endpoint using one of its keys, along
+// with the digest of that key.
+type Route struct {
+	Digest  string
+	KeyPath string
+	Handler http.Handler
+	// handlerFor constructs the handler for another key, e.g., when
+	// the key in KeyPath changes
+	handlerFor func(key []byte) http.Handler
+}
+
+// RoutesFromEndpoint constructs a handler for each of the endpoint's
+// keys; the first is that given in `keyPath` (or `key`), followed by
+// any given in `keyPaths`. All the routes go to the same source
+// handler, so that e.g., webhooks registered with an old key keep
+// working while the new key is rolled out.
+func RoutesFromEndpoint(baseDir, apiUrl string, ep Endpoint) ([]Route, error) {
 	// 1. find the relevant Source (e.g., DockerHub)
 	sourceHandler, ok := Sources[ep.Source]
 	if !ok {
-		return "", nil, fmt.Errorf("unknown source %q, check sources.go for possible values", ep.Source)
+		return nil, fmt.Errorf("unknown source %q, check sources.go for possible values", ep.Source)
+	}
+	if ep.Generic != nil {
+		mapping, err := compileGeneric(ep.Generic)
+		if err != nil {
+			return nil, err
+		}
+		sourceHandler = mapping.handler()
 	}
 
-	// 2. load the key so it can be used in the handler, and get the
-	// digest so it can be used to route to this handler
-	key, err := ioutil.ReadFile(filepath.Join(baseDir, ep.KeyPath))
+	// 2. load the keys so they can be used in the handler, and get
+	// the digests so they can be used to route to this handler
+	keys, err := loadEndpointKeys(baseDir, ep)
 	if err != nil {
-		return "", nil, fmt.Errorf("cannot load key from %q: %s", ep.KeyPath, err.Error())
+		return nil, err
 	}
 
-	sha := sha256.New()
-	sha.Write(key)
-	digest := fmt.Sprintf("%x", sha.Sum(nil))
+	secrets, err := loadSecrets(baseDir, ep)
+	if err != nil {
+		return nil, err
+	}
+
+	var api fluxapi.Server = fluxclient.New(downstreamClient, fluxhttp.NewAPIRouter(), apiUrl, fluxclient.Token(""))
+	if ep.ExtendedNotifications {
+		api = extendingServer{Server: api}
+	}
+	if ep.Faults != nil && ep.Faults.DropRatio > 0 {
+		api = faultyServer{Server: api, source: ep.Source, dropRatio: ep.Faults.DropRatio}
+	}
+	downstream := auditingServer{pooledServer{
+		Server: instrumentedServer{
+			Server: api,
+			source: ep.Source,
+		},
+		pool: newEndpointPool(ep.Source, keys[0].digest, ep.Isolation),
+	}}
+	apiClient, err := endpointServer(downstream, ep)
+	if err != nil {
+		return nil, err
+	}
+	// the first notification means the request was verified, so the
+	// delivery's ID can be claimed (see delivery.go)
+	apiClient = claimingServer{Server: apiClient}
+
+	allowCIDRs, err := parseCIDRs(ep.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	denyCIDRs, err := parseCIDRs(ep.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	var ranges *publishedRanges
+	if ep.ProviderIPs {
+		if ranges, err = newPublishedRanges(ep.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	maxBodyBytes := ep.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	var jsonLimits JSONLimits
+	if ep.JSONLimits != nil {
+		jsonLimits = *ep.JSONLimits
+	}
+
+	// the rate limits are shared by all the routes to the endpoint
+	var (
+		endpointLimit *rate.Limiter
+		ipLimits      *ipLimiters
+	)
+	if ep.RateLimit != nil {
+		endpointLimit = newLimiter(ep.RateLimit)
+	}
+	if ep.RateLimitPerIP != nil {
+		ipLimits = newIPLimiters(ep.RateLimitPerIP)
+	}
+
+	var basicAuth *basicAuthCredentials
+	if ep.BasicAuth != nil {
+		creds, err := loadBasicAuth(baseDir, ep.BasicAuth)
+		if err != nil {
+			return nil, err
+		}
+		basicAuth = &creds
+	}
 
-	apiClient := fluxclient.New(http.DefaultClient, fluxhttp.NewAPIRouter(), apiUrl, fluxclient.Token(""))
+	var tokenParam, token string
+	if ep.QueryToken != nil {
+		tokenParam, token, err = loadQueryToken(baseDir, ep.QueryToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var jwtKeys *jwks
+	if ep.JWT != nil {
+		jwtKeys = newJWKS(ep.Source, ep.JWT.JWKSURL)
+	}
+
+	var seenDeliveries *recentIDs
+	if ep.RejectReplays {
+		seenDeliveries = newRecentIDs(replayCacheSize)
+	}
+	var endpointSlots chan struct{}
+	if iso := ep.Isolation; iso != nil && iso.MaxConcurrent > 0 {
+		endpointSlots = make(chan struct{}, iso.MaxConcurrent)
+	}
+
+	var responses *responseCache
+	if ep.IdempotentResponses != nil {
+		responses = newResponseCache(*ep.IdempotentResponses)
+	}
+
+	// 3. construct a handler for each key from the above
+	handlerFor := func(key []byte) http.Handler {
+		v := endpointVerification(ep, key, secrets)
+		recordKeyCheck(ep.Source, keyDigest(key), v)
+		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := startSpan(r.Context(), "handle payload", spanKindInternal)
+			defer span.finish()
+			sourceHandler(apiClient, v, w, r.WithContext(ctx))
+		})
+		handler = withJSONLimits(ep.Source, jsonLimits, handler)
+		handler = withBodyLimit(ep.Source, maxBodyBytes, handler)
+		if sharedDedup != nil {
+			handler = withDedup(keyDigest(key), sharedDedup, handler)
+		}
+		if seenDeliveries != nil {
+			handler = withReplayProtection(ep.Source, seenDeliveries, handler)
+		}
+		if responses != nil {
+			handler = withIdempotentResponses(ep.Source, responses, handler)
+		}
+		if ep.Faults != nil {
+			handler = withFaults(ep.Source, *ep.Faults, handler)
+		}
+		if endpointSlots != nil {
+			handler = withEndpointConcurrency(ep.Source, endpointSlots, handler)
+		}
+		handler = endChecksSpan(handler)
 
-	// 3. construct a handler from the above
-	return digest, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sourceHandler(apiClient, key, w, r)
-	}), nil
+		checks := map[string]func(http.Handler) http.Handler{
+			requireCIDRs: func(h http.Handler) http.Handler {
+				return withCIDRs(ep.Source, allowCIDRs, denyCIDRs, h)
+			},
+			requireProviderIPs: func(h http.Handler) http.Handler {
+				return withProviderIPs(ranges, h)
+			},
+			requireClientCert: func(h http.Handler) http.Handler {
+				return withClientCert(ep.Source, h)
+			},
+			requireJWT: func(h http.Handler) http.Handler {
+				return withJWT(ep.Source, jwtKeys, *ep.JWT, h)
+			},
+			requireQueryToken: func(h http.Handler) http.Handler {
+				return withQueryToken(ep.Source, tokenParam, token, h)
+			},
+			requireBasicAuth: func(h http.Handler) http.Handler {
+				return withBasicAuth(ep.Source, *basicAuth, h)
+			},
+		}
+		withRequestLimits := func(h http.Handler) http.Handler {
+			if endpointLimit != nil || ipLimits != nil {
+				return withRateLimits(ep.Source, endpointLimit, ipLimits, h)
+			}
+			return h
+		}
+
+		if len(ep.Require) > 0 {
+			// the checks are made in the order given, after the rate
+			// limits
+			for i := len(ep.Require) - 1; i >= 0; i-- {
+				if check, ok := checks[ep.Require[i]]; ok {
+					handler = check(handler)
+				}
+			}
+			return withChecksSpan(withRequestLimits(handler))
+		}
+
+		configured := ep.configuredChecks(nil)
+		for _, name := range []string{requireBasicAuth, requireQueryToken, requireJWT, requireProviderIPs} {
+			if configured[name] {
+				handler = checks[name](handler)
+			}
+		}
+		handler = withRequestLimits(handler)
+		if configured[requireCIDRs] {
+			handler = checks[requireCIDRs](handler)
+		}
+		return withChecksSpan(handler)
+	}
+
+	var routes []Route
+	for _, k := range keys {
+		routes = append(routes, Route{
+			Digest:     k.digest,
+			KeyPath:    k.path,
+			Handler:    handlerFor(k.key),
+			handlerFor: handlerFor,
+		})
+	}
+	return routes, nil
+}
+
+// endpointVerification gives what requests to the endpoint are
+// verified with, using the key given (and any secrets).
+func endpointVerification(ep Endpoint, key []byte, secrets [][]byte) Verification {
+	// this was checked when the config was loaded
+	tolerance, _ := ep.timestampTolerance()
+	return Verification{
+		Keys:               append([][]byte{key}, secrets...),
+		Algorithms:         ep.SignatureAlgorithms,
+		RequireSignature:   ep.RequireSignature || requires(ep.Require, requireSignature),
+		TimestampTolerance: tolerance,
+	}
+}
+
+// endpointKey is one of the keys for an endpoint, along with its
+// digest and the path it was loaded from (empty if it was given
+// inline).
+type endpointKey struct {
+	path   string
+	key    []byte
+	digest string
+}
+
+// loadEndpointKeys loads all the keys for an endpoint, with the
+// paths taken as relative to baseDir.
+func loadEndpointKeys(baseDir string, ep Endpoint) ([]endpointKey, error) {
+	var keys []endpointKey
+	switch {
+	case ep.Key != "":
+		key, err := ep.InlineKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, endpointKey{key: key, digest: keyDigest(key)})
+	case ep.KeyPath != "":
+		key, digest, err := loadKey(baseDir, ep.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, endpointKey{path: ep.KeyPath, key: key, digest: digest})
+	default:
+		return nil, fmt.Errorf("endpoint for source %q has neither keyPath nor key", ep.Source)
+	}
+	for _, keyPath := range ep.KeyPaths {
+		key, digest, err := loadKey(baseDir, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, endpointKey{path: keyPath, key: key, digest: digest})
+	}
+	return keys, nil
+}
+
+// loadSecrets loads the additional secrets for an endpoint, that are
+// accepted when verifying requests but not used for routing.
+func loadSecrets(baseDir string, ep Endpoint) ([][]byte, error) {
+	var secrets [][]byte
+	for _, secretPath := range ep.SecretPaths {
+		secret, _, err := loadKey(baseDir, secretPath)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// loadKey reads the key at keyPath (relative to baseDir), returning
+// it along with its digest.
+func loadKey(baseDir, keyPath string) ([]byte, string, error) {
+	key, err := ioutil.ReadFile(filepath.Join(baseDir, keyPath))
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot load key from %q: %s", keyPath, err.Error())
+	}
+	if key, _, err = decryptFile(key); err != nil {
+		return nil, "", fmt.Errorf("cannot decrypt key from %q: %s", keyPath, err.Error())
+	}
+	return key, keyDigest(key), nil
+}
+
+// keyDigest gives the hex-encoded SHA256 of the key, which is used
+// in the path for its endpoint.
+func keyDigest(key []byte) string {
+	sha := sha256.New()
+	sha.Write(key)
+	return fmt.Sprintf("%x", sha.Sum(nil))
 }
 
-func doImageNotify(s fluxapi.Server, w http.ResponseWriter, r *http.Request, img string) {
+// doImageNotify notifies of a push of the image, with the details
+// given (of which the event is a push).
+func doImageNotify(s fluxapi.Server, w http.ResponseWriter, r *http.Request, img string, details *pushDetails) {
 	ref, err := image.ParseRef(img)
 	if err != nil {
 		http.Error(w, "Cannot parse image in webhook payload", http.StatusBadRequest)
-		log("could not parse image from hook payload:", img, ":", err.Error())
+		level.Warn(requestLogger(r)).Log("msg", "could not parse image from hook payload", "image", img, "err", err)
 		return
 	}
 	change := fluxapi_v9.Change{
@@ -70,7 +388,8 @@ func doImageNotify(s fluxapi.Server, w http.ResponseWriter, r *http.Request, img
 			Name: ref.Name,
 		},
 	}
-	ctx := r.Context()
+	details.Event = eventPush
+	ctx := withPushDetails(r.Context(), details)
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	s.NotifyChange(ctx, change)
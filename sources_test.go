@@ -3,9 +3,9 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -131,13 +131,77 @@ func Test_GitHubSource(t *testing.T) {
 
 // xHubSignature generates the X-Hub-Signature header value for the message and key
 func xHubSignature(message, key []byte) string {
-	mac := hmac.New(sha512.New, key)
+	return hubSignature("sha512", message, key)
+}
+
+// hubSignature generates a signature header value for the message
+// and key, using the named algorithm
+func hubSignature(alg string, message, key []byte) string {
+	mac := hmac.New(hmacAlgorithms[alg], key)
 	mac.Write(message)
 	signature := mac.Sum(nil)
 
 	hexSignature := make([]byte, hex.EncodedLen(len(signature)))
 	hex.Encode(hexSignature, signature)
-	return "sha512=" + string(hexSignature)
+	return alg + "=" + string(hexSignature)
+}
+
+// Test that X-Hub-Signature-256 is preferred over X-Hub-Signature,
+// and that only the algorithms accepted by the endpoint are used.
+func TestGitHubSignatureHeaders(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	payload := loadFixture(t, "github_payload")
+	key := loadFixture(t, "github_key")
+	good256 := hubSignature("sha256", payload, key)
+	good1 := hubSignature("sha1", payload, key)
+	bad256 := hubSignature("sha256", payload[1:], key)
+	bad1 := hubSignature("sha1", payload[1:], key)
+
+	for _, tt := range []struct {
+		desc       string
+		sig256     string
+		sig        string
+		algorithms []string
+		status     int
+	}{
+		{desc: "both good", sig256: good256, sig: good1, status: 200},
+		{desc: "legacy header with sha256", sig: hubSignature("sha256", payload, key), status: 200},
+		{desc: "only legacy, sha1 not accepted by default", sig: good1, status: 401},
+		{desc: "only legacy, sha1 accepted", sig: good1, algorithms: []string{"sha1"}, status: 200},
+		{desc: "256 preferred", sig256: good256, sig: bad1, status: 200},
+		{desc: "256 bad", sig256: bad256, sig: good1, status: 401},
+		{desc: "fall back to accepted algorithm", sig256: bad256, sig: good1, algorithms: []string{"sha1"}, status: 200},
+		{desc: "no accepted algorithm", sig: good1, algorithms: []string{"sha256"}, status: 401},
+		{desc: "no signature", status: 401},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			endpoint := Endpoint{Source: GitHub, KeyPath: "github_key", SignatureAlgorithms: tt.algorithms}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", "push")
+			if tt.sig256 != "" {
+				req.Header.Set("X-Hub-Signature-256", tt.sig256)
+			}
+			if tt.sig != "" {
+				req.Header.Set("X-Hub-Signature", tt.sig)
+			}
+
+			called = false
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == 200, called)
+		})
+	}
 }
 
 // expected notification posted to the flux API. NB because it's a branch head, the refs/heads/ is stripped.
@@ -209,16 +273,94 @@ func TestBitbucketCloud(t *testing.T) {
 	assert.True(t, called)
 	assert.Equal(t, 200, res.StatusCode)
 
-	// Check that wrong event key gets an error
-	called = false
-	req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
-	assert.NoError(t, err)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Event-Key", "flurb")
-	res, err = c.Do(req)
+	// Check that another event is ignored, and a missing event key
+	// gets an error
+	for key, status := range map[string]int{"flurb": 200, "": 400} {
+		called = false
+		req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-Key", key)
+		res, err = c.Do(req)
+		assert.NoError(t, err)
+		assert.False(t, called)
+		assert.Equal(t, status, res.StatusCode)
+	}
+}
+
+// Test that the author of the head commit is taken from the payload,
+// to check against the endpoint's ignoreAuthors.
+func TestIgnoreAuthors(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		notified bool
+	}{
+		{pattern: "mikeb@squaremobius.net", notified: false},
+		{pattern: "Michael*", notified: false},
+		{pattern: "fluxbot", notified: true},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expectedBitbucketCloud, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: BitbucketCloud, KeyPath: "bitbucket_cloud_key", IgnoreAuthors: []string{tt.pattern}}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "bitbucket_cloud_payload")))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Event-Key", "repo:push")
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.notified, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+func TestBitbucketCloudSignature(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedBitbucketCloud, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: BitbucketCloud, KeyPath: "bitbucket_cloud_key", RequireSignature: true}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
 	assert.NoError(t, err)
+
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "bitbucket_cloud_payload")
+	key := loadFixture(t, "bitbucket_cloud_key")
+
+	c := hookServer.Client()
+	send := func(signature string) int {
+		called = false
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-Key", "repo:push")
+		if signature != "" {
+			req.Header.Set("X-Hub-Signature", signature)
+		}
+		res, err := c.Do(req)
+		assert.NoError(t, err)
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 200, send(hubSignature("sha256", payload, key)))
+	assert.True(t, called)
+
+	assert.Equal(t, 401, send(hubSignature("sha256", payload, []byte("wrong key"))))
+	assert.False(t, called)
+
+	// required, so the request must be signed
+	assert.Equal(t, 401, send(""))
 	assert.False(t, called)
-	assert.Equal(t, 400, res.StatusCode)
 }
 
 func TestBitbucketServer(t *testing.T) {
@@ -282,3 +424,354 @@ func TestBitbucketServer(t *testing.T) {
 		})
 	}
 }
+
+// Test that each of an endpoint's keys gets a route, and requests at
+// each route are verified with the key for that route.
+func TestEndpointWithSeveralKeys(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGitlab, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", KeyPaths: []string{"bitbucket_server_key"}}
+	routes, err := RoutesFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	assert.Len(t, routes, 2)
+	assert.NotEqual(t, routes[0].Digest, routes[1].Digest)
+
+	payload := loadFixture(t, "gitlab_payload")
+	for i, key := range []string{"gitlab_key", "bitbucket_server_key"} {
+		t.Run(key, func(t *testing.T) {
+			hookServer := httptest.NewTLSServer(routes[i].Handler)
+			defer hookServer.Close()
+			c := hookServer.Client()
+
+			called = false
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+routes[i].Digest, bytes.NewReader(payload))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, key)))
+			res, err := c.Do(req)
+			assert.NoError(t, err)
+			assert.True(t, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+// Test that a catch-all endpoint forwards changes allowed by its
+// expression, and drops others.
+func TestCatchAllEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		allow    string
+		notified bool
+	}{
+		{allow: "svendowideit/.*", notified: true},
+		{allow: "svendowideit/other", notified: false},
+		{allow: "testhook", notified: false}, // must match the whole name
+	} {
+		t.Run(tt.allow, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expectedDockerhub, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key", CatchAll: true, Allow: tt.allow}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			c := hookServer.Client()
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+			assert.NoError(t, err)
+
+			res, err := c.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.notified, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+// Test that the default branch is taken from the payload, so that
+// with defaultBranchOnly, a push to it is forwarded, and a push of a
+// tag is dropped.
+func TestDefaultBranchOnly(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGitlab, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", DefaultBranchOnly: true}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "gitlab_payload")))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "gitlab_key")))
+	res, err := hookServer.Client().Do(req)
+	assert.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, 200, res.StatusCode)
+
+	called = false
+	downstream = newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+	endpoint = Endpoint{Source: GitHub, KeyPath: "github_key", DefaultBranchOnly: true}
+	fp, handler, err = HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer = httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "github_payload")
+	req, err = http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", hubSignature("sha256", payload, loadFixture(t, "github_key")))
+	res, err = hookServer.Client().Do(req)
+	assert.NoError(t, err)
+	assert.False(t, called)
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+// Test that the head commit's message is taken from the payload, to
+// check for the endpoint's skipMarkers.
+func TestSkipMarkers(t *testing.T) {
+	for _, tt := range []struct {
+		marker   string
+		notified bool
+	}{
+		// in the head commit
+		{marker: "fixed readme", notified: false},
+		// in another commit pushed
+		{marker: "Catalan", notified: true},
+	} {
+		t.Run(tt.marker, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expectedGitlab, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", SkipMarkers: []string{tt.marker}}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "gitlab_payload")))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "gitlab_key")))
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.notified, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+// Test that the tag of an image is taken from the payload, to match
+// with the endpoint's tagPattern.
+func TestTagPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		notified bool
+	}{
+		{pattern: "latest", notified: true},
+		{pattern: `v\d+\.\d+\.\d+`, notified: false},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, expectedDockerhub, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: DockerHub, KeyPath: "dockerhub_key", TagPattern: tt.pattern}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(loadFixture(t, "dockerhub_payload")))
+			assert.NoError(t, err)
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.notified, called)
+			assert.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+// Test that each kind of GitHub event gives the change expected, or
+// is ignored, for the events the endpoint accepts.
+func TestGitHubEvents(t *testing.T) {
+	const repo = `"repository": {"ssh_url": "git@github.com:example/config.git"}`
+	for _, tt := range []struct {
+		desc, event, payload string
+		events               []string
+		expected             string // the change, or empty if not notified
+		status               int    // if not 200
+	}{
+		{
+			desc:     "tag, by default",
+			event:    "push",
+			payload:  `{"ref": "refs/tags/v1.0.0", ` + repo + `}`,
+			expected: `{"Kind":"git","Source":{"URL":"git@github.com:example/config.git","Branch":"refs/tags/v1.0.0"}}`,
+		},
+		{
+			desc:    "release, by default",
+			event:   "release",
+			payload: `{"action": "published", "release": {"tag_name": "v1.0.0"}, ` + repo + `}`,
+		},
+		{
+			desc:     "release",
+			event:    "release",
+			payload:  `{"action": "published", "release": {"tag_name": "v1.0.0"}, ` + repo + `}`,
+			events:   []string{eventRelease},
+			expected: `{"Kind":"git","Source":{"URL":"git@github.com:example/config.git","Branch":"refs/tags/v1.0.0"}}`,
+		},
+		{
+			desc:     "pipeline succeeded",
+			event:    "workflow_run",
+			payload:  `{"action": "completed", "workflow_run": {"head_branch": "main", "conclusion": "success"}, ` + repo + `}`,
+			events:   []string{eventPipeline},
+			expected: `{"Kind":"git","Source":{"URL":"git@github.com:example/config.git","Branch":"main"}}`,
+		},
+		{
+			desc:    "pipeline failed",
+			event:   "workflow_run",
+			payload: `{"action": "completed", "workflow_run": {"head_branch": "main", "conclusion": "failure"}, ` + repo + `}`,
+			events:  []string{eventPipeline},
+		},
+		{
+			desc:    "push, only pipelines",
+			event:   "push",
+			payload: `{"ref": "refs/heads/main", ` + repo + `}`,
+			events:  []string{eventPipeline},
+		},
+		{
+			desc:    "not a change",
+			event:   "issues",
+			payload: `{"action": "opened", ` + repo + `}`,
+		},
+		{
+			desc:    "push without a repository URL",
+			event:   "push",
+			payload: `{"ref": "refs/heads/main", "repository": {"name": "config"}}`,
+			status:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var called bool
+			downstream := newDownstream(t, tt.expected, &called)
+			defer downstream.Close()
+
+			endpoint := Endpoint{Source: GitHub, KeyPath: "github_key", Events: tt.events}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, strings.NewReader(tt.payload))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", tt.event)
+			req.Header.Set("X-Hub-Signature-256", hubSignature("sha256", []byte(tt.payload), loadFixture(t, "github_key")))
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected != "", called)
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			assert.Equal(t, status, res.StatusCode)
+		})
+	}
+}
+
+// Test that requests signed with any of an endpoint's secrets are
+// accepted, at the route for its key.
+func TestEndpointWithSeveralSecrets(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGithub, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key", SecretPaths: []string{"gitlab_key"}}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	_, digest, err := loadKey("test/fixtures", "github_key")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, fp)
+
+	hookServer := httptest.NewTLSServer(handler)
+	defer hookServer.Close()
+
+	payload := loadFixture(t, "github_payload")
+	for _, tt := range []struct {
+		key    string
+		status int
+	}{
+		{key: "github_key", status: 200},
+		{key: "gitlab_key", status: 200},
+		{key: "bitbucket_server_key", status: 401},
+	} {
+		t.Run(tt.key, func(t *testing.T) {
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(payload))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", hubSignature("sha256", payload, loadFixture(t, tt.key)))
+
+			called = false
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == 200, called)
+		})
+	}
+}
+
+// Test that requests with bodies over the endpoint's limit are
+// refused, whether or not they give a Content-Length.
+func TestBodyLimit(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, expectedGitlab, &called)
+	defer downstream.Close()
+
+	payload := loadFixture(t, "gitlab_payload")
+	for _, tt := range []struct {
+		desc   string
+		limit  int64
+		body   func() io.Reader
+		status int
+	}{
+		{desc: "under limit", limit: int64(len(payload)), body: func() io.Reader { return bytes.NewReader(payload) }, status: 200},
+		{desc: "over limit", limit: 100, body: func() io.Reader { return bytes.NewReader(payload) }, status: 413},
+		// NB a reader that isn't a bytes.Reader etc. means the request won't have a Content-Length
+		{desc: "over limit, chunked", limit: 100, body: func() io.Reader { return io.MultiReader(bytes.NewReader(payload)) }, status: 413},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			endpoint := Endpoint{Source: GitLab, KeyPath: "gitlab_key", MaxBodyBytes: tt.limit}
+			fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+			assert.NoError(t, err)
+			hookServer := httptest.NewTLSServer(handler)
+			defer hookServer.Close()
+
+			req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, tt.body())
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", string(loadFixture(t, "gitlab_key")))
+
+			called = false
+			res, err := hookServer.Client().Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status == 200, called)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The payloads of sources that don't sign them are read in full
+// before being handled, so their JSON can be checked (see
+// jsonlimits.go). On a small node, a few large payloads at once could
+// use a lot of memory; so with `spool` in the config, a body larger
+// than the threshold is written to a temporary file as it's read, and
+// then read back from there, so each request uses no more than
+// that much memory. The maximum body size still applies.
+
+// Spool is the config for spooling large request bodies to disk.
+type Spool struct {
+	// ThresholdBytes is the most of a request body kept in memory;
+	// bodies larger than this are written to a file
+	ThresholdBytes int64 `json:"thresholdBytes"`
+	// Dir is the directory for the files, relative to the config
+	// file; the default is the system's temporary directory
+	Dir string `json:"dir,omitempty"`
+}
+
+func (s *Spool) validate() error {
+	if s.ThresholdBytes <= 0 {
+		return fmt.Errorf("spool: thresholdBytes must be positive")
+	}
+	return nil
+}
+
+var payloadsSpooled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "flux_recv",
+	Name:      "payloads_spooled_total",
+	Help:      "Request bodies written to disk because they were over the spool threshold, by source.",
+}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(payloadsSpooled)
+}
+
+// errSpool is returned, wrapped, when a body can't be written to
+// disk; unlike other errors from spool, it's not the request's fault.
+var errSpool = errors.New("cannot spool body to disk")
+
+// bodySpool spools large request bodies to disk, if configured;
+// otherwise it's nil.
+var bodySpool *spooler
+
+type spooler struct {
+	threshold int64
+	dir       string
+
+	// the files of the bodies not yet closed, so they can be removed
+	// if the requests are still in flight at shutdown
+	mu   sync.Mutex
+	live map[*spooledBody]struct{}
+}
+
+// newSpooler constructs a spooler, after checking files can be
+// written in its directory.
+func newSpooler(configDir string, config Spool) (*spooler, error) {
+	s := &spooler{threshold: config.ThresholdBytes, live: map[*spooledBody]struct{}{}}
+	if config.Dir != "" {
+		s.dir = resolvePath(configDir, config.Dir)
+	}
+	f, err := s.tempFile()
+	if err != nil {
+		return nil, fmt.Errorf("spool: cannot write to directory: %s", err.Error())
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return s, nil
+}
+
+func (s *spooler) tempFile() (*os.File, error) {
+	return ioutil.TempFile(s.dir, "flux-recv-payload-")
+}
+
+// spooledBody is a request body that's been read in full, kept in
+// memory or, if it's over the threshold, in a temporary file. It's
+// read from the start, and can be rewound to be read again. Closing it
+// removes the file.
+type spooledBody struct {
+	spooler *spooler
+	file    *os.File
+	r       io.ReadSeeker
+}
+
+// spool reads the body to the end, keeping it in memory if it's no
+// larger than the threshold, or else in a file.
+func (s *spooler) spool(source string, body io.Reader) (*spooledBody, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, body, s.threshold+1); err == io.EOF {
+		return &spooledBody{r: bytes.NewReader(buf.Bytes())}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := s.tempFile()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errSpool, err.Error())
+	}
+	b := &spooledBody{spooler: s, file: f, r: f}
+	s.mu.Lock()
+	s.live[b] = struct{}{}
+	s.mu.Unlock()
+	if _, err := buf.WriteTo(f); err != nil {
+		b.Close()
+		return nil, fmt.Errorf("%w: %s", errSpool, err.Error())
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		b.Close()
+		// writing the file fails with a *os.PathError; reading the
+		// body, with anything else
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return nil, fmt.Errorf("%w: %s", errSpool, err.Error())
+		}
+		return nil, err
+	}
+	payloadsSpooled.WithLabelValues(source).Inc()
+	return b, b.rewind()
+}
+
+func (b *spooledBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// rewind goes back to the start of the body.
+func (b *spooledBody) rewind() error {
+	_, err := b.r.Seek(0, io.SeekStart)
+	return err
+}
+
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.spooler.mu.Lock()
+	delete(b.spooler.live, b)
+	b.spooler.mu.Unlock()
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// removeAll removes the files of the bodies not yet closed, and gives
+// how many there were. It's for shutting down, when the requests
+// still in flight won't get to close them.
+func (s *spooler) removeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.live)
+	for b := range s.live {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		delete(s.live, b)
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bodySpool, err = newSpooler("", Spool{ThresholdBytes: 16, Dir: dir})
+	assert.NoError(t, err)
+	defer func() { bodySpool = nil }()
+
+	var (
+		got     string
+		spooled []string
+	)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		got = string(body)
+		spooled, _ = filepath.Glob(filepath.Join(dir, "*"))
+	})
+	h := withBodyLimit(DockerHub, 64, withJSONLimits(DockerHub, JSONLimits{MaxDepth: 2}, handler))
+	send := func(body string) int {
+		req := httptest.NewRequest("POST", "/hook/abc", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// under the threshold, it's kept in memory
+	assert.Equal(t, 200, send(`{"a": 1}`))
+	assert.Equal(t, `{"a": 1}`, got)
+	assert.Len(t, spooled, 0)
+
+	// over it, it's read back from a file, which is removed after
+	large := `{"a": [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]}`
+	assert.Equal(t, 200, send(large))
+	assert.Equal(t, large, got)
+	assert.Len(t, spooled, 1)
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, left, 0)
+
+	// the limits still apply
+	got = ""
+	assert.Equal(t, 400, send(`{"a": [[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]]}`))
+	assert.Equal(t, 413, send(`{"a": "`+strings.Repeat("x", 64)+`"}`))
+	assert.Equal(t, "", got)
+	left, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, left, 0)
+
+	_, err = newSpooler("", Spool{ThresholdBytes: 16, Dir: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
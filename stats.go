@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deliveryStats keeps, for each endpoint, counts of the deliveries to
+// it and when it last had one, so it's easy to see which webhooks are
+// firing. They're served by the admin API at /admin/stats.
+var deliveryStats = newStatsRegistry()
+
+// endpointStats are the statistics for one endpoint (that is, one of
+// its keys).
+type endpointStats struct {
+	Source   string `json:"source"`
+	Endpoint string `json:"endpoint"`
+	Listen   string `json:"listen"`
+	// Received counts all requests, Succeeded those answered with a
+	// 2xx status, and Failed the rest
+	Received  int64 `json:"received"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	// LastDelivery is the time of the last request, if there's been
+	// one
+	LastDelivery *time.Time `json:"lastDelivery,omitempty"`
+	// LastError is the status and reason of the last failed request
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+type statsRegistry struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{endpoints: map[string]*endpointStats{}}
+}
+
+// register adds an endpoint, so that it's listed before it has had
+// any deliveries.
+func (s *statsRegistry) register(listen, source, digest string) *endpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := listen + " " + digest
+	if stats, ok := s.endpoints[key]; ok {
+		return stats
+	}
+	stats := &endpointStats{Source: source, Endpoint: endpointLabel(digest), Listen: listen}
+	s.endpoints[key] = stats
+	return stats
+}
+
+func (s *statsRegistry) record(stats *endpointStats, at time.Time, status int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.Received++
+	stats.LastDelivery = &at
+	if status < 300 {
+		stats.Succeeded++
+		return
+	}
+	stats.Failed++
+	stats.LastError = strconv.Itoa(status) + " " + reason
+	stats.LastErrorTime = &at
+}
+
+// snapshot gives a copy of the statistics, ordered by listener,
+// source, and endpoint.
+func (s *statsRegistry) snapshot() []endpointStats {
+	s.mu.Lock()
+	out := make([]endpointStats, 0, len(s.endpoints))
+	for _, stats := range s.endpoints {
+		out = append(out, *stats)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Listen != b.Listen {
+			return a.Listen < b.Listen
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Endpoint < b.Endpoint
+	})
+	return out
+}
+
+// withStats records each request to the endpoint in its statistics.
+// Like withAudit, it goes outside the checks, so that refused
+// requests count as failures.
+func withStats(registry *statsRegistry, listen, source, digest string, next http.Handler) http.Handler {
+	stats := registry.register(listen, source, digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := time.Now().UTC()
+		aw := &auditResponseWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(aw, r)
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		registry.record(stats, at, status, aw.reasonText())
+	})
+}
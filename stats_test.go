@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryStats(t *testing.T) {
+	registry := newStatsRegistry()
+	fail := false
+	handler := withStats(registry, ":8080", GitHub, "0123456789abcdef", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "The GitHub signature header is invalid.", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	// registered, but no deliveries yet
+	withStats(registry, ":8080", GitLab, "fedcba9876543210", http.NotFoundHandler())
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hook/0123456789abcdef", nil))
+	fail = true
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hook/0123456789abcdef", nil))
+
+	stats := registry.snapshot()
+	assert.Len(t, stats, 2)
+	gh, gl := stats[0], stats[1]
+	assert.Equal(t, GitHub, gh.Source)
+	assert.Equal(t, "0123456789ab", gh.Endpoint)
+	assert.Equal(t, int64(2), gh.Received)
+	assert.Equal(t, int64(1), gh.Succeeded)
+	assert.Equal(t, int64(1), gh.Failed)
+	assert.Equal(t, "401 The GitHub signature header is invalid.", gh.LastError)
+	assert.NotNil(t, gh.LastDelivery)
+
+	assert.Equal(t, GitLab, gl.Source)
+	assert.Equal(t, int64(0), gl.Received)
+	assert.Nil(t, gl.LastDelivery)
+}
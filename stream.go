@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Push payloads can be several megabytes (e.g., GitHub's, with
+// thousands of commits), of which flux-recv needs a few fields. So
+// rather than reading the whole body then checking its signature and
+// decoding it, the signed sources stream it: it's written to the HMAC
+// as it's read, the fields wanted are decoded from it while the rest
+// is skipped, and the signature is checked once it's all been read --
+// before anything is done with what was decoded. This keeps memory
+// use flat, whatever the size of the payload.
+
+// signedBody is the request body, read through the HMAC for its
+// signature (if it's to be checked). It keeps the start of the body,
+// for logging.
+type signedBody struct {
+	body  io.Reader
+	check *signatureCheck
+	head  []byte
+}
+
+// newSignedBody prepares to check the signature given in the request
+// headers as the body is read, or if checked is false, just to read
+// the body. It returns an error if there's no signature that can be
+// checked, having read the body anyway, as it would have been (and so
+// it's seen by withRejectedPayloads).
+func newSignedBody(r *http.Request, v Verification, checked bool) (*signedBody, error) {
+	b := &signedBody{body: r.Body}
+	if checked {
+		check, err := newSignatureCheck(r, v)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body)
+			return nil, err
+		}
+		b.check = check
+	}
+	return b, nil
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.check != nil {
+		b.check.Write(p[:n])
+	}
+	// keep enough that the fragment logged isn't cut short by
+	// redaction
+	if room := 2*maxLoggedPayloadBytes - len(b.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		b.head = append(b.head, p[:room]...)
+	}
+	return n, err
+}
+
+// verify reads the rest of the body, then checks the signature, if
+// it's to be checked. Nothing decoded from the body should be used
+// until this has returned without error.
+func (b *signedBody) verify(ctx context.Context) (err error) {
+	_, span := startSpan(ctx, "verify signature", spanKindInternal)
+	defer func() {
+		if err != nil {
+			span.setError(err.Error())
+		}
+		span.finish()
+	}()
+
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return bodyReadError{err}
+	}
+	if b.check == nil {
+		return nil
+	}
+	return b.check.verify()
+}
+
+// bodyReadError is an error from reading the body, rather than from
+// checking its signature.
+type bodyReadError struct{ err error }
+
+func (e bodyReadError) Error() string { return e.err.Error() }
+func (e bodyReadError) Unwrap() error { return e.err }
+
+// unreadableBody checks whether the error (from verify) is because the
+// body couldn't be read, rather than because the signature is
+// invalid, and if so, responds accordingly.
+func unreadableBody(w http.ResponseWriter, r *http.Request, err error) bool {
+	var readErr bodyReadError
+	if !errors.As(err, &readErr) {
+		return false
+	}
+	if bodyTooLarge(w, r, err) || payloadNotAcceptable(w, r, err) {
+		return true
+	}
+	http.Error(w, "Unable to read payload", http.StatusBadRequest)
+	level.Warn(requestLogger(r)).Log("msg", "unable to read payload", "err", err)
+	return true
+}
+
+// decodeJSONObject decodes a JSON object from r into the struct out
+// points to, as json.Unmarshal would, except that the values of keys
+// with no field in the struct are skipped as they are read, rather
+// than read into memory first.
+func decodeJSONObject(r io.Reader, out interface{}) error {
+	v := reflect.ValueOf(out).Elem()
+	fields := jsonFieldIndexes(v.Type())
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("payload is not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		i, ok := fields[key]
+		if !ok {
+			i, ok = fields[strings.ToLower(key)]
+		}
+		if !ok {
+			if err := skipJSONValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dec.Decode(v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("decoding %q: %s", key, err.Error())
+		}
+	}
+	if _, err := dec.Token(); err != nil { // the closing brace
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return errors.New("unexpected data after the JSON object")
+	}
+	return nil
+}
+
+// jsonFieldIndexes gives the index of each exported field of the
+// struct type, by its JSON name, and that name in lower case (since
+// encoding/json matches names without regard to case).
+func jsonFieldIndexes(t reflect.Type) map[string]int {
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = i
+		if _, ok := fields[strings.ToLower(name)]; !ok {
+			fields[strings.ToLower(name)] = i
+		}
+	}
+	return fields
+}
+
+// skipJSONValue reads the next value from the decoder, a token at a
+// time, and throws it away.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeJSONObject(t *testing.T) {
+	type repo struct {
+		SSHURL string `json:"ssh_url"`
+	}
+	var got struct {
+		Ref        string
+		Repository repo   `json:"repository"`
+		Ignored    string `json:"-"`
+	}
+	payload := `{"REF": "refs/heads/master", "commits": [{"id": "a", "added": ["{"]}, {}], "repository": {"ssh_url": "git@github.com:a/b.git"}, "Ignored": "x", "n": null}` + "\n"
+	assert.NoError(t, decodeJSONObject(strings.NewReader(payload), &got))
+	assert.Equal(t, "refs/heads/master", got.Ref)
+	assert.Equal(t, "git@github.com:a/b.git", got.Repository.SSHURL)
+	assert.Equal(t, "", got.Ignored)
+
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`{"ref": "refs/heads/master"`,
+		`{"ref": 1}`,
+		`{"commits": [}`,
+		`{} {}`,
+	} {
+		assert.Error(t, decodeJSONObject(strings.NewReader(bad), &got), bad)
+	}
+}
+
+// A payload with many commits is verified and decoded as it's read.
+func TestLargeGitHubPayload(t *testing.T) {
+	var called bool
+	downstream := newDownstream(t, `{"Kind":"git","Source":{"URL":"git@github.com:Codertocat/Hello-World.git","Branch":"master"}}`, &called)
+	defer downstream.Close()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	hookServer := httptest.NewServer(handler)
+	defer hookServer.Close()
+
+	var payload bytes.Buffer
+	payload.WriteString(`{"ref":"refs/heads/master","commits":[`)
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			payload.WriteString(",")
+		}
+		fmt.Fprintf(&payload, `{"id":"%040d","message":"%s","added":["file-%d.yaml"]}`, i, strings.Repeat("m", 200), i)
+	}
+	payload.WriteString(`],"repository":{"ssh_url":"git@github.com:Codertocat/Hello-World.git"}}`)
+	key := loadFixture(t, "github_key")
+
+	send := func(body []byte, sig string) int {
+		req, err := http.NewRequest("POST", hookServer.URL+"/hook/"+fp, bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", sig)
+		called = false
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 200, send(payload.Bytes(), hubSignature("sha256", payload.Bytes(), key)))
+	assert.True(t, called)
+
+	// a change after the fields used still fails verification
+	tampered := bytes.Replace(payload.Bytes(), []byte("file-4999"), []byte("file-9999"), 1)
+	assert.Equal(t, 401, send(tampered, hubSignature("sha256", payload.Bytes(), key)))
+	assert.False(t, called)
+}
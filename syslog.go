@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// The audit log can be sent to a syslog server, rather than written
+// to a file, by giving --audit-log a URL: `syslog://host:514` (UDP),
+// `syslog+tcp://host:514`, or `syslog+tls://host:6514`. Messages are
+// in the RFC 5424 format, and over TCP and TLS are framed by octet
+// counting (RFC 6587, RFC 5425). They're queued, and sent in the
+// background, so that a slow or stalled syslog server doesn't hold up
+// hook requests.
+
+const (
+	// syslogPriority is facility local0, severity informational
+	syslogPriority    = 16*8 + 6
+	syslogDialTimeout = 10 * time.Second
+	// syslogWriteTimeout bounds the time spent sending each message
+	syslogWriteTimeout = 10 * time.Second
+	// maxPendingSyslog bounds the messages waiting to be sent; any
+	// more are dropped
+	maxPendingSyslog = 1000
+	syslogAppName    = "flux-recv"
+)
+
+// isSyslogURL reports whether the audit log destination is a syslog
+// server.
+func isSyslogURL(dest string) bool {
+	return strings.HasPrefix(dest, "syslog://") || strings.HasPrefix(dest, "syslog+tcp://") || strings.HasPrefix(dest, "syslog+tls://")
+}
+
+// syslogWriter sends each Write as a syslog message, from its run
+// goroutine.
+type syslogWriter struct {
+	network  string // udp, tcp, or tls
+	addr     string
+	hostname string
+	msgID    string
+	pending  chan []byte
+	conn     net.Conn
+}
+
+// newSyslogWriter constructs a writer for the syslog URL given,
+// tagging messages with msgID (e.g., "audit"). It connects straight
+// away, so that a wrong address is found out at once; messages are
+// sent once run is started.
+func newSyslogWriter(rawurl, msgID string) (*syslogWriter, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	network := map[string]string{"syslog": "udp", "syslog+tcp": "tcp", "syslog+tls": "tls"}[u.Scheme]
+	if network == "" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a syslog URL (syslog://, syslog+tcp://, or syslog+tls:// with a host and port)", rawurl)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("syslog URL %q needs a port", rawurl)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	w := &syslogWriter{network: network, addr: u.Host, hostname: hostname, msgID: msgID, pending: make(chan []byte, maxPendingSyslog)}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	var conn net.Conn
+	var err error
+	if w.network == "tls" {
+		dialer := &net.Dialer{Timeout: syslogDialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", w.addr, &tls.Config{})
+	} else {
+		conn, err = net.DialTimeout(w.network, w.addr, syslogDialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// format gives the message in the RFC 5424 format.
+func (w *syslogWriter) format(msg []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s - ", syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), w.hostname, syslogAppName, os.Getpid(), w.msgID)
+	buf.Write(bytes.TrimRight(msg, "\n"))
+	return buf.Bytes()
+}
+
+// Write queues p to be sent as one message. If the queue is full,
+// the message is dropped, and an error returned.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := w.format(p)
+	if w.network != "udp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	queuedSend("syslog")
+	select {
+	case w.pending <- msg:
+		return len(p), nil
+	default:
+		sentQueued("syslog")
+		return 0, errors.New("dropped syslog message, since the syslog server isn't keeping up")
+	}
+}
+
+// run sends the messages queued.
+func (w *syslogWriter) run() {
+	for msg := range w.pending {
+		if err := w.send(msg); err != nil {
+			level.Error(logger).Log("component", "syslog", "msg", "could not send message", "addr", w.addr, "err", err)
+		}
+		sentQueued("syslog")
+	}
+}
+
+// send sends one message. If sending fails, it reconnects and tries
+// once more, since a TCP connection may have been closed by the server
+// while idle.
+func (w *syslogWriter) send(msg []byte) error {
+	if w.conn != nil {
+		if err := w.write(msg); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return err
+	}
+	if err := w.write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *syslogWriter) write(msg []byte) error {
+	w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := w.conn.Write(msg)
+	return err
+}
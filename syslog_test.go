@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var syslogRE = regexp.MustCompile(`^<134>1 \S+ \S+ flux-recv \d+ audit - (.*)$`)
+
+func TestSyslogUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	w, err := newSyslogWriter("syslog://"+server.LocalAddr().String(), "audit")
+	assert.NoError(t, err)
+	go w.run()
+	_, err = w.Write([]byte(`{"source":"GitHub"}` + "\n"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	n, _, err := server.ReadFrom(buf)
+	assert.NoError(t, err)
+	m := syslogRE.FindStringSubmatch(string(buf[:n]))
+	if assert.NotNil(t, m, string(buf[:n])) {
+		assert.Equal(t, `{"source":"GitHub"}`, m[1])
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// octet-counted: `<length> <message>`
+				r := bufio.NewReader(conn)
+				for {
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(length))
+					msg := make([]byte, n)
+					if _, err := io.ReadFull(r, msg); err != nil {
+						return
+					}
+					messages <- string(msg)
+				}
+			}()
+		}
+	}()
+
+	w, err := newSyslogWriter("syslog+tcp://"+server.Addr().String(), "audit")
+	assert.NoError(t, err)
+	go w.run()
+	for _, rec := range []string{`{"n":1}`, `{"n":2}`} {
+		_, err := w.Write([]byte(rec + "\n"))
+		assert.NoError(t, err)
+		m := syslogRE.FindStringSubmatch(<-messages)
+		if assert.NotNil(t, m) {
+			assert.Equal(t, rec, m[1])
+		}
+	}
+}
+
+func TestSyslogQueueBounded(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	// nothing is sent until run is started, as though the server has
+	// stalled; writes don't wait, and once the queue is full, they
+	// are dropped
+	w, err := newSyslogWriter("syslog+tcp://"+server.Addr().String(), "audit")
+	assert.NoError(t, err)
+	for i := 0; i < maxPendingSyslog; i++ {
+		_, err := w.Write([]byte(`{}`))
+		assert.NoError(t, err)
+	}
+	_, err = w.Write([]byte(`{}`))
+	assert.Error(t, err)
+	for len(w.pending) > 0 {
+		<-w.pending
+		sentQueued("syslog")
+	}
+}
+
+func TestSyslogURL(t *testing.T) {
+	for _, u := range []string{"syslog://", "syslog+tcp://localhost", "syslog+smoke://localhost:514"} {
+		_, err := newSyslogWriter(u, "audit")
+		assert.Error(t, err, u)
+	}
+}
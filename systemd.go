@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Under systemd, flux-recv can be given its sockets by socket
+// activation, rather than opening them itself: so it can be started on
+// demand, run without the privilege to bind ports, and have the
+// socket-level hardening systemd gives (e.g., IPAddressAllow=). Each
+// socket in the .socket unit is named with FileDescriptorName=, and a
+// listener (or --listen, or --listen-admin) is given as
+// `systemd:<name>` to be served on the socket of that name.
+//
+// See sd_listen_fds(3) for the protocol.
+
+const (
+	systemdAddrPrefix = "systemd:"
+	// systemdFirstFD is the first file descriptor passed
+	systemdFirstFD = 3
+)
+
+// isSystemdAddr reports whether the address names a socket passed by
+// systemd.
+func isSystemdAddr(addr string) bool {
+	return strings.HasPrefix(addr, systemdAddrPrefix)
+}
+
+// systemdListeners gives the sockets passed by systemd, by name
+// (those not named are called "unknown", as systemd has it). It gives
+// none if the sockets weren't passed to this process. The environment
+// variables are unset, so that they aren't passed on.
+func systemdListeners() (map[string]net.Listener, error) {
+	return systemdListenersFrom(systemdFirstFD)
+}
+
+// systemdListenersFrom is systemdListeners, with the sockets passed
+// from firstFD on.
+func systemdListenersFrom(firstFD int) (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	listeners := map[string]net.Listener{}
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		// this duplicates the file descriptor, so the original can
+		// be closed
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %q passed by systemd: %s", name, err.Error())
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("more than one socket passed by systemd is named %q; give each a FileDescriptorName=", name)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// listenOn gives a listener for the address: the socket passed by
+// systemd, if it's `systemd:<name>`; a Unix socket, if it's
+// `unix:<path>`; or else a new TCP socket.
+func listenOn(addr string, activated map[string]net.Listener) (net.Listener, error) {
+	if isSystemdAddr(addr) {
+		name := strings.TrimPrefix(addr, systemdAddrPrefix)
+		l, ok := activated[name]
+		if !ok {
+			return nil, fmt.Errorf("no socket named %q was passed by systemd (see FileDescriptorName= in the .socket unit)", name)
+		}
+		return l, nil
+	}
+	if isUnixAddr(addr) {
+		return listenUnix(strings.TrimPrefix(addr, unixAddrPrefix))
+	}
+	return net.Listen("tcp", addr)
+}
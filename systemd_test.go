@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	assert.NoError(t, err)
+	// the sockets passed are closed once they're listened on, so
+	// pass one no *os.File owns
+	fd, err := syscall.Dup(int(f.Fd()))
+	assert.NoError(t, err)
+	f.Close()
+
+	// not for this process
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	activated, err := systemdListenersFrom(fd)
+	assert.NoError(t, err)
+	assert.Len(t, activated, 0)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "hooks")
+	activated, err = systemdListenersFrom(fd)
+	assert.NoError(t, err)
+	assert.Equal(t, "", os.Getenv("LISTEN_FDS"))
+	assert.Len(t, activated, 1)
+
+	ln, err := listenOn("systemd:hooks", activated)
+	assert.NoError(t, err)
+	defer ln.Close()
+	assert.Equal(t, l.Addr().String(), ln.Addr().String())
+	_, err = listenOn("systemd:admin", activated)
+	assert.Error(t, err)
+
+	ln, err = listenOn("127.0.0.1:0", activated)
+	assert.NoError(t, err)
+	ln.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Rather than JSONPath expressions, a Generic endpoint can be given a
+// Go template (https://golang.org/pkg/text/template/) that renders
+// the change from the payload and the request headers. This is for
+// payloads that need more than picking out values: e.g., a URL put
+// together from parts, or a change only for some kinds of event. The
+// template renders a JSON object, with either the "url" and (if
+// known) "branch", and the head commit's "sha", "message", "author"
+// and "committer", of a git change; or the "name" and (if known)
+// "tag" and "digest" of an image. If it renders nothing, the request
+// is ignored.
+
+// templateData is what a notification template is executed with.
+type templateData struct {
+	// Payload is the payload, decoded from JSON
+	Payload interface{}
+	// Headers are the request headers, so e.g., `.Headers.Get
+	// "X-Event"` gives a header
+	Headers http.Header
+}
+
+// templateFuncs are the functions notification templates can use,
+// beyond those built in. The string operated on is the last
+// argument, so they can be used at the end of a pipeline.
+var templateFuncs = template.FuncMap{
+	// json gives the value as JSON, so that strings are quoted
+	"json": func(v interface{}) (string, error) {
+		bs, err := json.Marshal(v)
+		return string(bs), err
+	},
+	"trimPrefix": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"hasPrefix": func(prefix, s string) bool {
+		return strings.HasPrefix(s, prefix)
+	},
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+}
+
+// compileTemplate parses a notification template.
+func compileTemplate(text string) (*template.Template, error) {
+	t, err := template.New("notification").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template: %s", err.Error())
+	}
+	return t, nil
+}
+
+// renderChange executes the template, and gives the fields of the
+// change it renders, as extract does; or nil if it renders nothing.
+func renderChange(t *template.Template, payload interface{}, headers http.Header) (map[string]string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, templateData{Payload: payload, Headers: headers}); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out.Bytes())) == 0 {
+		return nil, nil
+	}
+	var rendered struct {
+		URL       *string `json:"url"`
+		Branch    string  `json:"branch"`
+		SHA       string  `json:"sha"`
+		Message   string  `json:"message"`
+		Author    string  `json:"author"`
+		Committer string  `json:"committer"`
+		Name      *string `json:"name"`
+		Tag       string  `json:"tag"`
+		Digest    string  `json:"digest"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &rendered); err != nil {
+		return nil, fmt.Errorf("template did not render a JSON object: %s", err.Error())
+	}
+	switch {
+	case (rendered.URL == nil) == (rendered.Name == nil):
+		return nil, errors.New("template must render exactly one of url and name")
+	case rendered.URL != nil:
+		if *rendered.URL == "" {
+			return nil, errors.New("template rendered an empty url")
+		}
+		return map[string]string{
+			"url":       *rendered.URL,
+			"branch":    rendered.Branch,
+			"sha":       rendered.SHA,
+			"message":   rendered.Message,
+			"author":    rendered.Author,
+			"committer": rendered.Committer,
+		}, nil
+	default:
+		if *rendered.Name == "" {
+			return nil, errors.New("template rendered an empty name")
+		}
+		return map[string]string{"name": *rendered.Name, "tag": rendered.Tag, "digest": rendered.Digest}, nil
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderChange(t *testing.T) {
+	payload := map[string]interface{}{
+		"kind": "build",
+		"repo": map[string]interface{}{"owner": "example", "name": "config"},
+		"ref":  "refs/heads/main",
+	}
+	headers := http.Header{}
+	headers.Set("X-Event", "build")
+
+	for _, tt := range []struct {
+		desc, template string
+		fields         map[string]string
+		err            bool
+	}{
+		{
+			desc:     "git, from parts",
+			template: `{"url": {{ printf "git@example.com:%s/%s.git" .Payload.repo.owner .Payload.repo.name | json }}, "branch": {{ trimPrefix "refs/heads/" .Payload.ref | json }}}`,
+			fields:   map[string]string{"url": "git@example.com:example/config.git", "branch": "main", "sha": "", "message": "", "author": "", "committer": ""},
+		},
+		{
+			desc:     "image, by header",
+			template: `{{ if eq (.Headers.Get "X-Event") "build" }}{"name": "example/{{ .Payload.repo.name }}"}{{ end }}`,
+			fields:   map[string]string{"name": "example/config", "tag": "", "digest": ""},
+		},
+		{
+			desc:     "nothing rendered",
+			template: `{{ if eq .Payload.kind "push" }}{"url": "git@example.com:example/config.git"}{{ end }}`,
+		},
+		{
+			desc:     "not JSON",
+			template: `url={{ .Payload.ref }}`,
+			err:      true,
+		},
+		{
+			desc:     "both url and name",
+			template: `{"url": "git@example.com:example/config.git", "name": "example/config"}`,
+			err:      true,
+		},
+		{
+			desc:     "empty url",
+			template: `{"url": ""}`,
+			err:      true,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			tmpl, err := compileTemplate(tt.template)
+			assert.NoError(t, err)
+			fields, err := renderChange(tmpl, payload, headers)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.fields, fields)
+		})
+	}
+
+	_, err := compileTemplate(`{{ .Payload.ref`)
+	assert.Error(t, err)
+}
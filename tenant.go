@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// When one flux-recv serves endpoints for more than one team (or
+// cluster), each can be given a tenant. The endpoints of a tenant
+// send their notifications to the tenant's own API, rather than the
+// top-level `api`; are limited by the tenant's quota, as well as the
+// global quota; and can be seen in the admin API with the tenant's
+// own admin token, which sees only the tenant's endpoints (and their
+// deliveries). The tenant of each endpoint is in the metric
+// flux_recv_endpoint_tenant, to join the other metrics with.
+
+// Tenant is a group of endpoints.
+type Tenant struct {
+	Name string `json:"name"`
+	// API, if given, is where the notifications for the tenant's
+	// endpoints are sent; otherwise, they go to the top-level API
+	API string `json:"api,omitempty"`
+	// Quota, if given, limits the requests handled across the
+	// tenant's endpoints
+	Quota *Quota `json:"quota,omitempty"`
+	// AdminTokenPath, if given, is a file with a token for the admin
+	// API that sees only the tenant's endpoints
+	AdminTokenPath string `json:"adminTokenPath,omitempty"`
+}
+
+func (t *Tenant) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("tenant needs a name")
+	}
+	if q := t.Quota; q != nil {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("tenant %q: %s", t.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+var (
+	endpointTenant = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "flux_recv",
+		Name:      "endpoint_tenant",
+		Help:      "Always 1, for each endpoint that belongs to a tenant, with the tenant's name.",
+	}, []string{"source", "endpoint", "tenant"})
+	tenantRequestsShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "flux_recv",
+		Name:      "tenant_requests_shed_total",
+		Help:      "Requests refused because they were over a tenant's quota, by tenant and the limit exceeded.",
+	}, []string{"tenant", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(endpointTenant, tenantRequestsShed)
+}
+
+// tenant is a Tenant, ready to be used.
+type tenant struct {
+	name  string
+	api   string
+	quota *quota
+	// token is the tenant's admin token, or empty if it has none
+	token string
+}
+
+// tenants are the tenants by name; it's nil if there are none.
+var tenants map[string]*tenant
+
+// loadTenants gets the tenants ready, loading their admin tokens.
+// The tenants' APIs are checked against the downstream policy, and
+// those not given are apiBase.
+func loadTenants(baseDir, apiBase string, config Config) (map[string]*tenant, error) {
+	if len(config.Tenants) == 0 {
+		return nil, nil
+	}
+	res := map[string]*tenant{}
+	tokens := map[string]bool{adminToken: true}
+	for _, t := range config.Tenants {
+		loaded := &tenant{name: t.Name, api: t.API, quota: newQuota(t.Quota)}
+		if loaded.api == "" {
+			loaded.api = apiBase
+		}
+		if err := config.DownstreamPolicy.checkURL(loaded.api); err != nil {
+			return nil, fmt.Errorf("tenant %q: api: %s", t.Name, err.Error())
+		}
+		if loaded.quota != nil {
+			loaded.quota.tenant = t.Name
+		}
+		if t.AdminTokenPath != "" {
+			token, err := loadAdminToken(baseDir, &Admin{TokenPath: t.AdminTokenPath})
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: %s", t.Name, err.Error())
+			}
+			if tokens[token] {
+				return nil, fmt.Errorf("tenant %q: the admin token is the same as another one", t.Name)
+			}
+			tokens[token] = true
+			loaded.token = token
+		}
+		res[t.Name] = loaded
+	}
+	return res, nil
+}
+
+// endpointTenantOf gives the tenant the endpoint belongs to, or nil.
+func endpointTenantOf(ep Endpoint) *tenant {
+	return tenants[ep.Tenant]
+}
+
+// tenantWithToken gives the tenant whose admin token is given, or nil.
+func tenantWithToken(given string) *tenant {
+	var found *tenant
+	for _, t := range tenants {
+		if t.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(t.token)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+type adminScopeKey struct{}
+
+// withAdminScope gives the request the tenant it's from, so only the
+// tenant's endpoints are shown.
+func withAdminScope(r *http.Request, t *tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminScopeKey{}, t.name))
+}
+
+// adminScope gives the tenant a request to the admin API is from, or
+// an empty string if it was made with the admin token, so sees all.
+func adminScope(r *http.Request) string {
+	name, _ := r.Context().Value(adminScopeKey{}).(string)
+	return name
+}
+
+// inAdminScope reports whether the endpoint (as labelled in metrics)
+// can be seen by the request to the admin API.
+func inAdminScope(r *http.Request, endpoint string) bool {
+	scope := adminScope(r)
+	return scope == "" || servedEndpoints.tenantOf(endpoint) == scope
+}
+
+// withFullAdminScope refuses requests made with a tenant's admin
+// token, for what's not specific to an endpoint (e.g., pprof).
+func withFullAdminScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminScope(r) != "" {
+			http.Error(w, "Forbidden for a tenant's admin token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
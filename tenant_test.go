@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tenants")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "team-a-token"), []byte("team-a-token\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "admin-token"), []byte("s3cr3t-admin-token\n"), 0600))
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cr3t-admin-token"
+
+	loaded, err := loadTenants(dir, "http://fluxd:3030/api/flux", Config{Tenants: []Tenant{
+		{Name: "team-a", API: "http://fluxd.team-a:3030/api/flux", AdminTokenPath: "team-a-token", Quota: &Quota{MaxConcurrent: 2}},
+		{Name: "team-b"},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, "http://fluxd.team-a:3030/api/flux", loaded["team-a"].api)
+	assert.Equal(t, "team-a-token", loaded["team-a"].token)
+	assert.Equal(t, "team-a", loaded["team-a"].quota.tenant)
+	// without an API, the top-level API is used
+	assert.Equal(t, "http://fluxd:3030/api/flux", loaded["team-b"].api)
+	assert.Nil(t, loaded["team-b"].quota)
+
+	// a tenant can't have the admin token
+	_, err = loadTenants(dir, "http://fluxd:3030/api/flux", Config{Tenants: []Tenant{{Name: "team-a", AdminTokenPath: "admin-token"}}})
+	assert.Error(t, err)
+	// and its API has to be allowed by the downstream policy
+	_, err = loadTenants(dir, "http://fluxd:3030/api/flux", Config{
+		DownstreamPolicy: &DownstreamPolicy{AllowedHosts: []string{"fluxd"}},
+		Tenants:          []Tenant{{Name: "team-a", API: "http://elsewhere:3030/api/flux"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestTenantEndpoints(t *testing.T) {
+	defer func(reg *endpointRegistry) { servedEndpoints = reg }(servedEndpoints)
+	servedEndpoints = &endpointRegistry{}
+	defer func(ts map[string]*tenant) { tenants = ts }(tenants)
+	tenants = map[string]*tenant{
+		"team-a": {name: "team-a", api: "http://fluxd.team-a:3030/api/flux", token: "team-a-token"},
+	}
+
+	l := Listener{
+		Listen: ":8080",
+		Endpoints: []Endpoint{
+			{Source: GitHub, KeyPath: "github_key", Tenant: "team-a"},
+			{Source: DockerHub, KeyPath: "dockerhub_key"},
+		},
+	}
+	_, err := MuxFromListener("test/fixtures", "http://fluxd:3030/api/flux", l, nil, nil)
+	assert.NoError(t, err)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		adminHandler("s3cr3t-admin-token").ServeHTTP(rec, req)
+		return rec
+	}
+	endpoints := func(token string) []servedEndpoint {
+		rec := get(adminPrefix+"endpoints", token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var body struct {
+			Endpoints []servedEndpoint `json:"endpoints"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body.Endpoints
+	}
+
+	// the admin token sees all the endpoints ..
+	assert.Len(t, endpoints("s3cr3t-admin-token"), 2)
+	// .. and the tenant's token only the tenant's, which notify the
+	// tenant's API
+	scoped := endpoints("team-a-token")
+	assert.Len(t, scoped, 1)
+	assert.Equal(t, GitHub, scoped[0].Source)
+	assert.Equal(t, "team-a", scoped[0].Tenant)
+	assert.Equal(t, "http://fluxd.team-a:3030/api/flux", scoped[0].Downstream)
+	assert.Equal(t, "team-a", servedEndpoints.tenantOf(scoped[0].Routes[0].Endpoint))
+
+	// deliveries are seen only if they're to the tenant's endpoints
+	defer func(d *deliveryLog) { recentDeliveries = d }(recentDeliveries)
+	recentDeliveries, _ = newDeliveryLog(10, "")
+	recentDeliveries.add(&deliveryRecord{Source: GitHub, Endpoint: scoped[0].Routes[0].Endpoint, Status: 200})
+	recentDeliveries.add(&deliveryRecord{Source: DockerHub, Endpoint: "0123456789ab", Status: 200})
+	rec := get(adminPrefix+"deliveries", "team-a-token")
+	var body struct {
+		Deliveries []*deliveryRecord `json:"deliveries"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Deliveries, 1)
+	assert.Equal(t, GitHub, body.Deliveries[0].Source)
+
+	// pprof is for the admin token only
+	defer func() { pprofEnabled = false }()
+	pprofEnabled = true
+	assert.Equal(t, http.StatusForbidden, get(adminPrefix+"debug/pprof/", "team-a-token").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(adminPrefix+"endpoints", "team-b-token").Code)
+}
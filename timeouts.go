@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Each listener's server has timeouts for reading a request's headers
+// and for idle connections, even without --hardened, so that slow or
+// idle clients can't hold connections open indefinitely; `timeouts`
+// in the config (at the top level, for all listeners, or for a
+// listener) changes these and the others.
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// Timeouts give the server's timeouts for a listener, as durations
+// (e.g., "30s"); zero ("0s") means no timeout.
+type Timeouts struct {
+	// Read bounds the time to read a whole request, including the
+	// body
+	Read string `json:"read,omitempty"`
+	// ReadHeader bounds the time to read a request's headers
+	ReadHeader string `json:"readHeader,omitempty"`
+	// Write bounds the time from the end of reading the request
+	// headers to the end of writing the response
+	Write string `json:"write,omitempty"`
+	// Idle bounds the time to wait for the next request on a kept
+	// alive connection
+	Idle string `json:"idle,omitempty"`
+}
+
+// each calls fn with each timeout given, and the field of the server
+// it's for.
+func (t *Timeouts) each(s *http.Server, fn func(name, value string, field *time.Duration) error) error {
+	if t == nil {
+		return nil
+	}
+	for _, f := range []struct {
+		name, value string
+		field       *time.Duration
+	}{
+		{"read", t.Read, &s.ReadTimeout},
+		{"readHeader", t.ReadHeader, &s.ReadHeaderTimeout},
+		{"write", t.Write, &s.WriteTimeout},
+		{"idle", t.Idle, &s.IdleTimeout},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if err := fn(f.name, f.value, f.field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTimeout(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("timeouts: %s %q is not a duration, e.g., 30s", name, value)
+	}
+	return d, nil
+}
+
+// validate checks that each timeout given is a duration.
+func (t *Timeouts) validate() error {
+	return t.each(&http.Server{}, func(name, value string, _ *time.Duration) error {
+		_, err := parseTimeout(name, value)
+		return err
+	})
+}
+
+// withDefaults gives the timeouts, with those not given taken from
+// defaults.
+func (t *Timeouts) withDefaults(defaults *Timeouts) *Timeouts {
+	if t == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return t
+	}
+	merged := *t
+	for _, f := range []struct{ value, fallback *string }{
+		{&merged.Read, &defaults.Read},
+		{&merged.ReadHeader, &defaults.ReadHeader},
+		{&merged.Write, &defaults.Write},
+		{&merged.Idle, &defaults.Idle},
+	} {
+		if *f.value == "" {
+			*f.value = *f.fallback
+		}
+	}
+	return &merged
+}
+
+// applyServerTimeouts sets the default timeouts on the server, unless
+// it already has (e.g., hardened) timeouts, then those given.
+func applyServerTimeouts(s *http.Server, t *Timeouts) {
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = defaultIdleTimeout
+	}
+	t.each(s, func(name, value string, field *time.Duration) error {
+		*field, _ = parseTimeout(name, value) // already validated
+		return nil
+	})
+}
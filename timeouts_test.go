@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const configWithTimeouts = `
+apiVersion: flux-recv/v2
+timeouts:
+  read: 30s
+  idle: 0s
+endpoints:
+- source: GitHub
+  keyPath: github_key
+listeners:
+- listen: :8081
+  timeouts:
+    read: 5s
+    write: 1m
+  endpoints:
+  - source: DockerHub
+    keyPath: dockerhub_key
+`
+
+func TestServerTimeouts(t *testing.T) {
+	config, err := ConfigFromBytes([]byte(configWithTimeouts))
+	assert.NoError(t, err)
+	listeners := config.ListenersWithDefault(":8080")
+	assert.Len(t, listeners, 2)
+
+	// the top-level timeouts apply to the default listener ...
+	server := &http.Server{}
+	applyServerTimeouts(server, listeners[0].Timeouts)
+	assert.Equal(t, 30*time.Second, server.ReadTimeout)
+	assert.Equal(t, defaultReadHeaderTimeout, server.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), server.WriteTimeout)
+	assert.Equal(t, time.Duration(0), server.IdleTimeout, "0s means no timeout")
+
+	// ... and to others, for those they don't give
+	server = &http.Server{}
+	applyServerTimeouts(server, listeners[1].Timeouts)
+	assert.Equal(t, 5*time.Second, server.ReadTimeout)
+	assert.Equal(t, time.Minute, server.WriteTimeout)
+	assert.Equal(t, time.Duration(0), server.IdleTimeout)
+
+	// the hardened timeouts are kept, unless changed
+	server = &http.Server{}
+	hardenServer(server)
+	applyServerTimeouts(server, &Timeouts{Write: "2m"})
+	assert.Equal(t, 30*time.Second, server.ReadTimeout)
+	assert.Equal(t, 2*time.Minute, server.WriteTimeout)
+
+	// with nothing given, there are still some timeouts
+	server = &http.Server{}
+	applyServerTimeouts(server, nil)
+	assert.Equal(t, defaultReadHeaderTimeout, server.ReadHeaderTimeout)
+	assert.Equal(t, defaultIdleTimeout, server.IdleTimeout)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked
+// for changes. They are only checked when a TLS connection is being
+// set up, so this just stops every handshake from causing a stat.
+const certCheckInterval = 10 * time.Second
+
+// certReloader supplies the certificate for a TLS listener, loading
+// it again whenever the files change. This is so that when e.g.,
+// cert-manager rotates the certificate (and it's updated in the
+// mounted secret), flux-recv doesn't need to be restarted.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key, if they have changed since
+// they were last loaded. It must be called with the lock held, or
+// before the reloader is used.
+func (r *certReloader) load() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate from %q and %q: %s", r.certFile, r.keyFile, err.Error())
+	}
+	if r.cert != nil {
+		level.Info(logger).Log("msg", "reloaded TLS certificate", "file", r.certFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate. If the files
+// can't be reloaded, it keeps using the certificate it has.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.lastChecked) > certCheckInterval {
+		r.lastChecked = now
+		if err := r.load(); err != nil {
+			level.Error(logger).Log("msg", "TLS certificate not reloaded", "err", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// tlsVersions are the TLS versions that can be given as minVersion.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites are the cipher suites that can be given, by their
+// IANA names. (Newer versions of Go have tls.CipherSuites for
+// this.)
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// TLSConfigFor constructs the tls.Config for serving with the
+// certificate and key given, relative to configDir (unless they are
+// absolute paths); or, if autocert is given, with certificates
+// obtained via ACME. In the latter case, it also returns a handler
+// for answering HTTP-01 challenges, if those are to be answered.
+func TLSConfigFor(configDir string, t *TLS) (*tls.Config, http.Handler, error) {
+	var (
+		config     *tls.Config
+		challenges http.Handler
+	)
+	if t.Autocert != nil {
+		m := autocertManager(configDir, t.Autocert)
+		if t.Autocert.HTTPListen != "" {
+			challenges = m.HTTPHandler(nil)
+		}
+		config = m.TLSConfig()
+	} else {
+		reloader, err := newCertReloader(resolvePath(configDir, t.CertFile), resolvePath(configDir, t.KeyFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		config = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
+	if t.MinVersion != "" {
+		config.MinVersion = tlsVersions[t.MinVersion]
+	}
+	for _, name := range t.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, tlsCipherSuites[name])
+	}
+
+	if t.ClientCAFile != "" {
+		pool, err := loadCertPool(resolvePath(configDir, t.ClientCAFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, challenges, nil
+}
+
+// loadCertPool reads the PEM-encoded certificates in the file given.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+func autocertManager(configDir string, a *Autocert) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(a.Hosts...),
+		Email:      a.Email,
+	}
+	if a.CacheDir != "" {
+		m.Cache = autocert.DirCache(resolvePath(configDir, a.CacheDir))
+	} else {
+		level.Warn(logger).Log("msg", "no cacheDir given for autocert; certificates will be obtained again each time flux-recv starts")
+	}
+	if a.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: a.DirectoryURL}
+	}
+	return m
+}
+
+// resolvePath makes path relative to dir, unless it's absolute.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
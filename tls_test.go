@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generateCert generates a certificate and key, signed by the parent
+// given, or self-signed if parent is nil. It returns the certificate
+// and key, PEM-encoded, as well as parsed for use as a parent.
+func generateCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, []byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		cert, key
+}
+
+// writeCert generates a self-signed certificate and writes it and
+// its key to the files given.
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	certPEM, keyPEM, _, _ := generateCert(t, name, false, nil, nil)
+	assert.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first.example.com")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		assert.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+	assert.Equal(t, "first.example.com", commonName())
+
+	// rotate the certificate; make sure the modification time is
+	// later, since the filesystem may not have fine-grained times
+	writeCert(t, certFile, keyFile, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+
+	// not checked again until the interval has passed
+	assert.Equal(t, "first.example.com", commonName())
+
+	reloader.lastChecked = time.Time{}
+	assert.Equal(t, "second.example.com", commonName())
+
+	// a broken update leaves the certificate as it was
+	assert.NoError(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	even := later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, even, even))
+	reloader.lastChecked = time.Time{}
+	assert.Equal(t, "second.example.com", commonName())
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeCert(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "127.0.0.1")
+	caPEM, _, ca, caKey := generateCert(t, "ca.example.com", true, nil, nil)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0600))
+
+	config, _, err := TLSConfigFor(dir, &TLS{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt"})
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	clientFor := func(certPEM, keyPEM []byte) *http.Client {
+		c := server.Client()
+		transport := c.Transport.(*http.Transport)
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			assert.NoError(t, err)
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+		return c
+	}
+
+	// no client certificate
+	_, err = clientFor(nil, nil).Get(server.URL)
+	assert.Error(t, err)
+
+	// a client certificate not signed by the CA
+	otherPEM, otherKeyPEM, _, _ := generateCert(t, "other.example.com", false, nil, nil)
+	_, err = clientFor(otherPEM, otherKeyPEM).Get(server.URL)
+	assert.Error(t, err)
+
+	// a client certificate signed by the CA
+	clientPEM, clientKeyPEM, _, _ := generateCert(t, "client.example.com", false, ca, caKey)
+	res, err := clientFor(clientPEM, clientKeyPEM).Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestTLSVersionAndCipherSuites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeCert(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "127.0.0.1")
+
+	serve := func(config *TLS) *httptest.Server {
+		tlsConfig, _, err := TLSConfigFor(dir, config)
+		assert.NoError(t, err)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = tlsConfig
+		server.StartTLS()
+		return server
+	}
+	get := func(server *httptest.Server, configure func(*tls.Config)) error {
+		// server.Client() is shared, so configure a copy
+		clientConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		configure(clientConfig)
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		res, err := c.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	only13 := serve(&TLS{CertFile: "tls.crt", KeyFile: "tls.key", MinVersion: "1.3"})
+	defer only13.Close()
+	assert.Error(t, get(only13, func(c *tls.Config) { c.MaxVersion = tls.VersionTLS12 }))
+	assert.NoError(t, get(only13, func(c *tls.Config) {}))
+
+	// httptest serves its own (RSA) certificate to clients that
+	// don't give a server name, so these are RSA suites
+	restricted := serve(&TLS{CertFile: "tls.crt", KeyFile: "tls.key", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}})
+	defer restricted.Close()
+	assert.Error(t, get(restricted, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	}))
+	assert.NoError(t, get(restricted, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	}))
+}
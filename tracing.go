@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// This traces each delivery -- the endpoint's checks, verifying the
+// signature, handling the payload, and notifying downstream -- and
+// exports the spans to an OpenTelemetry collector, using OTLP over
+// HTTP with the JSON encoding
+// (https://opentelemetry.io/docs/specs/otlp/). Trace context is taken
+// from, and passed downstream in, the W3C `traceparent` header.
+
+const (
+	traceparentHeader = "traceparent"
+	// traceExportInterval is how often spans are sent to the
+	// collector
+	traceExportInterval = 5 * time.Second
+	// maxPendingSpans bounds the spans kept while waiting to be
+	// exported; any more are dropped
+	maxPendingSpans = 2048
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	statusCodeError  = 2
+)
+
+// activeTracer records spans, if tracing is enabled; otherwise it's
+// nil, and so are all spans.
+var activeTracer *tracer
+
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int
+}
+
+// newTracer constructs a tracer exporting to the OTLP/HTTP endpoint
+// given, e.g., `http://otel-collector:4318/v1/traces`.
+func newTracer(endpoint, service string) *tracer {
+	return &tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// otlpTracesEndpoint gives the endpoint to use by default, from the
+// environment variables OpenTelemetry SDKs use.
+func otlpTracesEndpoint() string {
+	if e := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); e != "" {
+		return e
+	}
+	if e := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); e != "" {
+		return strings.TrimSuffix(e, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]string
+	errMsg string
+}
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan starts a span as a child of the span in the context, if
+// there is one, or otherwise of the remote parent given (which may be
+// zero). It returns nil if tracing is not enabled; the methods of span
+// can all be called on nil.
+func (t *tracer) startSpan(ctx context.Context, name string, kind int, remote *span) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		parent = remote
+	}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// startSpan starts a span for a phase of handling a request, if
+// there's a span for the request in the context.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return activeTracer.startSpan(ctx, name, kind, nil)
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// finish ends the span, and queues it to be exported. Only the first
+// call has any effect.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+func (s *span) traceIDHex() string {
+	return hex.EncodeToString(s.traceID[:])
+}
+
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceparent gives the remote parent from a `traceparent`
+// header, or nil if there isn't a valid one.
+func parseTraceparent(h string) *span {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	var s span
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil
+	}
+	return &s
+}
+
+// withTracing starts a span for each request to an endpoint, which
+// the phases of handling it are recorded under.
+func withTracing(source, digest string, next http.Handler) http.Handler {
+	if activeTracer == nil {
+		return next
+	}
+	endpoint := endpointLabel(digest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := activeTracer.startSpan(r.Context(), "webhook "+source, spanKindServer, parseTraceparent(r.Header.Get(traceparentHeader)))
+		defer s.finish()
+		s.setAttr("http.method", r.Method)
+		s.setAttr("flux_recv.source", source)
+		s.setAttr("flux_recv.endpoint", endpoint)
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.setAttr("http.status_code", strconv.Itoa(status))
+		if status >= 500 {
+			s.setError(http.StatusText(status))
+		}
+	})
+}
+
+type checksSpanKey struct{}
+
+// checksSpan is the span for the endpoint's checks, and that for the
+// request it's part of.
+type checksSpan struct {
+	checks, request *span
+}
+
+// withChecksSpan and endChecksSpan go outside and inside the
+// endpoint's checks, so that the span covers the checks, whether the
+// request gets through them or not.
+func withChecksSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := spanFromContext(r.Context())
+		ctx, s := startSpan(r.Context(), "checks", spanKindInternal)
+		defer s.finish()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, checksSpanKey{}, checksSpan{checks: s, request: request})))
+	})
+}
+
+func endChecksSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if cs, ok := ctx.Value(checksSpanKey{}).(checksSpan); ok && cs.checks != nil {
+			cs.checks.finish()
+			// the rest is under the span for the request
+			ctx = context.WithValue(ctx, spanContextKey{}, cs.request)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tracingTransport passes the trace context downstream.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := spanFromContext(req.Context())
+	if s == nil {
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper mustn't change the request it's given
+	traced := req.Clone(req.Context())
+	traced.Header.Set(traceparentHeader, s.traceparent())
+	return t.base.RoundTrip(traced)
+}
+
+// run exports the spans recorded, periodically.
+func (t *tracer) run() {
+	for range time.Tick(traceExportInterval) {
+		if err := t.exportPending(); err != nil {
+			level.Error(logger).Log("component", "tracing", "msg", "could not export spans", "err", err)
+		}
+	}
+}
+
+func (t *tracer) exportPending() error {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		level.Warn(logger).Log("component", "tracing", "msg", "dropped spans, since the collector isn't keeping up", "spans", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, as much as is needed here.
+type (
+	otlpKeyValue struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpExportRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+func otlpAttr(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+func (t *tracer) otlpRequest(spans []*span) otlpExportRequest {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "flux-recv"
+	for _, s := range spans {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttr(k, v))
+		}
+		if s.errMsg != "" {
+			out.Status = &otlpStatus{Code: statusCodeError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", t.service)}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracing(t *testing.T) {
+	var exported otlpExportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&exported))
+	}))
+	defer collector.Close()
+
+	var downstreamTraceparent string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamTraceparent = r.Header.Get(traceparentHeader)
+		ioutil.ReadAll(r.Body)
+		fmt.Fprintln(w, `{"status": "OK"}`)
+	}))
+	defer downstream.Close()
+
+	activeTracer = newTracer(collector.URL, "flux-recv-test")
+	defer func() { activeTracer = nil }()
+
+	endpoint := Endpoint{Source: GitHub, KeyPath: "github_key"}
+	fp, handler, err := HandlerFromEndpoint("test/fixtures", downstream.URL, endpoint)
+	assert.NoError(t, err)
+	handler = withTracing(GitHub, fp, handler)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	payload := loadFixture(t, "github_payload")
+	req := httptest.NewRequest("POST", "/hook/"+fp, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature", xHubSignature(payload, loadFixture(t, "github_key")))
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-"+spanID+"-01")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+
+	assert.NoError(t, activeTracer.exportPending())
+	if !assert.Len(t, exported.ResourceSpans, 1) || !assert.Len(t, exported.ResourceSpans[0].ScopeSpans, 1) {
+		return
+	}
+	assert.Equal(t, "flux-recv-test", exported.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	spans := map[string]otlpSpan{}
+	for _, s := range exported.ResourceSpans[0].ScopeSpans[0].Spans {
+		assert.Equal(t, traceID, s.TraceID)
+		spans[s.Name] = s
+	}
+	assert.Len(t, spans, 5)
+	root := spans["webhook GitHub"]
+	assert.Equal(t, spanID, root.ParentSpanID)
+	assert.Equal(t, spanKindServer, root.Kind)
+	assert.Equal(t, root.SpanID, spans["checks"].ParentSpanID)
+	assert.Equal(t, root.SpanID, spans["handle payload"].ParentSpanID)
+	assert.Equal(t, spans["handle payload"].SpanID, spans["verify signature"].ParentSpanID)
+	notify := spans["notify"]
+	assert.Equal(t, spans["handle payload"].SpanID, notify.ParentSpanID)
+	assert.Nil(t, notify.Status)
+
+	// the notification carries on the trace
+	assert.Equal(t, "00-"+traceID+"-"+notify.SpanID+"-01", downstreamTraceparent)
+
+	// the latency of the notification is linked to the trace
+	metricsReq := httptest.NewRequest("GET", metricsPath, nil)
+	metricsReq.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	metrics := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(metrics, metricsReq)
+	assert.Contains(t, metrics.Body.String(), `# {trace_id="`+traceID+`"}`)
+
+	// nothing left to export
+	exported = otlpExportRequest{}
+	assert.NoError(t, activeTracer.exportPending())
+	assert.Empty(t, exported.ResourceSpans)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for h, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00": true,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":  false,
+		"not a traceparent": false,
+		"":                  false,
+	} {
+		assert.Equal(t, ok, parseTraceparent(h) != nil, h)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// When a reverse proxy on the same host (or in the same Pod) is the
+// edge of the network, flux-recv can listen on a Unix socket, given
+// as `unix:<path>`, rather than on a port. Requests on a Unix socket
+// come from the proxy, so the client's address is taken from the
+// header it adds (forwardedHeader), as for a trusted proxy.
+
+const (
+	unixAddrPrefix = "unix:"
+	// unixSocketMode lets the owner and group connect to the socket;
+	// e.g., the proxy, running as another user in the same group
+	unixSocketMode = 0660
+)
+
+// isUnixAddr reports whether the address is that of a Unix socket.
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixAddrPrefix)
+}
+
+// listenUnix listens on a Unix socket at the path. A socket left
+// there by a previous run is removed first, if nothing is listening
+// on it.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no path given for Unix socket (give it as %s<path>)", unixAddrPrefix)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("something is already listening on the Unix socket %q", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale Unix socket: %s", err.Error())
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// fromUnixSocket reports whether the request came in on a Unix
+// socket.
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flux-recv-unix")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hooks.sock")
+
+	// a socket left behind is removed
+	stale, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenOn("unix:"+path, nil)
+	assert.NoError(t, err)
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(unixSocketMode), fi.Mode().Perm())
+	// .. but not one in use
+	_, err = listenOn("unix:"+path, nil)
+	assert.Error(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientIP(r).String()))
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	// the proxy at the other end is trusted to give the client's
+	// address
+	req, err := http.NewRequest("POST", "http://flux-recv/hook/abc", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	res, err := c.Do(req)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", string(body))
+
+	_, err = listenOn("unix:", nil)
+	assert.Error(t, err)
+}
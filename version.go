@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The version and commit are set when building, with
+// `-ldflags "-X main.version=... -X main.commit=..."` (see the
+// Makefile). They're served at /version, and in the metric
+// flux_recv_build_info, along with the Go version and the sources
+// compiled in.
+
+const versionPath = "/version"
+
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+// buildInfo describes this build of flux-recv.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	GoVersion string   `json:"goVersion"`
+	Sources   []string `json:"sources"`
+}
+
+func currentBuildInfo() buildInfo {
+	var sources []string
+	for s := range Sources {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+	return buildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+		Sources:   sources,
+	}
+}
+
+var buildInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "flux_recv",
+	Name:      "build_info",
+	Help:      "Always 1, with the version, commit, Go version, and (comma-separated) sources of this build as labels.",
+}, []string{"version", "commit", "goversion", "sources"})
+
+func init() {
+	prometheus.MustRegister(buildInfoGauge)
+}
+
+// setBuildInfoMetric sets flux_recv_build_info. It's done from main
+// rather than init, since the sources are registered in init.
+func setBuildInfoMetric() {
+	info := currentBuildInfo()
+	buildInfoGauge.WithLabelValues(info.Version, info.Commit, info.GoVersion, strings.Join(info.Sources, ",")).Set(1)
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentBuildInfo())
+}
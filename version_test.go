@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveVersion(rec, httptest.NewRequest("GET", versionPath, nil))
+	var info buildInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, version, info.Version)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Contains(t, info.Sources, GitHub)
+	assert.Contains(t, info.Sources, DockerHub)
+
+	setBuildInfoMetric()
+	assert.Equal(t, float64(1), testutil.ToFloat64(buildInfoGauge.WithLabelValues(version, commit, runtime.Version(), strings.Join(info.Sources, ","))))
+}